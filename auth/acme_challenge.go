@@ -0,0 +1,136 @@
+package auth
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/go-acme/lego/v4/certcrypto"
+	"github.com/go-acme/lego/v4/challenge/dns01"
+	"github.com/go-acme/lego/v4/challenge/http01"
+	"github.com/go-acme/lego/v4/challenge/tlsalpn01"
+	"github.com/go-acme/lego/v4/lego"
+	"github.com/go-acme/lego/v4/providers/dns"
+
+	"github.com/getlantern/lantern-server-manager/common"
+)
+
+const (
+	// ChallengeHTTP01 proves control of the address by serving a token on port 80.
+	ChallengeHTTP01 = "http-01"
+	// ChallengeTLSALPN01 proves control of the address by serving a special certificate on port 443.
+	ChallengeTLSALPN01 = "tls-alpn-01"
+	// ChallengeDNS01 proves control of a host name by creating a TXT record through a DNS provider's API.
+	// It doesn't need any open port, but can't be used for IP addresses.
+	ChallengeDNS01 = "dns-01"
+)
+
+// keyTypes maps the accepted ACMEOptions.KeyType values to lego's key types.
+var keyTypes = map[string]certcrypto.KeyType{
+	"ec256":   certcrypto.EC256,
+	"ec384":   certcrypto.EC384,
+	"rsa2048": certcrypto.RSA2048,
+	"rsa3072": certcrypto.RSA3072,
+	"rsa4096": certcrypto.RSA4096,
+	"rsa8192": certcrypto.RSA8192,
+}
+
+// Validate checks that the ACME settings are usable.
+func (o ACMEOptions) Validate() error {
+	if o.Directory == "" {
+		return errors.New("an ACME directory is required")
+	}
+	if _, ok := keyTypes[o.KeyType]; !ok && o.KeyType != "" {
+		return fmt.Errorf("unknown key type %q, use one of ec256, ec384, rsa2048, rsa3072, rsa4096 or rsa8192", o.KeyType)
+	}
+	if (o.EABKeyID == "") != (o.EABHMACKey == "") {
+		return errors.New("External Account Binding needs both a key ID and an HMAC key")
+	}
+	if o.EABHMACKey != "" {
+		if _, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(o.EABHMACKey, "=")); err != nil {
+			return fmt.Errorf("invalid External Account Binding HMAC key, it must be base64url encoded: %w", err)
+		}
+	}
+	for _, domain := range o.Domains {
+		if net.ParseIP(domain) != nil {
+			return fmt.Errorf("domain %s is an IP address", domain)
+		}
+	}
+	if o.CACertFile != "" {
+		if _, err := os.Stat(o.CACertFile); err != nil {
+			return fmt.Errorf("invalid ACME CA certificate: %w", err)
+		}
+	}
+	switch o.Challenge {
+	case "", ChallengeHTTP01, ChallengeTLSALPN01:
+	case ChallengeDNS01:
+		if o.DNSProvider == "" {
+			return fmt.Errorf("a DNS provider is required for the %s challenge", ChallengeDNS01)
+		}
+	default:
+		return fmt.Errorf("unknown ACME challenge %q", o.Challenge)
+	}
+	return nil
+}
+
+// setChallengeProvider configures client to solve the challenge selected in acme for names.
+// HTTP-01 and TLS-ALPN-01 open their port in the firewall; the returned function closes it again,
+// unless an inbound in dataDir or the API needs it.
+// DNS-01 provider credentials are read by lego from the provider's environment variables,
+// or from the files named by the same variables with a "_FILE" suffix.
+func setChallengeProvider(client *lego.Client, dataDir string, acme ACMEOptions, names []string) (func(), error) {
+	switch acme.Challenge {
+	case "", ChallengeHTTP01:
+		common.OpenFirewallPort(80)
+		return func() { common.CloseChallengePort(dataDir, 80) }, client.Challenge.SetHTTP01Provider(http01.NewProviderServer("", "80"))
+	case ChallengeTLSALPN01:
+		common.OpenFirewallPort(443)
+		return func() { common.CloseChallengePort(dataDir, 443) }, client.Challenge.SetTLSALPN01Provider(tlsalpn01.NewProviderServer("", "443"))
+	case ChallengeDNS01:
+		for _, name := range names {
+			if net.ParseIP(name) != nil {
+				return nil, fmt.Errorf("%s can't be used for IP address %s, set external_ip to a host name or add domains", ChallengeDNS01, name)
+			}
+		}
+		provider, err := dns.NewDNSChallengeProviderByName(acme.DNSProvider)
+		if err != nil {
+			return nil, err
+		}
+		var opts []dns01.ChallengeOption
+		if len(acme.DNSResolvers) > 0 {
+			opts = append(opts, dns01.AddRecursiveNameservers(acme.DNSResolvers))
+		}
+		return func() {}, client.Challenge.SetDNS01Provider(provider, opts...)
+	default:
+		return nil, fmt.Errorf("unknown ACME challenge %q", acme.Challenge)
+	}
+}
+
+// trustCACert makes client, lego's HTTP client, trust the root certificates in the PEM file caCertFile
+// in addition to the system ones, so it can talk to an ACME directory of a private CA.
+func trustCACert(client *http.Client, caCertFile string) error {
+	caPEM, err := os.ReadFile(caCertFile)
+	if err != nil {
+		return fmt.Errorf("failed to read ACME CA certificate: %w", err)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return fmt.Errorf("no certificates found in %s", caCertFile)
+	}
+	transport, ok := client.Transport.(*http.Transport)
+	if !ok {
+		return errors.New("unexpected ACME HTTP transport")
+	}
+	transport = transport.Clone()
+	transport.TLSClientConfig.RootCAs = pool
+	client.Transport = transport
+	return nil
+}
@@ -0,0 +1,159 @@
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"slices"
+	"sync/atomic"
+)
+
+// certs holds the certificates served by the API, the default one first.
+var certs atomic.Pointer[[]*tls.Certificate]
+
+// CertificateFiles returns the paths of the certificate chain and key obtained for name,
+// the first name of a certificate, e.g. so that TLS inbounds can use the same certificate.
+func CertificateFiles(dataDir, name string) (certFile, keyFile string) {
+	dir := path.Join(dataDir, "certs", name)
+	return path.Join(dir, "cert.pem"), path.Join(dir, "key.pem")
+}
+
+// certificateNames returns the names to obtain certificates for, one list of SANs per certificate.
+// The first certificate is for the public IP or host name and is served to clients that don't send SNI.
+// It is left out if it can't be obtained with the DNS-01 challenge and there are domains to serve instead.
+func certificateNames(acme ACMEOptions, publicIP string) [][]string {
+	var names [][]string
+	unobtainable := acme.Challenge == ChallengeDNS01 && net.ParseIP(publicIP) != nil
+	if !slices.Contains(acme.Domains, publicIP) && (!unobtainable || len(acme.Domains) == 0) {
+		names = append(names, []string{publicIP})
+	}
+	if len(acme.Domains) > 0 {
+		names = append(names, acme.Domains)
+	}
+	return names
+}
+
+// loadCerts returns the certificates to serve: the custom one if certFile and keyFile are given,
+// otherwise the ACME certificates for certificateNames. The certificates that could be loaded are
+// returned even if others failed or couldn't be renewed.
+func loadCerts(dataDir, certFile, keyFile string, acme ACMEOptions, publicIP string) ([]*tls.Certificate, error) {
+	// If custom cert/key files are provided, use those directly
+	if certFile != "" && keyFile != "" {
+		acmeLog.Debug("Loading custom TLS certificate. Skipping ACME", "cert", certFile, "key", keyFile)
+		c, err := readCert(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		return []*tls.Certificate{c}, nil
+	}
+
+	migrateLegacyCert(dataDir)
+	var result []*tls.Certificate
+	var errs []error
+	for _, names := range certificateNames(acme, publicIP) {
+		c, err := loadCert(dataDir, acme, names)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", names[0], err))
+		}
+		if c != nil {
+			result = append(result, c)
+		}
+	}
+	return result, errors.Join(errs...)
+}
+
+// loadServingCerts returns the certificates to serve like loadCerts, but falls back to a certificate
+// issued by the self-signed CA if no ACME certificate could be obtained, so the API stays reachable
+// for clients that know the CertificatePin. In that case selfSigned is true and err is the ACME error.
+func loadServingCerts(dataDir, certFile, keyFile string, acme ACMEOptions, publicIP string) (c []*tls.Certificate, selfSigned bool, err error) {
+	c, err = loadCerts(dataDir, certFile, keyFile, acme, publicIP)
+	if len(c) > 0 || (certFile != "" && keyFile != "") {
+		return c, false, err
+	}
+	acmeLog.Error("Failed to obtain a certificate, serving a self-signed one", "error", err)
+	fallback, selfSignedErr := loadSelfSignedCert(dataDir, append([]string{publicIP}, acme.Domains...))
+	if selfSignedErr != nil {
+		return nil, false, errors.Join(err, fmt.Errorf("failed to create self-signed certificate: %w", selfSignedErr))
+	}
+	return []*tls.Certificate{fallback}, true, err
+}
+
+// readCert reads a certificate and its key from PEM files and parses its leaf.
+func readCert(certFile, keyFile string) (*tls.Certificate, error) {
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	c, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	if c.Leaf == nil {
+		if c.Leaf, err = x509.ParseCertificate(c.Certificate[0]); err != nil {
+			return nil, err
+		}
+	}
+	return &c, nil
+}
+
+// coversNames reports whether c is valid for all names.
+func coversNames(c *tls.Certificate, names []string) bool {
+	for _, name := range names {
+		if c.Leaf.VerifyHostname(name) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// getCertificate selects the certificate matching the SNI of the client, or the default one
+// if the client didn't send SNI (e.g. it connects to the IP address) or no certificate matches.
+func getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	loaded := *certs.Load()
+	if hello.ServerName != "" {
+		for _, c := range loaded {
+			if c.Leaf != nil && c.Leaf.VerifyHostname(hello.ServerName) == nil {
+				return c, nil
+			}
+		}
+	}
+	return loaded[0], nil
+}
+
+// migrateLegacyCert moves the certificate stored by earlier versions as acme_cert.pem and acme_key.pem
+// to the directory of the name it was issued for.
+func migrateLegacyCert(dataDir string) {
+	legacyCert, legacyKey := path.Join(dataDir, "acme_cert.pem"), path.Join(dataDir, "acme_key.pem")
+	c, err := readCert(legacyCert, legacyKey)
+	if err != nil {
+		return
+	}
+	var name string
+	switch {
+	case len(c.Leaf.IPAddresses) > 0:
+		name = c.Leaf.IPAddresses[0].String()
+	case len(c.Leaf.DNSNames) > 0:
+		name = c.Leaf.DNSNames[0]
+	default:
+		return
+	}
+	certFile, keyFile := CertificateFiles(dataDir, name)
+	if err = os.MkdirAll(path.Dir(certFile), 0755); err == nil {
+		if err = os.Rename(legacyKey, keyFile); err == nil {
+			err = os.Rename(legacyCert, certFile)
+		}
+	}
+	if err != nil {
+		acmeLog.Warn("Failed to move ACME certificate", "name", name, "error", err)
+		return
+	}
+	acmeLog.Info("Moved ACME certificate", "name", name, "path", certFile)
+}
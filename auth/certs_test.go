@@ -0,0 +1,64 @@
+package auth
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCertificateNames(t *testing.T) {
+	tests := []struct {
+		name     string
+		acme     ACMEOptions
+		publicIP string
+		want     [][]string
+	}{
+		{
+			name:     "public IP only",
+			publicIP: "203.0.113.1",
+			want:     [][]string{{"203.0.113.1"}},
+		},
+		{
+			name:     "public IP and domains",
+			acme:     ACMEOptions{Challenge: ChallengeHTTP01, Domains: []string{"a.example.com", "b.example.com"}},
+			publicIP: "203.0.113.1",
+			want:     [][]string{{"203.0.113.1"}, {"a.example.com", "b.example.com"}},
+		},
+		{
+			name:     "TLS-ALPN-01 with domains",
+			acme:     ACMEOptions{Challenge: ChallengeTLSALPN01, Domains: []string{"a.example.com"}},
+			publicIP: "203.0.113.1",
+			want:     [][]string{{"203.0.113.1"}, {"a.example.com"}},
+		},
+		{
+			name:     "public host name among the domains",
+			acme:     ACMEOptions{Domains: []string{"vpn.example.com", "a.example.com"}},
+			publicIP: "vpn.example.com",
+			want:     [][]string{{"vpn.example.com", "a.example.com"}},
+		},
+		{
+			name:     "DNS-01 can't prove an IP address",
+			acme:     ACMEOptions{Challenge: ChallengeDNS01, Domains: []string{"a.example.com"}},
+			publicIP: "203.0.113.1",
+			want:     [][]string{{"a.example.com"}},
+		},
+		{
+			name:     "DNS-01 without domains",
+			acme:     ACMEOptions{Challenge: ChallengeDNS01},
+			publicIP: "203.0.113.1",
+			want:     [][]string{{"203.0.113.1"}},
+		},
+		{
+			name:     "DNS-01 with a public host name",
+			acme:     ACMEOptions{Challenge: ChallengeDNS01, Domains: []string{"a.example.com"}},
+			publicIP: "vpn.example.com",
+			want:     [][]string{{"vpn.example.com"}, {"a.example.com"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := certificateNames(tt.acme, tt.publicIP); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("certificateNames() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,324 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ClientCertMode selects how admin client certificates are used by Middleware.
+type ClientCertMode string
+
+const (
+	// ClientCertOff ignores client certificates; admins authenticate with their token only.
+	ClientCertOff ClientCertMode = "off"
+	// ClientCertAlternative lets admins authenticate with either a client certificate or their token.
+	ClientCertAlternative ClientCertMode = "alternative"
+	// ClientCertRequired requires admins to present a client certificate in addition to their token.
+	ClientCertRequired ClientCertMode = "required"
+)
+
+const (
+	// clientCertValidity is how long an issued client certificate is valid.
+	clientCertValidity = 365 * 24 * time.Hour
+	// enrollmentCodeHeader carries a one-time enrollment code created with CreateEnrollmentCode.
+	enrollmentCodeHeader = "X-Enrollment-Code"
+)
+
+// ErrClientCertNotFound is returned when revoking a client certificate that wasn't issued.
+var ErrClientCertNotFound = errors.New("client certificate not found")
+
+// ClientCert is a client certificate issued to an admin device.
+type ClientCert struct {
+	// Serial is the hex encoded serial number of the certificate.
+	Serial string `json:"serial"`
+	// Name identifies the device, e.g. "laptop".
+	Name     string    `json:"name"`
+	IssuedAt time.Time `json:"issued_at"`
+	NotAfter time.Time `json:"not_after"`
+	// Revoked certificates are no longer accepted.
+	Revoked bool `json:"revoked,omitempty"`
+}
+
+// IssuedClientCert is the result of enrolling a device.
+type IssuedClientCert struct {
+	ClientCert
+	// Certificate is the PEM encoded client certificate.
+	Certificate string `json:"certificate"`
+	// Key is the PEM encoded private key, if it was generated by the server because no CSR was given.
+	Key string `json:"key,omitempty"`
+	// CA is the PEM encoded certificate of the client CA.
+	CA string `json:"ca"`
+}
+
+// ClientCerts issues, tracks and verifies admin client certificates signed by an internal CA
+// stored in the data directory. Issued certificates are recorded in client_certs.json.
+type ClientCerts struct {
+	dataDir string
+	mode    ClientCertMode
+	ca      *x509.Certificate
+	caKey   *ecdsa.PrivateKey
+
+	mu    sync.Mutex
+	certs []ClientCert
+}
+
+// NewClientCerts loads the client CA and the issued client certificates from dataDir,
+// creating the CA if it doesn't exist yet.
+func NewClientCerts(dataDir string, mode ClientCertMode) (*ClientCerts, error) {
+	switch mode {
+	case ClientCertOff, ClientCertAlternative, ClientCertRequired:
+	default:
+		return nil, fmt.Errorf("unknown client certificate mode %q, use off, alternative or required", mode)
+	}
+	dir := path.Join(dataDir, "certs", "client-ca")
+	ca, caKey, err := loadCA(path.Join(dir, "ca.pem"), path.Join(dir, "ca_key.pem"), "Lantern Server Manager Client CA")
+	if err != nil {
+		return nil, err
+	}
+	cc := &ClientCerts{dataDir: dataDir, mode: mode, ca: ca, caKey: caKey}
+	data, err := os.ReadFile(cc.registryPath())
+	if err == nil {
+		err = json.Unmarshal(data, &cc.certs)
+	} else if os.IsNotExist(err) {
+		err = nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client certificates: %w", err)
+	}
+	return cc, nil
+}
+
+// Mode returns how client certificates are used.
+func (cc *ClientCerts) Mode() ClientCertMode {
+	return cc.mode
+}
+
+// Pool returns the pool of CAs to verify client certificates with, or nil if they are ignored.
+func (cc *ClientCerts) Pool() *x509.CertPool {
+	if cc == nil || cc.mode == ClientCertOff {
+		return nil
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cc.ca)
+	return pool
+}
+
+// registryPath returns the path of the file recording the issued certificates.
+func (cc *ClientCerts) registryPath() string {
+	return path.Join(cc.dataDir, "client_certs.json")
+}
+
+// save writes the issued certificates to the registry. cc.mu must be held.
+func (cc *ClientCerts) save() error {
+	data, err := json.MarshalIndent(cc.certs, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(cc.registryPath(), data, 0600)
+}
+
+// List returns the issued client certificates.
+func (cc *ClientCerts) List() []ClientCert {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return slices.Clone(cc.certs)
+}
+
+// Issue issues a client certificate for the device name. If csrPEM is empty, a key is generated
+// and returned together with the certificate; otherwise the certificate is issued for the public key
+// of the PEM encoded certificate signing request.
+func (cc *ClientCerts) Issue(name string, csrPEM string) (*IssuedClientCert, error) {
+	if name == "" {
+		return nil, errors.New("a device name is required")
+	}
+	var keyPEM []byte
+	var pub any
+	if csrPEM == "" {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		keyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+		pub = &key.PublicKey
+	} else {
+		block, _ := pem.Decode([]byte(csrPEM))
+		if block == nil || block.Type != "CERTIFICATE REQUEST" {
+			return nil, errors.New("invalid certificate signing request: no PEM encoded CERTIFICATE REQUEST found")
+		}
+		csr, err := x509.ParseCertificateRequest(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid certificate signing request: %w", err)
+		}
+		if err = csr.CheckSignature(); err != nil {
+			return nil, fmt.Errorf("invalid certificate signing request: %w", err)
+		}
+		pub = csr.PublicKey
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		Subject:     pkix.Name{Organization: []string{"Lantern Server Manager"}, CommonName: name},
+		NotBefore:   now.Add(-time.Hour),
+		NotAfter:    now.Add(clientCertValidity),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := createCertificate(template, cc.ca, pub, cc.caKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to issue client certificate: %w", err)
+	}
+
+	issued := &IssuedClientCert{
+		ClientCert: ClientCert{
+			Serial:   template.SerialNumber.Text(16),
+			Name:     name,
+			IssuedAt: now.UTC(),
+			NotAfter: template.NotAfter.UTC(),
+		},
+		Certificate: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		Key:         string(keyPEM),
+		CA:          string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cc.ca.Raw})),
+	}
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.certs = append(cc.certs, issued.ClientCert)
+	if err = cc.save(); err != nil {
+		return nil, fmt.Errorf("failed to save client certificates: %w", err)
+	}
+	authLog.Info("Issued client certificate", "name", name, "serial", issued.Serial)
+	return issued, nil
+}
+
+// Revoke revokes the client certificate with the given hex encoded serial number.
+func (cc *ClientCerts) Revoke(serial string) error {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	i := slices.IndexFunc(cc.certs, func(c ClientCert) bool { return c.Serial == serial })
+	if i < 0 {
+		return ErrClientCertNotFound
+	}
+	cc.certs[i].Revoked = true
+	if err := cc.save(); err != nil {
+		return fmt.Errorf("failed to save client certificates: %w", err)
+	}
+	authLog.Info("Revoked client certificate", "name", cc.certs[i].Name, "serial", serial)
+	return nil
+}
+
+// verify returns the name of the device if r was made with a client certificate that was verified
+// against the client CA during the TLS handshake, issued by this server and not revoked.
+func (cc *ClientCerts) verify(r *http.Request) (string, bool) {
+	if cc == nil || cc.mode == ClientCertOff || r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return "", false
+	}
+	serial := r.TLS.VerifiedChains[0][0].SerialNumber.Text(16)
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	i := slices.IndexFunc(cc.certs, func(c ClientCert) bool { return c.Serial == serial })
+	if i < 0 || cc.certs[i].Revoked {
+		return "", false
+	}
+	return cc.certs[i].Name, true
+}
+
+// enrollmentCode is a one-time code, stored by its SHA-256 hash, that allows an admin to enroll a
+// device when client certificates are required and the admin has none yet.
+type enrollmentCode struct {
+	Hash    string    `json:"hash"`
+	Expires time.Time `json:"expires"`
+}
+
+// enrollmentCodesPath returns the path of the file holding the unused enrollment codes.
+func enrollmentCodesPath(dataDir string) string {
+	return path.Join(dataDir, "enrollment_codes.json")
+}
+
+// enrollmentMu serializes the read-modify-write cycles of the enrollment codes, so that
+// concurrent requests can't use the same one-time code twice.
+var enrollmentMu sync.Mutex
+
+// readEnrollmentCodes returns the enrollment codes that haven't expired.
+func readEnrollmentCodes(dataDir string) []enrollmentCode {
+	var codes []enrollmentCode
+	if data, err := os.ReadFile(enrollmentCodesPath(dataDir)); err == nil {
+		if err = json.Unmarshal(data, &codes); err != nil {
+			authLog.Warn("Failed to parse enrollment codes", "error", err)
+		}
+	}
+	return slices.DeleteFunc(codes, func(c enrollmentCode) bool { return time.Now().After(c.Expires) })
+}
+
+// writeEnrollmentCodes saves the enrollment codes.
+func writeEnrollmentCodes(dataDir string, codes []enrollmentCode) error {
+	data, err := json.MarshalIndent(codes, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(enrollmentCodesPath(dataDir), data, 0600)
+}
+
+// hashEnrollmentCode returns the hex encoded SHA-256 hash of code.
+func hashEnrollmentCode(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateEnrollmentCode creates a one-time code that is valid for ttl. It is meant to be run on the
+// server itself, so that enrolling the first device when client certificates are required proves
+// access to the server in addition to the admin token.
+func CreateEnrollmentCode(dataDir string, ttl time.Duration) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	code := hex.EncodeToString(b)
+	enrollmentMu.Lock()
+	defer enrollmentMu.Unlock()
+	codes := append(readEnrollmentCodes(dataDir), enrollmentCode{Hash: hashEnrollmentCode(code), Expires: time.Now().Add(ttl)})
+	if err := writeEnrollmentCodes(dataDir, codes); err != nil {
+		return "", fmt.Errorf("failed to save enrollment code: %w", err)
+	}
+	return code, nil
+}
+
+// useEnrollmentCode reports whether code is a valid enrollment code and, if so, invalidates it.
+func useEnrollmentCode(dataDir, code string) bool {
+	if code == "" {
+		return false
+	}
+	hash := hashEnrollmentCode(code)
+	enrollmentMu.Lock()
+	defer enrollmentMu.Unlock()
+	codes := readEnrollmentCodes(dataDir)
+	i := slices.IndexFunc(codes, func(c enrollmentCode) bool {
+		return subtle.ConstantTimeCompare([]byte(c.Hash), []byte(hash)) == 1
+	})
+	if i < 0 {
+		return false
+	}
+	if err := writeEnrollmentCodes(dataDir, slices.Delete(codes, i, i+1)); err != nil {
+		authLog.Errorf("failed to save enrollment codes: %v", err)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,221 @@
+package auth
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/mroth/jitter"
+
+	"github.com/getlantern/lantern-server-manager/common"
+)
+
+const (
+	// connectivityCheckInterval is how often the health endpoint is checked through the public address.
+	connectivityCheckInterval = time.Minute
+	// connectivityCheckTimeout limits a single connectivity check.
+	connectivityCheckTimeout = 10 * time.Second
+	// maxConnectivityResults is the number of check results kept.
+	maxConnectivityResults = 60
+)
+
+// ConnectivityResult is the result of checking the health endpoint through the server's public address.
+type ConnectivityResult struct {
+	// Time is when the check was made.
+	Time time.Time `json:"time"`
+	// StatusCode is the HTTP status of the response, if there was one.
+	StatusCode int `json:"status_code,omitempty"`
+	// LatencyMS is how long the check took, in milliseconds.
+	LatencyMS int64 `json:"latency_ms"`
+	// Error describes why the check failed.
+	Error string `json:"error,omitempty"`
+	// LocalOK is whether the health endpoint answered on the loopback address. It is only checked
+	// if the check through the public address failed, to tell a server problem from a network one.
+	LocalOK *bool `json:"local_ok,omitempty"`
+}
+
+// OK reports whether the health endpoint answered successfully.
+func (r ConnectivityResult) OK() bool {
+	return r.Error == "" && r.StatusCode == http.StatusOK
+}
+
+// ConnectivityStatus is the state of the connectivity checks.
+type ConnectivityStatus struct {
+	// Reachable is whether the last check reached the server through its public address.
+	Reachable bool `json:"reachable"`
+	// NAT is true if the public address isn't assigned to a local interface, e.g. behind a cloud
+	// provider's 1:1 NAT or a home router.
+	NAT bool `json:"nat"`
+	// HairpinFailed is true if the server is behind NAT, answers on the loopback address, but can't reach
+	// its own public address. The router doesn't support hairpinning, so the checks can't tell whether
+	// the server is reachable from outside.
+	HairpinFailed bool `json:"hairpin_failed"`
+	// Results are the last check results, oldest first.
+	Results []ConnectivityResult `json:"results"`
+}
+
+var (
+	connectivityChecks = common.NewCounter("lsm_connectivity_checks_total",
+		"Checks of the health endpoint through the public address, by result.", "result")
+	connectivityReachable = common.NewGauge("lsm_connectivity_reachable",
+		"Whether the last check reached the health endpoint through the public address.")
+	connectivityLatency = common.NewGauge("lsm_connectivity_latency_seconds",
+		"How long the last check of the health endpoint through the public address took.")
+)
+
+// connectivity holds the results of the connectivity checks in a ring buffer.
+var connectivity struct {
+	sync.Mutex
+	results [maxConnectivityResults]ConnectivityResult
+	// next is the index the next result is stored at.
+	next  int
+	count int
+	nat   bool
+}
+
+// GetConnectivityStatus returns the results of the connectivity checks.
+func GetConnectivityStatus() ConnectivityStatus {
+	connectivity.Lock()
+	defer connectivity.Unlock()
+	status := ConnectivityStatus{NAT: connectivity.nat, Results: make([]ConnectivityResult, 0, connectivity.count)}
+	start := (connectivity.next - connectivity.count + maxConnectivityResults) % maxConnectivityResults
+	for i := range connectivity.count {
+		status.Results = append(status.Results, connectivity.results[(start+i)%maxConnectivityResults])
+	}
+	if n := len(status.Results); n > 0 {
+		last := status.Results[n-1]
+		status.Reachable = last.OK()
+		status.HairpinFailed = status.NAT && !last.OK() && last.LocalOK != nil && *last.LocalOK
+	}
+	return status
+}
+
+// recordConnectivity stores a check result, logging when the server becomes unreachable or reachable again.
+func recordConnectivity(r ConnectivityResult, nat bool, port int) {
+	connectivity.Lock()
+	defer connectivity.Unlock()
+	var prev *ConnectivityResult
+	if connectivity.count > 0 {
+		prev = &connectivity.results[(connectivity.next-1+maxConnectivityResults)%maxConnectivityResults]
+	}
+	switch {
+	case !r.OK() && (prev == nil || prev.OK()):
+		if nat && r.LocalOK != nil && *r.LocalOK {
+			log.Warnf("The server can't reach its own public address, it is probably behind NAT without hairpinning. Make sure that port %d is reachable from outside. Error: %s", port, r.Error)
+		} else {
+			log.Errorf("Connectivity check failed. Please check the configuration, make sure that port %d is open. Error: %s", port, r.Error)
+		}
+	case r.OK() && prev != nil && !prev.OK():
+		log.Infof("Connectivity check succeeded again")
+	}
+	result, reachable := "failed", 0.0
+	if r.OK() {
+		result, reachable = "ok", 1
+	}
+	connectivityChecks.Inc(result)
+	connectivityReachable.Set(reachable)
+	connectivityLatency.Set(float64(r.LatencyMS) / 1000)
+	connectivity.results[connectivity.next] = r
+	connectivity.next = (connectivity.next + 1) % maxConnectivityResults
+	connectivity.count = min(connectivity.count+1, maxConnectivityResults)
+	connectivity.nat = nat
+}
+
+// checkConnectivity periodically checks the health endpoint of the server using its current public IP
+// and port until ctx is done. It uses an HTTP client that skips TLS verification, so self-signed
+// certificates work. If a check fails, the loopback address is checked too, to detect NAT without hairpinning.
+func checkConnectivity(ctx context.Context, publicIP func() string, port int) {
+	client := &http.Client{
+		Timeout: connectivityCheckTimeout,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: true,
+			},
+			// every check should make a new connection
+			DisableKeepAlives: true,
+		},
+	}
+	// initial delay before the first check, so the server is listening
+	timer := time.NewTimer(time.Second)
+	defer timer.Stop()
+	ticker := jitter.NewTicker(connectivityCheckInterval, 0.2)
+	defer ticker.Stop()
+	ticks := timer.C
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticks:
+		}
+		ticks = ticker.C
+
+		ip := publicIP()
+		r := checkHealth(ctx, client, ip, port)
+		if ctx.Err() != nil {
+			return
+		}
+		if !r.OK() {
+			local := checkHealth(ctx, client, "127.0.0.1", port).OK()
+			r.LocalOK = &local
+		}
+		recordConnectivity(r, !isLocalAddress(ip), port)
+	}
+}
+
+// checkHealth requests the health endpoint at host and port.
+func checkHealth(ctx context.Context, client *http.Client, host string, port int) ConnectivityResult {
+	r := ConnectivityResult{Time: time.Now().UTC()}
+	u := fmt.Sprintf("https://%s/api/v1/health", net.JoinHostPort(host, strconv.Itoa(port)))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		r.Error = err.Error()
+		return r
+	}
+	start := time.Now()
+	resp, err := client.Do(req)
+	r.LatencyMS = time.Since(start).Milliseconds()
+	if err != nil {
+		r.Error = err.Error()
+		return r
+	}
+	defer func() { _ = resp.Body.Close() }()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	r.StatusCode = resp.StatusCode
+	if resp.StatusCode != http.StatusOK {
+		r.Error = "unexpected status " + resp.Status
+	}
+	return r
+}
+
+// isLocalAddress reports whether host is an IP address assigned to a local interface.
+// Host names are resolved first.
+func isLocalAddress(host string) bool {
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		var err error
+		if ips, err = net.LookupIP(host); err != nil {
+			return false
+		}
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if ipNet, ok := a.(*net.IPNet); ok {
+			for _, ip := range ips {
+				if ipNet.IP.Equal(ip) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
@@ -3,40 +3,124 @@ package auth
 import (
 	"context"
 	"net/http"
+	"strings"
 
-	"github.com/charmbracelet/log"
 	"github.com/golang-jwt/jwt/v5"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/getlantern/lantern-server-manager/common"
 )
 
-// ctxUserKey is the context key for storing the username from the JWT claims.
+// authLog logs token and client certificate problems.
+var authLog = common.ComponentLogger(common.LogComponentAuth)
+
+// authFailures counts rejected requests by reason: missing_token, invalid_token or forbidden.
+var authFailures = common.NewCounter("lsm_auth_failures_total", "API requests rejected by authentication or authorization, by reason.", "reason")
+
+// ctxUserKey is the context key for storing the requestAuth set by the Middleware.
 type ctxUserKey struct{}
 
+// requestAuth is how a request was authenticated.
+type requestAuth struct {
+	// username is the subject of the JWT, or "admin" if the request was authenticated with a client certificate.
+	username string
+	// clientCert is the name of the device whose verified client certificate was presented, if any.
+	clientCert string
+	// clientCertRequired is whether admin requests need a client certificate in addition to the JWT.
+	clientCertRequired bool
+	// dataDir is where enrollment codes are stored.
+	dataDir string
+}
+
+// ctxSubjectKey is the context key for the subject recorder added by WithSubjectRecorder.
+type ctxSubjectKey struct{}
+
+// WithSubjectRecorder returns a context in which the Middleware records the username it authenticates,
+// and a function that returns it once the request has been served. Middleware wrapping the
+// authentication, such as request logging, can't see the request context set by it otherwise.
+func WithSubjectRecorder(ctx context.Context) (context.Context, func() string) {
+	subject := new(string)
+	return context.WithValue(ctx, ctxSubjectKey{}, subject), func() string { return *subject }
+}
+
+// setSubject makes the authenticated username known to the span of the request and the subject recorder, if any.
+func setSubject(r *http.Request, username string) {
+	trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("enduser.id", username))
+	if subject, ok := r.Context().Value(ctxSubjectKey{}).(*string); ok {
+		*subject = username
+	}
+}
+
 // GetRequestUsername retrieves the username stored in the request context by the Middleware.
 // It returns an empty string if the username is not found.
 func GetRequestUsername(r *http.Request) string {
-	if claims, ok := r.Context().Value(ctxUserKey{}).(string); ok {
-		return claims
+	if a, ok := r.Context().Value(ctxUserKey{}).(requestAuth); ok {
+		return a.username
 	}
 	return ""
 }
 
 // AdminOnly is a middleware that restricts access to admin users only.
-// It checks if the username retrieved by GetRequestUsername is "admin".
+// It checks if the username retrieved by GetRequestUsername is "admin" and, if client certificates
+// are required, that the request was made with one.
 func AdminOnly(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if username := GetRequestUsername(r); username != "admin" {
+		a, _ := r.Context().Value(ctxUserKey{}).(requestAuth)
+		if a.username != "admin" {
+			authFailures.Inc("forbidden")
 			http.Error(w, "Forbidden", http.StatusForbidden)
 			return
 		}
+		if a.clientCertRequired && a.clientCert == "" {
+			authFailures.Inc("forbidden")
+			http.Error(w, "Forbidden: client certificate required", http.StatusForbidden)
+			return
+		}
 		next.ServeHTTP(w, r)
 	})
 }
 
+// AdminEnrollment is like AdminOnly, but if client certificates are required, an admin without one
+// is let through with a one-time enrollment code (see CreateEnrollmentCode) in the X-Enrollment-Code
+// header instead, so that the first device can be enrolled.
+func AdminEnrollment(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a, _ := r.Context().Value(ctxUserKey{}).(requestAuth)
+		if a.username == "admin" && a.clientCertRequired && a.clientCert == "" {
+			if !useEnrollmentCode(a.dataDir, r.Header.Get(enrollmentCodeHeader)) {
+				authFailures.Inc("forbidden")
+				http.Error(w, "Forbidden: client certificate or enrollment code required", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		AdminOnly(next).ServeHTTP(w, r)
+	})
+}
+
 // Middleware is an HTTP middleware that validates JWT tokens from the Authorization header or "token" query parameter.
 // If the token is valid, it extracts the username (subject claim) and stores it in the request context.
 // If the token is missing or invalid, it returns an Unauthorized error.
-func Middleware(hmacSecret []byte, next http.Handler) http.Handler {
+// With clientCerts in ClientCertAlternative mode, a verified admin client certificate is accepted instead
+// of a token; in ClientCertRequired mode, AdminOnly requires one in addition to the admin token.
+// clientCerts may be nil if client certificates aren't used.
+func Middleware(hmacSecret []byte, clientCerts *ClientCerts, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a := requestAuth{}
+		if clientCerts != nil {
+			a.clientCert, _ = clientCerts.verify(r)
+			a.clientCertRequired = clientCerts.mode == ClientCertRequired
+			a.dataDir = clientCerts.dataDir
+			if a.clientCert != "" && clientCerts.mode == ClientCertAlternative {
+				a.username = "admin"
+				setSubject(r, a.username)
+				next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ctxUserKey{}, a)))
+				return
+			}
+		}
+
 		// Check for the presence of the Authorization header
 		authHeader := r.Header.Get("Authorization")
 		var tokenStr string
@@ -45,10 +129,16 @@ func Middleware(hmacSecret []byte, next http.Handler) http.Handler {
 			tokenStr = r.URL.Query().Get("token")
 		} else {
 			// Split the header into "Bearer" and the token
-			tokenStr = authHeader[len("Bearer "):]
+			var ok bool
+			if tokenStr, ok = strings.CutPrefix(authHeader, "Bearer "); !ok {
+				authFailures.Inc("invalid_token")
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
 		}
 
 		if tokenStr == "" {
+			authFailures.Inc("missing_token")
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
@@ -58,18 +148,22 @@ func Middleware(hmacSecret []byte, next http.Handler) http.Handler {
 			return hmacSecret, nil
 		}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
 		if err != nil {
-			log.Errorf("Error parsing token: %v", err)
+			authLog.Errorf("Error parsing token: %v", err)
+			authFailures.Inc("invalid_token")
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
 
 		if claims, err := token.Claims.GetSubject(); err != nil {
-			log.Errorf("Error parsing token: %v", err)
+			authLog.Errorf("Error parsing token: %v", err)
+			authFailures.Inc("invalid_token")
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		} else {
 			// Store the claims in the request context
-			ctx := context.WithValue(r.Context(), ctxUserKey{}, claims)
+			a.username = claims
+			setSubject(r, a.username)
+			ctx := context.WithValue(r.Context(), ctxUserKey{}, a)
 			next.ServeHTTP(w, r.WithContext(ctx))
 		}
 	})
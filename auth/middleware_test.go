@@ -0,0 +1,164 @@
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// clientCertState returns the TLS state of a connection made with the PEM encoded client certificate,
+// as if it was verified during the handshake.
+func clientCertState(t *testing.T, certPEM string) *tls.ConnectionState {
+	t.Helper()
+	block, _ := pem.Decode([]byte(certPEM))
+	if block == nil {
+		t.Fatal("no PEM encoded certificate")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+}
+
+func TestMiddleware(t *testing.T) {
+	secret := []byte("secret")
+	adminToken, err := GenerateAccessToken(secret, "admin", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	userToken, err := GenerateAccessToken(secret, "alice", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherToken, err := GenerateAccessToken([]byte("other"), "admin", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiredToken, err := GenerateAccessToken(secret, "admin", time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dataDir := t.TempDir()
+	newClientCerts := func(mode ClientCertMode) *ClientCerts {
+		cc, err := NewClientCerts(dataDir, mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cc
+	}
+	alternative := newClientCerts(ClientCertAlternative)
+	issued, err := alternative.Issue("laptop", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked, err := alternative.Issue("phone", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = alternative.Revoke(revoked.Serial); err != nil {
+		t.Fatal(err)
+	}
+	// the registry is read when ClientCerts is created, so this one sees the certificates issued above
+	required := newClientCerts(ClientCertRequired)
+
+	tests := []struct {
+		name        string
+		clientCerts *ClientCerts
+		header      string
+		query       string
+		clientCert  string
+		wantStatus  int
+	}{
+		{name: "admin token", header: "Bearer " + adminToken, wantStatus: http.StatusOK},
+		{name: "token in query", query: adminToken, wantStatus: http.StatusOK},
+		{name: "user token", header: "Bearer " + userToken, wantStatus: http.StatusForbidden},
+		{name: "no token", wantStatus: http.StatusUnauthorized},
+		{name: "malformed header", header: "Token " + adminToken, wantStatus: http.StatusUnauthorized},
+		{name: "bearer without token", header: "Bearer ", wantStatus: http.StatusUnauthorized},
+		{name: "wrong secret", header: "Bearer " + otherToken, wantStatus: http.StatusUnauthorized},
+		{name: "expired token", header: "Bearer " + expiredToken, wantStatus: http.StatusUnauthorized},
+		{name: "client certificate instead of token", clientCerts: alternative, clientCert: issued.Certificate, wantStatus: http.StatusOK},
+		{name: "revoked client certificate", clientCerts: alternative, clientCert: revoked.Certificate, wantStatus: http.StatusUnauthorized},
+		{name: "required client certificate missing", clientCerts: required, header: "Bearer " + adminToken, wantStatus: http.StatusForbidden},
+		{name: "required client certificate without token", clientCerts: required, clientCert: issued.Certificate, wantStatus: http.StatusUnauthorized},
+		{name: "required client certificate and token", clientCerts: required, header: "Bearer " + adminToken, clientCert: issued.Certificate, wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := Middleware(secret, tt.clientCerts, AdminOnly(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if username := GetRequestUsername(r); username != "admin" {
+					t.Errorf("username = %q, want admin", username)
+				}
+			})))
+			r := httptest.NewRequest(http.MethodGet, "/api/v1/test", nil)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			if tt.query != "" {
+				r.URL.RawQuery = "token=" + tt.query
+			}
+			if tt.clientCert != "" {
+				r.TLS = clientCertState(t, tt.clientCert)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestAdminEnrollment(t *testing.T) {
+	secret := []byte("secret")
+	adminToken, err := GenerateAccessToken(secret, "admin", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataDir := t.TempDir()
+	cc, err := NewClientCerts(dataDir, ClientCertRequired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := CreateEnrollmentCode(dataDir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := CreateEnrollmentCode(dataDir, -time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := Middleware(secret, cc, AdminEnrollment(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+
+	tests := []struct {
+		name       string
+		code       string
+		wantStatus int
+	}{
+		{name: "no code", wantStatus: http.StatusForbidden},
+		{name: "unknown code", code: "0123456789abcdef", wantStatus: http.StatusForbidden},
+		{name: "expired code", code: expired, wantStatus: http.StatusForbidden},
+		{name: "valid code", code: code, wantStatus: http.StatusOK},
+		{name: "used code", code: code, wantStatus: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/api/v1/client-certs", nil)
+			r.Header.Set("Authorization", "Bearer "+adminToken)
+			if tt.code != "" {
+				r.Header.Set(enrollmentCodeHeader, tt.code)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
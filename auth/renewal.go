@@ -0,0 +1,210 @@
+package auth
+
+import (
+	"context"
+	"crypto/tls"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/mroth/jitter"
+)
+
+const (
+	// renewalFraction is the part of a certificate's lifetime after which it is renewed, e.g. after
+	// 60 days for a 90 day certificate, or after about 4.5 days for a short-lived one, which leaves
+	// a third of the lifetime to retry.
+	renewalFraction = 2.0 / 3
+	// maxCheckInterval is the longest the renewal scheduler sleeps, so certificates are checked
+	// at least daily even if their renewal is far away.
+	maxCheckInterval = 24 * time.Hour
+	// minRetryInterval and maxRetryInterval bound the exponential backoff after a failed renewal.
+	minRetryInterval = time.Minute
+	maxRetryInterval = time.Hour
+	// certFilePollInterval is how often custom certificate files are checked for changes.
+	certFilePollInterval = 30 * time.Second
+)
+
+// Certificate sources reported in CertificateStatus.
+const (
+	CertSourceCustom     = "custom"
+	CertSourceACME       = "acme"
+	CertSourceSelfSigned = "self-signed"
+)
+
+// CertificateInfo describes a certificate served by the API.
+type CertificateInfo struct {
+	// Names are the DNS names and IP addresses the certificate is valid for.
+	Names     []string  `json:"names"`
+	Subject   string    `json:"subject"`
+	Issuer    string    `json:"issuer"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+	// RenewAt is when the certificate is due for renewal. It is not set for custom certificates.
+	RenewAt *time.Time `json:"renew_at,omitempty"`
+}
+
+// CertificateStatus is the state of the certificates served by the API and of their renewal.
+type CertificateStatus struct {
+	// Source is where the certificates come from: CertSourceCustom, CertSourceACME or CertSourceSelfSigned.
+	Source       string            `json:"source"`
+	Certificates []CertificateInfo `json:"certificates"`
+	// LastAttempt is when the certificates were last loaded or renewed.
+	LastAttempt time.Time `json:"last_attempt"`
+	// LastError is why the last attempt failed, if it did.
+	LastError string `json:"last_error,omitempty"`
+	// Failures is the number of consecutive failed attempts.
+	Failures int `json:"failures"`
+	// NextCheck is when the certificates are checked next.
+	NextCheck time.Time `json:"next_check"`
+}
+
+// renewal holds the current CertificateStatus.
+var renewal struct {
+	sync.Mutex
+	status CertificateStatus
+}
+
+// GetCertificateStatus returns the state of the certificates served by the API and of their renewal.
+func GetCertificateStatus() CertificateStatus {
+	renewal.Lock()
+	defer renewal.Unlock()
+	status := renewal.status
+	status.Certificates = slices.Clone(status.Certificates)
+	return status
+}
+
+// renewAt returns when c is due for renewal.
+func renewAt(c *tls.Certificate) time.Time {
+	lifetime := c.Leaf.NotAfter.Sub(c.Leaf.NotBefore)
+	return c.Leaf.NotBefore.Add(time.Duration(float64(lifetime) * renewalFraction))
+}
+
+// retryInterval returns how long to wait after the given number of consecutive failures.
+func retryInterval(failures int) time.Duration {
+	if failures > 7 {
+		return maxRetryInterval
+	}
+	return min(minRetryInterval<<(failures-1), maxRetryInterval)
+}
+
+// refreshCertificates loads or renews the certificates to serve, stores them for getCertificate and
+// updates the renewal status. The current certificates are kept if none could be loaded.
+func refreshCertificates(dataDir, certFile, keyFile string, acme ACMEOptions, publicIP string) error {
+	loaded, selfSigned, err := loadServingCerts(dataDir, certFile, keyFile, acme, publicIP)
+	if len(loaded) > 0 {
+		certs.Store(&loaded)
+	}
+
+	renewal.Lock()
+	defer renewal.Unlock()
+	status := &renewal.status
+	status.LastAttempt = time.Now()
+	if err != nil {
+		status.LastError = err.Error()
+		status.Failures++
+		status.NextCheck = time.Now().Add(jitter.Scale(retryInterval(status.Failures), 0.2))
+	} else {
+		status.LastError = ""
+		status.Failures = 0
+	}
+	if len(loaded) == 0 {
+		return err
+	}
+
+	switch {
+	case certFile != "" && keyFile != "":
+		status.Source = CertSourceCustom
+	case selfSigned:
+		status.Source = CertSourceSelfSigned
+	default:
+		status.Source = CertSourceACME
+	}
+	status.Certificates = status.Certificates[:0]
+	next := time.Now().Add(maxCheckInterval)
+	for _, c := range loaded {
+		info := CertificateInfo{
+			Names:     append(slices.Clone(c.Leaf.DNSNames), ipStrings(c)...),
+			Subject:   c.Leaf.Subject.String(),
+			Issuer:    c.Leaf.Issuer.String(),
+			NotBefore: c.Leaf.NotBefore,
+			NotAfter:  c.Leaf.NotAfter,
+		}
+		if status.Source != CertSourceCustom {
+			at := renewAt(c)
+			info.RenewAt = &at
+			if at.Before(next) {
+				next = at
+			}
+		}
+		status.Certificates = append(status.Certificates, info)
+	}
+	if err == nil {
+		status.NextCheck = next
+	}
+	return err
+}
+
+// ipStrings returns the IP addresses c is valid for.
+func ipStrings(c *tls.Certificate) []string {
+	var ips []string
+	for _, ip := range c.Leaf.IPAddresses {
+		ips = append(ips, ip.String())
+	}
+	return ips
+}
+
+// renewCertificates refreshes the certificates until ctx is cancelled: when they are due for
+// renewal, with exponential backoff after a failure, whenever RequestCertificateRenewal is called
+// and, for custom certificates, whenever their files change.
+func renewCertificates(ctx context.Context, dataDir, certFile, keyFile string, acme ACMEOptions, publicIP func() string) {
+	var poll <-chan time.Time
+	if certFile != "" && keyFile != "" {
+		ticker := time.NewTicker(certFilePollInterval)
+		defer ticker.Stop()
+		poll = ticker.C
+	}
+	lastModified := certFilesModified(certFile, keyFile)
+	for {
+		timer := time.NewTimer(time.Until(GetCertificateStatus().NextCheck))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		case <-certRenewal:
+		case <-poll:
+			modified := certFilesModified(certFile, keyFile)
+			if modified.Equal(lastModified) {
+				timer.Stop()
+				continue
+			}
+			lastModified = modified
+			acmeLog.Info("Certificate files changed, reloading", "cert", certFile, "key", keyFile)
+		}
+		timer.Stop()
+
+		ip := publicIP()
+		if err := refreshCertificates(dataDir, certFile, keyFile, acme, ip); err != nil {
+			status := GetCertificateStatus()
+			acmeLog.Error("Failed to renew certificates", "error", err, "failures", status.Failures, "retry", status.NextCheck)
+			continue
+		}
+		acmeLog.Debug("Certificates checked", "address", ip, "next", GetCertificateStatus().NextCheck)
+	}
+}
+
+// certFilesModified returns the latest modification time of the custom certificate files.
+func certFilesModified(certFile, keyFile string) time.Time {
+	var latest time.Time
+	for _, file := range []string{certFile, keyFile} {
+		if file == "" {
+			continue
+		}
+		if fi, err := os.Stat(file); err == nil && fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest
+}
@@ -0,0 +1,49 @@
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"testing"
+	"time"
+)
+
+func TestRenewAt(t *testing.T) {
+	notBefore := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		lifetime time.Duration
+		want     time.Time
+	}{
+		{"90 days", 90 * 24 * time.Hour, notBefore.Add(60 * 24 * time.Hour)},
+		{"6 days", 6 * 24 * time.Hour, notBefore.Add(4 * 24 * time.Hour)},
+		{"expired at issuance", 0, notBefore},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &tls.Certificate{Leaf: &x509.Certificate{NotBefore: notBefore, NotAfter: notBefore.Add(tt.lifetime)}}
+			if got := renewAt(c); !got.Equal(tt.want) {
+				t.Errorf("renewAt() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryInterval(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{3, 4 * time.Minute},
+		{6, 32 * time.Minute},
+		{7, time.Hour},
+		{8, time.Hour},
+		{100, time.Hour},
+	}
+	for _, tt := range tests {
+		if got := retryInterval(tt.failures); got != tt.want {
+			t.Errorf("retryInterval(%d) = %v, want %v", tt.failures, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+const (
+	// selfSignedName is the directory under <data dir>/certs holding the self-signed CA and certificate.
+	selfSignedName = "self-signed"
+	// caValidity is how long the self-signed CA and the client CA are valid. The self-signed CA's key
+	// is what clients pin, so it outlives the certificates it issues.
+	caValidity = 10 * 365 * 24 * time.Hour
+	// selfSignedValidity is how long a self-signed certificate is valid.
+	selfSignedValidity = 90 * 24 * time.Hour
+	// selfSignedRenewBefore is how long before it expires a self-signed certificate is replaced.
+	selfSignedRenewBefore = 30 * 24 * time.Hour
+)
+
+// selfSignedCAFiles returns the paths of the self-signed CA certificate and key.
+func selfSignedCAFiles(dataDir string) (certFile, keyFile string) {
+	dir := path.Join(dataDir, "certs", selfSignedName)
+	return path.Join(dir, "ca.pem"), path.Join(dir, "ca_key.pem")
+}
+
+// selfSignedCAName is the common name of the self-signed CA.
+const selfSignedCAName = "Lantern Server Manager CA"
+
+// caMu serializes reading and creating the CAs, so that concurrent callers can't create different ones.
+var caMu sync.Mutex
+
+// EnsureSelfSignedCA creates the self-signed CA in the data directory if it doesn't exist yet.
+// It is called once at startup, so the pin is known before the server starts and stays the same
+// when certificates are reissued.
+func EnsureSelfSignedCA(dataDir string) error {
+	certFile, keyFile := selfSignedCAFiles(dataDir)
+	_, _, err := loadCA(certFile, keyFile, selfSignedCAName)
+	return err
+}
+
+// CertificatePin returns the pin clients can use to verify the server's certificate when it
+// isn't signed by a public CA: the hex encoded SHA-256 hash of the self-signed CA's public key
+// (its DER encoded SubjectPublicKeyInfo). The CA must have been created with EnsureSelfSignedCA.
+func CertificatePin(dataDir string) (string, error) {
+	ca, _, err := loadSelfSignedCA(dataDir)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(ca.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// loadSelfSignedCA reads the self-signed CA created by EnsureSelfSignedCA from the data directory.
+// It is never created here, as a new CA would silently change the pin.
+func loadSelfSignedCA(dataDir string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	certFile, keyFile := selfSignedCAFiles(dataDir)
+	caMu.Lock()
+	defer caMu.Unlock()
+	return readCA(certFile, keyFile, selfSignedCAName)
+}
+
+// readCA reads a CA certificate and key.
+func readCA(certFile, keyFile, commonName string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	c, err := readCert(certFile, keyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read %s: %w", commonName, err)
+	}
+	key, ok := c.PrivateKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, nil, fmt.Errorf("unexpected key type of %s", commonName)
+	}
+	return c.Leaf, key, nil
+}
+
+// loadCA reads a CA certificate and key, creating a CA with the given common name if neither exists.
+// If only one of them exists, an error is returned rather than replacing the CA.
+func loadCA(certFile, keyFile, commonName string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	caMu.Lock()
+	defer caMu.Unlock()
+	_, certErr := os.Stat(certFile)
+	_, keyErr := os.Stat(keyFile)
+	switch {
+	case certErr == nil && keyErr == nil:
+		return readCA(certFile, keyFile, commonName)
+	case certErr == nil && os.IsNotExist(keyErr):
+		return nil, nil, fmt.Errorf("%s key %s is missing; restore it, or remove %s to create a new CA", commonName, keyFile, certFile)
+	case keyErr == nil && os.IsNotExist(certErr):
+		return nil, nil, fmt.Errorf("%s certificate %s is missing; restore it, or remove %s to create a new CA", commonName, certFile, keyFile)
+	case !os.IsNotExist(certErr):
+		return nil, nil, fmt.Errorf("failed to read %s: %w", commonName, certErr)
+	case !os.IsNotExist(keyErr):
+		return nil, nil, fmt.Errorf("failed to read %s: %w", commonName, keyErr)
+	}
+
+	acmeLog.Info("Generating CA", "name", commonName, "path", certFile)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		Subject:               pkix.Name{Organization: []string{"Lantern Server Manager"}, CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := createCertificate(template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = writeCertAndKey(certFile, keyFile, der, key); err != nil {
+		return nil, nil, err
+	}
+	ca, err := x509.ParseCertificate(der)
+	return ca, key, err
+}
+
+// loadSelfSignedCert returns a certificate for names issued by the self-signed CA, together with the CA
+// certificate. An existing certificate is reused unless it doesn't cover all names or expires soon.
+func loadSelfSignedCert(dataDir string, names []string) (*tls.Certificate, error) {
+	ca, caKey, err := loadSelfSignedCA(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	certFile, keyFile := CertificateFiles(dataDir, selfSignedName)
+	if c, err := readCert(certFile, keyFile); err == nil && coversNames(c, names) &&
+		time.Now().Before(c.Leaf.NotAfter.Add(-selfSignedRenewBefore)) && c.Leaf.CheckSignatureFrom(ca) == nil {
+		return c, nil
+	}
+
+	acmeLog.Info("Generating self-signed certificate", "names", names)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		Subject:     pkix.Name{Organization: []string{"Lantern Server Manager"}, CommonName: names[0]},
+		NotBefore:   time.Now().Add(-time.Hour),
+		NotAfter:    time.Now().Add(selfSignedValidity),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, name)
+		}
+	}
+	der, err := createCertificate(template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return nil, err
+	}
+	// the chain includes the CA so clients can check the pin against it
+	if err = writeCertAndKey(certFile, keyFile, append(der, ca.Raw...), key); err != nil {
+		return nil, err
+	}
+	return readCert(certFile, keyFile)
+}
+
+// createCertificate signs template with a random serial number.
+func createCertificate(template, parent *x509.Certificate, pub any, priv *ecdsa.PrivateKey) ([]byte, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	template.SerialNumber = serial
+	return x509.CreateCertificate(rand.Reader, template, parent, pub, priv)
+}
+
+// writeCertAndKey saves one or more concatenated DER certificates and their key as PEM files.
+func writeCertAndKey(certFile, keyFile string, der []byte, key *ecdsa.PrivateKey) error {
+	certs, err := x509.ParseCertificates(der)
+	if err != nil {
+		return err
+	}
+	var certPEM []byte
+	for _, c := range certs {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})...)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(path.Dir(certFile), 0755); err != nil {
+		return err
+	}
+	if err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return err
+	}
+	return os.WriteFile(certFile, certPEM, 0644)
+}
@@ -0,0 +1,96 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"testing"
+)
+
+func TestSelfSignedCA(t *testing.T) {
+	dataDir := t.TempDir()
+	if _, err := CertificatePin(dataDir); err == nil {
+		t.Fatal("CertificatePin() succeeded before the CA was created")
+	}
+	if err := EnsureSelfSignedCA(dataDir); err != nil {
+		t.Fatalf("EnsureSelfSignedCA() error = %v", err)
+	}
+	pin, err := CertificatePin(dataDir)
+	if err != nil {
+		t.Fatalf("CertificatePin() error = %v", err)
+	}
+	if err = EnsureSelfSignedCA(dataDir); err != nil {
+		t.Fatalf("second EnsureSelfSignedCA() error = %v", err)
+	}
+	if again, _ := CertificatePin(dataDir); again != pin {
+		t.Errorf("pin changed from %s to %s", pin, again)
+	}
+
+	cert, err := loadSelfSignedCert(dataDir, []string{"203.0.113.1", "vpn.example.com"})
+	if err != nil {
+		t.Fatalf("loadSelfSignedCert() error = %v", err)
+	}
+	if err = cert.Leaf.VerifyHostname("203.0.113.1"); err != nil {
+		t.Error(err)
+	}
+	if err = cert.Leaf.VerifyHostname("vpn.example.com"); err != nil {
+		t.Error(err)
+	}
+	if len(cert.Certificate) != 2 {
+		t.Fatalf("chain has %d certificates, want the certificate and the CA", len(cert.Certificate))
+	}
+	ca, _, err := loadSelfSignedCA(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cert.Leaf.CheckSignatureFrom(ca); err != nil {
+		t.Errorf("certificate isn't signed by the CA: %v", err)
+	}
+	sum := sha256.Sum256(ca.RawSubjectPublicKeyInfo)
+	if hex.EncodeToString(sum[:]) != pin {
+		t.Error("pin isn't the hash of the CA's public key")
+	}
+
+	reused, err := loadSelfSignedCert(dataDir, []string{"vpn.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reused.Leaf.SerialNumber.Cmp(cert.Leaf.SerialNumber) != 0 {
+		t.Error("certificate covering the names was reissued")
+	}
+	reissued, err := loadSelfSignedCert(dataDir, []string{"203.0.113.2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reissued.Leaf.SerialNumber.Cmp(cert.Leaf.SerialNumber) == 0 {
+		t.Error("certificate wasn't reissued for a new name")
+	}
+	if again, _ := CertificatePin(dataDir); again != pin {
+		t.Errorf("pin changed from %s to %s when the certificate was reissued", pin, again)
+	}
+}
+
+func TestSelfSignedCAHalfPresent(t *testing.T) {
+	for _, missing := range []string{"certificate", "key"} {
+		t.Run(missing, func(t *testing.T) {
+			dataDir := t.TempDir()
+			if err := EnsureSelfSignedCA(dataDir); err != nil {
+				t.Fatal(err)
+			}
+			certFile, keyFile := selfSignedCAFiles(dataDir)
+			removed := keyFile
+			if missing == "certificate" {
+				removed = certFile
+			}
+			if err := os.Remove(removed); err != nil {
+				t.Fatal(err)
+			}
+			if err := EnsureSelfSignedCA(dataDir); err == nil {
+				t.Errorf("EnsureSelfSignedCA() without the %s succeeded", missing)
+			}
+			if _, err := os.Stat(removed); !os.IsNotExist(err) {
+				t.Errorf("the missing %s was created again", missing)
+			}
+		})
+	}
+}
@@ -2,6 +2,7 @@ package auth
 
 import (
 	"bytes"
+	"context"
 	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
@@ -9,55 +10,42 @@ import (
 	"crypto/x509"
 	"encoding/json"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
 	"path"
-	"sync/atomic"
+	"strings"
 	"time"
 
-	"github.com/charmbracelet/log"
-	"github.com/getlantern/lantern-server-manager/common"
 	"github.com/go-acme/lego/v4/certcrypto"
 	"github.com/go-acme/lego/v4/certificate"
-	"github.com/go-acme/lego/v4/challenge/http01"
 	"github.com/go-acme/lego/v4/lego"
 	"github.com/go-acme/lego/v4/registration"
-	"github.com/mroth/jitter"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/getlantern/lantern-server-manager/common"
 )
 
-// CheckConnectivity periodically checks the health endpoint of the server using its public IP and port.
-// It runs in a loop, making requests every minute with jitter.
-// It uses an HTTP client configured to skip TLS verification, suitable for self-signed certificates.
-// Errors during the check are logged.
-func CheckConnectivity(ip string, port int) {
-	time.Sleep(1 * time.Second) // Initial delay before the first check
-	ticker := jitter.NewTicker(time.Minute, 0.2)
-	defer ticker.Stop()
-
-	client := http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: true,
-			},
-		},
-	}
-	for {
-		req, _ := http.NewRequest("GET", fmt.Sprintf("https://%s:%d/api/v1/health", ip, port), nil)
-
-		_, err := client.Do(req)
-		if err != nil {
-			log.Errorf("Connectivity check failed. Please check the configuration, make sure that port %d is open. Error: %v", port, err)
-		}
-		<-ticker.C
+// certRenewal wakes renewCertificates up before its next scheduled check.
+var certRenewal = make(chan struct{}, 1)
+
+// RequestCertificateRenewal makes the server check its certificate right away and obtain a new
+// one if it doesn't cover the current public IP, e.g. after the IP changed.
+func RequestCertificateRenewal() {
+	select {
+	case certRenewal <- struct{}{}:
+	default:
 	}
 }
 
-var cert atomic.Value // stores *tls.Certificate
-
 // legoUser implements the registration.User interface for ACME registration
 type legoUser struct {
-	Email        string                 `json:"email"`
+	Email string `json:"email"`
+	// Directory is the ACME directory the account is registered with. Accounts stored before it
+	// was recorded were registered with Let's Encrypt.
+	Directory    string                 `json:"directory,omitempty"`
 	Registration *registration.Resource `json:"registration"`
 	key          crypto.PrivateKey
 }
@@ -66,46 +54,97 @@ func (u *legoUser) GetEmail() string                        { return u.Email }
 func (u *legoUser) GetRegistration() *registration.Resource { return u.Registration }
 func (u *legoUser) GetPrivateKey() crypto.PrivateKey        { return u.key }
 
-func loadCert(dataDir, certPEMFile, keyPEMFile string, publicIP string) (*tls.Certificate, error) {
-	// If custom cert/key files are provided, use those directly
-	if certPEMFile != "" && keyPEMFile != "" {
-		log.Debug("Loading custom TLS certificate. Skipping ACME", "cert", certPEMFile, "key", keyPEMFile)
-		certPEM, err := os.ReadFile(certPEMFile)
-		if err != nil {
-			return nil, err
+// ACMEOptions configures how certificates are obtained from an ACME CA.
+type ACMEOptions struct {
+	// Email is the contact address of the ACME account.
+	Email string
+	// Directory is the URL of the ACME directory, e.g. lego.LEDirectoryProduction.
+	Directory string
+	// Challenge is how control of the address is proven: ChallengeHTTP01 (the default),
+	// ChallengeTLSALPN01 or ChallengeDNS01.
+	Challenge string
+	// DNSProvider is the name of the lego DNS provider used for ChallengeDNS01, e.g. "cloudflare".
+	DNSProvider string
+	// DNSResolvers are the nameservers used to check that DNS-01 records have propagated.
+	// The system resolvers are used if empty.
+	DNSResolvers []string
+	// Profile is the certificate profile requested from the CA, e.g. "shortlived" for Let's Encrypt.
+	// No profile is requested if empty.
+	Profile string
+	// KeyType is the type of the certificate key, one of the keys of keyTypes. RSA 2048 is used if empty.
+	KeyType string
+	// EABKeyID and EABHMACKey are the External Account Binding credentials some CAs require
+	// to register an account, e.g. ZeroSSL and Google Trust Services. The HMAC key is base64url encoded.
+	EABKeyID   string
+	EABHMACKey string
+	// CACertFile is a PEM file with additional root certificates to trust for the ACME directory,
+	// e.g. the one of a local test CA such as pebble.
+	CACertFile string
+	// Domains are DNS names to obtain a certificate for in addition to the one for the public IP.
+	// They are all included in a single certificate, which is named after the first one.
+	Domains []string
+}
+
+// acmeLog logs how certificates are obtained, renewed and loaded.
+var acmeLog = common.ComponentLogger(common.LogComponentACME)
+
+var (
+	acmeOperations = common.NewCounter("lsm_acme_operations_total",
+		"Attempts to obtain or renew a certificate from the ACME CA, by result.", "result")
+	acmeDuration = common.NewHistogram("lsm_acme_operation_duration_seconds",
+		"How long obtaining or renewing a certificate from the ACME CA took.", []float64{1, 2.5, 5, 10, 30, 60, 120, 300})
+)
+
+// loadCert returns a certificate for names, the first of which names it in the data directory.
+// An existing certificate is reused if it covers all names and isn't due for renewal (see renewAt);
+// otherwise a new one is obtained from the ACME CA. If that fails, an existing certificate
+// that hasn't expired yet is returned together with the error.
+// Obtaining a certificate is traced as its own trace, as it isn't caused by a request, and recorded in the audit log.
+func loadCert(dataDir string, acme ACMEOptions, names []string) (*tls.Certificate, error) {
+	acmeCertPath, acmeKeyPath := CertificateFiles(dataDir, names[0])
+
+	// Check if we have a valid existing certificate
+	existing, err := readCert(acmeCertPath, acmeKeyPath)
+	if err == nil && coversNames(existing, names) {
+		if time.Now().Before(renewAt(existing)) {
+			acmeLog.Debug("Using existing ACME certificate", "names", names)
+			return existing, nil
 		}
-		keyPEM, err := os.ReadFile(keyPEMFile)
-		if err != nil {
-			return nil, err
+		acmeLog.Debug("ACME certificate due for renewal, renewing...", "names", names)
+	} else {
+		existing = nil
+		acmeLog.Debug("No ACME certificate for these names, obtaining one...", "names", names)
+	}
+
+	ctx, span := common.Tracer.Start(context.Background(), "acme obtain certificate", trace.WithAttributes(
+		attribute.StringSlice("acme.names", names),
+		attribute.String("acme.challenge", acme.Challenge),
+		attribute.Bool("acme.renewal", existing != nil),
+	))
+	start := time.Now()
+	c, err := obtainCert(ctx, dataDir, acme, names)
+	acmeDuration.Observe(time.Since(start).Seconds())
+	common.EndSpan(span, err)
+	common.Audit(ctx, dataDir, "system", common.AuditCertRenewed, strings.Join(names, ","), "", err)
+	if err != nil {
+		acmeOperations.Inc("failed")
+		if existing != nil && time.Now().Before(existing.Leaf.NotAfter) {
+			common.WithTrace(ctx, acmeLog).Warn("Failed to renew certificate, keeping the current one", "names", names, "expires", existing.Leaf.NotAfter, "error", err)
+			return existing, err
 		}
-		c, err := tls.X509KeyPair(certPEM, keyPEM)
-		return &c, err
+		return nil, err
 	}
+	acmeOperations.Inc("ok")
+	return c, nil
+}
 
-	// Try to load existing ACME certificate
-	acmeCertPath := path.Join(dataDir, "acme_cert.pem")
-	acmeKeyPath := path.Join(dataDir, "acme_key.pem")
+// obtainCert obtains a certificate for names from the ACME CA, registering an account first if needed,
+// and saves it in the data directory.
+func obtainCert(ctx context.Context, dataDir string, acme ACMEOptions, names []string) (*tls.Certificate, error) {
+	logger := common.WithTrace(ctx, acmeLog)
 	acmeAccountPath := path.Join(dataDir, "acme_account.json")
 	accountKeyPath := path.Join(dataDir, "acme_account_key.pem")
 
-	// Check if we have a valid existing certificate
-	if certPEM, err := os.ReadFile(acmeCertPath); err == nil {
-		if keyPEM, err := os.ReadFile(acmeKeyPath); err == nil {
-			c, err := tls.X509KeyPair(certPEM, keyPEM)
-			if err == nil {
-				// Check if certificate is still valid (not expired)
-				if c.Leaf == nil {
-					c.Leaf, _ = x509.ParseCertificate(c.Certificate[0])
-				}
-				if c.Leaf != nil && time.Now().Before(c.Leaf.NotAfter.Add(-24*time.Hour)) {
-					log.Debug("Using existing ACME certificate")
-					return &c, nil
-				}
-				log.Debug("ACME certificate expired or expiring soon, renewing...")
-			}
-		}
-	}
-
 	// 1. Create/load account private key
 	var accountKey crypto.PrivateKey
 	if keyPEM, err := os.ReadFile(accountKeyPath); err == nil {
@@ -113,9 +152,9 @@ func loadCert(dataDir, certPEMFile, keyPEMFile string, publicIP string) (*tls.Ce
 		if err != nil {
 			return nil, fmt.Errorf("failed to parse account key: %w", err)
 		}
-		log.Debug("Loaded existing ACME account key")
+		logger.Debug("Loaded existing ACME account key")
 	} else {
-		log.Debug("Generating new ACME account key")
+		logger.Debug("Generating new ACME account key")
 		key, err := rsa.GenerateKey(rand.Reader, 2048)
 		if err != nil {
 			return nil, fmt.Errorf("failed to generate account key: %w", err)
@@ -137,41 +176,65 @@ func loadCert(dataDir, certPEMFile, keyPEMFile string, publicIP string) (*tls.Ce
 
 	// 2. Create/load user registration
 	user := &legoUser{
-		Email: "admin@thisbox.org",
+		Email: acme.Email,
 		key:   accountKey,
 	}
 
 	if accountData, err := os.ReadFile(acmeAccountPath); err == nil {
 		if err := json.Unmarshal(accountData, user); err != nil {
-			log.Warn("Failed to parse account file, will re-register", "error", err)
+			logger.Warn("Failed to parse account file, will re-register", "error", err)
 		}
 	}
+	if user.Directory == "" {
+		user.Directory = lego.LEDirectoryProduction
+	}
+	if user.Registration != nil && user.Directory != acme.Directory {
+		logger.Info("ACME directory changed, registering a new account", "old", user.Directory, "new", acme.Directory)
+		user.Registration = nil
+	}
+	user.Email = acme.Email
+	user.Directory = acme.Directory
 
 	// 3. Setup lego client
 	config := lego.NewConfig(user)
-	config.CADirURL = lego.LEDirectoryProduction
+	config.CADirURL = acme.Directory
 	config.Certificate.KeyType = certcrypto.RSA2048
+	if acme.KeyType != "" {
+		config.Certificate.KeyType = keyTypes[acme.KeyType]
+	}
 	config.Certificate.DisableCommonName = true
+	if acme.CACertFile != "" {
+		if err := trustCACert(config.HTTPClient, acme.CACertFile); err != nil {
+			return nil, err
+		}
+	}
 
 	client, err := lego.NewClient(config)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create ACME client: %w", err)
 	}
 
-	common.OpenFirewallPort(80)
-	defer common.CloseFirewallPort(80)
-	// Use HTTP-01 challenge on port 80
-	err = client.Challenge.SetHTTP01Provider(http01.NewProviderServer("", "80"))
+	cleanup, err := setChallengeProvider(client, dataDir, acme, names)
 	if err != nil {
-		return nil, fmt.Errorf("failed to set HTTP challenge provider: %w", err)
+		return nil, fmt.Errorf("failed to set %s challenge provider: %w", acme.Challenge, err)
 	}
+	defer cleanup()
 
 	// 4. Register if needed
 	if user.Registration == nil {
-		log.Debug("Registering new ACME account")
-		reg, err := client.Registration.Register(registration.RegisterOptions{
-			TermsOfServiceAgreed: true,
-		})
+		logger.Debug("Registering new ACME account", "directory", acme.Directory)
+		var reg *registration.Resource
+		if acme.EABKeyID != "" {
+			reg, err = client.Registration.RegisterWithExternalAccountBinding(registration.RegisterEABOptions{
+				TermsOfServiceAgreed: true,
+				Kid:                  acme.EABKeyID,
+				HmacEncoded:          acme.EABHMACKey,
+			})
+		} else {
+			reg, err = client.Registration.Register(registration.RegisterOptions{
+				TermsOfServiceAgreed: true,
+			})
+		}
 		if err != nil {
 			return nil, fmt.Errorf("failed to register ACME account: %w", err)
 		}
@@ -187,11 +250,11 @@ func loadCert(dataDir, certPEMFile, keyPEMFile string, publicIP string) (*tls.Ce
 	}
 
 	// 5. Obtain certificate
-	log.Debug("Obtaining ACME certificate", "domain", publicIP)
+	logger.Debug("Obtaining ACME certificate", "names", names)
 	request := certificate.ObtainRequest{
-		Domains: []string{publicIP},
+		Domains: names,
 		Bundle:  true,
-		Profile: "shortlived",
+		Profile: acme.Profile,
 	}
 
 	certificates, err := client.Certificate.Obtain(request)
@@ -200,6 +263,10 @@ func loadCert(dataDir, certPEMFile, keyPEMFile string, publicIP string) (*tls.Ce
 	}
 
 	// 6. Save certificate and key
+	acmeCertPath, acmeKeyPath := CertificateFiles(dataDir, names[0])
+	if err := os.MkdirAll(path.Dir(acmeCertPath), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create certificate directory: %w", err)
+	}
 	if err := os.WriteFile(acmeCertPath, certificates.Certificate, 0644); err != nil {
 		return nil, fmt.Errorf("failed to save certificate: %w", err)
 	}
@@ -207,7 +274,7 @@ func loadCert(dataDir, certPEMFile, keyPEMFile string, publicIP string) (*tls.Ce
 		return nil, fmt.Errorf("failed to save private key: %w", err)
 	}
 
-	log.Info("ACME certificate obtained successfully", "domain", publicIP)
+	logger.Info("ACME certificate obtained successfully", "names", names)
 
 	c, err := tls.X509KeyPair(certificates.Certificate, certificates.PrivateKey)
 	if err != nil {
@@ -216,38 +283,40 @@ func loadCert(dataDir, certPEMFile, keyPEMFile string, publicIP string) (*tls.Ce
 	return &c, nil
 }
 
-func ListenAndServeTLS(dataDir, certPEM, keyPEM string, publicIP string, listenPort int, handler http.Handler) error {
-	c, err := loadCert(dataDir, certPEM, keyPEM, publicIP)
-	if err != nil {
-		log.Fatal(err)
+// ListenAndServeTLS serves handler over TLS on listenPort until ctx is cancelled,
+// at which point in-flight requests are given a few seconds to complete.
+// publicIP returns the current public IP or host name of the server, which certificates are obtained for
+// together with acme.Domains. The certificate is selected by the SNI of each connection.
+// Client certificates issued by clientCerts are verified if presented, unless it is nil or off.
+func ListenAndServeTLS(ctx context.Context, dataDir, certPEM, keyPEM string, acme ACMEOptions, clientCerts *ClientCerts, publicIP func() string, listenPort int, handler http.Handler) error {
+	if err := refreshCertificates(dataDir, certPEM, keyPEM, acme, publicIP()); err != nil {
+		if certs.Load() == nil {
+			return err
+		}
+		acmeLog.Error("Failed to obtain some certificates", "error", err)
 	}
-	cert.Store(c)
 
 	conf := &tls.Config{
-		GetCertificate: func(chi *tls.ClientHelloInfo) (*tls.Certificate, error) {
-			return cert.Load().(*tls.Certificate), nil
-		},
-		MinVersion: tls.VersionTLS12,
+		GetCertificate: getCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+	if pool := clientCerts.Pool(); pool != nil {
+		conf.ClientCAs = pool
+		conf.ClientAuth = tls.VerifyClientCertIfGiven
 	}
 
-	go CheckConnectivity(publicIP, listenPort)
-	go keepCertificateFresh(dataDir, certPEM, keyPEM, publicIP)
+	go checkConnectivity(ctx, publicIP, listenPort)
+	go renewCertificates(ctx, dataDir, certPEM, keyPEM, acme, publicIP)
 	addr := fmt.Sprintf(":%d", listenPort)
 	server := &http.Server{Addr: addr, Handler: handler, TLSConfig: conf}
-	return server.ListenAndServeTLS("", "")
-}
-
-func keepCertificateFresh(dataDir, certPEM, keyPEM string, publicIP string) {
-	ticker := time.NewTicker(24 * time.Hour)
-	defer ticker.Stop()
-	for {
-		<-ticker.C
-		c, err := loadCert(dataDir, certPEM, keyPEM, publicIP)
-		if err != nil {
-			log.Error("Failed to renew certificate", "error", err)
-			continue
-		}
-		cert.Store(c)
-		log.Info("ACME certificate renewed successfully", "domain", publicIP)
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = server.Shutdown(shutdownCtx)
+	}()
+	if err := server.ListenAndServeTLS("", ""); !errors.Is(err, http.ErrServerClosed) {
+		return err
 	}
+	return nil
 }
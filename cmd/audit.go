@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/getlantern/lantern-server-manager/common"
+)
+
+const (
+	// defaultAuditLimit is the number of audit log entries returned if no limit is given.
+	defaultAuditLimit = 100
+	// maxAuditLimit is the largest page of audit log entries that can be requested.
+	maxAuditLimit = 1000
+)
+
+// auditHandler returns the audit log entries, newest first, filtered by the "since" and "until" times
+// (RFC 3339), the "actor" and the "action" query parameters; several actions can be given comma-separated
+// or by repeating "action". The entries are paginated with "offset" and "limit". This endpoint is admin-only.
+func (c *ServeCmd) auditHandler(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseAuditFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	page, err := common.QueryAuditLog(settings.DataDir, filter)
+	if err != nil {
+		common.Logger(r.Context()).Errorf("failed to read audit log: %v", err)
+		http.Error(w, "failed to read audit log", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(page)
+}
+
+// parseAuditFilter reads the filter and page of an audit log query from the query parameters of r.
+func parseAuditFilter(r *http.Request) (common.AuditFilter, error) {
+	query := r.URL.Query()
+	filter := common.AuditFilter{Actor: query.Get("actor"), Limit: defaultAuditLimit}
+	for _, param := range []struct {
+		name string
+		t    *time.Time
+	}{{"since", &filter.Since}, {"until", &filter.Until}} {
+		if v := query.Get(param.name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return filter, fmt.Errorf("invalid '%s' time, expected RFC 3339: %w", param.name, err)
+			}
+			*param.t = t
+		}
+	}
+	for _, v := range query["action"] {
+		for action := range strings.SplitSeq(v, ",") {
+			if action = strings.TrimSpace(action); action != "" {
+				filter.Actions = append(filter.Actions, action)
+			}
+		}
+	}
+	if v := query.Get("offset"); v != "" {
+		offset, err := strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			return filter, fmt.Errorf("invalid 'offset'")
+		}
+		filter.Offset = offset
+	}
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 || limit > maxAuditLimit {
+			return filter, fmt.Errorf("invalid 'limit', expected 1 to %d", maxAuditLimit)
+		}
+		filter.Limit = limit
+	}
+	return filter, nil
+}
@@ -0,0 +1,16 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/getlantern/lantern-server-manager/auth"
+)
+
+// certificateStatusHandler returns the certificates served by the API with their expiry, and the
+// state of their renewal: the last attempt, its error and when they are checked next.
+// This endpoint is admin-only.
+func (c *ServeCmd) certificateStatusHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(auth.GetCertificateStatus())
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/getlantern/lantern-server-manager/auth"
+	"github.com/getlantern/lantern-server-manager/common"
+)
+
+// enrollClientCertRequest is the body of an enrollment request.
+type enrollClientCertRequest struct {
+	// Name identifies the device.
+	Name string `json:"name"`
+	// CSR is an optional PEM encoded certificate signing request. Without it the server generates
+	// the key and returns it with the certificate.
+	CSR string `json:"csr"`
+}
+
+// enrollClientCertHandler issues an admin client certificate to a device.
+// This endpoint is admin-only; when client certificates are required, an admin without one
+// must send a one-time enrollment code instead.
+func (c *ServeCmd) enrollClientCertHandler(w http.ResponseWriter, r *http.Request) {
+	var req enrollClientCertRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxConfigBodySize)).Decode(&req); err != nil {
+		http.Error(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	issued, err := c.clientCerts.Issue(req.Name, req.CSR)
+	reason := ""
+	if issued != nil {
+		reason = "serial " + issued.Serial
+	}
+	common.Audit(r.Context(), settings.DataDir, auth.GetRequestUsername(r), common.AuditClientCertIssued, req.Name, reason, err)
+	if err != nil {
+		common.Logger(r.Context()).Errorf("failed to issue client certificate: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(issued)
+}
+
+// listClientCertsHandler returns the issued admin client certificates.
+// This endpoint is admin-only.
+func (c *ServeCmd) listClientCertsHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"mode":  c.clientCerts.Mode(),
+		"certs": c.clientCerts.List(),
+	})
+}
+
+// revokeClientCertHandler revokes the admin client certificate with the serial number in the URL path.
+// This endpoint is admin-only.
+func (c *ServeCmd) revokeClientCertHandler(w http.ResponseWriter, r *http.Request) {
+	serial := r.PathValue("serial")
+	err := c.clientCerts.Revoke(serial)
+	common.Audit(r.Context(), settings.DataDir, auth.GetRequestUsername(r), common.AuditClientCertRevoked, serial, "", err)
+	if err != nil {
+		if errors.Is(err, auth.ErrClientCertNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		common.Logger(r.Context()).Errorf("failed to revoke client certificate: %v", err)
+		http.Error(w, "failed to revoke client certificate", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write([]byte(`{"status": "ok"}`))
+}
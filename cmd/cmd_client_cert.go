@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/alexflint/go-arg"
+
+	"github.com/getlantern/lantern-server-manager/auth"
+)
+
+// ClientCertCmd defines the structure for the 'client-cert' subcommand.
+type ClientCertCmd struct {
+	Code *ClientCertCodeCmd `arg:"subcommand:code" help:"create a one-time code for enrolling an admin device when client certificates are required"`
+}
+
+// ClientCertCodeCmd defines the structure for the 'client-cert code' subcommand.
+type ClientCertCodeCmd struct {
+	TTL time.Duration `arg:"--ttl" default:"15m" help:"how long the code is valid"`
+}
+
+// Run executes the 'client-cert' subcommand logic.
+func (c ClientCertCmd) Run() error {
+	if c.Code == nil {
+		return arg.ErrHelp
+	}
+	return c.Code.Run()
+}
+
+// Run creates an enrollment code in the data directory and prints it. It is used once, in the
+// X-Enrollment-Code header of a POST /api/v1/client-certs request made with the admin token.
+func (c ClientCertCodeCmd) Run() error {
+	code, err := auth.CreateEnrollmentCode(settings.DataDir, c.TTL)
+	if err != nil {
+		return err
+	}
+	fmt.Println(code)
+	return nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/alexflint/go-arg"
+)
+
+// ConfigCmd defines the structure for the 'config' subcommand.
+type ConfigCmd struct {
+	Print *ConfigPrintCmd `arg:"subcommand:print" help:"print the effective settings and where they come from"`
+}
+
+// ConfigPrintCmd defines the structure for the 'config print' subcommand.
+type ConfigPrintCmd struct {
+}
+
+// Run executes the 'config' subcommand logic.
+func (c ConfigCmd) Run() error {
+	if c.Print == nil {
+		return arg.ErrHelp
+	}
+	return c.Print.Run()
+}
+
+// Run prints every setting with its effective value and its source:
+// "default", "file <path>", "env <variable>" or "flag <flag>". Secret values are masked.
+func (c ConfigPrintCmd) Run() error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "SETTING\tVALUE\tSOURCE")
+	for _, f := range settings.fields() {
+		value := fmt.Sprint(f.value.Interface())
+		if list, ok := f.value.Interface().([]string); ok {
+			value = strings.Join(list, ",")
+		}
+		if f.field.Tag.Get("secret") == "true" && value != "" {
+			value = "********"
+		}
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%s\n", f.name, value, settings.Source(f.name))
+	}
+	return w.Flush()
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/getlantern/lantern-server-manager/common"
+)
+
+// DNSCmd defines the structure for the 'dns' subcommand.
+// Without flags it prints the DNS settings; with flags it changes them.
+type DNSCmd struct {
+	Servers       []string `arg:"--server,separate" help:"replace the upstream DNS servers, e.g. https://1.1.1.1/dns-query, tls://8.8.8.8, udp://9.9.9.9 or local (can be repeated)"`
+	Strategy      string   `arg:"--strategy" help:"set the DNS strategy: prefer_ipv4, prefer_ipv6, ipv4_only or ipv6_only"`
+	DisableCache  *bool    `arg:"--disable-cache" help:"turn off caching of DNS responses, or turn it back on with --disable-cache=false"`
+	CacheCapacity *uint32  `arg:"--cache-capacity" help:"set the number of cached DNS responses, or 0 for the sing-box default"`
+	Reset         bool     `arg:"--reset" help:"restore the default DNS settings"`
+}
+
+// Run executes the 'dns' subcommand logic.
+// Changes are written to dns.json in the data directory and take effect when the server is started next.
+// Use the API to change the DNS settings of a running server.
+func (c DNSCmd) Run() error {
+	dc, err := common.ReadDNSConfig(settings.DataDir)
+	if err != nil {
+		return err
+	}
+	changed := c.Reset || len(c.Servers) > 0 || c.Strategy != "" || c.DisableCache != nil || c.CacheCapacity != nil
+	if c.Reset {
+		dc = common.DefaultDNSConfig()
+	}
+	if len(c.Servers) > 0 {
+		for _, id := range dc.ReplaceServers(c.Servers) {
+			_, _ = fmt.Fprintf(os.Stderr, "DNS rule %s used a removed server and now uses the default server\n", id)
+		}
+	}
+	if c.Strategy != "" {
+		dc.Strategy = c.Strategy
+	}
+	if c.DisableCache != nil {
+		dc.DisableCache = *c.DisableCache
+	}
+	if c.CacheCapacity != nil {
+		dc.CacheCapacity = *c.CacheCapacity
+	}
+	if changed {
+		if err = common.WriteDNSConfig(settings.DataDir, dc); err != nil {
+			return fmt.Errorf("invalid DNS settings: %w", err)
+		}
+		_, _ = fmt.Fprintln(os.Stderr, "DNS settings saved, restart the server to apply them")
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(dc)
+}
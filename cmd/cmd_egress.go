@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/getlantern/lantern-server-manager/common"
+)
+
+// EgressCmd defines the structure for the 'egress' subcommand.
+// Without flags it prints the upstream chaining settings; with flags it changes or checks them.
+type EgressCmd struct {
+	File    string `arg:"--file" help:"replace the settings with the contents of a JSON file"`
+	Default string `arg:"--default" help:"send all traffic through the outbound with this tag, or 'direct'"`
+	Check   bool   `arg:"--check" help:"check that the upstream outbounds are usable"`
+}
+
+// Run executes the 'egress' subcommand logic.
+// Changes are written to egress.json in the data directory and take effect when the server is started next.
+// Use the API to change the settings of a running server.
+func (c EgressCmd) Run() error {
+	ec, err := common.ReadEgressConfig(settings.DataDir)
+	if err != nil {
+		return err
+	}
+	if c.File != "" {
+		data, err := os.ReadFile(c.File)
+		if err != nil {
+			return err
+		}
+		ec = &common.EgressConfig{}
+		if err = json.Unmarshal(data, ec); err != nil {
+			return fmt.Errorf("failed to parse %s: %w", c.File, err)
+		}
+	}
+	if c.Default != "" {
+		ec.Default = c.Default
+	}
+	if c.File != "" || c.Default != "" {
+		if err = common.WriteEgressConfig(settings.DataDir, ec); err != nil {
+			return fmt.Errorf("invalid egress settings: %w", err)
+		}
+		_, _ = fmt.Fprintln(os.Stderr, "Egress settings saved, restart the server to apply them")
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if c.Check {
+		health := make([]common.EgressHealth, 0, len(ec.Outbounds))
+		for _, e := range ec.Outbounds {
+			health = append(health, common.CheckEgress(context.Background(), e))
+		}
+		return enc.Encode(health)
+	}
+	return enc.Encode(ec)
+}
@@ -1,9 +1,13 @@
 package main
 
 import (
+	"fmt"
+	"strings"
+
 	"github.com/charmbracelet/log"
 	"github.com/sagernet/sing-box/option"
 
+	"github.com/getlantern/lantern-server-manager/auth"
 	"github.com/getlantern/lantern-server-manager/common"
 )
 
@@ -12,18 +16,26 @@ import (
 type InitCmd struct {
 }
 
-// InitializeConfigs generates the initial server and sing-box configurations.
-// It uses the global 'args' variable to access the data directory and port settings.
+// InitializeConfigs generates the initial server and sing-box configurations and the self-signed CA.
+// It uses the global 'args' variable to access the data directory, port and DNS settings.
 // It returns the generated ServerConfig, sing-box Options, and any error encountered.
 func InitializeConfigs() (*ServerConfig, *option.Options, error) {
-	config, err := GenerateServerConfig(args.DataDir, args.APIPort)
+	config, err := GenerateServerConfig(settings.DataDir, settings.APIPort, settings.ExternalIP)
 	if err != nil {
 		return nil, nil, err
 	}
-	singboxConfig, err := common.GenerateBasicSingBoxServerConfig(args.DataDir, args.VPNPort)
+	if len(settings.DNSServers) > 0 || settings.DNSStrategy != "" {
+		if err = common.WriteDNSConfig(settings.DataDir, common.NewDNSConfig(settings.DNSServers, settings.DNSStrategy)); err != nil {
+			return nil, nil, fmt.Errorf("invalid DNS settings: %w", err)
+		}
+	}
+	singboxConfig, err := common.GenerateBasicSingBoxServerConfig(settings.DataDir, settings.VPNPort)
 	if err != nil {
 		return nil, nil, err
 	}
+	if err = auth.EnsureSelfSignedCA(settings.DataDir); err != nil {
+		return nil, nil, fmt.Errorf("failed to create self-signed CA: %w", err)
+	}
 	return config, singboxConfig, nil
 }
 
@@ -40,30 +52,35 @@ func (c InitCmd) Run() error {
 	return nil
 }
 
-// attemptToOpenPorts tries to open the necessary ports using firewall-cmd.
-// It opens the API port defined in the ServerConfig and the VPN port
-// defined in the sing-box configuration's Shadowsocks inbound options.
-// It skips execution if noFirewallD is true or if firewall-cmd is not found.
+// attemptToOpenPorts opens the API port defined in the ServerConfig and the ports needed by the
+// inbounds of the sing-box configuration in the host firewall, see common.RestoreFirewall.
 func attemptToOpenPorts(config *ServerConfig, singBoxConfig *option.Options) {
+	common.OpenManagerPort(config.Port)
+	common.RestoreFirewall(settings.DataDir, singBoxConfig)
+}
 
-	inboundOptions, err := common.GetShadowsocksInboundConfig(singBoxConfig)
-	if err != nil {
-		log.Fatal(err)
+// requiredPorts lists the ports that must be reachable: the API port, those of the inbounds and
+// the port hopping range, e.g. "8443/tcp (API), 12345/tcp, 12345/udp".
+func requiredPorts(config *ServerConfig, singBoxConfig *option.Options) string {
+	ports := []string{common.TCPPort(config.Port).String() + " (API)"}
+	for _, rule := range common.FirewallRules(singBoxConfig) {
+		ports = append(ports, rule.String())
 	}
-
-	common.OpenFirewallPort(config.Port)
-	common.OpenFirewallPort(int(inboundOptions.ListenPort))
+	if r := common.PortHoppingRange(); r != nil {
+		ports = append(ports, r.String()+" (port hopping)")
+	}
+	return strings.Join(ports, ", ")
 }
 
 // printRootToken logs information about the server setup, including required open ports,
 // the Lantern VPN connection URL, and a QR code representation of the URL.
 func printRootToken(config *ServerConfig, singBoxConfig *option.Options) {
-	inboundOptions, err := common.GetShadowsocksInboundConfig(singBoxConfig)
+	pin, err := auth.CertificatePin(settings.DataDir)
 	if err != nil {
-		log.Fatal(err)
+		log.Errorf("failed to get certificate pin: %v", err)
 	}
 
-	log.Infof("Make sure that the following ports are open: %d, %d", config.Port, inboundOptions.ListenPort)
-	log.Infof("Paste this link into Lantern VPN app:\n%s", config.GetNewServerURL())
-	log.Printf("Or scan this QR code in Lantern VPN app:\n%s", config.GetQR())
+	log.Infof("Make sure that the following ports are open: %s", requiredPorts(config, singBoxConfig))
+	log.Infof("Paste this link into Lantern VPN app:\n%s", config.GetNewServerURL(pin))
+	log.Printf("Or scan this QR code in Lantern VPN app:\n%s", config.GetQR(pin))
 }
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/getlantern/lantern-server-manager/auth"
+	"github.com/getlantern/lantern-server-manager/common"
+)
+
+// selfTestTimeout limits a self-test run through the API, which tests each inbound in turn and restarts
+// sing-box only if the probe user has to be added first.
+const selfTestTimeout = 5 * time.Minute
+
+// SelfTestCmd defines the structure for the 'selftest' subcommand.
+type SelfTestCmd struct {
+	URL   string `arg:"--url" help:"URL to fetch through each inbound, instead of the server's echo endpoint"`
+	Bytes int    `arg:"--bytes" help:"size of the download from the echo endpoint [default: 1048576]"`
+}
+
+// Run asks the server running on this host to test each inbound end-to-end through POST /api/v1/selftest,
+// authenticating with an admin token made from the server config in the data directory.
+// The results are printed as JSON. It fails if any inbound failed the test.
+func (c SelfTestCmd) Run() error {
+	config, err := ReadServerConfig(settings.DataDir)
+	if err != nil {
+		return fmt.Errorf("failed to read server config, is the server initialized? %w", err)
+	}
+	token, err := auth.GenerateAccessToken(config.HMACSecret, "admin", time.Now().Add(selfTestTimeout))
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(selfTestRequest{URL: c.URL, Bytes: c.Bytes})
+	if err != nil {
+		return err
+	}
+	u := fmt.Sprintf("https://%s/api/v1/selftest", net.JoinHostPort("127.0.0.1", strconv.Itoa(config.Port)))
+	req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	client := http.Client{
+		Timeout: selfTestTimeout,
+		// the certificate is for the public address, not localhost
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach the server, is it running? %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("self-test failed: %s: %s", resp.Status, bytes.TrimSpace(data))
+	}
+	var results []common.SelfTestResult
+	if err = json.Unmarshal(data, &results); err != nil {
+		return fmt.Errorf("invalid self-test response: %w", err)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err = enc.Encode(results); err != nil {
+		return err
+	}
+	for _, r := range results {
+		if !r.OK {
+			return errors.New("self-test failed for some inbounds")
+		}
+	}
+	return nil
+}
@@ -1,8 +1,17 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/charmbracelet/log"
@@ -15,36 +24,50 @@ import (
 // ServeCmd defines the structure for the 'serve' subcommand.
 // It holds the loaded server and sing-box configurations.
 type ServeCmd struct {
-	serverConfig  *ServerConfig
-	singboxConfig *option.Options
-
-	CertPEM string `arg:"--cert" help:"TLS certificate file" default:""`
-	KeyPEM  string `arg:"--key" help:"TLS key file" default:""`
+	// serverConfig is swapped atomically when the config is rolled back while serving.
+	serverConfig atomic.Pointer[ServerConfig]
+	// serverConfigMu serializes changes of "server.json" and serverConfig while serving.
+	serverConfigMu sync.Mutex
+	singboxConfig  *option.Options
+	egressMonitor  *common.EgressMonitor
+	probeMonitor   *common.ProbeMonitor
+	clientCerts    *auth.ClientCerts
 }
 
 // readConfigs loads the server and sing-box configurations from the data directory.
 // If the server configuration doesn't exist, it initializes both configurations.
 // It validates the loaded or initialized sing-box config and restarts the sing-box service.
 func (c *ServeCmd) readConfigs() error {
-	var err error
-	c.serverConfig, err = ReadServerConfig(args.DataDir)
+	serverConfig, err := ReadServerConfig(settings.DataDir)
 	if err != nil {
 		// no config found. init
-		c.serverConfig, c.singboxConfig, err = InitializeConfigs()
+		serverConfig, c.singboxConfig, err = InitializeConfigs()
 		if err != nil {
 			return fmt.Errorf("failed to init server: %w", err)
 		}
 	} else {
-		c.singboxConfig, err = common.ReadSingBoxServerConfig(args.DataDir)
+		c.singboxConfig, err = common.ReadSingBoxServerConfig(settings.DataDir)
 		if err != nil {
 			return fmt.Errorf("failed to read sing-box config: %w", err)
 		}
+		if settings.ExternalIP != "" && settings.ExternalIP != serverConfig.ExternalIP {
+			log.Infof("Using external IP %s instead of %s", settings.ExternalIP, serverConfig.ExternalIP)
+			serverConfig.ExternalIP = settings.ExternalIP
+			if err = WriteServerConfig(settings.DataDir, serverConfig, common.SystemChange("external IP override")); err != nil {
+				return fmt.Errorf("failed to write server config: %w", err)
+			}
+		}
+	}
+	c.serverConfig.Store(serverConfig)
+	c.recordStartupVersions()
+	if err = common.ReconcileManagedSections(settings.DataDir); err != nil {
+		return fmt.Errorf("failed to update sing-box config: %w", err)
 	}
-	if err = common.ValidateSingBoxConfig(args.DataDir); err != nil {
+	if err = common.ValidateSingBoxConfig(settings.DataDir); err != nil {
 		return fmt.Errorf("failed to validate sing-box config: %w", err)
 	}
 
-	if err = common.RestartSingBox(args.DataDir); err != nil {
+	if err = common.RestartSingBox(context.Background(), settings.DataDir); err != nil {
 		return fmt.Errorf("failed to start sing-box: %w", err)
 	}
 
@@ -54,22 +77,64 @@ func (c *ServeCmd) readConfigs() error {
 // Run executes the 'serve' subcommand logic.
 // It checks if sing-box is installed, reads configurations, prints the root token,
 // attempts to open firewall ports, starts a background connectivity check,
-// sets up HTTP API endpoints, and starts the HTTPS server.
+// sets up HTTP API endpoints, and starts the HTTPS server and, if configured, the metrics listener.
 func (c *ServeCmd) Run() error {
 	if !common.CheckSingBoxInstalled() {
 		return fmt.Errorf("sing-box not found in PATH")
 	}
+	if err := settings.ACMEOptions().Validate(); err != nil {
+		return err
+	}
 	if err := c.readConfigs(); err != nil {
 		return err
 	}
+	if err := auth.EnsureSelfSignedCA(settings.DataDir); err != nil {
+		return fmt.Errorf("failed to load self-signed CA: %w", err)
+	}
+	clientCerts, err := auth.NewClientCerts(settings.DataDir, auth.ClientCertMode(settings.AdminClientCert))
+	if err != nil {
+		return fmt.Errorf("failed to load client certificates: %w", err)
+	}
+	c.clientCerts = clientCerts
 
-	printRootToken(c.serverConfig, c.singboxConfig)
-	attemptToOpenPorts(c.serverConfig, c.singboxConfig)
+	serverConfig := c.config()
+	printRootToken(serverConfig, c.singboxConfig)
+	attemptToOpenPorts(serverConfig, c.singboxConfig)
+	c.egressMonitor = common.NewEgressMonitor()
+	c.probeMonitor = common.NewProbeMonitor(settings.BlockReportThreshold)
+	c.probeMonitor.OnBlocked = c.rotateBlocked
 	srv := http.NewServeMux()
 	srv.Handle("GET /api/v1/health", http.HandlerFunc(c.healthCheckHandler))
-	srv.Handle("GET /api/v1/connect-config", auth.Middleware(c.serverConfig.HMACSecret, http.HandlerFunc(c.getConnectConfigHandler)))
-	srv.Handle("GET /api/v1/share-link/{name}", auth.Middleware(c.serverConfig.HMACSecret, auth.AdminOnly(http.HandlerFunc(c.getShareLinkHandler))))
-	srv.Handle("POST /api/v1/revoke/{name}", auth.Middleware(c.serverConfig.HMACSecret, auth.AdminOnly(http.HandlerFunc(c.revokeAccess))))
+	srv.Handle("GET /api/v1/status", c.authenticated(auth.AdminOnly(http.HandlerFunc(c.statusHandler))))
+	srv.Handle("GET /api/v1/connect-config", c.authenticated(http.HandlerFunc(c.getConnectConfigHandler)))
+	srv.Handle("GET /api/v1/events", c.authenticated(http.HandlerFunc(c.eventsHandler)))
+	srv.Handle("POST /api/v1/transports/report", c.authenticated(http.HandlerFunc(c.reportTransportHandler)))
+	srv.Handle("GET /api/v1/transports", c.authenticated(auth.AdminOnly(http.HandlerFunc(c.transportsHandler))))
+	srv.Handle("GET /api/v1/selftest/echo", c.authenticated(http.HandlerFunc(c.selfTestEchoHandler)))
+	srv.Handle("POST /api/v1/selftest", c.authenticated(auth.AdminOnly(http.HandlerFunc(c.selfTestHandler))))
+	srv.Handle("GET /api/v1/share-link/{name}", c.authenticated(auth.AdminOnly(http.HandlerFunc(c.getShareLinkHandler))))
+	srv.Handle("POST /api/v1/revoke/{name}", c.authenticated(auth.AdminOnly(http.HandlerFunc(c.revokeAccess))))
+	srv.Handle("GET /api/v1/config/history", c.authenticated(auth.AdminOnly(http.HandlerFunc(c.configHistoryHandler))))
+	srv.Handle("GET /api/v1/config/diff", c.authenticated(auth.AdminOnly(http.HandlerFunc(c.configDiffHandler))))
+	srv.Handle("POST /api/v1/config/rollback/{version}", c.authenticated(auth.AdminOnly(http.HandlerFunc(c.configRollbackHandler))))
+	srv.Handle("GET /api/v1/config/sing-box", c.authenticated(auth.AdminOnly(http.HandlerFunc(c.getSingBoxConfigHandler))))
+	srv.Handle("PUT /api/v1/config/sing-box", c.authenticated(auth.AdminOnly(http.HandlerFunc(c.putSingBoxConfigHandler))))
+	srv.Handle("GET /api/v1/routing", c.authenticated(auth.AdminOnly(http.HandlerFunc(c.getRoutingHandler))))
+	srv.Handle("POST /api/v1/routing/rules", c.authenticated(auth.AdminOnly(http.HandlerFunc(c.upsertRouteRuleHandler))))
+	srv.Handle("DELETE /api/v1/routing/rules/{id}", c.authenticated(auth.AdminOnly(http.HandlerFunc(c.deleteRouteRuleHandler))))
+	srv.Handle("POST /api/v1/routing/rule-sets", c.authenticated(auth.AdminOnly(http.HandlerFunc(c.upsertRuleSetHandler))))
+	srv.Handle("DELETE /api/v1/routing/rule-sets/{tag}", c.authenticated(auth.AdminOnly(http.HandlerFunc(c.deleteRuleSetHandler))))
+	srv.Handle("GET /api/v1/dns", c.authenticated(auth.AdminOnly(http.HandlerFunc(c.getDNSHandler))))
+	srv.Handle("PUT /api/v1/dns", c.authenticated(auth.AdminOnly(http.HandlerFunc(c.putDNSHandler))))
+	srv.Handle("GET /api/v1/egress", c.authenticated(auth.AdminOnly(http.HandlerFunc(c.getEgressHandler))))
+	srv.Handle("PUT /api/v1/egress", c.authenticated(auth.AdminOnly(http.HandlerFunc(c.putEgressHandler))))
+	srv.Handle("GET /api/v1/client-certs", c.authenticated(auth.AdminOnly(http.HandlerFunc(c.listClientCertsHandler))))
+	srv.Handle("POST /api/v1/client-certs", c.authenticated(auth.AdminEnrollment(http.HandlerFunc(c.enrollClientCertHandler))))
+	srv.Handle("DELETE /api/v1/client-certs/{serial}", c.authenticated(auth.AdminOnly(http.HandlerFunc(c.revokeClientCertHandler))))
+	srv.Handle("GET /api/v1/certificates", c.authenticated(auth.AdminOnly(http.HandlerFunc(c.certificateStatusHandler))))
+	srv.Handle("GET /api/v1/egress/health", c.authenticated(auth.AdminOnly(http.HandlerFunc(c.egressHealthHandler))))
+	srv.Handle("GET /api/v1/audit", c.authenticated(auth.AdminOnly(http.HandlerFunc(c.auditHandler))))
+	srv.Handle("GET /metrics", c.authenticated(auth.AdminOnly(http.HandlerFunc(c.metricsHandler))))
 	srv.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
 		// The "/" pattern matches everything, so we need to check
 		// that we're at the root here.
@@ -80,17 +145,77 @@ func (c *ServeCmd) Run() error {
 		_, _ = fmt.Fprintf(w, "Welcome to Lantern Server Manager. In future, there will be UI here!")
 	})
 
-	return auth.ListenAndServeTLS(args.DataDir, c.CertPEM, c.KeyPEM, c.serverConfig.ExternalIP, c.serverConfig.Port, srv)
+	// stop serving and shut sing-box down gracefully on SIGINT/SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	defer common.StopSingBox()
+	c.registerMetricsCollectors(ctx)
+	if settings.OTLPEndpoint != "" {
+		headers, err := common.ParseTelemetryHeaders(settings.OTLPHeaders)
+		if err != nil {
+			return err
+		}
+		if settings.OTLPInterval.Duration <= 0 {
+			return fmt.Errorf("otlp_interval must be positive")
+		}
+		shutdownTelemetry, err := common.StartTelemetry(ctx, common.TelemetryOptions{
+			Endpoint: settings.OTLPEndpoint,
+			Headers:  headers,
+			Interval: settings.OTLPInterval.Duration,
+		})
+		if err != nil {
+			return err
+		}
+		// the spans of the shutdown are exported once everything else stopped, which it hasn't yet if serving failed
+		defer func() {
+			stop()
+			shutdownTelemetry()
+		}()
+	}
+	if settings.MetricsListen != "" {
+		ln, err := listenMetrics()
+		if err != nil {
+			return err
+		}
+		go c.serveMetrics(ctx, ln)
+	}
+	go c.egressMonitor.Run(ctx, settings.DataDir, egressCheckInterval)
+	go c.watchExternalIP(ctx)
+	if settings.PortRotationInterval.Duration > 0 && settings.PortRotationGrace.Duration > 0 {
+		if err := common.CanRedirectPorts(); err != nil {
+			return fmt.Errorf("port rotation with a grace period needs port redirects, set port_rotation_grace to 0 to rotate without one: %w", err)
+		}
+	}
+	go c.rotatePorts(ctx)
+	if settings.ProbeInterval.Duration > 0 {
+		go c.probeMonitor.Run(ctx, settings.DataDir, c.externalIP, settings.ProbeURL, settings.ProbeInterval.Duration)
+	}
+
+	return auth.ListenAndServeTLS(ctx, settings.DataDir, settings.CertFile, settings.KeyFile, settings.ACMEOptions(), c.clientCerts, c.externalIP, serverConfig.Port, instrumented(srv))
+}
+
+// config returns the server configuration currently in effect.
+func (c *ServeCmd) config() *ServerConfig {
+	return c.serverConfig.Load()
+}
+
+// authenticated wraps next in auth.Middleware using the HMAC secret of the
+// configuration in effect at the time of the request, so a rolled back secret applies immediately,
+// and the admin client certificates.
+func (c *ServeCmd) authenticated(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth.Middleware(c.config().HMACSecret, c.clientCerts, next).ServeHTTP(w, r)
+	})
 }
 
 // getConnectConfigHandler handles requests for generating sing-box client configurations.
 // It uses the username from the request context (validated by middleware) to generate
 // a tailored configuration including the necessary credentials.
 func (c *ServeCmd) getConnectConfigHandler(writer http.ResponseWriter, r *http.Request) {
-	cfg, err := common.GenerateSingBoxConnectConfig(args.DataDir, c.serverConfig.ExternalIP, auth.GetRequestUsername(r))
+	cfg, err := common.GenerateSingBoxConnectConfig(r.Context(), settings.DataDir, c.config().ExternalIP, auth.GetRequestUsername(r))
 	if err != nil {
-		log.Errorf("failed to generate connect config: %v", err)
-		http.Error(writer, "failed to generate connect config", http.StatusInternalServerError)
+		common.Logger(r.Context()).Errorf("failed to generate connect config: %v", err)
+		writeConfigError(writer, "failed to generate connect config", err)
 		return
 	}
 	writer.Header().Set("Content-Type", "application/json")
@@ -100,18 +225,30 @@ func (c *ServeCmd) getConnectConfigHandler(writer http.ResponseWriter, r *http.R
 // ShareLinkExpiration defines the validity duration for generated share links (access tokens).
 const ShareLinkExpiration = 24 * time.Hour
 
-// getShareLinkHandler handles requests to generate a temporary access token (share link) for a user.
-// This endpoint is admin-only. It extracts the username from the URL path.
+// getShareLinkHandler handles requests to generate a temporary access token (share link) for a user,
+// which is recorded in the audit log. This endpoint is admin-only. It extracts the username from the URL path.
+// The response also includes the certificate pin, so the app can verify the server if it uses a self-signed certificate.
 func (c *ServeCmd) getShareLinkHandler(w http.ResponseWriter, r *http.Request) {
 	username := r.PathValue("name")
-	accessToken, err := auth.GenerateAccessToken(c.serverConfig.HMACSecret, username, time.Now().Add(ShareLinkExpiration))
+	if username == common.ProbeUser {
+		http.Error(w, "reserved user name", http.StatusBadRequest)
+		return
+	}
+	accessToken, err := auth.GenerateAccessToken(c.config().HMACSecret, username, time.Now().Add(ShareLinkExpiration))
+	common.Audit(r.Context(), settings.DataDir, auth.GetRequestUsername(r), common.AuditShareLinkIssued, username, "", err)
 	if err != nil {
-		log.Errorf("failed to generate access token: %v", err)
+		common.Logger(r.Context()).Errorf("failed to generate access token: %v", err)
 		http.Error(w, "failed to generate access token", http.StatusInternalServerError)
 		return
 	}
+	pin, err := auth.CertificatePin(settings.DataDir)
+	if err != nil {
+		common.Logger(r.Context()).Errorf("failed to get certificate pin: %v", err)
+		http.Error(w, "failed to get certificate pin", http.StatusInternalServerError)
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
-	_, _ = w.Write([]byte(fmt.Sprintf(`{"token": "%s"}`, accessToken)))
+	_ = json.NewEncoder(w).Encode(map[string]string{"token": accessToken, "pin": pin})
 }
 
 // revokeAccess handles requests to revoke access for a specific user.
@@ -119,18 +256,44 @@ func (c *ServeCmd) getShareLinkHandler(w http.ResponseWriter, r *http.Request) {
 // and calls common.RevokeUser to remove the user from the sing-box config.
 func (c *ServeCmd) revokeAccess(w http.ResponseWriter, r *http.Request) {
 	username := r.PathValue("name")
-	if err := common.RevokeUser(args.DataDir, username); err != nil {
-		log.Errorf("failed to revoke user: %v", err)
-		http.Error(w, "failed to revoke user", http.StatusInternalServerError)
+	if err := common.RevokeUser(r.Context(), settings.DataDir, auth.GetRequestUsername(r), username); err != nil {
+		common.Logger(r.Context()).Errorf("failed to revoke user: %v", err)
+		writeConfigError(w, "failed to revoke user", err)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	_, _ = w.Write([]byte(fmt.Sprintf(`{"status": "ok"}`)))
 }
 
+// writeConfigError reports a failed sing-box config change to the API caller.
+// Invalid settings are reported with writeValidationErrors. If the candidate config failed
+// to apply, the caller gets a 422 with the reason (and whether the previous config was restored);
+// otherwise a generic 500 with msg.
+func writeConfigError(w http.ResponseWriter, msg string, err error) {
+	var validationErrs common.ValidationErrors
+	if errors.As(err, &validationErrs) {
+		writeValidationErrors(w, validationErrs)
+		return
+	}
+	var applyErr *common.ApplyError
+	if errors.As(err, &applyErr) {
+		http.Error(w, fmt.Sprintf("%s: %v", msg, applyErr), http.StatusUnprocessableEntity)
+		return
+	}
+	http.Error(w, msg, http.StatusInternalServerError)
+}
+
 // healthCheckHandler provides a simple health check endpoint.
-// It returns a JSON response indicating the server is running.
+// It returns a JSON response indicating the server is running. The status is "degraded" if sing-box
+// is not running or an upstream is unhealthy. As the endpoint is public, the details are only reported
+// by the admin-only status and egress health endpoints.
 func (c *ServeCmd) healthCheckHandler(w http.ResponseWriter, _ *http.Request) {
+	singBox := common.SingBoxStatus()
+	egress := c.egressMonitor.Status()
+	status := "ok"
+	if singBox.State != common.SupervisorRunning || slices.ContainsFunc(egress, func(h common.EgressHealth) bool { return !h.Healthy }) {
+		status = "degraded"
+	}
 	w.Header().Set("Content-Type", "application/json")
-	_, _ = w.Write([]byte(`{"status": "ok"}`))
+	_ = json.NewEncoder(w).Encode(map[string]string{"status": status})
 }
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+
+	"github.com/charmbracelet/log"
+
+	"github.com/getlantern/lantern-server-manager/auth"
+	"github.com/getlantern/lantern-server-manager/common"
+)
+
+// recordStartupVersions records the configs found on disk at startup in the config history,
+// so that configs created before history was kept (or edited by hand) can be rolled back to.
+// Nothing is recorded if they are unchanged since the last recorded version.
+func (c *ServeCmd) recordStartupVersions() {
+	if data, err := os.ReadFile(path.Join(settings.DataDir, "server.json")); err == nil {
+		if err = common.RecordConfigVersion(settings.DataDir, common.ConfigKindServer, data, common.SystemChange("found on startup")); err != nil {
+			log.Errorf("failed to record server config history: %v", err)
+		}
+	}
+	if data, err := common.ReadSingBoxServerConfigRaw(settings.DataDir); err == nil {
+		if err = common.RecordConfigVersion(settings.DataDir, common.ConfigKindSingBox, data, common.SystemChange("found on startup")); err != nil {
+			log.Errorf("failed to record sing-box config history: %v", err)
+		}
+	}
+}
+
+// configHistoryHandler lists all recorded config versions, newest first.
+// This endpoint is admin-only.
+func (c *ServeCmd) configHistoryHandler(w http.ResponseWriter, _ *http.Request) {
+	versions, err := common.ConfigHistory(settings.DataDir)
+	if err != nil {
+		log.Errorf("failed to read config history: %v", err)
+		http.Error(w, "failed to read config history", http.StatusInternalServerError)
+		return
+	}
+	if versions == nil {
+		versions = []common.ConfigVersion{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"versions": versions})
+}
+
+// configDiffHandler returns a unified diff between the "from" and "to" versions given as query parameters.
+// If "to" is omitted, "from" is compared against the latest version of the same config.
+// This endpoint is admin-only.
+func (c *ServeCmd) configDiffHandler(w http.ResponseWriter, r *http.Request) {
+	from, err := strconv.Atoi(r.URL.Query().Get("from"))
+	if err != nil || from <= 0 {
+		http.Error(w, "invalid 'from' version", http.StatusBadRequest)
+		return
+	}
+	to := 0
+	if toStr := r.URL.Query().Get("to"); toStr != "" {
+		if to, err = strconv.Atoi(toStr); err != nil || to <= 0 {
+			http.Error(w, "invalid 'to' version", http.StatusBadRequest)
+			return
+		}
+	}
+	diff, err := common.DiffConfigVersions(settings.DataDir, from, to)
+	if err != nil {
+		if errors.Is(err, common.ErrVersionNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "text/x-diff; charset=utf-8")
+	_, _ = w.Write([]byte(diff))
+}
+
+// configRollbackHandler restores the config version given in the URL path.
+// sing-box configs are validated and sing-box is restarted; server configs are validated
+// and take effect immediately. This endpoint is admin-only.
+func (c *ServeCmd) configRollbackHandler(w http.ResponseWriter, r *http.Request) {
+	version, err := strconv.Atoi(r.PathValue("version"))
+	if err != nil || version <= 0 {
+		http.Error(w, "invalid version", http.StatusBadRequest)
+		return
+	}
+	v, _, err := common.ReadConfigVersion(settings.DataDir, "", version)
+	if err != nil {
+		if errors.Is(err, common.ErrVersionNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		common.Logger(r.Context()).Errorf("failed to read config version %d: %v", version, err)
+		http.Error(w, "failed to read config version", http.StatusInternalServerError)
+		return
+	}
+	actor := auth.GetRequestUsername(r)
+	switch v.Kind {
+	case common.ConfigKindSingBox:
+		err = common.RollbackSingBoxConfig(r.Context(), settings.DataDir, version, actor)
+	case common.ConfigKindServer:
+		if err = c.rollbackServerConfig(r.Context(), version, actor); err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+	default:
+		err = fmt.Errorf("unknown config kind %q", v.Kind)
+	}
+	if err != nil {
+		common.Logger(r.Context()).Errorf("failed to roll back to config version %d: %v", version, err)
+		writeConfigError(w, "failed to roll back", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write([]byte(`{"status": "ok"}`))
+}
+
+// rollbackServerConfig validates a previous version of "server.json", writes it back with the
+// current access token and HMAC secret and makes it the configuration in effect.
+func (c *ServeCmd) rollbackServerConfig(ctx context.Context, version int, actor string) error {
+	_, data, err := common.ReadConfigVersion(settings.DataDir, common.ConfigKindServer, version)
+	if err != nil {
+		return err
+	}
+	conf, err := parseServerConfig(data)
+	if err != nil {
+		return fmt.Errorf("server config version %d is invalid: %w", version, err)
+	}
+	c.serverConfigMu.Lock()
+	defer c.serverConfigMu.Unlock()
+	// a rotated secret or access token must not come back
+	conf.AccessToken = c.config().AccessToken
+	conf.HMACSecret = c.config().HMACSecret
+	change := common.ConfigChange{Actor: actor, Reason: fmt.Sprintf("rollback to version %d", version), Context: ctx}
+	if err = WriteServerConfig(settings.DataDir, conf, change); err != nil {
+		return err
+	}
+	c.serverConfig.Store(conf)
+	return nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+
+	"github.com/charmbracelet/log"
+
+	"github.com/getlantern/lantern-server-manager/auth"
+	"github.com/getlantern/lantern-server-manager/common"
+)
+
+// maxConfigBodySize limits the size of a sing-box config submitted through the API.
+const maxConfigBodySize = 1 << 20
+
+// getSingBoxConfigHandler returns the current sing-box server config as stored on disk.
+// This endpoint is admin-only.
+func (c *ServeCmd) getSingBoxConfigHandler(w http.ResponseWriter, _ *http.Request) {
+	data, err := common.ReadSingBoxServerConfigRaw(settings.DataDir)
+	if err != nil {
+		log.Errorf("failed to read sing-box config: %v", err)
+		http.Error(w, "failed to read sing-box config", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(data)
+}
+
+// putSingBoxConfigHandler replaces the sing-box server config with the request body.
+// With a Content-Type of "application/merge-patch+json" the body is merged into the current config instead.
+// Changes of the sections owned by the manager, e.g. the users or the route section, are rejected
+// with the API to change them through. Rejected configs are reported as
+// {"errors": [{"field": "...", "message": "..."}]} with status 422. This endpoint is admin-only.
+func (c *ServeCmd) putSingBoxConfigHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxConfigBodySize))
+	if err != nil {
+		http.Error(w, "failed to read request body", http.StatusBadRequest)
+		return
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	patch := mediaType == "application/merge-patch+json"
+
+	change := common.ConfigChange{Actor: auth.GetRequestUsername(r), Reason: "edit sing-box config", Context: r.Context()}
+	if patch {
+		change.Reason = "patch sing-box config"
+	}
+	err = common.EditSingBoxConfig(settings.DataDir, body, patch, change, c.config().Port)
+	if err != nil {
+		var validationErrs common.ValidationErrors
+		var applyErr *common.ApplyError
+		switch {
+		case errors.As(err, &validationErrs):
+			writeValidationErrors(w, validationErrs)
+		case errors.As(err, &applyErr):
+			writeValidationErrors(w, common.ValidationErrors{{Message: applyErr.Error()}})
+		default:
+			common.Logger(r.Context()).Errorf("failed to edit sing-box config: %v", err)
+			http.Error(w, "failed to edit sing-box config", http.StatusInternalServerError)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write([]byte(`{"status": "ok"}`))
+}
+
+// writeValidationErrors responds with status 422 and the list of problems found in a submitted config.
+func writeValidationErrors(w http.ResponseWriter, errs common.ValidationErrors) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	_ = json.NewEncoder(w).Encode(map[string]any{"errors": errs})
+}
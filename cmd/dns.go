@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/charmbracelet/log"
+
+	"github.com/getlantern/lantern-server-manager/auth"
+	"github.com/getlantern/lantern-server-manager/common"
+)
+
+// getDNSHandler returns the DNS settings sing-box is configured with.
+// This endpoint is admin-only.
+func (c *ServeCmd) getDNSHandler(w http.ResponseWriter, _ *http.Request) {
+	dc, err := common.ReadDNSConfig(settings.DataDir)
+	if err != nil {
+		log.Errorf("failed to read DNS config: %v", err)
+		http.Error(w, "failed to read DNS config", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(dc)
+}
+
+// putDNSHandler replaces the DNS settings with the request body and applies them.
+// This endpoint is admin-only.
+func (c *ServeCmd) putDNSHandler(w http.ResponseWriter, r *http.Request) {
+	var newConfig common.DNSConfig
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxConfigBodySize)).Decode(&newConfig); err != nil {
+		http.Error(w, fmt.Sprintf("invalid DNS config: %v", err), http.StatusBadRequest)
+		return
+	}
+	change := common.ConfigChange{Actor: auth.GetRequestUsername(r), Reason: "update DNS settings", Context: r.Context()}
+	err := common.UpdateDNS(settings.DataDir, change, func(dc *common.DNSConfig) error {
+		*dc = newConfig
+		return nil
+	})
+	if err != nil {
+		common.Logger(r.Context()).Errorf("failed to update DNS config: %v", err)
+		writeConfigError(w, "failed to update DNS config", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(newConfig)
+}
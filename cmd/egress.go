@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/charmbracelet/log"
+
+	"github.com/getlantern/lantern-server-manager/auth"
+	"github.com/getlantern/lantern-server-manager/common"
+)
+
+// egressCheckInterval is how often the upstream outbounds are health checked.
+const egressCheckInterval = time.Minute
+
+// getEgressHandler returns the upstream outbounds, default route and egress rules, with passwords and
+// keys redacted. This endpoint is admin-only.
+func (c *ServeCmd) getEgressHandler(w http.ResponseWriter, _ *http.Request) {
+	ec, err := common.ReadEgressConfig(settings.DataDir)
+	if err != nil {
+		log.Errorf("failed to read egress config: %v", err)
+		http.Error(w, "failed to read egress config", http.StatusInternalServerError)
+		return
+	}
+	writeRedactedJSON(w, ec)
+}
+
+// putEgressHandler replaces the upstream outbounds, default route and egress rules with the request body
+// and applies them. Redacted secrets are kept from the outbound with the same tag, so the response of
+// getEgressHandler can be edited and sent back. This endpoint is admin-only.
+func (c *ServeCmd) putEgressHandler(w http.ResponseWriter, r *http.Request) {
+	var newConfig common.EgressConfig
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxConfigBodySize)).Decode(&newConfig); err != nil {
+		http.Error(w, fmt.Sprintf("invalid egress config: %v", err), http.StatusBadRequest)
+		return
+	}
+	change := common.ConfigChange{Actor: auth.GetRequestUsername(r), Reason: "update egress settings", Context: r.Context()}
+	err := common.UpdateEgress(settings.DataDir, change, func(ec *common.EgressConfig) error {
+		if err := newConfig.RestoreSecrets(ec); err != nil {
+			return err
+		}
+		*ec = newConfig
+		return nil
+	})
+	if err != nil {
+		common.Logger(r.Context()).Errorf("failed to update egress config: %v", err)
+		writeConfigError(w, "failed to update egress config", err)
+		return
+	}
+	writeRedactedJSON(w, newConfig)
+}
+
+// writeRedactedJSON writes v as JSON with its passwords and keys redacted.
+func writeRedactedJSON(w http.ResponseWriter, v any) {
+	data, err := common.MarshalRedacted(v)
+	if err != nil {
+		log.Errorf("failed to encode response: %v", err)
+		http.Error(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(data)
+}
+
+// egressHealthHandler returns the result of the last health check of each upstream outbound.
+// This endpoint is admin-only.
+func (c *ServeCmd) egressHealthHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(c.egressMonitor.Status())
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/mroth/jitter"
+
+	"github.com/getlantern/lantern-server-manager/auth"
+	"github.com/getlantern/lantern-server-manager/common"
+)
+
+// externalIPCheckInterval is how often the public IP is re-detected.
+const externalIPCheckInterval = 10 * time.Minute
+
+// externalIP returns the public IP or host name of the server currently in effect.
+func (c *ServeCmd) externalIP() string {
+	return c.config().ExternalIP
+}
+
+// watchExternalIP periodically re-detects the public IP until ctx is done, unless it was set explicitly.
+// When it changed, the server config is updated, a new certificate is requested and an
+// EventExternalIPChanged event is published so clients can be told.
+func (c *ServeCmd) watchExternalIP(ctx context.Context) {
+	if settings.ExternalIP != "" {
+		return
+	}
+	ticker := jitter.NewTicker(externalIPCheckInterval, 0.2)
+	defer ticker.Stop()
+	for {
+		detected, err := common.GetPublicIP()
+		switch {
+		case err != nil:
+			log.Warnf("failed to detect public IP: %v", err)
+		case net.ParseIP(detected) == nil:
+			log.Warnf("public IP detection returned %q, ignoring", detected)
+		default:
+			if err = c.updateExternalIP(detected); err != nil {
+				log.Errorf("failed to update public IP: %v", err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// updateExternalIP stores a newly detected public IP, if it differs from the one in effect.
+func (c *ServeCmd) updateExternalIP(ip string) error {
+	c.serverConfigMu.Lock()
+	defer c.serverConfigMu.Unlock()
+	current := c.config()
+	if current.ExternalIP == ip {
+		return nil
+	}
+	updated := *current
+	updated.ExternalIP = ip
+	if err := WriteServerConfig(settings.DataDir, &updated, common.SystemChange("public IP changed")); err != nil {
+		return err
+	}
+	c.serverConfig.Store(&updated)
+	log.Warnf("Public IP changed from %s to %s, clients need to be updated", current.ExternalIP, ip)
+	common.PublishEvent(common.EventExternalIPChanged, map[string]any{"old": current.ExternalIP, "new": ip})
+	auth.RequestCertificateRenewal()
+	return nil
+}
+
+// eventsHandler returns the events published after the one with the ID given in the "since" query parameter.
+// This endpoint is available to all authenticated users, so apps can learn e.g. about a changed server address.
+func (c *ServeCmd) eventsHandler(w http.ResponseWriter, r *http.Request) {
+	var since int64
+	if s := r.URL.Query().Get("since"); s != "" {
+		var err error
+		if since, err = strconv.ParseInt(s, 10, 64); err != nil {
+			http.Error(w, "invalid since", http.StatusBadRequest)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(common.EventsSince(since))
+}
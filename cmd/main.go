@@ -3,9 +3,13 @@ package main
 import (
 	"errors"
 	"fmt"
+	"os"
+	"time"
+
 	"github.com/alexflint/go-arg"
 	"github.com/charmbracelet/log"
-	"os"
+
+	"github.com/getlantern/lantern-server-manager/common"
 )
 
 // LogLevel is a wrapper around charmbracelet/log.Level to allow
@@ -25,30 +29,127 @@ func (ll *LogLevel) UnmarshalText(b []byte) error {
 	return nil
 }
 
+// Duration is a wrapper around time.Duration to allow parsing durations like "12h"
+// from command-line arguments, environment variables and the config file.
+type Duration struct {
+	time.Duration
+}
+
+// UnmarshalText implements the encoding.TextUnmarshaler interface for Duration.
+func (d *Duration) UnmarshalText(b []byte) error {
+	v, err := time.ParseDuration(string(b))
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
 // args holds the command-line arguments parsed by go-arg.
+// Flags for settings are pointers so that loadSettings can tell whether they were given;
+// see Settings for the defaults and the environment variables and config file keys they override.
 var args struct {
-	LogLevel LogLevel `arg:"-l,--log-level" help:"set log level" default:"info"`
-	DataDir  string   `arg:"-d" help:"data directory" default:"./data"`
-	APIPort  int      `arg:"--api-port" help:"API port"`
-	VPNPort  int      `arg:"--vpn-port" help:"VPN port"`
+	ConfigFile *string   `arg:"-c,--config" help:"YAML config file [env: LSM_CONFIG, default: /etc/lantern-server-manager/config.yaml if it exists]"`
+	LogLevel   *LogLevel `arg:"-l,--log-level" help:"set log level [default: info]"`
+	DataDir    *string   `arg:"-d,--datadir" help:"data directory [default: ./data]"`
+	APIPort    *int      `arg:"--api-port" help:"API port"`
+	VPNPort    *int      `arg:"--vpn-port" help:"VPN port"`
+	ExternalIP *string   `arg:"--external-ip" help:"public IP address or host name of the server, instead of detecting it"`
+	Domains    []string  `arg:"--domain,separate" help:"DNS name to obtain a certificate for, in addition to the public IP (can be repeated)"`
+	CertFile   *string   `arg:"--cert" help:"TLS certificate file, instead of obtaining one with ACME"`
+	KeyFile    *string   `arg:"--key" help:"TLS key file, instead of obtaining one with ACME"`
+
+	ACMEEmail        *string  `arg:"--acme-email" help:"contact email of the ACME account [default: admin@thisbox.org]"`
+	ACMEDirectory    *string  `arg:"--acme-directory" help:"ACME directory URL [default: Let's Encrypt]"`
+	ACMEChallenge    *string  `arg:"--acme-challenge" help:"ACME challenge: http-01 (port 80), tls-alpn-01 (port 443) or dns-01 [default: http-01]"`
+	ACMEDNSProvider  *string  `arg:"--acme-dns-provider" help:"lego DNS provider for the dns-01 challenge, e.g. cloudflare; credentials are read from the provider's environment variables"`
+	ACMEDNSResolvers []string `arg:"--acme-dns-resolver,separate" help:"nameserver used to check DNS-01 propagation (can be repeated)"`
+	ACMEProfile      *string  `arg:"--acme-profile" help:"certificate profile to request, empty for none [default: shortlived]"`
+	ACMEKeyType      *string  `arg:"--acme-key-type" help:"certificate key type: ec256, ec384, rsa2048, rsa3072, rsa4096 or rsa8192 [default: rsa2048]"`
+	ACMEEABKeyID     *string  `arg:"--acme-eab-kid" help:"External Account Binding key ID, required by some CAs such as ZeroSSL"`
+	ACMEEABHMACKey   *string  `arg:"--acme-eab-hmac-key" help:"base64url encoded External Account Binding HMAC key; prefer the LSM_ACME_EAB_HMAC_KEY environment variable"`
+	ACMECACert       *string  `arg:"--acme-ca-cert" help:"PEM file with root certificates to trust for the ACME directory, e.g. of a local test CA"`
+	AdminClientCert  *string  `arg:"--admin-client-cert" help:"admin client certificates: off, alternative to the token, or required in addition to it [default: off]"`
+	FirewallBackend  *string  `arg:"--firewall" help:"firewall to open ports in: auto, firewalld, ufw, nftables, iptables or none [default: auto]"`
+	SupervisorMode   *string  `arg:"--supervisor" help:"how sing-box is run: systemd, or process to run it as a child process [default: systemd]"`
+
+	PortRotationInterval *Duration `arg:"--port-rotation-interval" help:"move the VPN inbounds to new random ports this often, e.g. 24h; 0 disables rotation [default: 0]"`
+	PortRotationGrace    *Duration `arg:"--port-rotation-grace" help:"keep redirecting the previous ports to the new ones for this long after a rotation [default: 1h]"`
+	PortHoppingRange     *string   `arg:"--port-hopping-range" help:"UDP port range redirected to the first Hysteria, Hysteria2 or TUIC inbound for port hopping, e.g. 20000-40000"`
+	ProbeInterval        *Duration `arg:"--probe-interval" help:"probe each inbound end-to-end this often; 0 disables probing [default: 15m]"`
+	ProbeURL             *string   `arg:"--probe-url" help:"URL fetched through the inbounds when probing them [default: https://www.gstatic.com/generate_204]"`
+	BlockReportThreshold *int      `arg:"--block-report-threshold" help:"number of users reporting failed connections after which an inbound is considered blocked [default: 3]"`
+	AutoRotateBlocked    *bool     `arg:"--auto-rotate-blocked" help:"move the inbounds to new ports when one is considered blocked"`
+	MetricsListen        *string   `arg:"--metrics-listen" help:"loopback address to also serve /metrics on without authentication, e.g. 127.0.0.1:9100"`
+	OTLPEndpoint         *string   `arg:"--otlp-endpoint" help:"base URL of an OTLP/HTTP collector to export traces and metrics to, e.g. http://localhost:4318"`
+	OTLPHeaders          []string  `arg:"--otlp-header,separate" help:"key=value header added to the OTLP export requests (can be repeated)"`
+	OTLPInterval         *Duration `arg:"--otlp-interval" help:"how often traces and metrics are exported [default: 10s]"`
+	LogFormat            *string   `arg:"--log-format" help:"log format: text or json [default: text]"`
+	ComponentLogLevels   []string  `arg:"--component-log-level,separate" help:"level of the auth, acme, firewall or supervisor logs, e.g. acme=debug (can be repeated)"`
 
-	Serve *ServeCmd `arg:"subcommand:serve" help:"start the server"`
-	Init  *InitCmd  `arg:"subcommand:init" help:"generate initial configuration"`
+	DNSServers  []string `arg:"--dns-server,separate" help:"upstream DNS server used when generating the initial configuration, e.g. https://1.1.1.1/dns-query, tls://8.8.8.8, udp://9.9.9.9 or local (can be repeated)"`
+	DNSStrategy *string  `arg:"--dns-strategy" help:"DNS strategy used when generating the initial configuration: prefer_ipv4, prefer_ipv6, ipv4_only or ipv6_only"`
+
+	AuditMaxFiles *int `arg:"--audit-max-files" help:"number of rotated audit logs to keep, deleting older ones; 0 keeps all of them [default: 0]"`
+
+	Serve      *ServeCmd      `arg:"subcommand:serve" help:"start the server"`
+	Init       *InitCmd       `arg:"subcommand:init" help:"generate initial configuration"`
+	DNS        *DNSCmd        `arg:"subcommand:dns" help:"show or change the DNS settings"`
+	Egress     *EgressCmd     `arg:"subcommand:egress" help:"show, change or check the upstream outbounds"`
+	Config     *ConfigCmd     `arg:"subcommand:config" help:"inspect the settings"`
+	ClientCert *ClientCertCmd `arg:"subcommand:client-cert" help:"manage admin client certificate enrollment"`
+	SelfTest   *SelfTestCmd   `arg:"subcommand:selftest" help:"test each inbound end-to-end through the running server"`
 }
 
+// settings holds the effective settings, resolved by loadSettings.
+var settings *Settings
+
 // main is the entry point of the application.
-// It parses command-line arguments, sets the log level, ensures the data directory exists,
-// and dispatches execution to the appropriate subcommand (serve or init).
+// It parses command-line arguments, resolves the settings, configures logging, ensures the data
+// directory exists, and dispatches execution to the appropriate subcommand.
 func main() {
-	var err error
 	p := arg.MustParse(&args)
-	log.SetLevel(args.LogLevel.Level)
-	ensureDataDirectoryExists()
+	var err error
+	if settings, err = loadSettings(); err != nil {
+		p.Fail(err.Error())
+	}
+	componentLevels, err := common.ParseComponentLogLevels(settings.ComponentLogLevels)
+	if err != nil {
+		p.Fail(err.Error())
+	}
+	if err = common.ConfigureLogging(settings.LogLevel.Level, common.LogFormat(settings.LogFormat), componentLevels); err != nil {
+		p.Fail(err.Error())
+	}
+	if err = common.SetSupervisorMode(common.SupervisorMode(settings.SupervisorMode)); err != nil {
+		p.Fail(err.Error())
+	}
+	if err = common.SetFirewallBackend(common.FirewallBackend(settings.FirewallBackend)); err != nil {
+		p.Fail(err.Error())
+	}
+	if err = common.SetPortHoppingRange(settings.PortHoppingRange); err != nil {
+		p.Fail(err.Error())
+	}
+	if err = common.SetAuditMaxFiles(settings.AuditMaxFiles); err != nil {
+		p.Fail(err.Error())
+	}
+	if args.Config == nil {
+		ensureDataDirectoryExists()
+	}
 	switch {
 	case args.Serve != nil:
 		err = args.Serve.Run()
 	case args.Init != nil:
 		err = args.Init.Run()
+	case args.DNS != nil:
+		err = args.DNS.Run()
+	case args.Egress != nil:
+		err = args.Egress.Run()
+	case args.Config != nil:
+		err = args.Config.Run()
+	case args.ClientCert != nil:
+		err = args.ClientCert.Run()
+	case args.SelfTest != nil:
+		err = args.SelfTest.Run()
 	default:
 		p.WriteHelp(os.Stderr)
 	}
@@ -62,14 +163,14 @@ func main() {
 	}
 }
 
-// ensureDataDirectoryExists checks if the data directory specified by args.DataDir exists.
+// ensureDataDirectoryExists checks if the data directory specified by settings.DataDir exists.
 // If it doesn't exist, it creates the directory with 0755 permissions.
 // If the path exists but is not a directory, it logs a fatal error.
 func ensureDataDirectoryExists() {
-	if fi, err := os.Stat(args.DataDir); err != nil {
+	if fi, err := os.Stat(settings.DataDir); err != nil {
 		if os.IsNotExist(err) {
-			log.Debug("data directory does not exist, creating", "path", args.DataDir)
-			err = os.MkdirAll(args.DataDir, 0755)
+			log.Debug("data directory does not exist, creating", "path", settings.DataDir)
+			err = os.MkdirAll(settings.DataDir, 0755)
 			if err != nil {
 				log.Fatalf("Unable to create data folder %v", err)
 			}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/sagernet/sing-box/option"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/getlantern/lantern-server-manager/auth"
+	"github.com/getlantern/lantern-server-manager/common"
+)
+
+var (
+	apiRequests = common.NewCounter("lsm_api_requests_total",
+		"API requests by route, method and status code.", "route", "method", "code")
+	apiRequestDuration = common.NewHistogram("lsm_api_request_duration_seconds",
+		"Latency of API requests by route and method.", common.DefaultLatencyBuckets, "route", "method")
+	certificateExpiry = common.NewGauge("lsm_certificate_expiry_timestamp_seconds",
+		"When each certificate served by the API expires, as a Unix timestamp.", "names")
+	certificateFailures = common.NewGauge("lsm_certificate_renewal_failures",
+		"Consecutive failed attempts to load or renew the certificates.")
+	singBoxUp            = common.NewGauge("lsm_singbox_up", "Whether the sing-box process is running.")
+	singBoxCrashRestarts = common.NewGauge("lsm_singbox_crash_restarts",
+		"Times sing-box was restarted after it exited unexpectedly, as reported by the supervisor or systemd.")
+	userCount = common.NewGauge("lsm_users", "Users of each Shadowsocks inbound, without the probe user.", "inbound")
+)
+
+// statusRecorder remembers the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying ResponseWriter.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// instrumented traces and logs the requests to mux, counts them and measures their latency, labelled with the
+// pattern of the route that handled them, so that path parameters like user names don't end up in the metrics.
+// A trace started by the client is continued if the request has a traceparent header.
+func instrumented(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := common.Tracer.Start(ctx, r.Method, trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(attribute.String("http.request.method", r.Method)))
+		defer span.End()
+		ctx, subject := auth.WithSubjectRecorder(ctx)
+		ctx = common.WithSourceIP(ctx, remoteIP(r))
+		r = r.WithContext(ctx)
+
+		rec := &statusRecorder{ResponseWriter: w}
+		mux.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		route := r.Pattern
+		if route == "" {
+			route = "unmatched"
+		}
+		// the method is part of most patterns, e.g. "GET /api/v1/health"
+		if _, path, ok := strings.Cut(route, " "); ok {
+			route = path
+		}
+		latency := time.Since(start)
+		apiRequests.Inc(route, r.Method, fmt.Sprint(rec.status))
+		apiRequestDuration.Observe(latency.Seconds(), route, r.Method)
+		logRequest(r, route, rec.status, latency, subject())
+
+		span.SetName(r.Method + " " + route)
+		span.SetAttributes(attribute.String("http.route", route), attribute.Int("http.response.status_code", rec.status))
+		if rec.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(rec.status))
+		}
+	})
+}
+
+// metricsHandler writes the metrics in the Prometheus text format.
+// On the API port this endpoint is admin-only; it is also served without authentication
+// on settings.MetricsListen if that is set.
+func (c *ServeCmd) metricsHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := common.WriteMetrics(w); err != nil {
+		log.Debugf("failed to write metrics: %v", err)
+	}
+}
+
+// registerMetricsCollectors sets the gauges that are read from elsewhere each time the metrics are written,
+// and polls the traffic counters until ctx is done.
+func (c *ServeCmd) registerMetricsCollectors(ctx context.Context) {
+	common.RegisterMetricsCollector(func() {
+		status := auth.GetCertificateStatus()
+		certificateExpiry.Reset()
+		for _, cert := range status.Certificates {
+			certificateExpiry.Set(float64(cert.NotAfter.Unix()), strings.Join(cert.Names, ","))
+		}
+		certificateFailures.Set(float64(status.Failures))
+	})
+	common.RegisterMetricsCollector(func() {
+		st := common.SingBoxStatus()
+		up := 0.0
+		if st.State == common.SupervisorRunning {
+			up = 1
+		}
+		singBoxUp.Set(up)
+		singBoxCrashRestarts.Set(float64(st.Restarts))
+	})
+	common.RegisterMetricsCollector(func() {
+		opt, err := common.ReadSingBoxServerConfig(settings.DataDir)
+		if err != nil {
+			log.Debugf("failed to read sing-box config for metrics: %v", err)
+			return
+		}
+		userCount.Reset()
+		for _, inbound := range opt.Inbounds {
+			if ss, ok := inbound.Options.(*option.ShadowsocksInboundOptions); ok {
+				users := slices.DeleteFunc(slices.Clone(ss.Users), func(u option.ShadowsocksUser) bool { return u.Name == common.ProbeUser })
+				userCount.Set(float64(len(users)), inbound.Tag)
+			}
+		}
+	})
+	// the traffic counters are polled on their own, as connections that close between scrapes would be missed
+	go common.RunTrafficMetrics(ctx, settings.DataDir)
+}
+
+// serveMetrics serves the metrics without authentication on ln until ctx is done.
+func (c *ServeCmd) serveMetrics(ctx context.Context, ln net.Listener) {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", http.HandlerFunc(c.metricsHandler))
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		_ = srv.Close()
+	}()
+	log.Infof("Serving metrics on http://%s/metrics", ln.Addr())
+	if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Errorf("failed to serve metrics: %v", err)
+	}
+}
+
+// listenMetrics opens the listener for settings.MetricsListen, refusing addresses other than loopback
+// as the metrics are served there without authentication.
+func listenMetrics() (net.Listener, error) {
+	host, _, err := net.SplitHostPort(settings.MetricsListen)
+	if err != nil {
+		return nil, fmt.Errorf("invalid metrics_listen %q: %w", settings.MetricsListen, err)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, fmt.Errorf("metrics_listen %q must be a loopback address, as the metrics are served there without authentication", settings.MetricsListen)
+	}
+	return net.Listen("tcp", settings.MetricsListen)
+}
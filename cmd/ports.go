@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/charmbracelet/log"
+
+	"github.com/getlantern/lantern-server-manager/common"
+)
+
+// portRotationRetry is how long to wait before trying again after a failed port rotation.
+const portRotationRetry = 5 * time.Minute
+
+// rotatePorts moves the inbounds to new ports every settings.PortRotationInterval until ctx is done,
+// and removes the redirects of previous ports when their grace period is over. After a rotation an
+// EventPortsRotated event is published, so clients know to fetch a new connect config.
+func (c *ServeCmd) rotatePorts(ctx context.Context) {
+	interval := settings.PortRotationInterval.Duration
+	// the first rotation is an interval after startup if the inbounds were never rotated
+	last := time.Now()
+	var retryAt time.Time
+	for {
+		if err := common.ExpirePreviousPorts(settings.DataDir); err != nil {
+			log.Errorf("failed to expire previous ports: %v", err)
+		}
+		state, err := common.ReadPortRotationState(settings.DataDir)
+		if err != nil {
+			log.Errorf("failed to read port rotation state: %v", err)
+			state = &common.PortRotationState{}
+		}
+		if !state.LastRotation.IsZero() {
+			last = state.LastRotation
+		}
+
+		var next time.Time
+		if interval > 0 {
+			next = last.Add(interval)
+			if retryAt.After(next) {
+				next = retryAt
+			}
+			if !next.After(time.Now()) {
+				if err = c.rotatePortsNow(); err != nil {
+					log.Errorf("failed to rotate ports, trying again in %v: %v", portRotationRetry, err)
+					retryAt = time.Now().Add(portRotationRetry)
+				}
+				continue
+			}
+		}
+		if expiry := state.NextExpiry(); !expiry.IsZero() && (next.IsZero() || expiry.Before(next)) {
+			next = expiry
+		}
+		if next.IsZero() {
+			// nothing to rotate or expire
+			return
+		}
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// rotatePortsNow moves the inbounds to new ports once and publishes an EventPortsRotated event.
+func (c *ServeCmd) rotatePortsNow() error {
+	grace := settings.PortRotationGrace.Duration
+	changes, err := common.RotatePorts(settings.DataDir, grace, c.config().Port)
+	if err != nil {
+		return err
+	}
+	common.PublishEvent(common.EventPortsRotated, map[string]any{
+		"ports":       changes,
+		"grace_until": time.Now().Add(grace).UTC(),
+	})
+	return nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/getlantern/lantern-server-manager/common"
+)
+
+// redactedQueryParams are query parameters whose values are replaced before a request is logged,
+// since they carry access tokens.
+var redactedQueryParams = []string{"token"}
+
+// logRequest logs a served API request with its route, status, latency, authenticated user and remote IP.
+func logRequest(r *http.Request, route string, status int, latency time.Duration, user string) {
+	common.Logger(r.Context()).Info("request",
+		"method", r.Method,
+		"route", route,
+		"uri", redactedRequestURI(r.URL),
+		"status", status,
+		"latency", latency,
+		"user", user,
+		"remote_ip", remoteIP(r),
+	)
+}
+
+// remoteIP returns the IP address the request came from.
+func remoteIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// redactedRequestURI returns the path and query of u with the values of redactedQueryParams replaced.
+func redactedRequestURI(u *url.URL) string {
+	query := u.Query()
+	redacted := false
+	for _, name := range redactedQueryParams {
+		if query.Has(name) {
+			query.Set(name, "REDACTED")
+			redacted = true
+		}
+	}
+	if !redacted {
+		return u.RequestURI()
+	}
+	clean := *u
+	clean.RawQuery = query.Encode()
+	return clean.RequestURI()
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestRedactedRequestURI(t *testing.T) {
+	tests := []struct {
+		uri  string
+		want string
+	}{
+		{"/api/v1/users", "/api/v1/users"},
+		{"/api/v1/users?limit=10", "/api/v1/users?limit=10"},
+		{"/api/v1/connect-config?token=secret", "/api/v1/connect-config?token=REDACTED"},
+		{"/api/v1/connect-config?token=secret&token=other", "/api/v1/connect-config?token=REDACTED"},
+		{"/api/v1/share-link/alice?token=secret&expires=24h", "/api/v1/share-link/alice?expires=24h&token=REDACTED"},
+		{"/api/v1/users/a%2Fb?token=secret", "/api/v1/users/a%2Fb?token=REDACTED"},
+		{"/api/v1/users?tokens=1", "/api/v1/users?tokens=1"},
+	}
+	for _, tt := range tests {
+		u, err := url.Parse(tt.uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := redactedRequestURI(u); got != tt.want {
+			t.Errorf("redactedRequestURI(%q) = %q, want %q", tt.uri, got, tt.want)
+		}
+	}
+}
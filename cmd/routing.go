@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/charmbracelet/log"
+
+	"github.com/getlantern/lantern-server-manager/auth"
+	"github.com/getlantern/lantern-server-manager/common"
+)
+
+// getRoutingHandler returns the managed routing rules and rule sets.
+// This endpoint is admin-only.
+func (c *ServeCmd) getRoutingHandler(w http.ResponseWriter, _ *http.Request) {
+	rc, err := common.ReadRoutingConfig(settings.DataDir)
+	if err != nil {
+		log.Errorf("failed to read routing config: %v", err)
+		http.Error(w, "failed to read routing config", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(rc)
+}
+
+// upsertRouteRuleHandler adds the routing rule in the request body, or replaces the rule with the same id.
+// New rules are added at the end and enabled unless "enabled" is explicitly false.
+// It responds with the stored rule. This endpoint is admin-only.
+func (c *ServeCmd) upsertRouteRuleHandler(w http.ResponseWriter, r *http.Request) {
+	rule := common.RouteRule{Enabled: true}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxConfigBodySize)).Decode(&rule); err != nil {
+		http.Error(w, fmt.Sprintf("invalid rule: %v", err), http.StatusBadRequest)
+		return
+	}
+	change := common.ConfigChange{Actor: auth.GetRequestUsername(r), Reason: fmt.Sprintf("update routing rule %s", rule.ID), Context: r.Context()}
+	err := common.UpdateRouting(settings.DataDir, change, func(rc *common.RoutingConfig) error {
+		rule = rc.UpsertRule(rule)
+		return nil
+	})
+	if err != nil {
+		common.Logger(r.Context()).Errorf("failed to update routing rule: %v", err)
+		writeConfigError(w, "failed to update routing rule", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(rule)
+}
+
+// deleteRouteRuleHandler removes the routing rule with the id given in the URL path.
+// This endpoint is admin-only.
+func (c *ServeCmd) deleteRouteRuleHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	change := common.ConfigChange{Actor: auth.GetRequestUsername(r), Reason: fmt.Sprintf("remove routing rule %s", id), Context: r.Context()}
+	err := common.UpdateRouting(settings.DataDir, change, func(rc *common.RoutingConfig) error {
+		if !rc.RemoveRule(id) {
+			return common.ErrRuleNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		if errors.Is(err, common.ErrRuleNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		common.Logger(r.Context()).Errorf("failed to remove routing rule: %v", err)
+		writeConfigError(w, "failed to remove routing rule", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write([]byte(`{"status": "ok"}`))
+}
+
+// upsertRuleSetHandler adds the remote rule set in the request body, or replaces the one with the same tag.
+// This endpoint is admin-only.
+func (c *ServeCmd) upsertRuleSetHandler(w http.ResponseWriter, r *http.Request) {
+	var rs common.RuleSetSource
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxConfigBodySize)).Decode(&rs); err != nil {
+		http.Error(w, fmt.Sprintf("invalid rule set: %v", err), http.StatusBadRequest)
+		return
+	}
+	change := common.ConfigChange{Actor: auth.GetRequestUsername(r), Reason: fmt.Sprintf("update rule set %s", rs.Tag), Context: r.Context()}
+	err := common.UpdateRouting(settings.DataDir, change, func(rc *common.RoutingConfig) error {
+		rc.UpsertRuleSet(rs)
+		return nil
+	})
+	if err != nil {
+		common.Logger(r.Context()).Errorf("failed to update rule set: %v", err)
+		writeConfigError(w, "failed to update rule set", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(rs)
+}
+
+// deleteRuleSetHandler removes the rule set with the tag given in the URL path.
+// Rule sets still used by a rule can't be removed. This endpoint is admin-only.
+func (c *ServeCmd) deleteRuleSetHandler(w http.ResponseWriter, r *http.Request) {
+	tag := r.PathValue("tag")
+	change := common.ConfigChange{Actor: auth.GetRequestUsername(r), Reason: fmt.Sprintf("remove rule set %s", tag), Context: r.Context()}
+	err := common.UpdateRouting(settings.DataDir, change, func(rc *common.RoutingConfig) error {
+		removed, err := rc.RemoveRuleSet(tag)
+		if err != nil {
+			return common.ValidationErrors{{Field: "tag", Message: err.Error()}}
+		}
+		if !removed {
+			return common.ErrRuleNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		if errors.Is(err, common.ErrRuleNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		common.Logger(r.Context()).Errorf("failed to remove rule set: %v", err)
+		writeConfigError(w, "failed to remove rule set", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write([]byte(`{"status": "ok"}`))
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/getlantern/lantern-server-manager/auth"
+	"github.com/getlantern/lantern-server-manager/common"
+)
+
+const (
+	// defaultSelfTestBytes is the size of the download from the echo endpoint in a self-test.
+	defaultSelfTestBytes = 1 << 20
+	// maxSelfTestBytes limits the size of the download from the echo endpoint.
+	maxSelfTestBytes = 16 << 20
+	// selfTestTokenExpiration is how long the access token for the echo endpoint is valid.
+	selfTestTokenExpiration = 5 * time.Minute
+)
+
+// selfTestRequest is the optional body of a self-test request.
+type selfTestRequest struct {
+	// URL is fetched through each inbound instead of the echo endpoint.
+	URL string `json:"url"`
+	// Bytes is the size of the download from the echo endpoint.
+	Bytes int `json:"bytes"`
+}
+
+// selfTestHandler tests each inbound end-to-end as the probe user and returns the latency,
+// throughput and result per inbound. Unless a URL is given, the download is made from the echo endpoint
+// of this server. This endpoint is admin-only.
+func (c *ServeCmd) selfTestHandler(w http.ResponseWriter, r *http.Request) {
+	var req selfTestRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxConfigBodySize)).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, fmt.Sprintf("invalid self-test request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if req.Bytes <= 0 || req.Bytes > maxSelfTestBytes {
+		req.Bytes = defaultSelfTestBytes
+	}
+
+	config := c.config()
+	opts := common.SelfTestOptions{PublicIP: config.ExternalIP, URL: req.URL}
+	if opts.URL == "" {
+		token, err := auth.GenerateAccessToken(config.HMACSecret, common.ProbeUser, time.Now().Add(selfTestTokenExpiration))
+		if err != nil {
+			common.Logger(r.Context()).Errorf("failed to generate access token: %v", err)
+			http.Error(w, "failed to generate access token", http.StatusInternalServerError)
+			return
+		}
+		echo := url.URL{
+			Scheme:   "https",
+			Host:     net.JoinHostPort(config.ExternalIP, strconv.Itoa(config.Port)),
+			Path:     "/api/v1/selftest/echo",
+			RawQuery: url.Values{"bytes": {strconv.Itoa(req.Bytes)}, "token": {token}}.Encode(),
+		}
+		opts.URL = echo.String()
+		// the request goes to this server, whose certificate may be self-signed
+		opts.Insecure = true
+	}
+
+	results, err := common.SelfTest(r.Context(), settings.DataDir, opts)
+	if err != nil {
+		common.Logger(r.Context()).Errorf("self-test failed: %v", err)
+		writeConfigError(w, "self-test failed", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(results)
+}
+
+// selfTestEchoHandler writes the number of bytes given in the "bytes" query parameter, so self-tests
+// can measure the throughput through an inbound. This endpoint is available to all authenticated users.
+func (c *ServeCmd) selfTestEchoHandler(w http.ResponseWriter, r *http.Request) {
+	n, err := strconv.Atoi(r.URL.Query().Get("bytes"))
+	if err != nil || n <= 0 || n > maxSelfTestBytes {
+		http.Error(w, "invalid bytes", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(n))
+	buf := make([]byte, 32<<10)
+	for n > 0 {
+		k, err := w.Write(buf[:min(n, len(buf))])
+		if err != nil {
+			return
+		}
+		n -= k
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestSelfTestEchoHandler(t *testing.T) {
+	tests := []struct {
+		bytes      string
+		wantStatus int
+		wantBytes  int
+	}{
+		{bytes: "1", wantStatus: http.StatusOK, wantBytes: 1},
+		{bytes: "100000", wantStatus: http.StatusOK, wantBytes: 100000},
+		{bytes: strconv.Itoa(maxSelfTestBytes), wantStatus: http.StatusOK, wantBytes: maxSelfTestBytes},
+		{bytes: strconv.Itoa(maxSelfTestBytes + 1), wantStatus: http.StatusBadRequest},
+		{bytes: "0", wantStatus: http.StatusBadRequest},
+		{bytes: "-1", wantStatus: http.StatusBadRequest},
+		{bytes: "many", wantStatus: http.StatusBadRequest},
+		{bytes: "", wantStatus: http.StatusBadRequest},
+	}
+	c := &ServeCmd{}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		c.selfTestEchoHandler(w, httptest.NewRequest(http.MethodGet, "/api/v1/selftest/echo?bytes="+tt.bytes, nil))
+		if w.Code != tt.wantStatus {
+			t.Errorf("bytes=%s: status = %d, want %d", tt.bytes, w.Code, tt.wantStatus)
+			continue
+		}
+		if tt.wantStatus == http.StatusOK && w.Body.Len() != tt.wantBytes {
+			t.Errorf("bytes=%s: body has %d bytes, want %d", tt.bytes, w.Body.Len(), tt.wantBytes)
+		}
+	}
+}
@@ -32,16 +32,21 @@ type ServerConfig struct {
 }
 
 // GetNewServerURL generates the URL used by the Lantern VPN app to configure a new private server.
-// It includes the server's external IP, API port, and the admin access token.
-func (c *ServerConfig) GetNewServerURL() string {
-	return fmt.Sprintf("lantern://new-private-server?ip=%s&port=%d&token=%s", c.ExternalIP, c.Port, c.AccessToken)
+// It includes the server's external IP, API port, and the admin access token, and the certificate pin
+// (see auth.CertificatePin) if not empty, so the app can verify a self-signed certificate.
+func (c *ServerConfig) GetNewServerURL(pin string) string {
+	u := fmt.Sprintf("lantern://new-private-server?ip=%s&port=%d&token=%s", c.ExternalIP, c.Port, c.AccessToken)
+	if pin != "" {
+		u += "&pin=" + pin
+	}
+	return u
 }
 
 // GetQR generates a string representation of a QR code for the server URL.
 // This QR code can be scanned by the Lantern VPN app.
-func (c *ServerConfig) GetQR() string {
+func (c *ServerConfig) GetQR(pin string) string {
 	qrCode := bytes.NewBufferString("")
-	qrterminal.GenerateHalfBlock(c.GetNewServerURL(), qrterminal.L, qrCode)
+	qrterminal.GenerateHalfBlock(c.GetNewServerURL(pin), qrterminal.L, qrCode)
 
 	return qrCode.String()
 }
@@ -54,6 +59,11 @@ func ReadServerConfig(dataDir string) (*ServerConfig, error) {
 	if err != nil {
 		return nil, err
 	}
+	return parseServerConfig(data)
+}
+
+// parseServerConfig unmarshalls and validates the contents of a "server.json" file.
+func parseServerConfig(data []byte) (*ServerConfig, error) {
 	var config ServerConfig
 	if err := json.Unmarshal(data, &config); err != nil {
 		return nil, err
@@ -73,19 +83,45 @@ func ReadServerConfig(dataDir string) (*ServerConfig, error) {
 	return &config, nil
 }
 
+// WriteServerConfig writes the server configuration to "server.json" in the data directory
+// and records the new contents in the config history together with change. The change is also
+// recorded in the audit log, as a rotation of the secret too if the HMAC secret changed.
+func WriteServerConfig(dataDir string, conf *ServerConfig, change common.ConfigChange) error {
+	data, err := json.Marshal(conf)
+	if err != nil {
+		return err
+	}
+	previous, _ := ReadServerConfig(dataDir)
+	if err = common.WriteFileAtomic(path.Join(dataDir, "server.json"), data, 0600); err != nil {
+		common.AuditConfigChange(dataDir, common.ConfigKindServer, change, err)
+		return err
+	}
+	if err = common.RecordConfigVersion(dataDir, common.ConfigKindServer, data, change); err != nil {
+		log.Errorf("failed to record server config history: %v", err)
+	}
+	common.AuditConfigChange(dataDir, common.ConfigKindServer, change, nil)
+	if previous != nil && !bytes.Equal(previous.HMACSecret, conf.HMACSecret) {
+		common.Audit(change.Context, dataDir, change.Actor, common.AuditSecretRotated, "hmac_secret", change.Reason, nil)
+	}
+	return nil
+}
+
 // AdminExpirationTime defines a far-future expiration date for the initial admin token.
 var AdminExpirationTime = time.Date(2900, 1, 1, 0, 0, 0, 0, time.UTC)
 
 // GenerateServerConfig creates a new initial server configuration.
-// It attempts to detect the public IP, generates a random API port if not provided,
+// It attempts to detect the public IP unless externalIP is given, generates a random API port if not provided,
 // creates a strong HMAC secret, generates an initial admin access token with a
 // very long expiration time, and writes the configuration to "server.json"
 // in the specified data directory.
-func GenerateServerConfig(dataDir string, listenPort int) (*ServerConfig, error) {
-	publicIP, err := common.GetPublicIP()
-	if err != nil {
-		log.Error("Cannot detect your public ExternalIP, please get it from your host provider")
-		publicIP = "0.0.0.0"
+func GenerateServerConfig(dataDir string, listenPort int, externalIP string) (*ServerConfig, error) {
+	publicIP := externalIP
+	if publicIP == "" {
+		var err error
+		if publicIP, err = common.GetPublicIP(); err != nil {
+			log.Error("Cannot detect your public ExternalIP, please get it from your host provider and set external_ip")
+			publicIP = "0.0.0.0"
+		}
 	}
 
 	port := listenPort
@@ -106,11 +142,6 @@ func GenerateServerConfig(dataDir string, listenPort int) (*ServerConfig, error)
 		AccessToken: accessToken,
 		HMACSecret:  []byte(hmacSecret),
 	}
-	// write the config to a file
-	data, err := json.Marshal(conf)
-	if err != nil {
-		return nil, err
-	}
 	log.Infof("Writing intial config to server.json")
-	return conf, os.WriteFile(path.Join(dataDir, "server.json"), data, 0600)
+	return conf, WriteServerConfig(dataDir, conf, common.SystemChange("initial config"))
 }
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/getlantern/lantern-server-manager/auth"
+)
+
+// envPrefix is prepended to the upper-cased setting names to get their environment variables,
+// e.g. data_dir is read from LSM_DATA_DIR.
+const envPrefix = "LSM_"
+
+// defaultConfigFile is read if no config file is given and it exists.
+const defaultConfigFile = "/etc/lantern-server-manager/config.yaml"
+
+// Settings holds the effective settings of the manager. Each setting is resolved from, in
+// increasing order of precedence: its default, the config file, its environment variable and its flag.
+// The yaml tag is the setting's name in the config file; the flag with the same Go field name in args
+// overrides it. Lists are comma-separated in environment variables. Settings tagged secret aren't printed.
+type Settings struct {
+	LogLevel             LogLevel `yaml:"log_level" default:"info"`
+	DataDir              string   `yaml:"data_dir" default:"./data"`
+	APIPort              int      `yaml:"api_port"`
+	VPNPort              int      `yaml:"vpn_port"`
+	ExternalIP           string   `yaml:"external_ip"`
+	Domains              []string `yaml:"domains"`
+	CertFile             string   `yaml:"cert_file"`
+	KeyFile              string   `yaml:"key_file"`
+	ACMEEmail            string   `yaml:"acme_email" default:"admin@thisbox.org"`
+	ACMEDirectory        string   `yaml:"acme_directory" default:"https://acme-v02.api.letsencrypt.org/directory"`
+	ACMEChallenge        string   `yaml:"acme_challenge" default:"http-01"`
+	ACMEDNSProvider      string   `yaml:"acme_dns_provider"`
+	ACMEDNSResolvers     []string `yaml:"acme_dns_resolvers"`
+	ACMEProfile          string   `yaml:"acme_profile" default:"shortlived"`
+	ACMEKeyType          string   `yaml:"acme_key_type" default:"rsa2048"`
+	ACMEEABKeyID         string   `yaml:"acme_eab_kid"`
+	ACMEEABHMACKey       string   `yaml:"acme_eab_hmac_key" secret:"true"`
+	ACMECACert           string   `yaml:"acme_ca_cert"`
+	AdminClientCert      string   `yaml:"admin_client_cert" default:"off"`
+	FirewallBackend      string   `yaml:"firewall_backend" default:"auto"`
+	SupervisorMode       string   `yaml:"supervisor_mode" default:"systemd"`
+	PortRotationInterval Duration `yaml:"port_rotation_interval" default:"0s"`
+	PortRotationGrace    Duration `yaml:"port_rotation_grace" default:"1h"`
+	PortHoppingRange     string   `yaml:"port_hopping_range"`
+	ProbeInterval        Duration `yaml:"probe_interval" default:"15m"`
+	ProbeURL             string   `yaml:"probe_url" default:"https://www.gstatic.com/generate_204"`
+	BlockReportThreshold int      `yaml:"block_report_threshold" default:"3"`
+	AutoRotateBlocked    bool     `yaml:"auto_rotate_blocked"`
+	MetricsListen        string   `yaml:"metrics_listen"`
+	OTLPEndpoint         string   `yaml:"otlp_endpoint"`
+	OTLPHeaders          []string `yaml:"otlp_headers" secret:"true"`
+	OTLPInterval         Duration `yaml:"otlp_interval" default:"10s"`
+	LogFormat            string   `yaml:"log_format" default:"text"`
+	ComponentLogLevels   []string `yaml:"component_log_levels"`
+	DNSServers           []string `yaml:"dns_servers"`
+	DNSStrategy          string   `yaml:"dns_strategy"`
+	AuditMaxFiles        int      `yaml:"audit_max_files" default:"0"`
+
+	// sources records where each setting came from, by setting name.
+	sources map[string]string
+}
+
+// legacyEnv maps environment variables from before the layered settings to the setting and value they imply.
+// They are only used if the setting's own environment variable isn't set.
+var legacyEnv = []struct {
+	name, setting, value string
+}{
+	{"NO_FIREWALLD", "firewall_backend", "none"},
+	{"NO_SYSTEMD", "supervisor_mode", "process"},
+}
+
+// settingField is a field of Settings together with its setting name.
+type settingField struct {
+	name  string
+	field reflect.StructField
+	value reflect.Value
+}
+
+// fields returns the settings in declaration order.
+func (s *Settings) fields() []settingField {
+	v := reflect.ValueOf(s).Elem()
+	var fields []settingField
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Type().Field(i)
+		name := f.Tag.Get("yaml")
+		if name == "" {
+			continue
+		}
+		fields = append(fields, settingField{name: name, field: f, value: v.Field(i)})
+	}
+	return fields
+}
+
+// setFromString parses a default or environment variable value into a setting.
+func setFromString(v reflect.Value, s string) error {
+	if u, ok := v.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText([]byte(s))
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(n))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Slice:
+		var items []string
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		v.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported setting type %s", v.Type())
+	}
+	return nil
+}
+
+// flagName returns the long flag name of an args field, e.g. "--api-port".
+func flagName(f reflect.StructField) string {
+	for _, part := range strings.Split(f.Tag.Get("arg"), ",") {
+		if strings.HasPrefix(part, "--") {
+			return part
+		}
+	}
+	return "--" + strings.ToLower(f.Name)
+}
+
+// loadSettings resolves the settings from their defaults, the config file, the environment and the parsed flags in args.
+func loadSettings() (*Settings, error) {
+	s := &Settings{sources: make(map[string]string)}
+	fields := s.fields()
+
+	for _, f := range fields {
+		if def, ok := f.field.Tag.Lookup("default"); ok {
+			if err := setFromString(f.value, def); err != nil {
+				return nil, fmt.Errorf("invalid default for %s: %w", f.name, err)
+			}
+		}
+		s.sources[f.name] = "default"
+	}
+
+	configFile, required := os.Getenv(envPrefix+"CONFIG"), true
+	if args.ConfigFile != nil {
+		configFile = *args.ConfigFile
+	}
+	if configFile == "" {
+		configFile, required = defaultConfigFile, false
+	}
+	if data, err := os.ReadFile(configFile); err == nil {
+		var nodes map[string]yaml.Node
+		if err = yaml.Unmarshal(data, &nodes); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", configFile, err)
+		}
+		for _, f := range fields {
+			node, ok := nodes[f.name]
+			if !ok {
+				continue
+			}
+			if err = node.Decode(f.value.Addr().Interface()); err != nil {
+				return nil, fmt.Errorf("%s: invalid %s: %w", configFile, f.name, err)
+			}
+			s.sources[f.name] = "file " + configFile
+			delete(nodes, f.name)
+		}
+		for name := range nodes {
+			return nil, fmt.Errorf("%s: unknown setting %q", configFile, name)
+		}
+	} else if required || !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	for _, f := range fields {
+		env := envPrefix + strings.ToUpper(f.name)
+		if value, ok := os.LookupEnv(env); ok {
+			if err := setFromString(f.value, value); err != nil {
+				return nil, fmt.Errorf("invalid %s: %w", env, err)
+			}
+			s.sources[f.name] = "env " + env
+			continue
+		}
+		for _, legacy := range legacyEnv {
+			if legacy.setting == f.name && os.Getenv(legacy.name) != "" {
+				_ = setFromString(f.value, legacy.value)
+				s.sources[f.name] = "env " + legacy.name
+			}
+		}
+	}
+
+	flags := reflect.ValueOf(&args).Elem()
+	for _, f := range fields {
+		flagField, ok := flags.Type().FieldByName(f.field.Name)
+		if !ok {
+			continue
+		}
+		flag := flags.FieldByIndex(flagField.Index)
+		if flag.IsNil() || (flag.Kind() == reflect.Slice && flag.Len() == 0) {
+			continue
+		}
+		if flag.Kind() == reflect.Pointer {
+			flag = flag.Elem()
+		}
+		f.value.Set(flag)
+		s.sources[f.name] = "flag " + flagName(flagField)
+	}
+	return s, nil
+}
+
+// ACMEOptions returns the settings for obtaining certificates with ACME.
+func (s *Settings) ACMEOptions() auth.ACMEOptions {
+	return auth.ACMEOptions{
+		Email:        s.ACMEEmail,
+		Directory:    s.ACMEDirectory,
+		Challenge:    s.ACMEChallenge,
+		DNSProvider:  s.ACMEDNSProvider,
+		DNSResolvers: s.ACMEDNSResolvers,
+		Profile:      s.ACMEProfile,
+		KeyType:      s.ACMEKeyType,
+		EABKeyID:     s.ACMEEABKeyID,
+		EABHMACKey:   s.ACMEEABHMACKey,
+		CACertFile:   s.ACMECACert,
+		Domains:      s.Domains,
+	}
+}
+
+// Source returns where the setting with the given name came from, e.g. "env LSM_DATA_DIR".
+func (s *Settings) Source(name string) string {
+	return s.sources[name]
+}
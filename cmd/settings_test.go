@@ -0,0 +1,130 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadSettings(t *testing.T) {
+	ptr := func(s string) *string { return &s }
+	// wanted is the part of the settings that the tests compare
+	type wanted struct {
+		DataDir         string
+		APIPort         int
+		DNSServers      []string
+		FirewallBackend string
+	}
+	saved := args
+	t.Cleanup(func() { args = saved })
+
+	tests := []struct {
+		name  string
+		yaml  string
+		env   map[string]string
+		flags func()
+		want  wanted
+		// wantSources maps setting names to their source, with "file" standing for the config file
+		wantSources map[string]string
+		wantErr     bool
+	}{
+		{
+			name:        "defaults",
+			want:        wanted{DataDir: "./data", FirewallBackend: "auto"},
+			wantSources: map[string]string{"data_dir": "default", "api_port": "default", "dns_servers": "default"},
+		},
+		{
+			name:        "config file",
+			yaml:        "data_dir: /srv/lsm\napi_port: 8443\ndns_servers: [tls://8.8.8.8, udp://9.9.9.9]\n",
+			want:        wanted{DataDir: "/srv/lsm", APIPort: 8443, DNSServers: []string{"tls://8.8.8.8", "udp://9.9.9.9"}, FirewallBackend: "auto"},
+			wantSources: map[string]string{"data_dir": "file", "api_port": "file", "dns_servers": "file", "firewall_backend": "default"},
+		},
+		{
+			name:        "environment overrides the config file",
+			yaml:        "data_dir: /srv/lsm\napi_port: 8443\n",
+			env:         map[string]string{"LSM_DATA_DIR": "/var/lib/lsm", "LSM_DNS_SERVERS": "local, https://1.1.1.1/dns-query,"},
+			want:        wanted{DataDir: "/var/lib/lsm", APIPort: 8443, DNSServers: []string{"local", "https://1.1.1.1/dns-query"}, FirewallBackend: "auto"},
+			wantSources: map[string]string{"data_dir": "env LSM_DATA_DIR", "api_port": "file", "dns_servers": "env LSM_DNS_SERVERS"},
+		},
+		{
+			name: "flags override the environment",
+			yaml: "data_dir: /srv/lsm\napi_port: 8443\n",
+			env:  map[string]string{"LSM_DATA_DIR": "/var/lib/lsm", "LSM_DNS_SERVERS": "local"},
+			flags: func() {
+				args.DataDir = ptr("/opt/lsm")
+				args.DNSServers = []string{"tcp://9.9.9.9"}
+			},
+			want:        wanted{DataDir: "/opt/lsm", APIPort: 8443, DNSServers: []string{"tcp://9.9.9.9"}, FirewallBackend: "auto"},
+			wantSources: map[string]string{"data_dir": "flag --datadir", "api_port": "file", "dns_servers": "flag --dns-server"},
+		},
+		{
+			name:        "legacy environment variable",
+			env:         map[string]string{"NO_FIREWALLD": "1"},
+			want:        wanted{DataDir: "./data", FirewallBackend: "none"},
+			wantSources: map[string]string{"firewall_backend": "env NO_FIREWALLD"},
+		},
+		{
+			name:        "setting environment variable overrides the legacy one",
+			env:         map[string]string{"NO_FIREWALLD": "1", "LSM_FIREWALL_BACKEND": "firewalld"},
+			want:        wanted{DataDir: "./data", FirewallBackend: "firewalld"},
+			wantSources: map[string]string{"firewall_backend": "env LSM_FIREWALL_BACKEND"},
+		},
+		{
+			name:    "unknown setting in the config file",
+			yaml:    "data_dirr: /srv/lsm\n",
+			wantErr: true,
+		},
+		{
+			name:    "invalid value in the config file",
+			yaml:    "api_port: https\n",
+			wantErr: true,
+		},
+		{
+			name:    "invalid environment variable",
+			env:     map[string]string{"LSM_API_PORT": "https"},
+			wantErr: true,
+		},
+		{
+			name:    "missing config file",
+			flags:   func() { args.ConfigFile = ptr(filepath.Join(t.TempDir(), "missing.yaml")) },
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args = saved
+			configFile := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(configFile, []byte(tt.yaml), 0600); err != nil {
+				t.Fatal(err)
+			}
+			t.Setenv("LSM_CONFIG", configFile)
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			if tt.flags != nil {
+				tt.flags()
+			}
+
+			s, err := loadSettings()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadSettings() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			got := wanted{DataDir: s.DataDir, APIPort: s.APIPort, DNSServers: s.DNSServers, FirewallBackend: s.FirewallBackend}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("loadSettings() = %+v, want %+v", got, tt.want)
+			}
+			for name, want := range tt.wantSources {
+				if want == "file" {
+					want = "file " + configFile
+				}
+				if got := s.Source(name); got != want {
+					t.Errorf("Source(%q) = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
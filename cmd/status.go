@@ -0,0 +1,31 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/charmbracelet/log"
+
+	"github.com/getlantern/lantern-server-manager/auth"
+	"github.com/getlantern/lantern-server-manager/common"
+)
+
+// statusHandler returns the state of the server: the results of the connectivity checks through the
+// public address, the sing-box process, the upstream outbounds, the inbounds and the certificates.
+// This endpoint is admin-only.
+func (c *ServeCmd) statusHandler(w http.ResponseWriter, _ *http.Request) {
+	transports, err := c.probeMonitor.Status(settings.DataDir)
+	if err != nil {
+		log.Errorf("failed to get transport status: %v", err)
+		transports = []common.TransportStatus{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"external_ip":  c.externalIP(),
+		"connectivity": auth.GetConnectivityStatus(),
+		"sing_box":     common.SingBoxStatus(),
+		"egress":       c.egressMonitor.Status(),
+		"transports":   transports,
+		"certificates": auth.GetCertificateStatus(),
+	})
+}
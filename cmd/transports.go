@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/charmbracelet/log"
+
+	"github.com/getlantern/lantern-server-manager/auth"
+	"github.com/getlantern/lantern-server-manager/common"
+)
+
+// transportReport is the body of a client report of a failed connection. The inbound is identified
+// by its tag or, as clients may only know the address they connect to, by its port.
+type transportReport struct {
+	Tag   string `json:"tag"`
+	Port  uint16 `json:"port"`
+	Error string `json:"error"`
+}
+
+// transportsHandler returns the state of each inbound, as assessed by the probes and the client reports.
+// This endpoint is admin-only.
+func (c *ServeCmd) transportsHandler(w http.ResponseWriter, _ *http.Request) {
+	statuses, err := c.probeMonitor.Status(settings.DataDir)
+	if err != nil {
+		log.Errorf("failed to get transport status: %v", err)
+		http.Error(w, "failed to get transport status", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(statuses)
+}
+
+// reportTransportHandler records that the requesting user failed to connect to an inbound.
+// This endpoint is available to all authenticated users, so apps can report connections that
+// fail on their network, but only users of the inbound are counted; others get 403.
+func (c *ServeCmd) reportTransportHandler(w http.ResponseWriter, r *http.Request) {
+	var report transportReport
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxConfigBodySize)).Decode(&report); err != nil {
+		http.Error(w, fmt.Sprintf("invalid report: %v", err), http.StatusBadRequest)
+		return
+	}
+	statuses, err := c.probeMonitor.Status(settings.DataDir)
+	if err != nil {
+		common.Logger(r.Context()).Errorf("failed to get transport status: %v", err)
+		http.Error(w, "failed to get transport status", http.StatusInternalServerError)
+		return
+	}
+	var found *common.TransportStatus
+	for i, st := range statuses {
+		if (report.Tag != "" && st.Tag == report.Tag) || (report.Tag == "" && st.Port == report.Port) {
+			found = &statuses[i]
+			break
+		}
+	}
+	if found == nil {
+		http.Error(w, "unknown inbound", http.StatusNotFound)
+		return
+	}
+	user := auth.GetRequestUsername(r)
+	common.Logger(r.Context()).Debug("Client reported failed connection", "user", user, "inbound", found.Tag, "index", found.Index, "port", found.Port, "error", report.Error)
+	if err = c.probeMonitor.Report(settings.DataDir, found.Index, found.Port, user); errors.Is(err, common.ErrNotInboundUser) {
+		http.Error(w, "not a user of this inbound", http.StatusForbidden)
+		return
+	} else if err != nil {
+		common.Logger(r.Context()).Errorf("failed to record transport report: %v", err)
+		http.Error(w, "failed to record report", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write([]byte(`{"status": "ok"}`))
+}
+
+// rotateBlocked moves the inbounds to new ports after the named inbound was considered blocked,
+// if settings.AutoRotateBlocked is set.
+func (c *ServeCmd) rotateBlocked(name string) {
+	if !settings.AutoRotateBlocked {
+		return
+	}
+	log.Infof("Moving the inbounds to new ports as inbound %s seems to be blocked", name)
+	if err := c.rotatePortsNow(); err != nil {
+		log.Errorf("failed to rotate ports: %v", err)
+	}
+}
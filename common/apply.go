@@ -0,0 +1,241 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sagernet/sing-box/option"
+	"github.com/sagernet/sing/common/json/badjson"
+	N "github.com/sagernet/sing/common/network"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// applyTimeout is how long to wait for sing-box to listen on all inbound ports after a restart.
+const applyTimeout = 15 * time.Second
+
+// configMu serializes all read-modify-apply cycles of the sing-box config,
+// so concurrent API calls cannot overwrite each other's changes.
+var configMu sync.Mutex
+
+var (
+	configChanges = NewCounter("lsm_config_changes_total",
+		"Attempts to apply a sing-box config change, by result: ok or the stage that failed.", "result")
+	configApplyDuration = NewHistogram("lsm_config_apply_duration_seconds",
+		"How long applying a sing-box config change took, including the restart of sing-box.", DefaultLatencyBuckets)
+)
+
+// ApplyStage identifies the step of ApplySingBoxConfig that failed.
+type ApplyStage string
+
+const (
+	// ApplyStageParse means the candidate config could not be parsed.
+	ApplyStageParse ApplyStage = "parse"
+	// ApplyStageValidate means `lantern-box check` rejected the candidate config.
+	ApplyStageValidate ApplyStage = "validate"
+	// ApplyStageWrite means the candidate config could not be written to disk.
+	ApplyStageWrite ApplyStage = "write"
+	// ApplyStageRestart means sing-box could not be restarted with the candidate config.
+	ApplyStageRestart ApplyStage = "restart"
+	// ApplyStageVerify means sing-box did not come back listening on all of its ports.
+	ApplyStageVerify ApplyStage = "verify"
+)
+
+// ApplyError is returned when a candidate sing-box config could not be applied.
+type ApplyError struct {
+	// Stage is the step that failed.
+	Stage ApplyStage
+	// Err is the underlying error.
+	Err error
+	// RolledBack is true if the previous config was restored successfully.
+	RolledBack bool
+}
+
+func (e *ApplyError) Error() string {
+	msg := fmt.Sprintf("failed to apply sing-box config (%s): %v", e.Stage, e.Err)
+	if e.RolledBack {
+		msg += "; previous config restored"
+	}
+	return msg
+}
+
+func (e *ApplyError) Unwrap() error {
+	return e.Err
+}
+
+// UpdateSingBoxConfig reads the current sing-box config, lets mutate change it and applies the result
+// with ApplySingBoxConfig. Concurrent updates are serialized.
+// If mutate returns an error, nothing is applied and the error is returned as-is.
+func UpdateSingBoxConfig(dataDir string, change ConfigChange, mutate func(opt *option.Options) error) error {
+	configMu.Lock()
+	defer configMu.Unlock()
+
+	opt, err := ReadSingBoxServerConfig(dataDir)
+	if err != nil {
+		return err
+	}
+	if err = mutate(opt); err != nil {
+		return err
+	}
+	return applySingBoxConfig(dataDir, opt, change)
+}
+
+// ApplySingBoxConfig safely replaces the running sing-box config with opt.
+// The candidate is validated with `lantern-box check` before it is written, sing-box is restarted,
+// and every inbound port is checked to be listening again. If any step after writing fails,
+// the last known-good config is restored and sing-box restarted with it.
+// On success the new config is recorded in the config history and the firewall is reconciled with its inbounds.
+// The users whose traffic is counted are updated to the users of the inbounds first.
+func ApplySingBoxConfig(dataDir string, opt *option.Options, change ConfigChange) error {
+	configMu.Lock()
+	defer configMu.Unlock()
+	return applySingBoxConfig(dataDir, opt, change)
+}
+
+// ApplySingBoxConfigData is like ApplySingBoxConfig but takes a raw JSON config,
+// which is parsed with the embedded sing-box parser first.
+func ApplySingBoxConfigData(dataDir string, data []byte, change ConfigChange) error {
+	opt, err := ParseSingBoxConfig(data)
+	if err != nil {
+		return &ApplyError{Stage: ApplyStageParse, Err: err}
+	}
+	return ApplySingBoxConfig(dataDir, opt, change)
+}
+
+// applySingBoxConfig implements ApplySingBoxConfig. configMu must be held.
+// The change is traced as a span in the context of the request that made it.
+func applySingBoxConfig(dataDir string, opt *option.Options, change ConfigChange) (err error) {
+	ctx, span := Tracer.Start(change.context(), "config apply", trace.WithAttributes(
+		attribute.String("config.actor", change.Actor),
+		attribute.String("config.reason", change.Reason),
+	))
+	start := time.Now()
+	defer func() {
+		result := "ok"
+		var applyErr *ApplyError
+		if errors.As(err, &applyErr) {
+			result = string(applyErr.Stage)
+			span.SetAttributes(attribute.Bool("config.rolled_back", applyErr.RolledBack))
+		}
+		configChanges.Inc(result)
+		configApplyDuration.Observe(time.Since(start).Seconds())
+		EndSpan(span, err)
+		AuditConfigChange(dataDir, ConfigKindSingBox, change, err)
+	}()
+
+	countUserTraffic(opt)
+	data, err := badjson.MarshallObjects(opt)
+	if err != nil {
+		return &ApplyError{Stage: ApplyStageParse, Err: err}
+	}
+	if err = validateCandidate(dataDir, data); err != nil {
+		return &ApplyError{Stage: ApplyStageValidate, Err: err}
+	}
+
+	previous, err := ReadSingBoxServerConfigRaw(dataDir)
+	if err != nil {
+		return &ApplyError{Stage: ApplyStageWrite, Err: fmt.Errorf("failed to read current config: %w", err)}
+	}
+	if err = writeSingBoxConfigFile(dataDir, data); err != nil {
+		return rollbackSingBoxConfig(ctx, dataDir, previous, &ApplyError{Stage: ApplyStageWrite, Err: err})
+	}
+	if err = RestartSingBox(ctx, dataDir); err != nil {
+		return rollbackSingBoxConfig(ctx, dataDir, previous, &ApplyError{Stage: ApplyStageRestart, Err: err})
+	}
+	if err = waitForListeners(InboundListeners(opt), applyTimeout); err != nil {
+		return rollbackSingBoxConfig(ctx, dataDir, previous, &ApplyError{Stage: ApplyStageVerify, Err: err})
+	}
+
+	if err := RecordConfigVersion(dataDir, ConfigKindSingBox, data, change); err != nil {
+		Logger(ctx).Errorf("failed to record sing-box config history: %v", err)
+	}
+	ReconcileFirewall(dataDir, opt)
+	return nil
+}
+
+// rollbackSingBoxConfig restores the previous config after applyErr happened and restarts sing-box.
+// It returns applyErr, marked as rolled back if the restore worked.
+func rollbackSingBoxConfig(ctx context.Context, dataDir string, previous []byte, applyErr *ApplyError) error {
+	logger := Logger(ctx)
+	logger.Errorf("%v, restoring previous config", applyErr)
+	if err := writeSingBoxConfigFile(dataDir, previous); err != nil {
+		logger.Errorf("failed to restore previous sing-box config: %v", err)
+		return applyErr
+	}
+	if err := RestartSingBox(ctx, dataDir); err != nil {
+		logger.Errorf("failed to restart sing-box with previous config: %v", err)
+		return applyErr
+	}
+	applyErr.RolledBack = true
+	return applyErr
+}
+
+// validateCandidate runs `lantern-box check` on data without touching the live config file.
+func validateCandidate(dataDir string, data []byte) error {
+	candidate := path.Join(dataDir, "sing-box-config.candidate.json")
+	if err := os.WriteFile(candidate, data, 0600); err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(candidate) }()
+	return validateSingBoxConfigFile(candidate)
+}
+
+// waitForListeners waits until every listener accepts connections (TCP) or has its port bound (UDP).
+// It fails early if the supervised sing-box process is not running.
+func waitForListeners(listeners []Listener, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		err := checkListeners(listeners)
+		if err == nil {
+			return nil
+		}
+		if noSystemd {
+			if st := singBoxSupervisor.Status(); st.State != SupervisorRunning {
+				return fmt.Errorf("sing-box is not running (%s): %s", st.State, st.LastExit)
+			}
+		}
+		if time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+}
+
+// checkListeners returns an error describing the first listener that is not up.
+func checkListeners(listeners []Listener) error {
+	for _, l := range listeners {
+		host := l.Address
+		if host == "" {
+			host = "127.0.0.1"
+		}
+		addr := net.JoinHostPort(host, strconv.Itoa(int(l.Port)))
+		for _, network := range l.Networks {
+			switch network {
+			case N.NetworkTCP:
+				conn, err := net.DialTimeout("tcp", addr, time.Second)
+				if err != nil {
+					return fmt.Errorf("inbound %s is not listening on tcp port %d: %w", l.Tag, l.Port, err)
+				}
+				_ = conn.Close()
+			case N.NetworkUDP:
+				// UDP can't be probed with a dial, but if we can bind the port nobody is listening on it
+				bindAddr := net.JoinHostPort(l.Address, strconv.Itoa(int(l.Port)))
+				if conn, err := net.ListenPacket("udp", bindAddr); err == nil {
+					_ = conn.Close()
+					return fmt.Errorf("inbound %s is not listening on udp port %d", l.Tag, l.Port)
+				} else if !errors.Is(err, syscall.EADDRINUSE) {
+					return fmt.Errorf("failed to check udp port %d of inbound %s: %w", l.Port, l.Tag, err)
+				}
+			}
+		}
+	}
+	return nil
+}
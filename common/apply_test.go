@@ -0,0 +1,179 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"path"
+	"testing"
+
+	C "github.com/sagernet/sing-box/constant"
+	"github.com/sagernet/sing-box/option"
+	"github.com/sagernet/sing/common"
+	"github.com/sagernet/sing/common/json/badjson"
+	"github.com/sagernet/sing/common/json/badoption"
+	N "github.com/sagernet/sing/common/network"
+)
+
+// fakeSingBox is a lantern-box stand-in whose "check" rejects configs with the log level "invalid"
+// and whose "run" exits at once for configs logging to "crash.log". It never listens on any port.
+const fakeSingBox = `#!/bin/sh
+case "$1" in
+check) ! grep -q '"level":"invalid"' "$3" ;;
+run) grep -q crash.log "$3" && exit 1; exec sleep 60 ;;
+esac
+`
+
+// useFakeSingBox puts fakeSingBox first in PATH and runs it under the supervisor for the rest of the test.
+func useFakeSingBox(t *testing.T) {
+	t.Helper()
+	bin := t.TempDir()
+	if err := os.WriteFile(path.Join(bin, SingBoxExe), []byte(fakeSingBox), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	if err := SetSupervisorMode(SupervisorModeProcess); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		singBoxSupervisor.Stop()
+		_ = SetSupervisorMode(SupervisorModeSystemd)
+	})
+}
+
+// unusedPort returns a TCP port on the loopback address that nothing listens on.
+func unusedPort(t *testing.T) uint16 {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	_ = l.Close()
+	return uint16(port)
+}
+
+func TestApplySingBoxConfig(t *testing.T) {
+	useFakeSingBox(t)
+	dataDir := t.TempDir()
+	initial, err := badjson.MarshallObjects(option.Options{Log: &option.LogOptions{Level: "info"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = writeSingBoxConfigFile(dataDir, initial); err != nil {
+		t.Fatal(err)
+	}
+	if err = RestartSingBox(context.Background(), dataDir); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name           string
+		opt            option.Options
+		wantStage      ApplyStage
+		wantRolledBack bool
+	}{
+		{
+			name:      "rejected by check",
+			opt:       option.Options{Log: &option.LogOptions{Level: "invalid"}},
+			wantStage: ApplyStageValidate,
+		},
+		{
+			name: "sing-box exits",
+			opt: option.Options{
+				Log: &option.LogOptions{Level: "info", Output: "crash.log"},
+				Inbounds: []option.Inbound{{Type: C.TypeShadowsocks, Tag: "ss", Options: &option.ShadowsocksInboundOptions{
+					ListenOptions: option.ListenOptions{
+						Listen:     common.Ptr(badoption.Addr(netip.MustParseAddr("127.0.0.1"))),
+						ListenPort: unusedPort(t),
+					},
+					Method:   "chacha20-ietf-poly1305",
+					Password: "password",
+				}}},
+			},
+			wantStage:      ApplyStageVerify,
+			wantRolledBack: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ApplySingBoxConfig(dataDir, &tt.opt, SystemChange(tt.name))
+			var applyErr *ApplyError
+			if !errors.As(err, &applyErr) {
+				t.Fatalf("ApplySingBoxConfig() error = %v, want an ApplyError", err)
+			}
+			if applyErr.Stage != tt.wantStage || applyErr.RolledBack != tt.wantRolledBack {
+				t.Errorf("ApplySingBoxConfig() failed at %s, rolled back %v, want %s, %v",
+					applyErr.Stage, applyErr.RolledBack, tt.wantStage, tt.wantRolledBack)
+			}
+			current, err := ReadSingBoxServerConfigRaw(dataDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(current, initial) {
+				t.Errorf("config after failed apply = %s, want %s", current, initial)
+			}
+			if state := singBoxSupervisor.Status().State; state != SupervisorRunning {
+				t.Errorf("sing-box state after failed apply = %s, want %s", state, SupervisorRunning)
+			}
+		})
+	}
+
+	t.Run("applied", func(t *testing.T) {
+		opt := option.Options{Log: &option.LogOptions{Level: "warn"}}
+		if err := ApplySingBoxConfig(dataDir, &opt, SystemChange("applied")); err != nil {
+			t.Fatalf("ApplySingBoxConfig() error = %v", err)
+		}
+		current, err := ReadSingBoxServerConfig(dataDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if current.Log == nil || current.Log.Level != "warn" {
+			t.Errorf("applied log options = %+v, want level warn", current.Log)
+		}
+		versions, err := ConfigHistory(dataDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(versions) != 1 || versions[0].Reason != "applied" {
+			t.Errorf("history = %+v, want only the applied version", versions)
+		}
+	})
+}
+
+func TestCheckListeners(t *testing.T) {
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = tcp.Close() }()
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = udp.Close() }()
+	tcpPort := uint16(tcp.Addr().(*net.TCPAddr).Port)
+	udpPort := uint16(udp.LocalAddr().(*net.UDPAddr).Port)
+
+	tests := []struct {
+		name     string
+		listener Listener
+		wantErr  bool
+	}{
+		{name: "tcp listening", listener: Listener{Tag: "a", Address: "127.0.0.1", Port: tcpPort, Networks: []string{N.NetworkTCP}}},
+		{name: "tcp closed", listener: Listener{Tag: "b", Address: "127.0.0.1", Port: unusedPort(t), Networks: []string{N.NetworkTCP}}, wantErr: true},
+		{name: "udp bound", listener: Listener{Tag: "c", Address: "127.0.0.1", Port: udpPort, Networks: []string{N.NetworkUDP}}},
+		{name: "udp unbound", listener: Listener{Tag: "d", Address: "127.0.0.1", Port: unusedPort(t), Networks: []string{N.NetworkUDP}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkListeners([]Listener{tt.listener})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkListeners() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
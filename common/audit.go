@@ -0,0 +1,295 @@
+package common
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// Audited actions.
+const (
+	// AuditShareLinkIssued is recorded when an admin generates a share link (access token) for a user.
+	AuditShareLinkIssued = "share_link_issued"
+	// AuditUserCreated is recorded when a user is added to the sing-box config on their first connect.
+	AuditUserCreated = "user_created"
+	// AuditUserRevoked is recorded when a user is removed from the sing-box config.
+	AuditUserRevoked = "user_revoked"
+	// AuditConfigChanged is recorded for every change of the sing-box or server config. Its target is the ConfigKind.
+	AuditConfigChanged = "config_changed"
+	// AuditSecretRotated is recorded when the HMAC secret that signs the access tokens changes.
+	AuditSecretRotated = "secret_rotated"
+	// AuditCertRenewed is recorded when a certificate is obtained or renewed from the ACME CA.
+	AuditCertRenewed = "cert_renewed"
+	// AuditClientCertIssued is recorded when an admin client certificate is issued to a device. Its target is the device name.
+	AuditClientCertIssued = "client_cert_issued"
+	// AuditClientCertRevoked is recorded when an admin client certificate is revoked. Its target is the serial number.
+	AuditClientCertRevoked = "client_cert_revoked"
+)
+
+// auditMaxSize is the size at which the audit log is rotated to "audit.log.1".
+const auditMaxSize = 10 << 20
+
+// Audit results.
+const (
+	AuditResultSuccess = "success"
+	AuditResultFailure = "failure"
+)
+
+// AuditEntry is an admin action recorded in the audit log.
+type AuditEntry struct {
+	Time time.Time `json:"time"`
+	// Actor is the subject of the token that made the request, or "system" for internal actions.
+	Actor string `json:"actor"`
+	// SourceIP is the remote IP of the request, if the action was made by one.
+	SourceIP string `json:"source_ip,omitempty"`
+	// Action is what was done, e.g. AuditUserRevoked.
+	Action string `json:"action"`
+	// Target is what the action was done to, e.g. the name of the user.
+	Target string `json:"target,omitempty"`
+	// Reason describes the action in more detail, e.g. the reason of a config change.
+	Reason string `json:"reason,omitempty"`
+	// Result is AuditResultSuccess or AuditResultFailure.
+	Result string `json:"result"`
+	// Error is why the action failed.
+	Error string `json:"error,omitempty"`
+}
+
+// AuditFilter selects entries from the audit log. Zero fields match all entries.
+type AuditFilter struct {
+	// Since and Until bound the time of the entries, inclusive.
+	Since time.Time
+	Until time.Time
+	Actor string
+	// Actions are the actions to return.
+	Actions []string
+	// Offset is the number of matching entries to skip, newest first.
+	Offset int
+	// Limit is the maximum number of entries to return; 0 means all.
+	Limit int
+}
+
+// AuditPage is a page of audit log entries, newest first.
+type AuditPage struct {
+	Entries []AuditEntry `json:"entries"`
+	Offset  int          `json:"offset"`
+	Limit   int          `json:"limit"`
+	// More is true if there are more matching entries after this page.
+	More bool `json:"more"`
+}
+
+var (
+	// auditMu serializes writes to the audit log and its rotation.
+	auditMu sync.Mutex
+	// auditMaxFiles is the number of rotated audit logs that are kept, set with SetAuditMaxFiles.
+	// 0 keeps all of them.
+	auditMaxFiles int
+)
+
+// SetAuditMaxFiles sets the number of rotated audit logs that are kept; older ones are deleted when
+// the audit log is rotated. 0, the default, keeps all of them, so no entry is ever deleted.
+func SetAuditMaxFiles(n int) error {
+	if n < 0 {
+		return fmt.Errorf("invalid number of audit logs to keep: %d", n)
+	}
+	auditMaxFiles = n
+	return nil
+}
+
+// auditLogPath returns the path of the audit log in the data directory, or of the rotated log n if n > 0.
+func auditLogPath(dataDir string, n int) string {
+	if n > 0 {
+		return path.Join(dataDir, fmt.Sprintf("audit.log.%d", n))
+	}
+	return path.Join(dataDir, "audit.log")
+}
+
+// ctxSourceIPKey is the context key for the remote IP set by WithSourceIP.
+type ctxSourceIPKey struct{}
+
+// WithSourceIP returns a context carrying the remote IP of the request, which Audit records.
+func WithSourceIP(ctx context.Context, ip string) context.Context {
+	return context.WithValue(ctx, ctxSourceIPKey{}, ip)
+}
+
+// Audit appends an entry for action to the audit log, with the source IP from ctx (see WithSourceIP),
+// which may be nil for internal actions. The result is a failure if err isn't nil.
+// Failing to write the log is logged rather than returned, so it doesn't fail the action itself.
+func Audit(ctx context.Context, dataDir, actor, action, target, reason string, err error) {
+	e := AuditEntry{
+		Time:   time.Now().UTC(),
+		Actor:  actor,
+		Action: action,
+		Target: target,
+		Reason: reason,
+		Result: AuditResultSuccess,
+	}
+	if ctx != nil {
+		e.SourceIP, _ = ctx.Value(ctxSourceIPKey{}).(string)
+	}
+	if err != nil {
+		e.Result = AuditResultFailure
+		e.Error = err.Error()
+	}
+	if err := appendAuditEntry(dataDir, e); err != nil {
+		log.Errorf("failed to write audit log: %v", err)
+	}
+}
+
+// AuditConfigChange records a change of the config of the given kind in the audit log.
+func AuditConfigChange(dataDir string, kind ConfigKind, change ConfigChange, err error) {
+	Audit(change.context(), dataDir, change.Actor, AuditConfigChanged, string(kind), change.Reason, err)
+}
+
+// appendAuditEntry appends e as a JSON line to the audit log, rotating it first if it would grow
+// beyond auditMaxSize. The files are only ever appended to.
+func appendAuditEntry(dataDir string, e AuditEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	if info, err := os.Stat(auditLogPath(dataDir, 0)); err == nil && info.Size()+int64(len(data))+1 > auditMaxSize {
+		if err = rotateAuditLog(dataDir); err != nil {
+			return fmt.Errorf("failed to rotate audit log: %w", err)
+		}
+	}
+	f, err := os.OpenFile(auditLogPath(dataDir, 0), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(data, '\n'))
+	return errors.Join(err, f.Close())
+}
+
+// rotateAuditLog renames "audit.log" to "audit.log.1", shifting the rotated logs up by one. If
+// SetAuditMaxFiles limits their number, the oldest ones are deleted. auditMu must be held.
+func rotateAuditLog(dataDir string) error {
+	n := rotatedAuditLogs(dataDir)
+	for ; auditMaxFiles > 0 && n >= auditMaxFiles; n-- {
+		if err := os.Remove(auditLogPath(dataDir, n)); err != nil {
+			return err
+		}
+	}
+	for ; n >= 0; n-- {
+		if err := os.Rename(auditLogPath(dataDir, n), auditLogPath(dataDir, n+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// rotatedAuditLogs returns the number of rotated audit logs, which are numbered from 1 without gaps.
+func rotatedAuditLogs(dataDir string) int {
+	n := 0
+	for {
+		if _, err := os.Stat(auditLogPath(dataDir, n+1)); err != nil {
+			return n
+		}
+		n++
+	}
+}
+
+// matches reports whether e is selected by f, ignoring Offset and Limit.
+func (f AuditFilter) matches(e AuditEntry) bool {
+	if !f.Since.IsZero() && e.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && e.Time.After(f.Until) {
+		return false
+	}
+	if f.Actor != "" && e.Actor != f.Actor {
+		return false
+	}
+	return len(f.Actions) == 0 || slices.Contains(f.Actions, e.Action)
+}
+
+// QueryAuditLog returns the entries of the audit log and the rotated logs selected by filter, newest first.
+// The logs are read from the newest one until the page is full. Lines that can't be parsed, e.g. one cut
+// short by a crash, are skipped.
+func QueryAuditLog(dataDir string, filter AuditFilter) (AuditPage, error) {
+	page := AuditPage{Entries: []AuditEntry{}, Offset: filter.Offset, Limit: filter.Limit}
+	files, err := openAuditLogs(dataDir)
+	if err != nil {
+		return page, err
+	}
+	defer func() {
+		for _, f := range files {
+			_ = f.Close()
+		}
+	}()
+
+	var matched []AuditEntry
+	for _, f := range files {
+		entries, err := readAuditLog(f, filter)
+		if err != nil {
+			return page, err
+		}
+		slices.Reverse(entries)
+		matched = append(matched, entries...)
+		// one more entry than the page holds tells whether there are more
+		if filter.Limit > 0 && len(matched) > filter.Offset+filter.Limit {
+			break
+		}
+	}
+	if filter.Offset >= len(matched) {
+		return page, nil
+	}
+	matched = matched[filter.Offset:]
+	if filter.Limit > 0 && len(matched) > filter.Limit {
+		matched = matched[:filter.Limit]
+		page.More = true
+	}
+	page.Entries = append(page.Entries, matched...)
+	return page, nil
+}
+
+// openAuditLogs opens the audit log and the rotated logs, newest first. They are opened while holding
+// auditMu, so a rotation can't move entries between them, but read without it, so that a query doesn't
+// block the actions being audited. A missing audit log is skipped.
+func openAuditLogs(dataDir string) ([]*os.File, error) {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	var files []*os.File
+	for n := range rotatedAuditLogs(dataDir) + 1 {
+		f, err := os.Open(auditLogPath(dataDir, n))
+		if err != nil {
+			if n == 0 && os.IsNotExist(err) {
+				continue
+			}
+			for _, f := range files {
+				_ = f.Close()
+			}
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// readAuditLog returns the entries of the audit log file f selected by filter, ignoring Offset and Limit,
+// in the order they were written.
+func readAuditLog(f *os.File, filter AuditFilter) ([]AuditEntry, error) {
+	var matched []AuditEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64<<10), 1<<20)
+	for scanner.Scan() {
+		var e AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue
+		}
+		if filter.matches(e) {
+			matched = append(matched, e)
+		}
+	}
+	return matched, scanner.Err()
+}
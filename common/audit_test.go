@@ -0,0 +1,137 @@
+package common
+
+import (
+	"os"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestQueryAuditLog(t *testing.T) {
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(h int) time.Time { return start.Add(time.Duration(h) * time.Hour) }
+	dataDir := t.TempDir()
+	write := func(h int, actor, action, target string) {
+		t.Helper()
+		e := AuditEntry{Time: at(h), Actor: actor, Action: action, Target: target, Result: AuditResultSuccess}
+		if err := appendAuditEntry(dataDir, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the oldest entry is in a rotated log, and a line cut short by a crash is in the middle
+	write(0, "admin", AuditUserCreated, "a")
+	if err := rotateAuditLog(dataDir); err != nil {
+		t.Fatal(err)
+	}
+	write(1, "system", AuditConfigChanged, "b")
+	write(2, "admin", AuditUserRevoked, "c")
+	f, err := os.OpenFile(auditLogPath(dataDir, 0), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.WriteString(`{"time":"2025-01-01T02:30:00Z","act` + "\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	write(3, "admin", AuditUserCreated, "d")
+	write(4, "system", AuditSecretRotated, "e")
+
+	tests := []struct {
+		name     string
+		filter   AuditFilter
+		want     []string
+		wantMore bool
+	}{
+		{name: "all", want: []string{"e", "d", "c", "b", "a"}},
+		{name: "since", filter: AuditFilter{Since: at(3)}, want: []string{"e", "d"}},
+		{name: "until", filter: AuditFilter{Until: at(1)}, want: []string{"b", "a"}},
+		{name: "since and until", filter: AuditFilter{Since: at(1), Until: at(3)}, want: []string{"d", "c", "b"}},
+		{name: "actor", filter: AuditFilter{Actor: "system"}, want: []string{"e", "b"}},
+		{name: "actions", filter: AuditFilter{Actions: []string{AuditUserCreated, AuditUserRevoked}}, want: []string{"d", "c", "a"}},
+		{name: "actor and action", filter: AuditFilter{Actor: "admin", Actions: []string{AuditUserCreated}}, want: []string{"d", "a"}},
+		{name: "no match", filter: AuditFilter{Actor: "nobody"}, want: []string{}},
+		{name: "limit", filter: AuditFilter{Limit: 2}, want: []string{"e", "d"}, wantMore: true},
+		{name: "offset", filter: AuditFilter{Offset: 3}, want: []string{"b", "a"}},
+		{name: "offset and limit", filter: AuditFilter{Offset: 1, Limit: 2}, want: []string{"d", "c"}, wantMore: true},
+		{name: "last page", filter: AuditFilter{Offset: 3, Limit: 2}, want: []string{"b", "a"}},
+		{name: "limit beyond the end", filter: AuditFilter{Offset: 4, Limit: 10}, want: []string{"a"}},
+		{name: "offset beyond the end", filter: AuditFilter{Offset: 10}, want: []string{}},
+		{name: "filtered page", filter: AuditFilter{Actor: "admin", Offset: 1, Limit: 1}, want: []string{"c"}, wantMore: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page, err := QueryAuditLog(dataDir, tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := []string{}
+			for _, e := range page.Entries {
+				got = append(got, e.Target)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("QueryAuditLog() entries = %v, want %v", got, tt.want)
+			}
+			if page.More != tt.wantMore {
+				t.Errorf("QueryAuditLog() more = %v, want %v", page.More, tt.wantMore)
+			}
+			if page.Offset != tt.filter.Offset || page.Limit != tt.filter.Limit {
+				t.Errorf("QueryAuditLog() offset, limit = %d, %d, want %d, %d", page.Offset, page.Limit, tt.filter.Offset, tt.filter.Limit)
+			}
+		})
+	}
+}
+
+func TestQueryAuditLogEmpty(t *testing.T) {
+	page, err := QueryAuditLog(t.TempDir(), AuditFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Entries == nil || len(page.Entries) != 0 || page.More {
+		t.Errorf("QueryAuditLog() = %+v, want an empty page", page)
+	}
+}
+
+func TestRotateAuditLog(t *testing.T) {
+	t.Cleanup(func() { _ = SetAuditMaxFiles(0) })
+	tests := []struct {
+		name     string
+		maxFiles int
+		want     []string
+	}{
+		{name: "all kept", maxFiles: 0, want: []string{"4", "3", "2", "1", "0"}},
+		{name: "limited", maxFiles: 2, want: []string{"4", "3", "2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := SetAuditMaxFiles(tt.maxFiles); err != nil {
+				t.Fatal(err)
+			}
+			dataDir := t.TempDir()
+			for i := range 5 {
+				if i > 0 {
+					if err := rotateAuditLog(dataDir); err != nil {
+						t.Fatal(err)
+					}
+				}
+				e := AuditEntry{Time: time.Now(), Actor: "admin", Action: AuditUserCreated, Target: strconv.Itoa(i)}
+				if err := appendAuditEntry(dataDir, e); err != nil {
+					t.Fatal(err)
+				}
+			}
+			page, err := QueryAuditLog(dataDir, AuditFilter{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := []string{}
+			for _, e := range page.Entries {
+				got = append(got, e.Target)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("entries after rotating = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
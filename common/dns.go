@@ -0,0 +1,380 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+
+	C "github.com/sagernet/sing-box/constant"
+	"github.com/sagernet/sing-box/option"
+)
+
+// DNSServer is an upstream DNS server sing-box resolves destination domains with.
+type DNSServer struct {
+	// Tag is the name DNS rules use to refer to the server.
+	Tag string `json:"tag"`
+	// Address is the server in URL form: "udp://9.9.9.9", "tcp://9.9.9.9", "tls://8.8.8.8",
+	// "https://1.1.1.1/dns-query", "quic://dns.adguard-dns.com", "h3://1.1.1.1/dns-query",
+	// or "local" for the resolver of the host system.
+	Address string `json:"address"`
+}
+
+// DNSRule sends queries for matching domains to a specific server, or blocks them.
+type DNSRule struct {
+	// ID uniquely identifies the rule.
+	ID string `json:"id"`
+	// Type is one of "domain", "domain_suffix" or "domain_keyword".
+	Type RouteRuleType `json:"type"`
+	// Values are the domains or keywords to match.
+	Values []string `json:"values"`
+	// Server is the tag of the server that resolves matching queries. If empty, they are blocked.
+	Server string `json:"server,omitempty"`
+}
+
+// DNSConfig is the manager's DNS policy. It is stored in "dns.json" in the data directory
+// and generated into the "dns" section of the sing-box config.
+type DNSConfig struct {
+	// Servers are the upstream servers. At least one is required.
+	Servers []DNSServer `json:"servers"`
+	// Final is the tag of the server used for queries no rule matches. Defaults to the first server.
+	Final string `json:"final,omitempty"`
+	// Strategy is "prefer_ipv4", "prefer_ipv6", "ipv4_only", "ipv6_only", or empty to use whatever is returned.
+	Strategy string `json:"strategy,omitempty"`
+	// DisableCache turns off caching of DNS responses.
+	DisableCache bool `json:"disable_cache,omitempty"`
+	// CacheCapacity is the number of cached responses. sing-box picks a default if zero.
+	CacheCapacity uint32 `json:"cache_capacity,omitempty"`
+	// Rules are evaluated in order; the first matching rule decides.
+	Rules []DNSRule `json:"rules"`
+}
+
+// dnsStrategies maps the strategy names accepted in DNSConfig to sing-box domain strategies.
+var dnsStrategies = map[string]C.DomainStrategy{
+	"":            C.DomainStrategyAsIS,
+	"prefer_ipv4": C.DomainStrategyPreferIPv4,
+	"prefer_ipv6": C.DomainStrategyPreferIPv6,
+	"ipv4_only":   C.DomainStrategyIPv4Only,
+	"ipv6_only":   C.DomainStrategyIPv6Only,
+}
+
+// DefaultDNSConfig returns the DNS policy used for new servers: Cloudflare over HTTPS,
+// with Google over TLS and the system resolver as fallbacks, preferring IPv4 since
+// many VPS providers don't route IPv6.
+func DefaultDNSConfig() *DNSConfig {
+	return &DNSConfig{
+		Servers: []DNSServer{
+			{Tag: "cloudflare", Address: "https://1.1.1.1/dns-query"},
+			{Tag: "google", Address: "tls://8.8.8.8"},
+			{Tag: "local", Address: "local"},
+		},
+		Final:    "cloudflare",
+		Strategy: "prefer_ipv4",
+		Rules:    []DNSRule{},
+	}
+}
+
+// NewDNSConfig returns DefaultDNSConfig with the given servers and strategy, where set.
+// Servers are tagged "dns-1", "dns-2" etc. in the given order, and the first one is used by default.
+func NewDNSConfig(servers []string, strategy string) *DNSConfig {
+	dc := DefaultDNSConfig()
+	if len(servers) > 0 {
+		dc.Servers = make([]DNSServer, len(servers))
+		for i, address := range servers {
+			dc.Servers[i] = DNSServer{Tag: fmt.Sprintf("dns-%d", i+1), Address: address}
+		}
+		dc.Final = dc.Servers[0].Tag
+	}
+	if strategy != "" {
+		dc.Strategy = strategy
+	}
+	return dc
+}
+
+// ReplaceServers replaces the upstream servers with the given addresses and keeps the other settings.
+// Servers whose address is already in use keep their tag; the others are tagged "dns-1", "dns-2" etc.
+// If the final server is removed, the first server becomes the final one. Rules that used a removed
+// server are changed to use the final server, and their IDs are returned.
+func (dc *DNSConfig) ReplaceServers(addresses []string) []string {
+	previous := make(map[string]string, len(dc.Servers))
+	for _, s := range dc.Servers {
+		if _, ok := previous[s.Address]; !ok {
+			previous[s.Address] = s.Tag
+		}
+	}
+	tags := make([]string, len(addresses))
+	used := make(map[string]bool, len(addresses))
+	for i, address := range addresses {
+		if tag, ok := previous[address]; ok && !used[tag] {
+			tags[i] = tag
+			used[tag] = true
+		}
+	}
+	n := 0
+	servers := make([]DNSServer, len(addresses))
+	for i, address := range addresses {
+		for tags[i] == "" {
+			n++
+			if tag := fmt.Sprintf("dns-%d", n); !used[tag] {
+				tags[i] = tag
+				used[tag] = true
+			}
+		}
+		servers[i] = DNSServer{Tag: tags[i], Address: address}
+	}
+	dc.Servers = servers
+	if len(servers) == 0 {
+		return nil
+	}
+
+	if dc.Final != "" && !used[dc.Final] {
+		dc.Final = servers[0].Tag
+	}
+	final := dc.Final
+	if final == "" {
+		final = servers[0].Tag
+	}
+	var changed []string
+	for i, r := range dc.Rules {
+		if r.Server != "" && !used[r.Server] {
+			dc.Rules[i].Server = final
+			changed = append(changed, r.ID)
+		}
+	}
+	return changed
+}
+
+// ReadDNSConfig reads "dns.json" from the data directory.
+// If it doesn't exist, DefaultDNSConfig is returned.
+func ReadDNSConfig(dataDir string) (*DNSConfig, error) {
+	data, err := os.ReadFile(path.Join(dataDir, "dns.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return DefaultDNSConfig(), nil
+		}
+		return nil, err
+	}
+	var dc DNSConfig
+	if err = json.Unmarshal(data, &dc); err != nil {
+		return nil, fmt.Errorf("failed to parse dns.json: %w", err)
+	}
+	return &dc, nil
+}
+
+// WriteDNSConfig validates dc and writes it to "dns.json" in the data directory without touching
+// the sing-box config; it is regenerated from the file the next time the server starts.
+func WriteDNSConfig(dataDir string, dc *DNSConfig) error {
+	if err := dc.Validate(); err != nil {
+		return err
+	}
+	return writeDNSConfig(dataDir, dc)
+}
+
+// writeDNSConfig writes "dns.json" to the data directory.
+func writeDNSConfig(dataDir string, dc *DNSConfig) error {
+	data, err := json.MarshalIndent(dc, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(path.Join(dataDir, "dns.json"), data, 0600)
+}
+
+// parsedDNSAddress is a DNSServer address split into its parts.
+type parsedDNSAddress struct {
+	scheme string
+	host   string
+	port   uint16
+	path   string
+}
+
+// parseDNSAddress parses a DNSServer address.
+func parseDNSAddress(address string) (*parsedDNSAddress, error) {
+	if address == C.DNSTypeLocal {
+		return &parsedDNSAddress{scheme: C.DNSTypeLocal}, nil
+	}
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case C.DNSTypeUDP, C.DNSTypeTCP, C.DNSTypeTLS, C.DNSTypeQUIC, C.DNSTypeHTTPS, C.DNSTypeHTTP3:
+	case "":
+		return nil, fmt.Errorf("missing scheme, expected e.g. udp://%s", address)
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("missing host")
+	}
+	p := &parsedDNSAddress{scheme: u.Scheme, host: u.Hostname(), path: u.Path}
+	if u.Port() != "" {
+		port, err := strconv.ParseUint(u.Port(), 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q", u.Port())
+		}
+		p.port = uint16(port)
+	}
+	return p, nil
+}
+
+// needsResolver returns true if the server address is a host name that has to be resolved first.
+func (p *parsedDNSAddress) needsResolver() bool {
+	if p.scheme == C.DNSTypeLocal {
+		return false
+	}
+	_, err := netip.ParseAddr(p.host)
+	return err != nil
+}
+
+// Validate checks the servers, strategy and rules.
+func (dc *DNSConfig) Validate() error {
+	if len(dc.Servers) == 0 {
+		return fmt.Errorf("at least one DNS server is required")
+	}
+	tags := make(map[string]bool)
+	hasResolver := false
+	for _, s := range dc.Servers {
+		if !ruleIDPattern.MatchString(s.Tag) {
+			return fmt.Errorf("invalid DNS server tag %q", s.Tag)
+		}
+		if tags[s.Tag] {
+			return fmt.Errorf("duplicate DNS server tag %q", s.Tag)
+		}
+		tags[s.Tag] = true
+		p, err := parseDNSAddress(s.Address)
+		if err != nil {
+			return fmt.Errorf("DNS server %s: invalid address %q: %w", s.Tag, s.Address, err)
+		}
+		if !p.needsResolver() {
+			hasResolver = true
+		}
+	}
+	if !hasResolver {
+		return fmt.Errorf("at least one DNS server must be given by IP address or be \"local\", to resolve the others")
+	}
+	if dc.Final != "" && !tags[dc.Final] {
+		return fmt.Errorf("final DNS server %q doesn't exist", dc.Final)
+	}
+	if _, ok := dnsStrategies[dc.Strategy]; !ok {
+		return fmt.Errorf("unknown DNS strategy %q", dc.Strategy)
+	}
+	ids := make(map[string]bool)
+	for _, r := range dc.Rules {
+		if !ruleIDPattern.MatchString(r.ID) {
+			return fmt.Errorf("invalid DNS rule id %q", r.ID)
+		}
+		if ids[r.ID] {
+			return fmt.Errorf("duplicate DNS rule id %q", r.ID)
+		}
+		ids[r.ID] = true
+		switch r.Type {
+		case RouteRuleDomain, RouteRuleDomainSuffix, RouteRuleDomainKeyword:
+		default:
+			return fmt.Errorf("DNS rule %s: unsupported type %q", r.ID, r.Type)
+		}
+		if len(r.Values) == 0 {
+			return fmt.Errorf("DNS rule %s: at least one value is required", r.ID)
+		}
+		if r.Server != "" && !tags[r.Server] {
+			return fmt.Errorf("DNS rule %s: server %q doesn't exist", r.ID, r.Server)
+		}
+	}
+	return nil
+}
+
+// buildDNSOptions converts the DNS policy into sing-box DNS options.
+// Servers given by host name are resolved with the first server given by IP address.
+// Queries to remote servers are sent through the outbound with the detour tag, if set.
+// dc must be valid.
+func (dc *DNSConfig) buildDNSOptions(detour string) *option.DNSOptions {
+	var resolver string
+	for _, s := range dc.Servers {
+		if p, _ := parseDNSAddress(s.Address); !p.needsResolver() {
+			resolver = s.Tag
+			break
+		}
+	}
+
+	servers := make([]option.DNSServerOptions, 0, len(dc.Servers))
+	for _, s := range dc.Servers {
+		p, _ := parseDNSAddress(s.Address)
+		local := option.LocalDNSServerOptions{}
+		if p.needsResolver() {
+			local.DomainResolver = &option.DomainResolveOptions{Server: resolver}
+		}
+		if p.scheme != C.DNSTypeLocal {
+			local.Detour = detour
+		}
+		remote := option.RemoteDNSServerOptions{
+			LocalDNSServerOptions:   local,
+			DNSServerAddressOptions: option.DNSServerAddressOptions{Server: p.host, ServerPort: p.port},
+		}
+		var opts any
+		switch p.scheme {
+		case C.DNSTypeLocal:
+			opts = &local
+		case C.DNSTypeUDP, C.DNSTypeTCP:
+			opts = &remote
+		case C.DNSTypeTLS, C.DNSTypeQUIC:
+			opts = &option.RemoteTLSDNSServerOptions{RemoteDNSServerOptions: remote}
+		case C.DNSTypeHTTPS, C.DNSTypeHTTP3:
+			opts = &option.RemoteHTTPSDNSServerOptions{
+				RemoteTLSDNSServerOptions: option.RemoteTLSDNSServerOptions{RemoteDNSServerOptions: remote},
+				Path:                      p.path,
+			}
+		}
+		servers = append(servers, option.DNSServerOptions{Type: p.scheme, Tag: s.Tag, Options: opts})
+	}
+
+	rules := make([]option.DNSRule, 0, len(dc.Rules))
+	for _, r := range dc.Rules {
+		var raw option.RawDefaultDNSRule
+		switch r.Type {
+		case RouteRuleDomain:
+			raw.Domain = r.Values
+		case RouteRuleDomainSuffix:
+			raw.DomainSuffix = r.Values
+		case RouteRuleDomainKeyword:
+			raw.DomainKeyword = r.Values
+		}
+		action := option.DNSRuleAction{Action: C.RuleActionTypeReject}
+		if r.Server != "" {
+			action = option.DNSRuleAction{
+				Action:       C.RuleActionTypeRoute,
+				RouteOptions: option.DNSRouteActionOptions{Server: r.Server},
+			}
+		}
+		rules = append(rules, option.DNSRule{
+			Type:           C.RuleTypeDefault,
+			DefaultOptions: option.DefaultDNSRule{RawDefaultDNSRule: raw, DNSRuleAction: action},
+		})
+	}
+
+	final := dc.Final
+	if final == "" {
+		final = dc.Servers[0].Tag
+	}
+	return &option.DNSOptions{
+		RawDNSOptions: option.RawDNSOptions{
+			Servers: servers,
+			Rules:   rules,
+			Final:   final,
+			DNSClientOptions: option.DNSClientOptions{
+				Strategy:      option.DomainStrategy(dnsStrategies[dc.Strategy]),
+				DisableCache:  dc.DisableCache,
+				CacheCapacity: dc.CacheCapacity,
+			},
+		},
+	}
+}
+
+// UpdateDNS lets mutate change the DNS policy and applies the regenerated sing-box config.
+// The policy is only saved if the new config was applied successfully.
+func UpdateDNS(dataDir string, change ConfigChange, mutate func(dc *DNSConfig) error) error {
+	return updateManagedSections(dataDir, change, func(m *managedSections) error {
+		return mutate(m.dns)
+	})
+}
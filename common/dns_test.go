@@ -0,0 +1,198 @@
+package common
+
+import (
+	"reflect"
+	"testing"
+
+	C "github.com/sagernet/sing-box/constant"
+	"github.com/sagernet/sing-box/option"
+)
+
+func TestReplaceServers(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      DNSConfig
+		addresses   []string
+		wantServers []DNSServer
+		wantFinal   string
+		wantRules   []DNSRule
+		wantChanged []string
+	}{
+		{
+			name:        "default servers",
+			config:      *DefaultDNSConfig(),
+			addresses:   []string{"udp://9.9.9.9", "tls://8.8.8.8"},
+			wantServers: []DNSServer{{Tag: "dns-1", Address: "udp://9.9.9.9"}, {Tag: "google", Address: "tls://8.8.8.8"}},
+			wantFinal:   "dns-1",
+			wantRules:   []DNSRule{},
+		},
+		{
+			name: "kept final server",
+			config: DNSConfig{
+				Servers: []DNSServer{{Tag: "a", Address: "udp://1.1.1.1"}, {Tag: "b", Address: "udp://9.9.9.9"}},
+				Final:   "b",
+			},
+			addresses:   []string{"local", "udp://9.9.9.9"},
+			wantServers: []DNSServer{{Tag: "dns-1", Address: "local"}, {Tag: "b", Address: "udp://9.9.9.9"}},
+			wantFinal:   "b",
+		},
+		{
+			name: "new tags skip used ones",
+			config: DNSConfig{
+				Servers: []DNSServer{{Tag: "dns-1", Address: "udp://1.1.1.1"}},
+			},
+			addresses:   []string{"udp://9.9.9.9", "udp://1.1.1.1", "tls://8.8.8.8"},
+			wantServers: []DNSServer{{Tag: "dns-2", Address: "udp://9.9.9.9"}, {Tag: "dns-1", Address: "udp://1.1.1.1"}, {Tag: "dns-3", Address: "tls://8.8.8.8"}},
+		},
+		{
+			name: "duplicate addresses",
+			config: DNSConfig{
+				Servers: []DNSServer{{Tag: "a", Address: "udp://1.1.1.1"}},
+			},
+			addresses:   []string{"udp://1.1.1.1", "udp://1.1.1.1"},
+			wantServers: []DNSServer{{Tag: "a", Address: "udp://1.1.1.1"}, {Tag: "dns-1", Address: "udp://1.1.1.1"}},
+		},
+		{
+			name: "rules of removed servers",
+			config: DNSConfig{
+				Servers: []DNSServer{{Tag: "a", Address: "udp://1.1.1.1"}, {Tag: "b", Address: "udp://9.9.9.9"}},
+				Final:   "b",
+				Rules: []DNSRule{
+					{ID: "kept", Type: RouteRuleDomain, Values: []string{"a.com"}, Server: "a"},
+					{ID: "moved", Type: RouteRuleDomain, Values: []string{"b.com"}, Server: "b"},
+					{ID: "blocked", Type: RouteRuleDomain, Values: []string{"c.com"}},
+				},
+			},
+			addresses:   []string{"tls://8.8.8.8", "udp://1.1.1.1"},
+			wantServers: []DNSServer{{Tag: "dns-1", Address: "tls://8.8.8.8"}, {Tag: "a", Address: "udp://1.1.1.1"}},
+			wantFinal:   "dns-1",
+			wantRules: []DNSRule{
+				{ID: "kept", Type: RouteRuleDomain, Values: []string{"a.com"}, Server: "a"},
+				{ID: "moved", Type: RouteRuleDomain, Values: []string{"b.com"}, Server: "dns-1"},
+				{ID: "blocked", Type: RouteRuleDomain, Values: []string{"c.com"}},
+			},
+			wantChanged: []string{"moved"},
+		},
+		{
+			name: "rules without a final server",
+			config: DNSConfig{
+				Servers: []DNSServer{{Tag: "a", Address: "udp://1.1.1.1"}},
+				Rules:   []DNSRule{{ID: "moved", Type: RouteRuleDomain, Values: []string{"a.com"}, Server: "a"}},
+			},
+			addresses:   []string{"local"},
+			wantServers: []DNSServer{{Tag: "dns-1", Address: "local"}},
+			wantRules:   []DNSRule{{ID: "moved", Type: RouteRuleDomain, Values: []string{"a.com"}, Server: "dns-1"}},
+			wantChanged: []string{"moved"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dc := tt.config
+			changed := dc.ReplaceServers(tt.addresses)
+			if !reflect.DeepEqual(dc.Servers, tt.wantServers) {
+				t.Errorf("servers = %+v, want %+v", dc.Servers, tt.wantServers)
+			}
+			if dc.Final != tt.wantFinal {
+				t.Errorf("final = %q, want %q", dc.Final, tt.wantFinal)
+			}
+			if !reflect.DeepEqual(dc.Rules, tt.wantRules) {
+				t.Errorf("rules = %+v, want %+v", dc.Rules, tt.wantRules)
+			}
+			if !reflect.DeepEqual(changed, tt.wantChanged) {
+				t.Errorf("changed rules = %v, want %v", changed, tt.wantChanged)
+			}
+		})
+	}
+}
+
+func TestDNSConfigValidate(t *testing.T) {
+	servers := []DNSServer{{Tag: "a", Address: "udp://1.1.1.1"}, {Tag: "b", Address: "https://dns.google/dns-query"}}
+	tests := []struct {
+		name    string
+		config  DNSConfig
+		wantErr bool
+	}{
+		{name: "default", config: *DefaultDNSConfig()},
+		{name: "rules", config: DNSConfig{Servers: servers, Final: "b", Rules: []DNSRule{
+			{ID: "a", Type: RouteRuleDomainSuffix, Values: []string{"example.com"}, Server: "a"},
+			{ID: "b", Type: RouteRuleDomainKeyword, Values: []string{"ads"}},
+		}}},
+		{name: "no servers", config: DNSConfig{}, wantErr: true},
+		{name: "duplicate tag", config: DNSConfig{Servers: []DNSServer{servers[0], servers[0]}}, wantErr: true},
+		{name: "invalid tag", config: DNSConfig{Servers: []DNSServer{{Tag: "a b", Address: "local"}}}, wantErr: true},
+		{name: "missing scheme", config: DNSConfig{Servers: []DNSServer{{Tag: "a", Address: "1.1.1.1"}}}, wantErr: true},
+		{name: "unsupported scheme", config: DNSConfig{Servers: []DNSServer{{Tag: "a", Address: "ftp://1.1.1.1"}}}, wantErr: true},
+		{name: "invalid port", config: DNSConfig{Servers: []DNSServer{{Tag: "a", Address: "udp://1.1.1.1:99999"}}}, wantErr: true},
+		{name: "only host names", config: DNSConfig{Servers: []DNSServer{servers[1]}}, wantErr: true},
+		{name: "unknown final", config: DNSConfig{Servers: servers, Final: "c"}, wantErr: true},
+		{name: "unknown strategy", config: DNSConfig{Servers: servers, Strategy: "ipv5_only"}, wantErr: true},
+		{name: "duplicate rule", config: DNSConfig{Servers: servers, Rules: []DNSRule{
+			{ID: "a", Type: RouteRuleDomain, Values: []string{"a.com"}},
+			{ID: "a", Type: RouteRuleDomain, Values: []string{"b.com"}},
+		}}, wantErr: true},
+		{name: "unsupported rule type", config: DNSConfig{Servers: servers, Rules: []DNSRule{
+			{ID: "a", Type: RouteRuleIPCIDR, Values: []string{"10.0.0.0/8"}},
+		}}, wantErr: true},
+		{name: "rule without values", config: DNSConfig{Servers: servers, Rules: []DNSRule{
+			{ID: "a", Type: RouteRuleDomain},
+		}}, wantErr: true},
+		{name: "rule with unknown server", config: DNSConfig{Servers: servers, Rules: []DNSRule{
+			{ID: "a", Type: RouteRuleDomain, Values: []string{"a.com"}, Server: "c"},
+		}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.config.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestBuildDNSOptions(t *testing.T) {
+	dc := DNSConfig{
+		Servers: []DNSServer{
+			{Tag: "doh", Address: "https://dns.google/dns-query"},
+			{Tag: "udp", Address: "udp://9.9.9.9:5353"},
+			{Tag: "local", Address: "local"},
+		},
+		Strategy:      "ipv4_only",
+		CacheCapacity: 1024,
+		Rules:         []DNSRule{{ID: "ads", Type: RouteRuleDomainKeyword, Values: []string{"ads"}}},
+	}
+	opts := dc.buildDNSOptions("egress-upstream")
+
+	if opts.Final != "doh" {
+		t.Errorf("final = %q, want the first server", opts.Final)
+	}
+	if opts.CacheCapacity != 1024 || opts.DisableCache {
+		t.Errorf("cache options = %+v, want a capacity of 1024", opts.DNSClientOptions)
+	}
+	doh, ok := opts.Servers[0].Options.(*option.RemoteHTTPSDNSServerOptions)
+	if !ok {
+		t.Fatalf("options of the DoH server = %T", opts.Servers[0].Options)
+	}
+	if doh.Server != "dns.google" || doh.Path != "/dns-query" || doh.Detour != "egress-upstream" {
+		t.Errorf("DoH server = %+v", doh)
+	}
+	if doh.DomainResolver == nil || doh.DomainResolver.Server != "udp" {
+		t.Errorf("DoH server resolver = %+v, want the first server given by IP address", doh.DomainResolver)
+	}
+	udp, ok := opts.Servers[1].Options.(*option.RemoteDNSServerOptions)
+	if !ok {
+		t.Fatalf("options of the UDP server = %T", opts.Servers[1].Options)
+	}
+	if udp.Server != "9.9.9.9" || udp.ServerPort != 5353 || udp.DomainResolver != nil {
+		t.Errorf("UDP server = %+v", udp)
+	}
+	local, ok := opts.Servers[2].Options.(*option.LocalDNSServerOptions)
+	if !ok {
+		t.Fatalf("options of the local server = %T", opts.Servers[2].Options)
+	}
+	if local.Detour != "" {
+		t.Errorf("local server detour = %q, want none", local.Detour)
+	}
+	if len(opts.Rules) != 1 || opts.Rules[0].DefaultOptions.Action != C.RuleActionTypeReject {
+		t.Errorf("rules = %+v, want one reject rule", opts.Rules)
+	}
+}
@@ -0,0 +1,424 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+	C "github.com/sagernet/sing-box/constant"
+	"github.com/sagernet/sing-box/option"
+)
+
+const (
+	// egressTagPrefix is prepended to the tags of managed outbounds in the sing-box config,
+	// so they can be told apart from outbounds and endpoints added by hand.
+	egressTagPrefix = "egress-"
+	// EgressDirect is the outbound name that sends traffic straight out of the server.
+	EgressDirect = "direct"
+	// egressProbeURL is fetched through upstreams to check they work.
+	egressProbeURL = "https://www.gstatic.com/generate_204"
+)
+
+// Egress is an upstream proxy or WireGuard exit that traffic can be sent through instead of leaving the server directly.
+type Egress struct {
+	// Tag is the name rules and the default route use to refer to the outbound.
+	Tag string `json:"tag"`
+	// Type is "socks", "http", "shadowsocks" or "wireguard".
+	Type string `json:"type"`
+	// Server is the host name or IP address of the upstream.
+	Server string `json:"server"`
+	// ServerPort is the port of the upstream.
+	ServerPort uint16 `json:"server_port"`
+	// Username authenticates with socks and http upstreams.
+	Username string `json:"username,omitempty"`
+	// Password authenticates with socks, http and shadowsocks upstreams.
+	Password string `json:"password,omitempty"`
+	// Method is the shadowsocks cipher, e.g. "chacha20-ietf-poly1305".
+	Method string `json:"method,omitempty"`
+	// PrivateKey is the local WireGuard private key.
+	PrivateKey string `json:"private_key,omitempty"`
+	// PeerPublicKey is the public key of the WireGuard exit.
+	PeerPublicKey string `json:"peer_public_key,omitempty"`
+	// PreSharedKey is the optional WireGuard pre-shared key.
+	PreSharedKey string `json:"pre_shared_key,omitempty"`
+	// Address lists the local WireGuard interface addresses assigned by the exit, e.g. "10.2.0.2/32".
+	Address []string `json:"address,omitempty"`
+	// MTU is the WireGuard interface MTU. sing-box picks a default if zero.
+	MTU uint32 `json:"mtu,omitempty"`
+}
+
+// EgressRule sends the traffic of some users, or to some domains, through a specific outbound.
+// If both users and domains are given, traffic has to match both.
+type EgressRule struct {
+	// ID uniquely identifies the rule.
+	ID string `json:"id"`
+	// Users are the names users were invited with.
+	Users []string `json:"users,omitempty"`
+	// Domains match destination domains by suffix, e.g. "example.com" matches "www.example.com".
+	Domains []string `json:"domains,omitempty"`
+	// Outbound is the tag of the outbound to use, or "direct".
+	Outbound string `json:"outbound"`
+}
+
+// EgressConfig is the manager's upstream chaining policy. It is stored in "egress.json" in the data
+// directory and generated into the outbounds, endpoints and route of the sing-box config.
+type EgressConfig struct {
+	// Outbounds are the upstreams available.
+	Outbounds []Egress `json:"outbounds"`
+	// Default is the tag of the outbound all other traffic (and DNS) goes through. Empty or "direct" means directly.
+	Default string `json:"default,omitempty"`
+	// Rules are evaluated in order, after the routing rules; the first matching rule decides.
+	Rules []EgressRule `json:"rules"`
+}
+
+// ReadEgressConfig reads "egress.json" from the data directory.
+// If it doesn't exist, an empty config sending everything directly is returned.
+func ReadEgressConfig(dataDir string) (*EgressConfig, error) {
+	data, err := os.ReadFile(path.Join(dataDir, "egress.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &EgressConfig{Outbounds: []Egress{}, Rules: []EgressRule{}}, nil
+		}
+		return nil, err
+	}
+	var ec EgressConfig
+	if err = json.Unmarshal(data, &ec); err != nil {
+		return nil, fmt.Errorf("failed to parse egress.json: %w", err)
+	}
+	return &ec, nil
+}
+
+// WriteEgressConfig validates ec and writes it to "egress.json" in the data directory without touching
+// the sing-box config; it is regenerated from the file the next time the server starts.
+func WriteEgressConfig(dataDir string, ec *EgressConfig) error {
+	if err := ec.Validate(); err != nil {
+		return err
+	}
+	return writeEgressConfig(dataDir, ec)
+}
+
+// writeEgressConfig writes "egress.json" to the data directory.
+func writeEgressConfig(dataDir string, ec *EgressConfig) error {
+	data, err := json.MarshalIndent(ec, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(path.Join(dataDir, "egress.json"), data, 0600)
+}
+
+// Validate checks an outbound.
+func (e *Egress) Validate() error {
+	if !ruleIDPattern.MatchString(e.Tag) || e.Tag == EgressDirect {
+		return fmt.Errorf("invalid outbound tag %q", e.Tag)
+	}
+	if e.Server == "" {
+		return fmt.Errorf("outbound %s: server is required", e.Tag)
+	}
+	if e.ServerPort == 0 {
+		return fmt.Errorf("outbound %s: server_port is required", e.Tag)
+	}
+	switch e.Type {
+	case C.TypeSOCKS, C.TypeHTTP:
+	case C.TypeShadowsocks:
+		if e.Method == "" || e.Password == "" {
+			return fmt.Errorf("outbound %s: method and password are required", e.Tag)
+		}
+	case C.TypeWireGuard:
+		if e.PrivateKey == "" || e.PeerPublicKey == "" {
+			return fmt.Errorf("outbound %s: private_key and peer_public_key are required", e.Tag)
+		}
+		if len(e.Address) == 0 {
+			return fmt.Errorf("outbound %s: at least one address is required", e.Tag)
+		}
+		for _, a := range e.Address {
+			if _, err := netip.ParsePrefix(a); err != nil {
+				return fmt.Errorf("outbound %s: invalid address %q: %w", e.Tag, a, err)
+			}
+		}
+	default:
+		return fmt.Errorf("outbound %s: unsupported type %q", e.Tag, e.Type)
+	}
+	return nil
+}
+
+// Validate checks all outbounds, the default and the rules.
+func (ec *EgressConfig) Validate() error {
+	tags := map[string]bool{EgressDirect: true}
+	for i := range ec.Outbounds {
+		if err := ec.Outbounds[i].Validate(); err != nil {
+			return err
+		}
+		if tags[ec.Outbounds[i].Tag] {
+			return fmt.Errorf("duplicate outbound tag %q", ec.Outbounds[i].Tag)
+		}
+		tags[ec.Outbounds[i].Tag] = true
+	}
+	if ec.Default != "" && !tags[ec.Default] {
+		return fmt.Errorf("default outbound %q doesn't exist", ec.Default)
+	}
+	ids := make(map[string]bool)
+	for _, r := range ec.Rules {
+		if !ruleIDPattern.MatchString(r.ID) {
+			return fmt.Errorf("invalid egress rule id %q", r.ID)
+		}
+		if ids[r.ID] {
+			return fmt.Errorf("duplicate egress rule id %q", r.ID)
+		}
+		ids[r.ID] = true
+		if len(r.Users) == 0 && len(r.Domains) == 0 {
+			return fmt.Errorf("egress rule %s: users or domains are required", r.ID)
+		}
+		if !tags[r.Outbound] {
+			return fmt.Errorf("egress rule %s: outbound %q doesn't exist", r.ID, r.Outbound)
+		}
+	}
+	return nil
+}
+
+// finalOutbound returns the sing-box tag of the default outbound, or "" if traffic leaves directly.
+func (ec *EgressConfig) finalOutbound() string {
+	if ec.Default == "" || ec.Default == EgressDirect {
+		return ""
+	}
+	return egressTagPrefix + ec.Default
+}
+
+// buildOutbounds generates the managed outbounds and endpoints. WireGuard upstreams are endpoints
+// in sing-box, so they are merged into endpoints, replacing previously generated ones.
+// If there are no upstreams, no outbounds are generated and sing-box connects directly.
+func (ec *EgressConfig) buildOutbounds(endpoints []option.Endpoint) ([]option.Outbound, []option.Endpoint) {
+	endpoints = slices.DeleteFunc(slices.Clone(endpoints), func(ep option.Endpoint) bool {
+		return strings.HasPrefix(ep.Tag, egressTagPrefix)
+	})
+	if len(ec.Outbounds) == 0 {
+		return nil, endpoints
+	}
+	// the first outbound is used if there is no default, so it has to be direct
+	outbounds := []option.Outbound{{Type: C.TypeDirect, Tag: EgressDirect, Options: &option.DirectOutboundOptions{}}}
+	for _, e := range ec.Outbounds {
+		tag := egressTagPrefix + e.Tag
+		server := option.ServerOptions{Server: e.Server, ServerPort: e.ServerPort}
+		switch e.Type {
+		case C.TypeSOCKS:
+			outbounds = append(outbounds, option.Outbound{Type: e.Type, Tag: tag, Options: &option.SOCKSOutboundOptions{
+				ServerOptions: server,
+				Username:      e.Username,
+				Password:      e.Password,
+			}})
+		case C.TypeHTTP:
+			outbounds = append(outbounds, option.Outbound{Type: e.Type, Tag: tag, Options: &option.HTTPOutboundOptions{
+				ServerOptions: server,
+				Username:      e.Username,
+				Password:      e.Password,
+			}})
+		case C.TypeShadowsocks:
+			outbounds = append(outbounds, option.Outbound{Type: e.Type, Tag: tag, Options: &option.ShadowsocksOutboundOptions{
+				ServerOptions: server,
+				Method:        e.Method,
+				Password:      e.Password,
+			}})
+		case C.TypeWireGuard:
+			addresses := make([]netip.Prefix, 0, len(e.Address))
+			for _, a := range e.Address {
+				addresses = append(addresses, netip.MustParsePrefix(a))
+			}
+			endpoints = append(endpoints, option.Endpoint{Type: e.Type, Tag: tag, Options: &option.WireGuardEndpointOptions{
+				MTU:        e.MTU,
+				Address:    addresses,
+				PrivateKey: e.PrivateKey,
+				Peers: []option.WireGuardPeer{{
+					Address:      e.Server,
+					Port:         e.ServerPort,
+					PublicKey:    e.PeerPublicKey,
+					PreSharedKey: e.PreSharedKey,
+					AllowedIPs:   []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0"), netip.MustParsePrefix("::/0")},
+				}},
+			}})
+		}
+	}
+	return outbounds, endpoints
+}
+
+// buildRouteRules converts the egress rules into sing-box rules. It also reports whether
+// the rules need the connection to be sniffed first to match on domains.
+func (ec *EgressConfig) buildRouteRules() (rules []option.Rule, needSniff bool) {
+	for _, r := range ec.Rules {
+		raw := option.RawDefaultRule{
+			AuthUser:     r.Users,
+			DomainSuffix: r.Domains,
+		}
+		if len(r.Domains) > 0 {
+			needSniff = true
+		}
+		action := option.RuleAction{Action: C.RuleActionTypeDirect}
+		if r.Outbound != EgressDirect {
+			action = routeTo(egressTagPrefix + r.Outbound)
+		}
+		rules = append(rules, option.Rule{
+			Type:           C.RuleTypeDefault,
+			DefaultOptions: option.DefaultRule{RawDefaultRule: raw, RuleAction: action},
+		})
+	}
+	return rules, needSniff
+}
+
+// checkEgressSections returns an error if the outbounds or the upstream WireGuard endpoints of candidate
+// differ from those of current, as they are generated from the egress settings. Other endpoints may be changed.
+func checkEgressSections(current, candidate *option.Options) []ValidationError {
+	var errs []ValidationError
+	if !sameJSON(current.Outbounds, candidate.Outbounds) {
+		errs = append(errs, managedSectionError("outbounds", "the egress API, /api/v1/egress"))
+	}
+	isEgress := func(ep option.Endpoint) bool { return strings.HasPrefix(ep.Tag, egressTagPrefix) }
+	currentEndpoints := slices.DeleteFunc(slices.Clone(current.Endpoints), func(ep option.Endpoint) bool { return !isEgress(ep) })
+	candidateEndpoints := slices.DeleteFunc(slices.Clone(candidate.Endpoints), func(ep option.Endpoint) bool { return !isEgress(ep) })
+	if !sameJSON(currentEndpoints, candidateEndpoints) {
+		errs = append(errs, managedSectionError("endpoints", "the egress API, /api/v1/egress"))
+	}
+	return errs
+}
+
+// UpdateEgress lets mutate change the upstream chaining policy and applies the regenerated sing-box config.
+// The policy is only saved if the new config was applied successfully.
+func UpdateEgress(dataDir string, change ConfigChange, mutate func(ec *EgressConfig) error) error {
+	return updateManagedSections(dataDir, change, func(m *managedSections) error {
+		return mutate(m.egress)
+	})
+}
+
+// EgressHealth is the result of a health check of an upstream outbound.
+type EgressHealth struct {
+	// Tag is the tag of the outbound.
+	Tag string `json:"tag"`
+	// Healthy is true if the upstream could be used.
+	Healthy bool `json:"healthy"`
+	// LatencyMS is how long the check took, in milliseconds.
+	LatencyMS int64 `json:"latency_ms"`
+	// Error describes why the check failed.
+	Error string `json:"error,omitempty"`
+	// CheckedAt is when the check was run.
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// CheckEgress checks that an upstream is usable by fetching egressProbeURL through it with a lantern-box
+// client, like ProbeInbound does for the inbounds.
+func CheckEgress(ctx context.Context, e Egress) EgressHealth {
+	outbounds, endpoints := (&EgressConfig{Outbounds: []Egress{e}}).buildOutbounds(nil)
+	via := option.Options{
+		Outbounds: outbounds,
+		Endpoints: endpoints,
+		Route:     &option.RouteOptions{Final: egressTagPrefix + e.Tag},
+	}
+	start := time.Now()
+	stats, err := fetchThrough(ctx, via, egressProbeURL, false)
+	h := EgressHealth{Tag: e.Tag, Healthy: err == nil, LatencyMS: stats.latency.Milliseconds(), CheckedAt: start}
+	if err != nil {
+		h.Error = err.Error()
+	}
+	return h
+}
+
+// RestoreSecrets replaces the secrets of ec that are RedactedValue, as returned by the API, with the
+// secrets of the outbound with the same tag in current, so settings read from the API can be sent back.
+func (ec *EgressConfig) RestoreSecrets(current *EgressConfig) error {
+	var errs ValidationErrors
+	for i := range ec.Outbounds {
+		e := &ec.Outbounds[i]
+		j := slices.IndexFunc(current.Outbounds, func(c Egress) bool { return c.Tag == e.Tag })
+		restore := func(key string, value *string, previous func(c *Egress) string) {
+			if *value != RedactedValue {
+				return
+			}
+			if j < 0 {
+				errs = append(errs, ValidationError{
+					Field:   fmt.Sprintf("outbounds[%d].%s", i, key),
+					Message: fmt.Sprintf("is redacted, but there is no outbound %q to keep it from", e.Tag),
+				})
+				return
+			}
+			*value = previous(&current.Outbounds[j])
+		}
+		restore("password", &e.Password, func(c *Egress) string { return c.Password })
+		restore("private_key", &e.PrivateKey, func(c *Egress) string { return c.PrivateKey })
+		restore("pre_shared_key", &e.PreSharedKey, func(c *Egress) string { return c.PreSharedKey })
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// EgressMonitor periodically checks the health of the upstream outbounds.
+type EgressMonitor struct {
+	mu     sync.Mutex
+	status map[string]EgressHealth
+}
+
+// NewEgressMonitor creates an EgressMonitor. Call Run to start checking.
+func NewEgressMonitor() *EgressMonitor {
+	return &EgressMonitor{status: make(map[string]EgressHealth)}
+}
+
+// Run checks all upstreams configured in the data directory every interval until ctx is done.
+// Upstreams becoming unhealthy or recovering are logged.
+func (m *EgressMonitor) Run(ctx context.Context, dataDir string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		m.check(ctx, dataDir)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// check runs one round of health checks.
+func (m *EgressMonitor) check(ctx context.Context, dataDir string) {
+	ec, err := ReadEgressConfig(dataDir)
+	if err != nil {
+		log.Errorf("failed to read egress config: %v", err)
+		return
+	}
+	status := make(map[string]EgressHealth, len(ec.Outbounds))
+	for _, e := range ec.Outbounds {
+		status[e.Tag] = CheckEgress(ctx, e)
+	}
+	if ctx.Err() != nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for tag, h := range status {
+		prev, ok := m.status[tag]
+		switch {
+		case !h.Healthy && (!ok || prev.Healthy):
+			log.Warnf("upstream outbound %s is unhealthy: %s", tag, h.Error)
+		case h.Healthy && ok && !prev.Healthy:
+			log.Infof("upstream outbound %s recovered", tag)
+		}
+	}
+	m.status = status
+}
+
+// Status returns the results of the last health check of each upstream, sorted by tag.
+func (m *EgressMonitor) Status() []EgressHealth {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	status := make([]EgressHealth, 0, len(m.status))
+	for _, h := range m.status {
+		status = append(status, h)
+	}
+	slices.SortFunc(status, func(a, b EgressHealth) int { return strings.Compare(a.Tag, b.Tag) })
+	return status
+}
@@ -0,0 +1,123 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	C "github.com/sagernet/sing-box/constant"
+	"github.com/sagernet/sing-box/option"
+)
+
+// testEgress returns upstreams of every type.
+func testEgress() []Egress {
+	return []Egress{
+		{Tag: "socks", Type: C.TypeSOCKS, Server: "10.0.0.1", ServerPort: 1080, Username: "user", Password: "socks-secret"},
+		{Tag: "ss", Type: C.TypeShadowsocks, Server: "ss.example.com", ServerPort: 8388, Method: "aes-128-gcm", Password: "ss-secret"},
+		{Tag: "wg", Type: C.TypeWireGuard, Server: "wg.example.com", ServerPort: 51820, PrivateKey: "private", PeerPublicKey: "public", PreSharedKey: "psk", Address: []string{"10.2.0.2/32"}},
+	}
+}
+
+func TestEgressConfigValidate(t *testing.T) {
+	outbounds := testEgress()
+	tests := []struct {
+		name    string
+		config  EgressConfig
+		wantErr bool
+	}{
+		{name: "empty"},
+		{name: "valid", config: EgressConfig{Outbounds: outbounds, Default: "wg", Rules: []EgressRule{
+			{ID: "a", Users: []string{"alice"}, Outbound: "ss"},
+			{ID: "b", Domains: []string{"example.com"}, Outbound: EgressDirect},
+		}}},
+		{name: "direct tag", config: EgressConfig{Outbounds: []Egress{{Tag: EgressDirect, Type: C.TypeSOCKS, Server: "a", ServerPort: 1}}}, wantErr: true},
+		{name: "missing server", config: EgressConfig{Outbounds: []Egress{{Tag: "a", Type: C.TypeSOCKS, ServerPort: 1}}}, wantErr: true},
+		{name: "missing port", config: EgressConfig{Outbounds: []Egress{{Tag: "a", Type: C.TypeSOCKS, Server: "a"}}}, wantErr: true},
+		{name: "unsupported type", config: EgressConfig{Outbounds: []Egress{{Tag: "a", Type: C.TypeVMess, Server: "a", ServerPort: 1}}}, wantErr: true},
+		{name: "shadowsocks without password", config: EgressConfig{Outbounds: []Egress{{Tag: "a", Type: C.TypeShadowsocks, Server: "a", ServerPort: 1, Method: "aes-128-gcm"}}}, wantErr: true},
+		{name: "wireguard without address", config: EgressConfig{Outbounds: []Egress{{Tag: "a", Type: C.TypeWireGuard, Server: "a", ServerPort: 1, PrivateKey: "a", PeerPublicKey: "b"}}}, wantErr: true},
+		{name: "wireguard with invalid address", config: EgressConfig{Outbounds: []Egress{{Tag: "a", Type: C.TypeWireGuard, Server: "a", ServerPort: 1, PrivateKey: "a", PeerPublicKey: "b", Address: []string{"10.2.0.2"}}}}, wantErr: true},
+		{name: "duplicate tag", config: EgressConfig{Outbounds: []Egress{outbounds[0], outbounds[0]}}, wantErr: true},
+		{name: "unknown default", config: EgressConfig{Outbounds: outbounds, Default: "other"}, wantErr: true},
+		{name: "rule without match", config: EgressConfig{Outbounds: outbounds, Rules: []EgressRule{{ID: "a", Outbound: "ss"}}}, wantErr: true},
+		{name: "rule with unknown outbound", config: EgressConfig{Rules: []EgressRule{{ID: "a", Users: []string{"alice"}, Outbound: "ss"}}}, wantErr: true},
+		{name: "duplicate rule", config: EgressConfig{Rules: []EgressRule{
+			{ID: "a", Users: []string{"alice"}, Outbound: EgressDirect},
+			{ID: "a", Users: []string{"bob"}, Outbound: EgressDirect},
+		}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.config.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestBuildEgressOutbounds(t *testing.T) {
+	manual := option.Endpoint{Type: C.TypeWireGuard, Tag: "wg-in"}
+	stale := option.Endpoint{Type: C.TypeWireGuard, Tag: egressTagPrefix + "old"}
+
+	outbounds, endpoints := (&EgressConfig{}).buildOutbounds([]option.Endpoint{manual, stale})
+	if outbounds != nil || !reflect.DeepEqual(endpoints, []option.Endpoint{manual}) {
+		t.Errorf("without upstreams got outbounds %+v and endpoints %+v, want none and the manual endpoint", outbounds, endpoints)
+	}
+
+	outbounds, endpoints = (&EgressConfig{Outbounds: testEgress()}).buildOutbounds([]option.Endpoint{manual, stale})
+	var tags []string
+	for _, o := range outbounds {
+		tags = append(tags, o.Tag)
+	}
+	if want := []string{EgressDirect, "egress-socks", "egress-ss"}; !reflect.DeepEqual(tags, want) {
+		t.Errorf("outbound tags = %v, want %v", tags, want)
+	}
+	if len(endpoints) != 2 || endpoints[0].Tag != manual.Tag || endpoints[1].Tag != "egress-wg" {
+		t.Fatalf("endpoints = %+v, want the manual endpoint and egress-wg", endpoints)
+	}
+	wg := endpoints[1].Options.(*option.WireGuardEndpointOptions)
+	if len(wg.Peers) != 1 || wg.Peers[0].Address != "wg.example.com" || wg.Peers[0].PreSharedKey != "psk" {
+		t.Errorf("WireGuard peers = %+v", wg.Peers)
+	}
+}
+
+func TestEgressRestoreSecrets(t *testing.T) {
+	current := &EgressConfig{Outbounds: testEgress()}
+	data, err := MarshalRedacted(current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var redacted EgressConfig
+	if err = json.Unmarshal(data, &redacted); err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range redacted.Outbounds {
+		for _, secret := range []string{e.Password, e.PrivateKey, e.PreSharedKey} {
+			if secret != "" && secret != RedactedValue {
+				t.Errorf("outbound %s reveals the secret %q", e.Tag, secret)
+			}
+		}
+	}
+
+	if err = redacted.RestoreSecrets(current); err != nil {
+		t.Fatalf("RestoreSecrets() error = %v", err)
+	}
+	if !reflect.DeepEqual(redacted.Outbounds, current.Outbounds) {
+		t.Errorf("restored outbounds = %+v, want %+v", redacted.Outbounds, current.Outbounds)
+	}
+
+	// changed secrets are kept, redacted ones of new outbounds can't be restored
+	update := EgressConfig{Outbounds: []Egress{
+		{Tag: "socks", Type: C.TypeSOCKS, Server: "10.0.0.1", ServerPort: 1080, Password: "changed"},
+		{Tag: "new", Type: C.TypeShadowsocks, Server: "10.0.0.2", ServerPort: 8388, Method: "aes-128-gcm", Password: RedactedValue},
+	}}
+	err = update.RestoreSecrets(current)
+	var errs ValidationErrors
+	if !errors.As(err, &errs) || len(errs) != 1 || errs[0].Field != "outbounds[1].password" {
+		t.Fatalf("RestoreSecrets() error = %v, want one for outbounds[1].password", err)
+	}
+	if update.Outbounds[0].Password != "changed" {
+		t.Errorf("changed password = %q, want it kept", update.Outbounds[0].Password)
+	}
+}
@@ -0,0 +1,60 @@
+package common
+
+import (
+	"sync"
+	"time"
+)
+
+// maxEvents is the number of events kept in memory.
+const maxEvents = 100
+
+// EventExternalIPChanged is published when the server's public IP changed.
+// Its data holds the "old" and "new" addresses.
+const EventExternalIPChanged = "external_ip_changed"
+
+// Event is something that happened on the server that API clients may need to react to.
+type Event struct {
+	// ID increases with every event, also across restarts, so clients can ask for the events
+	// after the last one they saw.
+	ID int64 `json:"id"`
+	// Type is what happened, e.g. EventExternalIPChanged.
+	Type string `json:"type"`
+	// Time is when it happened.
+	Time time.Time `json:"time"`
+	// Data holds details that depend on the type.
+	Data map[string]any `json:"data,omitempty"`
+}
+
+var (
+	eventsMu sync.Mutex
+	events   []Event
+	lastID   int64
+)
+
+// PublishEvent records an event. Only the last maxEvents events are kept, and they are lost on restart.
+func PublishEvent(eventType string, data map[string]any) Event {
+	eventsMu.Lock()
+	defer eventsMu.Unlock()
+	now := time.Now().UTC()
+	// IDs are based on the time so they keep increasing after a restart
+	lastID = max(lastID+1, now.UnixMilli())
+	e := Event{ID: lastID, Type: eventType, Time: now, Data: data}
+	events = append(events, e)
+	if len(events) > maxEvents {
+		events = events[len(events)-maxEvents:]
+	}
+	return e
+}
+
+// EventsSince returns the events with an ID greater than id, oldest first.
+func EventsSince(id int64) []Event {
+	eventsMu.Lock()
+	defer eventsMu.Unlock()
+	result := make([]Event, 0)
+	for _, e := range events {
+		if e.ID > id {
+			result = append(result, e)
+		}
+	}
+	return result
+}
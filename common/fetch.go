@@ -0,0 +1,145 @@
+package common
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+
+	"github.com/sagernet/sing-box/option"
+	"github.com/sagernet/sing/common"
+	"github.com/sagernet/sing/common/json/badjson"
+	"github.com/sagernet/sing/common/json/badoption"
+)
+
+const (
+	// fetchTimeout limits a single fetch through a lantern-box client, including starting the client.
+	fetchTimeout = 20 * time.Second
+	// clientStartTimeout is how long to wait for the client to listen on its socks port.
+	clientStartTimeout = 5 * time.Second
+)
+
+// fetchStats describes a download made by fetchThrough.
+type fetchStats struct {
+	// latency is the time until the response headers were received.
+	latency time.Duration
+	// bytes is the size of the response body.
+	bytes int64
+	// transfer is the time it took to read the response body.
+	transfer time.Duration
+}
+
+// fetchThrough runs a lantern-box client with the outbounds, endpoints and route of via and fetches
+// target through it. The client sends everything to the final outbound of the route, or to the first
+// outbound if there is none. With insecure, the TLS certificate of target isn't verified, e.g. when
+// fetching from the server itself.
+func fetchThrough(ctx context.Context, via option.Options, target string, insecure bool) (fetchStats, error) {
+	var stats fetchStats
+	ctx, cancel := context.WithTimeout(ctx, fetchTimeout)
+	defer cancel()
+
+	socksPort, err := freeLocalPort()
+	if err != nil {
+		return stats, err
+	}
+	via.Log = &option.LogOptions{Level: "warn"}
+	via.Inbounds = []option.Inbound{{
+		Type: "socks",
+		Tag:  "client-in",
+		Options: &option.SocksInboundOptions{
+			ListenOptions: option.ListenOptions{
+				Listen:     common.Ptr(badoption.Addr(netip.AddrFrom4([4]byte{127, 0, 0, 1}))),
+				ListenPort: socksPort,
+			},
+		},
+	}}
+	config, err := badjson.MarshallObjects(via)
+	if err != nil {
+		return stats, err
+	}
+	f, err := os.CreateTemp("", "lantern-client-*.json")
+	if err != nil {
+		return stats, err
+	}
+	defer func() { _ = os.Remove(f.Name()) }()
+	if _, err = f.Write(config); err != nil {
+		_ = f.Close()
+		return stats, err
+	}
+	if err = f.Close(); err != nil {
+		return stats, err
+	}
+
+	singBoxPath, err := exec.LookPath(SingBoxExe)
+	if err != nil {
+		return stats, fmt.Errorf("'%s' not found in PATH: %w", SingBoxExe, err)
+	}
+	cmd := exec.CommandContext(ctx, singBoxPath, "run", "--config", f.Name())
+	if err = cmd.Start(); err != nil {
+		return stats, fmt.Errorf("failed to start client: %w", err)
+	}
+	defer func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	}()
+
+	socksAddr := net.JoinHostPort("127.0.0.1", strconv.Itoa(int(socksPort)))
+	deadline := time.Now().Add(clientStartTimeout)
+	for {
+		conn, err := net.DialTimeout("tcp", socksAddr, time.Second)
+		if err == nil {
+			_ = conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			return stats, fmt.Errorf("client didn't start: %w", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(&url.URL{Scheme: "socks5", Host: socksAddr}),
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: insecure},
+	}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return stats, err
+	}
+	start := time.Now()
+	resp, err := client.Do(req)
+	stats.latency = time.Since(start)
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		// the URL may contain a token
+		err = urlErr.Err
+	}
+	if err != nil {
+		return stats, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return stats, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	start = time.Now()
+	stats.bytes, err = io.Copy(io.Discard, resp.Body)
+	stats.transfer = time.Since(start)
+	return stats, err
+}
+
+// freeLocalPort returns a TCP port on the loopback interface that is currently free.
+func freeLocalPort() (uint16, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = ln.Close() }()
+	return uint16(ln.Addr().(*net.TCPAddr).Port), nil
+}
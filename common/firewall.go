@@ -1,66 +1,466 @@
 package common
 
 import (
+	"errors"
 	"fmt"
-	"os"
 	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 
-	"github.com/charmbracelet/log"
+	N "github.com/sagernet/sing/common/network"
 )
 
-// noFirewallD controls whether firewall rules are skipped.
-// If the environment variable NO_FIREWALLD is set to any non-empty value,
-// firewall modifications using firewall-cmd will be skipped.
-// This is useful for local testing or running within containers like Docker.
-var noFirewallD = os.Getenv("NO_FIREWALLD") != ""
+// FirewallBackend selects the firewall that ports are opened in.
+type FirewallBackend string
 
-// CloseFirewallPort attempts to close the specified port using firewall-cmd.
-// If permanent is true, the rule will be removed permanently.
-// If NO_FIREWALLD is set or firewall-cmd is not found, it logs the information and returns.
-func CloseFirewallPort(port int) {
-	if noFirewallD {
-		log.Infof("NO_FIREWALLD is set, not opening ports")
-		return
+const (
+	// FirewallAuto uses the first firewall that is installed and active: firewalld, ufw, nftables
+	// or iptables, in that order. Firewall changes are skipped if there is none.
+	FirewallAuto FirewallBackend = "auto"
+	// FirewallFirewalld uses firewall-cmd.
+	FirewallFirewalld FirewallBackend = "firewalld"
+	// FirewallUFW uses ufw, the default firewall of Ubuntu.
+	FirewallUFW FirewallBackend = "ufw"
+	// FirewallNftables adds rules to the nftables input chains through netlink.
+	FirewallNftables FirewallBackend = "nftables"
+	// FirewallIptables adds rules to the INPUT chain with iptables and ip6tables.
+	FirewallIptables FirewallBackend = "iptables"
+	// FirewallNone skips firewall changes. This is useful for local testing or running
+	// within containers like Docker.
+	FirewallNone FirewallBackend = "none"
+)
+
+// firewallComment marks the rules added by the manager, where the firewall supports comments.
+const firewallComment = "lantern-server-manager"
+
+// PortRule allows incoming traffic of a transport protocol to a port or a range of ports.
+type PortRule struct {
+	// Protocol is "tcp" or "udp".
+	Protocol string `json:"protocol"`
+	// Port is the port, or the first port of the range.
+	Port uint16 `json:"port"`
+	// EndPort is the last port of the range, or 0 for a single port.
+	EndPort uint16 `json:"end_port,omitempty"`
+}
+
+// TCPPort returns the rule for a single TCP port.
+func TCPPort(port int) PortRule {
+	return PortRule{Protocol: N.NetworkTCP, Port: uint16(port)}
+}
+
+// isRange reports whether the rule covers more than one port.
+func (r PortRule) isRange() bool {
+	return r.EndPort > r.Port
+}
+
+// covers reports whether the rule allows traffic of protocol to port.
+func (r PortRule) covers(protocol string, port int) bool {
+	return r.Protocol == protocol && port >= int(r.Port) && port <= int(max(r.Port, r.EndPort))
+}
+
+// ports formats the port or range with sep between its ends, e.g. "20000-20100" for "-".
+func (r PortRule) ports(sep string) string {
+	if r.isRange() {
+		return fmt.Sprintf("%d%s%d", r.Port, sep, r.EndPort)
 	}
-	// check if firewall-cmd exists
-	if path, _ := exec.LookPath("firewall-cmd"); path == "" {
-		log.Infof("firewall-cmd not found in $PATH. You may need to open the ports manually.")
-		return
+	return strconv.Itoa(int(r.Port))
+}
+
+// String returns the rule in firewalld's notation, e.g. "443/tcp" or "20000-20100/udp".
+func (r PortRule) String() string {
+	return r.ports("-") + "/" + r.Protocol
+}
+
+// PortRedirect sends incoming traffic for the ports of Rule to ToPort on the server itself,
+// e.g. from a previous port of an inbound to its current one. Only ToPort has to be open.
+type PortRedirect struct {
+	Rule   PortRule `json:"rule"`
+	ToPort uint16   `json:"to_port"`
+}
+
+// String returns the redirect like "20000-20100/udp to 443".
+func (r PortRedirect) String() string {
+	return fmt.Sprintf("%s to %d", r.Rule, r.ToPort)
+}
+
+// Firewall opens and closes ports for incoming traffic.
+type Firewall interface {
+	// Name returns the backend of the firewall.
+	Name() FirewallBackend
+	// Open allows the incoming traffic described by rule. Opening an open port is not an error.
+	Open(rule PortRule) error
+	// Close removes what Open added for rule.
+	Close(rule PortRule) error
+	// Redirect adds redirect. Adding an existing redirect is not an error.
+	Redirect(redirect PortRedirect) error
+	// RemoveRedirect removes what Redirect added for redirect.
+	RemoveRedirect(redirect PortRedirect) error
+}
+
+// firewallConstructors create the firewall of each backend, failing if it isn't installed or active.
+// They are tried in this order by FirewallAuto.
+var firewallConstructors = []struct {
+	backend FirewallBackend
+	create  func() (Firewall, error)
+}{
+	{FirewallFirewalld, newFirewalld},
+	{FirewallUFW, newUFW},
+	{FirewallNftables, newNftablesFirewall},
+	{FirewallIptables, newIptables},
+}
+
+var (
+	// firewallBackend is the firewall ports are opened in. It is set with SetFirewallBackend.
+	firewallBackend = FirewallAuto
+	// firewall is the resolved firewallBackend, created on first use by activeFirewall.
+	firewall     Firewall
+	firewallOnce sync.Once
+)
+
+// firewallLog logs the changes made to the firewall.
+var firewallLog = ComponentLogger(LogComponentFirewall)
+
+// SetFirewallBackend selects the firewall that ports are opened in.
+// It must be called before any port is opened.
+func SetFirewallBackend(backend FirewallBackend) error {
+	switch backend {
+	case FirewallAuto, FirewallFirewalld, FirewallUFW, FirewallNftables, FirewallIptables, FirewallNone:
+		firewallBackend = backend
+		return nil
+	default:
+		return fmt.Errorf("unknown firewall backend %q", backend)
 	}
+}
+
+// activeFirewall returns the firewall selected with SetFirewallBackend, detecting it the first time.
+// If the selected firewall isn't available, or none is found, firewall changes are skipped.
+func activeFirewall() Firewall {
+	firewallOnce.Do(func() {
+		firewall = detectFirewall(firewallBackend)
+		firewallLog.Info("Using firewall", "backend", firewall.Name())
+	})
+	return firewall
+}
 
-	if err := exec.Command("firewall-cmd", "--remove-port", fmt.Sprintf("%d/tcp", port), "--permanent").Run(); err != nil {
-		log.Errorf("failed to close port %d: %v", port, err)
-	} else {
-		log.Infof("closed port %d", port)
+// detectFirewall creates the firewall for backend, or finds the first available one for FirewallAuto.
+func detectFirewall(backend FirewallBackend) Firewall {
+	if backend == FirewallNone {
+		return noFirewall{}
 	}
-	if err := exec.Command("firewall-cmd", "--reload").Run(); err != nil {
-		log.Errorf("failed to reload firewall: %v", err)
-	} else {
-		log.Infof("reloaded firewall")
+	for _, c := range firewallConstructors {
+		if backend != FirewallAuto && backend != c.backend {
+			continue
+		}
+		fw, err := c.create()
+		if err == nil {
+			return fw
+		}
+		if backend != FirewallAuto {
+			firewallLog.Errorf("Firewall %s is not available: %v. You may need to open the ports manually.", backend, err)
+			return noFirewall{}
+		}
+		firewallLog.Debug("Firewall not available", "backend", c.backend, "error", err)
 	}
+	firewallLog.Infof("No firewall found. You may need to open the ports manually.")
+	return noFirewall{}
 }
 
-// OpenFirewallPort attempts to open the specified port using firewall-cmd.
-// If permanent is true, the rule will be added permanently.
-// If NO_FIREWALLD is set or firewall-cmd is not found, it logs the information and returns.
+// CloseFirewallPort attempts to close the specified TCP port in the active firewall.
+// Errors are logged.
+func CloseFirewallPort(port int) {
+	closeFirewallRule(TCPPort(port))
+}
+
+// OpenFirewallPort attempts to open the specified TCP port in the active firewall.
+// Errors are logged.
 func OpenFirewallPort(port int) {
-	if noFirewallD {
-		log.Infof("NO_FIREWALLD is set, not opening ports")
+	openFirewallRule(TCPPort(port))
+}
+
+// managerPorts are the TCP ports opened with OpenManagerPort.
+var managerPorts struct {
+	sync.Mutex
+	ports []int
+}
+
+// OpenManagerPort opens a TCP port the manager itself listens on, such as the API port, and keeps
+// CloseChallengePort from closing it. Errors are logged.
+func OpenManagerPort(port int) {
+	managerPorts.Lock()
+	if !slices.Contains(managerPorts.ports, port) {
+		managerPorts.ports = append(managerPorts.ports, port)
+	}
+	managerPorts.Unlock()
+	OpenFirewallPort(port)
+}
+
+// CloseChallengePort closes a TCP port that was opened to solve an ACME challenge, unless the manager
+// listens on it (see OpenManagerPort) or an inbound needs it according to the rules recorded by
+// ReconcileFirewall. Errors are logged.
+func CloseChallengePort(dataDir string, port int) {
+	managerPorts.Lock()
+	reserved := slices.Contains(managerPorts.ports, port)
+	managerPorts.Unlock()
+	if reserved {
 		return
 	}
-	// check if firewall-cmd exists
-	if path, _ := exec.LookPath("firewall-cmd"); path == "" {
-		log.Infof("firewall-cmd not found in $PATH. You may need to open the ports manually.")
+	if slices.ContainsFunc(readFirewallState(dataDir).Rules, func(r PortRule) bool { return r.covers(N.NetworkTCP, port) }) {
 		return
 	}
-	if err := exec.Command("firewall-cmd", "--add-port", fmt.Sprintf("%d/tcp", port), "--permanent").Run(); err != nil {
-		log.Errorf("failed to open port %d: %v", port, err)
-	} else {
-		log.Infof("opened port %d", port)
+	CloseFirewallPort(port)
+}
+
+// openFirewallRule opens rule in the active firewall, logging errors.
+func openFirewallRule(rule PortRule) {
+	fw := activeFirewall()
+	if err := fw.Open(rule); err != nil {
+		firewallLog.Errorf("failed to open port %s: %v", rule, err)
+	} else if fw.Name() != FirewallNone {
+		firewallLog.Infof("opened port %s", rule)
+	}
+}
+
+// closeFirewallRule closes rule in the active firewall, logging errors.
+func closeFirewallRule(rule PortRule) {
+	fw := activeFirewall()
+	if err := fw.Close(rule); err != nil {
+		firewallLog.Errorf("failed to close port %s: %v", rule, err)
+	} else if fw.Name() != FirewallNone {
+		firewallLog.Infof("closed port %s", rule)
+	}
+}
+
+// addFirewallRedirect adds redirect in the active firewall, logging errors.
+func addFirewallRedirect(redirect PortRedirect) {
+	fw := activeFirewall()
+	if err := fw.Redirect(redirect); err != nil {
+		firewallLog.Errorf("failed to redirect port %s: %v", redirect, err)
+	} else if fw.Name() != FirewallNone {
+		firewallLog.Infof("redirected port %s", redirect)
+	}
+}
+
+// removeFirewallRedirect removes redirect from the active firewall, logging errors.
+func removeFirewallRedirect(redirect PortRedirect) {
+	fw := activeFirewall()
+	if err := fw.RemoveRedirect(redirect); err != nil {
+		firewallLog.Errorf("failed to remove port redirect %s: %v", redirect, err)
+	} else if fw.Name() != FirewallNone {
+		firewallLog.Infof("removed port redirect %s", redirect)
+	}
+}
+
+// CanRedirectPorts returns an error if the active firewall can't add port redirects, i.e. if there is
+// no firewall or ufw is used without iptables.
+func CanRedirectPorts() error {
+	switch fw := activeFirewall().(type) {
+	case noFirewall:
+		return errors.New("there is no firewall to add port redirects to")
+	case ufw:
+		if len(fw.nat.commands) == 0 {
+			return errors.New("iptables is needed for port redirects with ufw")
+		}
+	}
+	return nil
+}
+
+// runFirewallCmd runs a firewall command, including its output in the error if it fails.
+func runFirewallCmd(name string, args ...string) error {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s: %w: %s", name, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// noFirewall skips all firewall changes.
+type noFirewall struct{}
+
+func (noFirewall) Name() FirewallBackend { return FirewallNone }
+
+func (noFirewall) Open(rule PortRule) error {
+	firewallLog.Debugf("No firewall, not opening port %s", rule)
+	return nil
+}
+
+func (noFirewall) Close(rule PortRule) error {
+	firewallLog.Debugf("No firewall, not closing port %s", rule)
+	return nil
+}
+
+func (noFirewall) Redirect(redirect PortRedirect) error {
+	firewallLog.Debugf("No firewall, not redirecting port %s", redirect)
+	return nil
+}
+
+func (noFirewall) RemoveRedirect(redirect PortRedirect) error {
+	firewallLog.Debugf("No firewall, not removing port redirect %s", redirect)
+	return nil
+}
+
+// firewalld changes the permanent configuration of firewalld with firewall-cmd and reloads it.
+type firewalld struct{}
+
+// newFirewalld returns the firewalld backend if firewall-cmd is installed and firewalld is running.
+func newFirewalld() (Firewall, error) {
+	if _, err := exec.LookPath("firewall-cmd"); err != nil {
+		return nil, err
+	}
+	if err := runFirewallCmd("firewall-cmd", "--state"); err != nil {
+		return nil, err
 	}
-	if err := exec.Command("firewall-cmd", "--reload").Run(); err != nil {
-		log.Errorf("failed to reload firewall: %v", err)
-	} else {
-		log.Infof("reloaded firewall")
+	return firewalld{}, nil
+}
+
+func (firewalld) Name() FirewallBackend { return FirewallFirewalld }
+
+func (f firewalld) Open(rule PortRule) error {
+	return f.change("--add-port", rule.String())
+}
+
+func (f firewalld) Close(rule PortRule) error {
+	return f.change("--remove-port", rule.String())
+}
+
+// Redirect adds a forward port without a destination address, which redirects on the server itself.
+func (f firewalld) Redirect(redirect PortRedirect) error {
+	return f.change("--add-forward-port", f.forwardPort(redirect))
+}
+
+func (f firewalld) RemoveRedirect(redirect PortRedirect) error {
+	return f.change("--remove-forward-port", f.forwardPort(redirect))
+}
+
+// forwardPort returns the forward port for redirect, e.g. "port=20000-20100:proto=udp:toport=443".
+func (firewalld) forwardPort(redirect PortRedirect) string {
+	return fmt.Sprintf("port=%s:proto=%s:toport=%d", redirect.Rule.ports("-"), redirect.Rule.Protocol, redirect.ToPort)
+}
+
+// change adds or removes a port or forward port and reloads firewalld.
+func (firewalld) change(op, value string) error {
+	if err := runFirewallCmd("firewall-cmd", op+"="+value, "--permanent"); err != nil {
+		return err
+	}
+	return runFirewallCmd("firewall-cmd", "--reload")
+}
+
+// ufw manages rules with ufw. As ufw doesn't manage NAT rules, redirects are added with iptables.
+type ufw struct {
+	nat iptables
+}
+
+// newUFW returns the ufw backend if ufw is installed and active.
+func newUFW() (Firewall, error) {
+	if _, err := exec.LookPath("ufw"); err != nil {
+		return nil, err
+	}
+	out, err := exec.Command("ufw", "status").Output()
+	if err != nil {
+		return nil, fmt.Errorf("ufw status: %w", err)
+	}
+	if !strings.Contains(string(out), "Status: active") {
+		return nil, errors.New("ufw is not active")
+	}
+	var f ufw
+	if nat, err := newIptables(); err == nil {
+		f.nat = nat.(iptables)
+	}
+	return f, nil
+}
+
+func (ufw) Name() FirewallBackend { return FirewallUFW }
+
+func (ufw) Open(rule PortRule) error {
+	return runFirewallCmd("ufw", "allow", rule.ports(":")+"/"+rule.Protocol, "comment", firewallComment)
+}
+
+func (ufw) Close(rule PortRule) error {
+	return runFirewallCmd("ufw", "delete", "allow", rule.ports(":")+"/"+rule.Protocol)
+}
+
+func (f ufw) Redirect(redirect PortRedirect) error {
+	if len(f.nat.commands) == 0 {
+		return errors.New("iptables is needed for port redirects with ufw")
+	}
+	return f.nat.Redirect(redirect)
+}
+
+func (f ufw) RemoveRedirect(redirect PortRedirect) error {
+	return f.nat.RemoveRedirect(redirect)
+}
+
+// iptables inserts rules into the INPUT chain, and redirects into the PREROUTING chain of the nat table,
+// with iptables and ip6tables if it is installed.
+// The rules are not persisted, but are added again when the server starts.
+type iptables struct {
+	commands []string
+}
+
+// newIptables returns the iptables backend if iptables is installed.
+func newIptables() (Firewall, error) {
+	if _, err := exec.LookPath("iptables"); err != nil {
+		return nil, err
+	}
+	f := iptables{commands: []string{"iptables"}}
+	if _, err := exec.LookPath("ip6tables"); err == nil {
+		f.commands = append(f.commands, "ip6tables")
+	}
+	return f, nil
+}
+
+func (iptables) Name() FirewallBackend { return FirewallIptables }
+
+// spec returns the chain, match and target of the iptables rule for rule.
+func (iptables) spec(rule PortRule) []string {
+	return []string{"INPUT", "-p", rule.Protocol, "--dport", rule.ports(":"), "-m", "comment", "--comment", firewallComment, "-j", "ACCEPT"}
+}
+
+// redirectSpec returns the chain, match and target of the nat rule for redirect.
+func (iptables) redirectSpec(redirect PortRedirect) []string {
+	return []string{"PREROUTING", "-p", redirect.Rule.Protocol, "--dport", redirect.Rule.ports(":"), "-m", "comment", "--comment", firewallComment,
+		"-j", "REDIRECT", "--to-ports", strconv.Itoa(int(redirect.ToPort))}
+}
+
+func (f iptables) Open(rule PortRule) error {
+	return f.insert("filter", f.spec(rule))
+}
+
+func (f iptables) Close(rule PortRule) error {
+	return f.delete("filter", f.spec(rule))
+}
+
+func (f iptables) Redirect(redirect PortRedirect) error {
+	return f.insert("nat", f.redirectSpec(redirect))
+}
+
+func (f iptables) RemoveRedirect(redirect PortRedirect) error {
+	return f.delete("nat", f.redirectSpec(redirect))
+}
+
+// insert inserts the rule spec into table, unless it is there already.
+func (f iptables) insert(table string, spec []string) error {
+	for _, cmd := range f.commands {
+		// -C fails if the rule doesn't exist yet
+		if runFirewallCmd(cmd, append([]string{"-t", table, "-C"}, spec...)...) == nil {
+			continue
+		}
+		if err := runFirewallCmd(cmd, append([]string{"-t", table, "-I"}, spec...)...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// delete deletes all copies of the rule spec from table.
+func (f iptables) delete(table string, spec []string) error {
+	for _, cmd := range f.commands {
+		for runFirewallCmd(cmd, append([]string{"-t", table, "-C"}, spec...)...) == nil {
+			if err := runFirewallCmd(cmd, append([]string{"-t", table, "-D"}, spec...)...); err != nil {
+				return err
+			}
+		}
 	}
+	return nil
 }
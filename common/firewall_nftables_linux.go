@@ -0,0 +1,240 @@
+package common
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/sagernet/nftables"
+	"github.com/sagernet/nftables/binaryutil"
+	"github.com/sagernet/nftables/expr"
+	"github.com/sagernet/nftables/userdata"
+	N "github.com/sagernet/sing/common/network"
+	"golang.org/x/sys/unix"
+)
+
+// nftRedirectTable holds the nat chain that port redirects are added to.
+var nftRedirectTable = &nftables.Table{Family: nftables.TableFamilyINet, Name: "lantern_server_manager"}
+
+// nftablesFirewall inserts accept rules into the filter chains hooked into input, e.g. the input chain
+// of the inet filter table of /etc/nftables.conf. The chains of iptables-nft are left to the iptables backend.
+// Redirects are added to the prerouting chain of a table of its own, nftRedirectTable.
+// The rules are not persisted, but are added again when the server starts.
+type nftablesFirewall struct{}
+
+// newNftablesFirewall returns the nftables backend if there are input chains to add rules to.
+func newNftablesFirewall() (Firewall, error) {
+	conn, err := nftables.New()
+	if err != nil {
+		return nil, err
+	}
+	chains, err := nftInputChains(conn)
+	if err != nil {
+		return nil, err
+	}
+	if len(chains) == 0 {
+		return nil, errors.New("no nftables input chains found")
+	}
+	return nftablesFirewall{}, nil
+}
+
+func (nftablesFirewall) Name() FirewallBackend { return FirewallNftables }
+
+// nftInputChains returns the filter base chains hooked into input, except those created by iptables-nft.
+func nftInputChains(conn *nftables.Conn) ([]*nftables.Chain, error) {
+	chains, err := conn.ListChains()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list nftables chains: %w", err)
+	}
+	var result []*nftables.Chain
+	for _, c := range chains {
+		if c.Hooknum == nil || *c.Hooknum != *nftables.ChainHookInput || c.Type != nftables.ChainTypeFilter || c.Name == "INPUT" {
+			continue
+		}
+		switch c.Table.Family {
+		case nftables.TableFamilyINet, nftables.TableFamilyIPv4, nftables.TableFamilyIPv6:
+			result = append(result, c)
+		}
+	}
+	return result, nil
+}
+
+// nftRuleComment returns the comment identifying the nftables rule for rule.
+func nftRuleComment(rule PortRule) []byte {
+	return userdata.AppendString(nil, userdata.TypeComment, firewallComment+" "+rule.String())
+}
+
+// nftExprs returns the expressions of the nftables rule for rule, e.g.
+// "meta l4proto udp udp dport 20000-20100 accept".
+func nftExprs(rule PortRule) []expr.Any {
+	return append(nftMatch(rule), &expr.Verdict{Kind: expr.VerdictAccept})
+}
+
+// nftMatch returns the expressions matching the traffic of rule, e.g. "meta l4proto udp udp dport 20000-20100".
+func nftMatch(rule PortRule) []expr.Any {
+	proto := byte(unix.IPPROTO_TCP)
+	if rule.Protocol == N.NetworkUDP {
+		proto = unix.IPPROTO_UDP
+	}
+	exprs := []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{proto}},
+		// the destination port is at the same offset in TCP and UDP headers
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+	}
+	if rule.isRange() {
+		exprs = append(exprs,
+			&expr.Cmp{Op: expr.CmpOpGte, Register: 1, Data: binaryutil.BigEndian.PutUint16(rule.Port)},
+			&expr.Cmp{Op: expr.CmpOpLte, Register: 1, Data: binaryutil.BigEndian.PutUint16(rule.EndPort)},
+		)
+	} else {
+		exprs = append(exprs, &expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.BigEndian.PutUint16(rule.Port)})
+	}
+	return exprs
+}
+
+// nftRedirectComment returns the comment identifying the nftables rule for redirect.
+func nftRedirectComment(redirect PortRedirect) []byte {
+	return userdata.AppendString(nil, userdata.TypeComment, firewallComment+" redirect "+redirect.String())
+}
+
+// nftFindRules returns the nftables rules in chain with the given comment.
+func nftFindRules(conn *nftables.Conn, chain *nftables.Chain, comment []byte) ([]*nftables.Rule, error) {
+	rules, err := conn.GetRules(chain.Table, chain)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list rules of %s: %w", chain.Name, err)
+	}
+	var result []*nftables.Rule
+	for _, r := range rules {
+		if bytes.Equal(r.UserData, comment) {
+			result = append(result, r)
+		}
+	}
+	return result, nil
+}
+
+func (nftablesFirewall) Open(rule PortRule) error {
+	conn, err := nftables.New()
+	if err != nil {
+		return err
+	}
+	chains, err := nftInputChains(conn)
+	if err != nil {
+		return err
+	}
+	for _, chain := range chains {
+		existing, err := nftFindRules(conn, chain, nftRuleComment(rule))
+		if err != nil {
+			return err
+		}
+		if len(existing) > 0 {
+			continue
+		}
+		conn.InsertRule(&nftables.Rule{
+			Table:    chain.Table,
+			Chain:    chain,
+			Exprs:    nftExprs(rule),
+			UserData: nftRuleComment(rule),
+		})
+	}
+	return conn.Flush()
+}
+
+func (nftablesFirewall) Close(rule PortRule) error {
+	conn, err := nftables.New()
+	if err != nil {
+		return err
+	}
+	chains, err := nftInputChains(conn)
+	if err != nil {
+		return err
+	}
+	for _, chain := range chains {
+		rules, err := nftFindRules(conn, chain, nftRuleComment(rule))
+		if err != nil {
+			return err
+		}
+		for _, r := range rules {
+			if err = conn.DelRule(r); err != nil {
+				return err
+			}
+		}
+	}
+	return conn.Flush()
+}
+
+// nftRedirectChain returns the prerouting chain of nftRedirectTable, or nil if it doesn't exist.
+func nftRedirectChain(conn *nftables.Conn) (*nftables.Chain, error) {
+	chains, err := conn.ListChainsOfTableFamily(nftRedirectTable.Family)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list nftables chains: %w", err)
+	}
+	for _, c := range chains {
+		if c.Table.Name == nftRedirectTable.Name && c.Name == "prerouting" {
+			return c, nil
+		}
+	}
+	return nil, nil
+}
+
+// Redirect adds e.g. "meta l4proto udp udp dport 20000-20100 redirect to :443", creating the
+// table and its chain if needed.
+func (nftablesFirewall) Redirect(redirect PortRedirect) error {
+	conn, err := nftables.New()
+	if err != nil {
+		return err
+	}
+	chain, err := nftRedirectChain(conn)
+	if err != nil {
+		return err
+	}
+	if chain == nil {
+		conn.AddTable(nftRedirectTable)
+		chain = conn.AddChain(&nftables.Chain{
+			Name:     "prerouting",
+			Table:    nftRedirectTable,
+			Type:     nftables.ChainTypeNAT,
+			Hooknum:  nftables.ChainHookPrerouting,
+			Priority: nftables.ChainPriorityNATDest,
+		})
+	} else {
+		existing, err := nftFindRules(conn, chain, nftRedirectComment(redirect))
+		if err != nil {
+			return err
+		}
+		if len(existing) > 0 {
+			return nil
+		}
+	}
+	conn.AddRule(&nftables.Rule{
+		Table: chain.Table,
+		Chain: chain,
+		Exprs: append(nftMatch(redirect.Rule),
+			&expr.Immediate{Register: 1, Data: binaryutil.BigEndian.PutUint16(redirect.ToPort)},
+			&expr.Redir{RegisterProtoMin: 1},
+		),
+		UserData: nftRedirectComment(redirect),
+	})
+	return conn.Flush()
+}
+
+func (nftablesFirewall) RemoveRedirect(redirect PortRedirect) error {
+	conn, err := nftables.New()
+	if err != nil {
+		return err
+	}
+	chain, err := nftRedirectChain(conn)
+	if err != nil || chain == nil {
+		return err
+	}
+	rules, err := nftFindRules(conn, chain, nftRedirectComment(redirect))
+	if err != nil {
+		return err
+	}
+	for _, r := range rules {
+		if err = conn.DelRule(r); err != nil {
+			return err
+		}
+	}
+	return conn.Flush()
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package common
+
+import "errors"
+
+// newNftablesFirewall fails because nftables is only available on Linux.
+func newNftablesFirewall() (Firewall, error) {
+	return nil, errors.New("nftables is only supported on Linux")
+}
@@ -0,0 +1,104 @@
+package common
+
+import (
+	"cmp"
+	"encoding/json"
+	"net/netip"
+	"os"
+	"path"
+	"slices"
+
+	"github.com/sagernet/sing-box/option"
+)
+
+// FirewallRules returns the firewall rules needed by the inbounds and endpoints of a sing-box config,
+// sorted by port. Listeners bound to a loopback address don't need any.
+func FirewallRules(opt *option.Options) []PortRule {
+	var rules []PortRule
+	for _, l := range InboundListeners(opt) {
+		if addr, err := netip.ParseAddr(l.Address); err == nil && addr.IsLoopback() {
+			continue
+		}
+		for _, network := range l.Networks {
+			rule := PortRule{Protocol: network, Port: l.Port}
+			if !slices.Contains(rules, rule) {
+				rules = append(rules, rule)
+			}
+		}
+	}
+	slices.SortFunc(rules, func(a, b PortRule) int {
+		return cmp.Or(cmp.Compare(a.Port, b.Port), cmp.Compare(a.EndPort, b.EndPort), cmp.Compare(a.Protocol, b.Protocol))
+	})
+	return rules
+}
+
+// firewallState records the rules and redirects added for the inbounds.
+type firewallState struct {
+	Rules     []PortRule     `json:"rules"`
+	Redirects []PortRedirect `json:"redirects,omitempty"`
+}
+
+// firewallStatePath returns the path of the file recording the rules opened for the inbounds.
+func firewallStatePath(dataDir string) string {
+	return path.Join(dataDir, "firewall.json")
+}
+
+// readFirewallState reads the rules and redirects added for a previous config.
+func readFirewallState(dataDir string) firewallState {
+	var state firewallState
+	data, err := os.ReadFile(firewallStatePath(dataDir))
+	if err != nil {
+		return state
+	}
+	if err = json.Unmarshal(data, &state); err != nil {
+		firewallLog.Warn("Failed to parse firewall state", "error", err)
+	}
+	return state
+}
+
+// ReconcileFirewall opens the ports needed by the inbounds of opt that weren't needed by the previous config,
+// adds the new port redirects returned by PortRedirects, and removes the rules and redirects added for
+// the previous config that are no longer needed. They are recorded in firewall.json in the data directory.
+// Errors are logged. Rules that didn't change are left alone; RestoreFirewall adds all of them again.
+func ReconcileFirewall(dataDir string, opt *option.Options) {
+	reconcileFirewall(dataDir, opt, false)
+}
+
+// RestoreFirewall is like ReconcileFirewall, but adds all rules and redirects again, including those
+// that were added before, as nftables and iptables rules don't survive a reboot. It is called at startup.
+func RestoreFirewall(dataDir string, opt *option.Options) {
+	reconcileFirewall(dataDir, opt, true)
+}
+
+// reconcileFirewall implements ReconcileFirewall and, with all, RestoreFirewall.
+func reconcileFirewall(dataDir string, opt *option.Options, all bool) {
+	previous := readFirewallState(dataDir)
+	state := firewallState{Rules: FirewallRules(opt), Redirects: PortRedirects(dataDir, opt)}
+	for _, redirect := range previous.Redirects {
+		if !slices.Contains(state.Redirects, redirect) {
+			removeFirewallRedirect(redirect)
+		}
+	}
+	for _, rule := range previous.Rules {
+		if !slices.Contains(state.Rules, rule) {
+			closeFirewallRule(rule)
+		}
+	}
+	for _, rule := range state.Rules {
+		if all || !slices.Contains(previous.Rules, rule) {
+			openFirewallRule(rule)
+		}
+	}
+	for _, redirect := range state.Redirects {
+		if all || !slices.Contains(previous.Redirects, redirect) {
+			addFirewallRedirect(redirect)
+		}
+	}
+	data, err := json.Marshal(state)
+	if err == nil {
+		err = os.WriteFile(firewallStatePath(dataDir), data, 0600)
+	}
+	if err != nil {
+		firewallLog.Errorf("failed to save firewall state: %v", err)
+	}
+}
@@ -0,0 +1,140 @@
+package common
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	C "github.com/sagernet/sing-box/constant"
+	"github.com/sagernet/sing-box/option"
+	N "github.com/sagernet/sing/common/network"
+)
+
+// testWireGuard returns a WireGuard endpoint listening on port.
+func testWireGuard(tag string, port uint16) option.Endpoint {
+	return option.Endpoint{Type: C.TypeWireGuard, Tag: tag, Options: &option.WireGuardEndpointOptions{ListenPort: port}}
+}
+
+func TestFirewallRules(t *testing.T) {
+	tests := []struct {
+		name string
+		opt  option.Options
+		want []PortRule
+	}{
+		{
+			name: "shadowsocks on tcp and udp",
+			opt:  option.Options{Inbounds: []option.Inbound{testShadowsocks("ss", "0.0.0.0", 8388, "")}},
+			want: []PortRule{{Protocol: N.NetworkTCP, Port: 8388}, {Protocol: N.NetworkUDP, Port: 8388}},
+		},
+		{
+			name: "loopback",
+			opt:  option.Options{Inbounds: []option.Inbound{testShadowsocks("ss", "127.0.0.1", 8388, "")}},
+			want: nil,
+		},
+		{
+			name: "sorted by port",
+			opt: option.Options{
+				Inbounds:  []option.Inbound{testHysteria2("hy2", 443), testShadowsocks("ss", "0.0.0.0", 80, N.NetworkTCP)},
+				Endpoints: []option.Endpoint{testWireGuard("wg", 51820)},
+			},
+			want: []PortRule{{Protocol: N.NetworkTCP, Port: 80}, {Protocol: N.NetworkUDP, Port: 443}, {Protocol: N.NetworkUDP, Port: 51820}},
+		},
+		{
+			name: "shared port",
+			opt: option.Options{Inbounds: []option.Inbound{
+				testShadowsocks("ss", "0.0.0.0", 443, ""),
+				testShadowsocks("", "0.0.0.0", 443, N.NetworkTCP),
+				testHysteria2("hy2", 443),
+			}},
+			want: []PortRule{{Protocol: N.NetworkTCP, Port: 443}, {Protocol: N.NetworkUDP, Port: 443}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := FirewallRules(&tt.opt); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("FirewallRules() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// recordingFirewall records the changes made to it.
+type recordingFirewall struct {
+	changes *[]string
+}
+
+func (recordingFirewall) Name() FirewallBackend { return FirewallIptables }
+
+func (f recordingFirewall) Open(rule PortRule) error {
+	*f.changes = append(*f.changes, "open "+rule.String())
+	return nil
+}
+
+func (f recordingFirewall) Close(rule PortRule) error {
+	*f.changes = append(*f.changes, "close "+rule.String())
+	return nil
+}
+
+func (f recordingFirewall) Redirect(redirect PortRedirect) error {
+	*f.changes = append(*f.changes, "redirect "+redirect.String())
+	return nil
+}
+
+func (f recordingFirewall) RemoveRedirect(redirect PortRedirect) error {
+	*f.changes = append(*f.changes, "remove redirect "+redirect.String())
+	return nil
+}
+
+// useRecordingFirewall makes a recordingFirewall the active firewall for the rest of the test and returns
+// a function that returns and clears the changes made since it was last called.
+func useRecordingFirewall(t *testing.T) func() []string {
+	t.Helper()
+	// keep activeFirewall from detecting the firewall of the host later on
+	firewallOnce.Do(func() { firewall = noFirewall{} })
+	previous := firewall
+	var changes []string
+	firewall = recordingFirewall{changes: &changes}
+	t.Cleanup(func() { firewall = previous })
+	return func() []string {
+		recorded := changes
+		changes = nil
+		return recorded
+	}
+}
+
+func TestReconcileFirewall(t *testing.T) {
+	changes := useRecordingFirewall(t)
+	dataDir := t.TempDir()
+	config := func(port uint16, network string) *option.Options {
+		return &option.Options{Inbounds: []option.Inbound{
+			testShadowsocks("ss", "0.0.0.0", port, network),
+			testShadowsocks("local", "127.0.0.1", 1080, ""),
+		}}
+	}
+
+	steps := []struct {
+		name    string
+		opt     *option.Options
+		restore bool
+		want    []string
+	}{
+		{name: "initial", opt: config(8388, ""), want: []string{"open 8388/tcp", "open 8388/udp"}},
+		{name: "unchanged", opt: config(8388, "")},
+		{name: "network removed", opt: config(8388, N.NetworkTCP), want: []string{"close 8388/udp"}},
+		{name: "port changed", opt: config(9000, N.NetworkTCP), want: []string{"close 8388/tcp", "open 9000/tcp"}},
+		{name: "restored", opt: config(9000, N.NetworkTCP), restore: true, want: []string{"open 9000/tcp"}},
+	}
+	for _, step := range steps {
+		if step.restore {
+			RestoreFirewall(dataDir, step.opt)
+		} else {
+			ReconcileFirewall(dataDir, step.opt)
+		}
+		if got := changes(); !reflect.DeepEqual(got, step.want) {
+			t.Errorf("%s: changes = %q, want %q", step.name, got, step.want)
+		}
+	}
+	if got, want := fmt.Sprint(readFirewallState(dataDir).Rules), "[9000/tcp]"; got != want {
+		t.Errorf("recorded rules = %s, want %s", got, want)
+	}
+}
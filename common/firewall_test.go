@@ -0,0 +1,170 @@
+package common
+
+import (
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeFirewallCmd is a stand-in for firewall-cmd, ufw, iptables and ip6tables that appends its name and
+// arguments to $FIREWALL_LOG. Like iptables, it keeps the rules added with -I in $FIREWALL_LOG.rules,
+// fails -C for rules that weren't added and removes one copy with -D. ufw reports that it is active.
+const fakeFirewallCmd = `#!/bin/sh
+PATH=/usr/bin:/bin
+name=$(basename "$0")
+echo "$name $*" >> "$FIREWALL_LOG"
+[ "$1" = status ] && echo "Status: active"
+[ "$1" = -t ] || exit 0
+rules="$FIREWALL_LOG.rules"
+touch "$rules"
+op=$3
+shift 3
+rule="$name $*"
+case "$op" in
+-C) grep -qxF -- "$rule" "$rules" ;;
+-I) echo "$rule" >> "$rules" ;;
+-D) awk -v rule="$rule" '$0 == rule && !done { done = 1; next } { print }' "$rules" > "$rules.new" && mv "$rules.new" "$rules" ;;
+esac
+`
+
+// useFakeFirewallCmds makes fakeFirewallCmd the only commands in PATH, under each of the names, and returns
+// a function that returns and clears the commands run since it was last called.
+func useFakeFirewallCmds(t *testing.T, names ...string) func() []string {
+	t.Helper()
+	bin := t.TempDir()
+	for _, name := range names {
+		if err := os.WriteFile(path.Join(bin, name), []byte(fakeFirewallCmd), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", bin)
+	logFile := path.Join(t.TempDir(), "commands")
+	t.Setenv("FIREWALL_LOG", logFile)
+	return func() []string {
+		data, _ := os.ReadFile(logFile)
+		_ = os.WriteFile(logFile, nil, 0644)
+		return strings.Split(strings.TrimSpace(string(data)), "\n")
+	}
+}
+
+func TestDetectFirewall(t *testing.T) {
+	tests := []struct {
+		name    string
+		cmds    []string
+		backend FirewallBackend
+		want    FirewallBackend
+	}{
+		{name: "none", cmds: []string{"iptables"}, backend: FirewallNone, want: FirewallNone},
+		{name: "firewalld first", cmds: []string{"firewall-cmd", "ufw", "iptables"}, backend: FirewallAuto, want: FirewallFirewalld},
+		{name: "ufw before iptables", cmds: []string{"ufw", "iptables"}, backend: FirewallAuto, want: FirewallUFW},
+		{name: "selected backend", cmds: []string{"firewall-cmd", "iptables"}, backend: FirewallIptables, want: FirewallIptables},
+		{name: "selected backend missing", cmds: []string{"iptables"}, backend: FirewallUFW, want: FirewallNone},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useFakeFirewallCmds(t, tt.cmds...)
+			if got := detectFirewall(tt.backend).Name(); got != tt.want {
+				t.Errorf("detectFirewall(%s) = %s, want %s", tt.backend, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFirewalld(t *testing.T) {
+	commands := useFakeFirewallCmds(t, "firewall-cmd")
+	fw := firewalld{}
+	if err := fw.Open(PortRule{Protocol: "udp", Port: 20000, EndPort: 20100}); err != nil {
+		t.Fatal(err)
+	}
+	if err := fw.RemoveRedirect(PortRedirect{Rule: PortRule{Protocol: "udp", Port: 20000, EndPort: 20100}, ToPort: 443}); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"firewall-cmd --add-port=20000-20100/udp --permanent",
+		"firewall-cmd --reload",
+		"firewall-cmd --remove-forward-port=port=20000-20100:proto=udp:toport=443 --permanent",
+		"firewall-cmd --reload",
+	}
+	if got := commands(); !reflect.DeepEqual(got, want) {
+		t.Errorf("commands = %q, want %q", got, want)
+	}
+}
+
+func TestUFW(t *testing.T) {
+	commands := useFakeFirewallCmds(t, "ufw")
+	fw, err := newUFW()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = fw.Open(PortRule{Protocol: "tcp", Port: 443}); err != nil {
+		t.Fatal(err)
+	}
+	if err = fw.Close(PortRule{Protocol: "udp", Port: 20000, EndPort: 20100}); err != nil {
+		t.Fatal(err)
+	}
+	if err = fw.Redirect(PortRedirect{Rule: PortRule{Protocol: "udp", Port: 8000}, ToPort: 443}); err == nil {
+		t.Error("Redirect() without iptables succeeded")
+	}
+	want := []string{
+		"ufw status",
+		"ufw allow 443/tcp comment " + firewallComment,
+		"ufw delete allow 20000:20100/udp",
+	}
+	if got := commands(); !reflect.DeepEqual(got, want) {
+		t.Errorf("commands = %q, want %q", got, want)
+	}
+}
+
+func TestIptables(t *testing.T) {
+	commands := useFakeFirewallCmds(t, "iptables", "ip6tables")
+	fw, err := newIptables()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rule := PortRule{Protocol: "tcp", Port: 443}
+	spec := "INPUT -p tcp --dport 443 -m comment --comment " + firewallComment + " -j ACCEPT"
+
+	// opening twice adds the rule once
+	for range 2 {
+		if err = fw.Open(rule); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []string{
+		"iptables -t filter -C " + spec,
+		"iptables -t filter -I " + spec,
+		"ip6tables -t filter -C " + spec,
+		"ip6tables -t filter -I " + spec,
+		"iptables -t filter -C " + spec,
+		"ip6tables -t filter -C " + spec,
+	}
+	if got := commands(); !reflect.DeepEqual(got, want) {
+		t.Errorf("commands to open = %q, want %q", got, want)
+	}
+
+	if err = fw.Close(rule); err != nil {
+		t.Fatal(err)
+	}
+	want = []string{
+		"iptables -t filter -C " + spec,
+		"iptables -t filter -D " + spec,
+		"iptables -t filter -C " + spec,
+		"ip6tables -t filter -C " + spec,
+		"ip6tables -t filter -D " + spec,
+		"ip6tables -t filter -C " + spec,
+	}
+	if got := commands(); !reflect.DeepEqual(got, want) {
+		t.Errorf("commands to close = %q, want %q", got, want)
+	}
+
+	redirect := PortRedirect{Rule: PortRule{Protocol: "udp", Port: 20000, EndPort: 20100}, ToPort: 443}
+	if err = fw.Redirect(redirect); err != nil {
+		t.Fatal(err)
+	}
+	redirectSpec := "PREROUTING -p udp --dport 20000:20100 -m comment --comment " + firewallComment + " -j REDIRECT --to-ports 443"
+	if got := commands(); len(got) != 4 || got[1] != "iptables -t nat -I "+redirectSpec {
+		t.Errorf("commands to redirect = %q, want them to insert %q", got, redirectSpec)
+	}
+}
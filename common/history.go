@@ -0,0 +1,543 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ConfigKind identifies which configuration file a history entry belongs to.
+type ConfigKind string
+
+const (
+	// ConfigKindSingBox is the sing-box server configuration ("sing-box-config.json").
+	ConfigKindSingBox ConfigKind = "sing-box"
+	// ConfigKindServer is the manager's own configuration ("server.json").
+	ConfigKindServer ConfigKind = "server"
+)
+
+// maxConfigHistory is the number of versions kept for each ConfigKind.
+// Older versions are deleted when a new one is recorded.
+const maxConfigHistory = 50
+
+// ErrVersionNotFound is returned when a requested config version is not in the history.
+var ErrVersionNotFound = errors.New("config version not found")
+
+// ConfigChange describes who made a configuration change and why.
+type ConfigChange struct {
+	// Actor is the subject of the token that made the change, or "system" for internal changes.
+	Actor string
+	// Reason is a short human-readable description of the change.
+	Reason string
+	// Context is the context of the request that made the change, so the change is traced as part
+	// of it. It may be nil, e.g. for internal changes.
+	Context context.Context
+}
+
+// context returns the context the change is traced in.
+func (c ConfigChange) context() context.Context {
+	if c.Context == nil {
+		return context.Background()
+	}
+	return c.Context
+}
+
+// SystemChange returns a ConfigChange attributed to the manager itself.
+func SystemChange(reason string) ConfigChange {
+	return ConfigChange{Actor: "system", Reason: reason}
+}
+
+// ConfigVersion is a single entry in the configuration history.
+type ConfigVersion struct {
+	// Version is a number that increases with every recorded change, across all kinds.
+	Version int `json:"version"`
+	// Kind tells which configuration file this version belongs to.
+	Kind ConfigKind `json:"kind"`
+	// Timestamp is when the version was recorded.
+	Timestamp time.Time `json:"timestamp"`
+	// Actor is who made the change.
+	Actor string `json:"actor"`
+	// Reason describes the change.
+	Reason string `json:"reason"`
+}
+
+// historyMu serializes access to the history index.
+var historyMu sync.Mutex
+
+// historyDir returns the directory holding config history in the data directory.
+func historyDir(dataDir string) string {
+	return path.Join(dataDir, "history")
+}
+
+// historyFile returns the path of the stored contents of a config version.
+func historyFile(dataDir string, v ConfigVersion) string {
+	return path.Join(historyDir(dataDir), fmt.Sprintf("%06d-%s.json", v.Version, v.Kind))
+}
+
+// readHistoryIndex reads the list of recorded versions, oldest first.
+// A missing index is treated as an empty history.
+func readHistoryIndex(dataDir string) ([]ConfigVersion, error) {
+	data, err := os.ReadFile(path.Join(historyDir(dataDir), "index.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var versions []ConfigVersion
+	if err = json.Unmarshal(data, &versions); err != nil {
+		return nil, fmt.Errorf("failed to parse config history: %w", err)
+	}
+	return versions, nil
+}
+
+// writeHistoryIndex atomically replaces the history index.
+func writeHistoryIndex(dataDir string, versions []ConfigVersion) error {
+	data, err := json.MarshalIndent(versions, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(path.Join(historyDir(dataDir), "index.json"), data, 0600)
+}
+
+// WriteFileAtomic writes data to a temporary file next to name and renames it into place,
+// so readers never observe a partially written file.
+func WriteFileAtomic(name string, data []byte, perm os.FileMode) error {
+	tmp := name + ".tmp"
+	if err := os.WriteFile(tmp, data, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+// RecordConfigVersion stores data as a new version of the given kind in the history.
+// Nothing is recorded if data is identical to the latest version of that kind.
+// Only the newest maxConfigHistory versions of each kind are kept.
+func RecordConfigVersion(dataDir string, kind ConfigKind, data []byte, change ConfigChange) error {
+	historyMu.Lock()
+	defer historyMu.Unlock()
+
+	if err := os.MkdirAll(historyDir(dataDir), 0700); err != nil {
+		return err
+	}
+	versions, err := readHistoryIndex(dataDir)
+	if err != nil {
+		return err
+	}
+	next := 1
+	if len(versions) > 0 {
+		next = versions[len(versions)-1].Version + 1
+	}
+	for i := len(versions) - 1; i >= 0; i-- {
+		if versions[i].Kind != kind {
+			continue
+		}
+		if latest, err := os.ReadFile(historyFile(dataDir, versions[i])); err == nil && bytes.Equal(latest, data) {
+			return nil
+		}
+		break
+	}
+
+	v := ConfigVersion{
+		Version:   next,
+		Kind:      kind,
+		Timestamp: time.Now().UTC(),
+		Actor:     change.Actor,
+		Reason:    change.Reason,
+	}
+	if err = os.WriteFile(historyFile(dataDir, v), data, 0600); err != nil {
+		return err
+	}
+	versions = append(versions, v)
+
+	// prune the oldest versions of this kind
+	kept := versions[:0]
+	count := 0
+	for i := len(versions) - 1; i >= 0; i-- {
+		if versions[i].Kind == kind {
+			count++
+		}
+		if versions[i].Kind == kind && count > maxConfigHistory {
+			_ = os.Remove(historyFile(dataDir, versions[i]))
+			versions[i].Version = 0
+		}
+	}
+	for _, cv := range versions {
+		if cv.Version != 0 {
+			kept = append(kept, cv)
+		}
+	}
+	return writeHistoryIndex(dataDir, kept)
+}
+
+// ConfigHistory returns all recorded config versions, newest first.
+func ConfigHistory(dataDir string) ([]ConfigVersion, error) {
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	versions, err := readHistoryIndex(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(versions)-1; i < j; i, j = i+1, j-1 {
+		versions[i], versions[j] = versions[j], versions[i]
+	}
+	return versions, nil
+}
+
+// ReadConfigVersion returns the metadata and stored contents of a config version.
+// If version is 0, the latest version of kind is returned.
+func ReadConfigVersion(dataDir string, kind ConfigKind, version int) (ConfigVersion, []byte, error) {
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	versions, err := readHistoryIndex(dataDir)
+	if err != nil {
+		return ConfigVersion{}, nil, err
+	}
+	for i := len(versions) - 1; i >= 0; i-- {
+		v := versions[i]
+		if (version == 0 && v.Kind == kind) || (version != 0 && v.Version == version) {
+			data, err := os.ReadFile(historyFile(dataDir, v))
+			return v, data, err
+		}
+	}
+	return ConfigVersion{}, nil, ErrVersionNotFound
+}
+
+// DiffConfigVersions returns a unified diff between two versions of the same kind.
+// If to is 0, the latest version of the same kind as from is used.
+// Both versions are pretty-printed before comparing, so the diff is line-oriented, and secrets
+// such as passwords and keys are redacted.
+func DiffConfigVersions(dataDir string, from, to int) (string, error) {
+	fromVersion, fromData, err := ReadConfigVersion(dataDir, "", from)
+	if err != nil {
+		return "", err
+	}
+	toVersion, toData, err := ReadConfigVersion(dataDir, fromVersion.Kind, to)
+	if err != nil {
+		return "", err
+	}
+	if fromVersion.Kind != toVersion.Kind {
+		return "", fmt.Errorf("cannot diff %s version %d against %s version %d", fromVersion.Kind, fromVersion.Version, toVersion.Kind, toVersion.Version)
+	}
+	fromLines, err := prettyLines(redactSecrets(fromData))
+	if err != nil {
+		return "", err
+	}
+	toLines, err := prettyLines(redactSecrets(toData))
+	if err != nil {
+		return "", err
+	}
+	return unifiedDiff(
+		fmt.Sprintf("%s version %d", fromVersion.Kind, fromVersion.Version),
+		fmt.Sprintf("%s version %d", toVersion.Kind, toVersion.Version),
+		fromLines, toLines), nil
+}
+
+// secretConfigKeys are the keys of JSON values that redactSecrets replaces: the secrets of server.json
+// and the passwords, keys and UUIDs users and inbounds authenticate with in the sing-box config.
+var secretConfigKeys = map[string]bool{
+	"access_token":   true,
+	"hmac_secret":    true,
+	"password":       true,
+	"uuid":           true,
+	"auth":           true,
+	"auth_str":       true,
+	"secret":         true,
+	"key":            true,
+	"private_key":    true,
+	"pre_shared_key": true,
+}
+
+// RedactedValue replaces the values of secretConfigKeys in redacted documents.
+const RedactedValue = "REDACTED"
+
+// MarshalRedacted encodes v as JSON with the values of secretConfigKeys replaced, for API responses
+// that must not reveal secrets.
+func MarshalRedacted(v any) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return redactSecrets(data), nil
+}
+
+// redactSecrets returns the JSON document data with the values of secretConfigKeys replaced,
+// at any depth. Documents that can't be parsed are returned unchanged.
+func redactSecrets(data []byte) []byte {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var doc any
+	if err := decoder.Decode(&doc); err != nil {
+		return data
+	}
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(redactValue(doc)); err != nil {
+		return data
+	}
+	return buf.Bytes()
+}
+
+// redactValue replaces the values of secretConfigKeys in a decoded JSON value.
+func redactValue(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for key, value := range v {
+			if secretConfigKeys[key] {
+				v[key] = RedactedValue
+			} else {
+				v[key] = redactValue(value)
+			}
+		}
+	case []any:
+		for i, value := range v {
+			v[i] = redactValue(value)
+		}
+	}
+	return v
+}
+
+// prettyLines indents a JSON document and splits it into lines.
+func prettyLines(data []byte) ([]string, error) {
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, data, "", "  "); err != nil {
+		return nil, err
+	}
+	return strings.Split(strings.TrimRight(buf.String(), "\n"), "\n"), nil
+}
+
+// diffContext is the number of unchanged lines shown around each change in a diff.
+const diffContext = 3
+
+// unifiedDiff produces a unified diff of two line slices using the edits found by diffLines.
+// An empty string is returned if the inputs are equal.
+func unifiedDiff(fromName, toName string, a, b []string) string {
+	type edit struct {
+		diffOp
+		ai int // line number in a, 1-based, of this or the next line of a
+		bi int // line number in b, 1-based, of this or the next line of b
+	}
+	ops := diffLines(a, b)
+	// show the removed lines of a change before the added ones
+	for start := 0; start < len(ops); {
+		end := start
+		for end < len(ops) && ops[end].op != ' ' {
+			end++
+		}
+		slices.SortStableFunc(ops[start:end], func(x, y diffOp) int { return int(y.op) - int(x.op) })
+		start = end + 1
+	}
+	var edits []edit
+	i, j := 1, 1
+	for _, op := range ops {
+		edits = append(edits, edit{op, i, j})
+		if op.op != '+' {
+			i++
+		}
+		if op.op != '-' {
+			j++
+		}
+	}
+
+	var out strings.Builder
+	for start := 0; start < len(edits); {
+		// find the next change
+		for start < len(edits) && edits[start].op == ' ' {
+			start++
+		}
+		if start == len(edits) {
+			break
+		}
+		// extend the hunk while changes are within 2*diffContext lines of each other
+		end := start
+		for k := start; k < len(edits); k++ {
+			if edits[k].op != ' ' {
+				end = k
+			} else if k-end > 2*diffContext {
+				break
+			}
+		}
+		lo := max(start-diffContext, 0)
+		hi := min(end+diffContext+1, len(edits))
+
+		if out.Len() == 0 {
+			_, _ = fmt.Fprintf(&out, "--- %s\n+++ %s\n", fromName, toName)
+		}
+		aCount, bCount := 0, 0
+		for _, e := range edits[lo:hi] {
+			if e.op != '+' {
+				aCount++
+			}
+			if e.op != '-' {
+				bCount++
+			}
+		}
+		_, _ = fmt.Fprintf(&out, "@@ -%d,%d +%d,%d @@\n", edits[lo].ai, aCount, edits[lo].bi, bCount)
+		for _, e := range edits[lo:hi] {
+			out.WriteByte(e.op)
+			out.WriteString(e.line)
+			out.WriteByte('\n')
+		}
+		start = hi
+	}
+	return out.String()
+}
+
+// diffOp is a line of a diff: op is ' ' for a line both inputs have, '-' for a removed line
+// and '+' for an added one.
+type diffOp struct {
+	op   byte
+	line string
+}
+
+// diffLines returns the shortest edit script turning a into b. It uses Myers' algorithm, searching
+// from both ends for a point on the shortest path and recursing on either side of it, which takes
+// O((n+m)·d) time for d differing lines and O(n+m) space.
+func diffLines(a, b []string) []diffOp {
+	var ops []diffOp
+	// lines both inputs start or end with are kept
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		ops = append(ops, diffOp{' ', a[prefix]})
+		prefix++
+	}
+	a, b = a[prefix:], b[prefix:]
+	suffix := 0
+	for suffix < len(a) && suffix < len(b) && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	common := a[len(a)-suffix:]
+	a, b = a[:len(a)-suffix], b[:len(b)-suffix]
+
+	switch {
+	case len(a) == 0 || len(b) == 0:
+		for _, line := range a {
+			ops = append(ops, diffOp{'-', line})
+		}
+		for _, line := range b {
+			ops = append(ops, diffOp{'+', line})
+		}
+	default:
+		x, y := diffMiddle(a, b)
+		ops = append(ops, diffLines(a[:x], b[:y])...)
+		ops = append(ops, diffLines(a[x:], b[y:])...)
+	}
+	for _, line := range common {
+		ops = append(ops, diffOp{' ', line})
+	}
+	return ops
+}
+
+// diffMiddle returns a point (x, y) on a shortest edit path from a to b, at which the path can be
+// split into two halves with about the same number of edits. a and b must not be empty and
+// must start and end with different lines.
+func diffMiddle(a, b []string) (int, int) {
+	n, m := len(a), len(b)
+	maxD := (n + m + 1) / 2
+	offset := maxD + 1
+	// forward[offset+k] is the furthest x reached on diagonal k = x-y from the start,
+	// backward[offset+k] the furthest x reached on diagonal k from the end, counted from the end
+	forward := make([]int, 2*offset+1)
+	backward := make([]int, 2*offset+1)
+	for i := range forward {
+		forward[i] = -1
+		backward[i] = -1
+	}
+	forward[offset+1] = 0
+	backward[offset+1] = 0
+	delta := n - m
+	// with an odd delta, the paths meet while extending the forward path, otherwise the backward one
+	odd := delta%2 != 0
+	// diagonals whose paths ran off the edit graph are skipped from then on
+	var forwardStart, forwardEnd, backwardStart, backwardEnd int
+	for d := 0; d <= maxD; d++ {
+		for k := -d + forwardStart; k <= d-forwardEnd; k += 2 {
+			var x int
+			if k == -d || (k != d && forward[offset+k-1] < forward[offset+k+1]) {
+				x = forward[offset+k+1]
+			} else {
+				x = forward[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			forward[offset+k] = x
+			switch kb := delta - k; {
+			case x > n:
+				forwardEnd += 2
+			case y > m:
+				forwardStart += 2
+			case odd && kb >= -maxD && kb <= maxD && backward[offset+kb] >= 0 && x >= n-backward[offset+kb]:
+				return x, y
+			}
+		}
+		for k := -d + backwardStart; k <= d-backwardEnd; k += 2 {
+			var x int
+			if k == -d || (k != d && backward[offset+k-1] < backward[offset+k+1]) {
+				x = backward[offset+k+1]
+			} else {
+				x = backward[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[n-1-x] == b[m-1-y] {
+				x++
+				y++
+			}
+			backward[offset+k] = x
+			switch kf := delta - k; {
+			case x > n:
+				backwardEnd += 2
+			case y > m:
+				backwardStart += 2
+			case !odd && kf >= -maxD && kf <= maxD && forward[offset+kf] >= 0 && forward[offset+kf] >= n-x:
+				return forward[offset+kf], forward[offset+kf] - kf
+			}
+		}
+	}
+	// unreachable: the paths meet after at most n+m edits
+	return n, m
+}
+
+// RollbackSingBoxConfig restores a previous version of the sing-box configuration
+// with ApplySingBoxConfig, so it is validated and the current config is kept if it fails.
+// The current users are kept, so users revoked or added since that version stay so, and the sections
+// generated from the routing, DNS and egress settings are regenerated from the current settings.
+func RollbackSingBoxConfig(ctx context.Context, dataDir string, version int, actor string) error {
+	v, data, err := ReadConfigVersion(dataDir, ConfigKindSingBox, version)
+	if err != nil {
+		return err
+	}
+	if v.Kind != ConfigKindSingBox {
+		return fmt.Errorf("version %d is a %s config, not %s", version, v.Kind, ConfigKindSingBox)
+	}
+	opt, err := ParseSingBoxConfig(data)
+	if err != nil {
+		return &ApplyError{Stage: ApplyStageParse, Err: err}
+	}
+	change := ConfigChange{Actor: actor, Reason: fmt.Sprintf("rollback to version %d", version), Context: ctx}
+
+	configMu.Lock()
+	defer configMu.Unlock()
+	current, err := ReadSingBoxServerConfig(dataDir)
+	if err != nil {
+		return err
+	}
+	preserveUsers(current, opt)
+	m, err := loadManagedSections(dataDir)
+	if err != nil {
+		return err
+	}
+	m.apply(opt)
+	return applySingBoxConfig(dataDir, opt, change)
+}
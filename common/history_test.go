@@ -0,0 +1,155 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	numbers := func(n int) []string {
+		lines := make([]string, n)
+		for i := range lines {
+			lines[i] = strings.Repeat("x", i+1)
+		}
+		return lines
+	}
+	counted := func(n int) []string {
+		lines := make([]string, n)
+		for i := range lines {
+			lines[i] = strconv.Itoa(i)
+		}
+		return lines
+	}
+	replace := func(lines []string, i int, s string) []string {
+		lines = append([]string(nil), lines...)
+		lines[i] = s
+		return lines
+	}
+
+	tests := []struct {
+		name string
+		a, b []string
+		want string
+	}{
+		{
+			name: "equal",
+			a:    []string{"a", "b"},
+			b:    []string{"a", "b"},
+			want: "",
+		},
+		{
+			name: "changed line",
+			a:    []string{"a", "b", "c"},
+			b:    []string{"a", "B", "c"},
+			want: "--- from\n+++ to\n@@ -1,3 +1,3 @@\n a\n-b\n+B\n c\n",
+		},
+		{
+			name: "added line",
+			a:    []string{"a", "c"},
+			b:    []string{"a", "b", "c"},
+			want: "--- from\n+++ to\n@@ -1,2 +1,3 @@\n a\n+b\n c\n",
+		},
+		{
+			name: "removed line",
+			a:    []string{"a", "b", "c"},
+			b:    []string{"a", "c"},
+			want: "--- from\n+++ to\n@@ -1,3 +1,2 @@\n a\n-b\n c\n",
+		},
+		{
+			name: "nearby changes share a hunk",
+			a:    numbers(5),
+			b:    replace(replace(numbers(5), 0, "first"), 4, "last"),
+			want: "--- from\n+++ to\n@@ -1,5 +1,5 @@\n-x\n+first\n xx\n xxx\n xxxx\n-xxxxx\n+last\n",
+		},
+		{
+			name: "distant changes get their own hunks",
+			a:    numbers(10),
+			b:    replace(replace(numbers(10), 0, "first"), 9, "last"),
+			want: "--- from\n+++ to\n" +
+				"@@ -1,4 +1,4 @@\n-x\n+first\n xx\n xxx\n xxxx\n" +
+				"@@ -7,4 +7,4 @@\n xxxxxxx\n xxxxxxxx\n xxxxxxxxx\n-xxxxxxxxxx\n+last\n",
+		},
+		{
+			name: "moved line",
+			a:    []string{"a", "b", "c", "d"},
+			b:    []string{"b", "c", "d", "a"},
+			want: "--- from\n+++ to\n@@ -1,4 +1,4 @@\n-a\n b\n c\n d\n+a\n",
+		},
+		{
+			name: "everything replaced",
+			a:    []string{"a", "b"},
+			b:    []string{"c", "d", "e"},
+			want: "--- from\n+++ to\n@@ -1,2 +1,3 @@\n-a\n-b\n+c\n+d\n+e\n",
+		},
+		{
+			// too large for a table of all pairs of lines
+			name: "large inputs",
+			a:    counted(100000),
+			b:    replace(counted(100000), 50000, "changed"),
+			want: "--- from\n+++ to\n@@ -49998,7 +49998,7 @@\n" +
+				" 49997\n 49998\n 49999\n-50000\n+changed\n 50001\n 50002\n 50003\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := unifiedDiff("from", "to", tt.a, tt.b); got != tt.want {
+				t.Errorf("unifiedDiff() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedactSecrets(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{
+			name: "server config",
+			data: `{"port":8443,"access_token":"t","hmac_secret":"s"}`,
+			want: `{"port":8443,"access_token":"REDACTED","hmac_secret":"REDACTED"}`,
+		},
+		{
+			name: "nested users",
+			data: `{"inbounds":[{"password":"p","users":[{"name":"u","password":"x"}],"listen_port":1}]}`,
+			want: `{"inbounds":[{"password":"REDACTED","users":[{"name":"u","password":"REDACTED"}],"listen_port":1}]}`,
+		},
+		{
+			name: "large numbers are kept",
+			data: `{"n":18446744073709551615,"private_key":{"a":1}}`,
+			want: `{"n":18446744073709551615,"private_key":"REDACTED"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := redactSecrets([]byte(tt.data)); !jsonEqual(t, got, []byte(tt.want)) {
+				t.Errorf("redactSecrets() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	invalid := []byte(`{"password":`)
+	if got := redactSecrets(invalid); string(got) != string(invalid) {
+		t.Errorf("redactSecrets(%s) = %s, want it unchanged", invalid, got)
+	}
+}
+
+// jsonEqual reports whether a and b are the same JSON value, comparing numbers by their text.
+func jsonEqual(t *testing.T, a, b []byte) bool {
+	t.Helper()
+	decode := func(data []byte) any {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		var v any
+		if err := decoder.Decode(&v); err != nil {
+			t.Fatalf("invalid JSON %s: %v", data, err)
+		}
+		return v
+	}
+	return reflect.DeepEqual(decode(a), decode(b))
+}
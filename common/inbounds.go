@@ -0,0 +1,105 @@
+package common
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+
+	C "github.com/sagernet/sing-box/constant"
+	"github.com/sagernet/sing-box/option"
+	N "github.com/sagernet/sing/common/network"
+)
+
+// Listener describes a port that sing-box listens on for an inbound or endpoint.
+type Listener struct {
+	// Tag is the tag of the inbound or endpoint.
+	Tag string `json:"tag"`
+	// Type is the sing-box protocol type, e.g. "shadowsocks".
+	Type string `json:"type"`
+	// Address is the address sing-box binds to. Unspecified addresses are left empty.
+	Address string `json:"address,omitempty"`
+	// Port is the port sing-box binds to.
+	Port uint16 `json:"port"`
+	// Networks lists the transport protocols used on the port ("tcp", "udp").
+	Networks []string `json:"networks"`
+	// Index is the position of the inbound in the inbounds or, for endpoints, in the endpoints of the
+	// config, which identifies it also if it has no tag.
+	Index int `json:"-"`
+	// Endpoint is true if the listener is an endpoint rather than an inbound.
+	Endpoint bool `json:"-"`
+}
+
+// Name returns the tag of the listener or, if it has none, its position, e.g. "inbounds[1]".
+func (l Listener) Name() string {
+	if l.Tag != "" {
+		return l.Tag
+	}
+	return strings.TrimSuffix(l.Field(), ".listen_port")
+}
+
+// Field returns the JSON path of the listener's port in the config, e.g. "inbounds[0].listen_port".
+func (l Listener) Field() string {
+	if l.Endpoint {
+		return fmt.Sprintf("endpoints[%d].listen_port", l.Index)
+	}
+	return fmt.Sprintf("inbounds[%d].listen_port", l.Index)
+}
+
+// udpOnlyTypes are protocols that only listen on UDP.
+var udpOnlyTypes = map[string]bool{
+	C.TypeHysteria:  true,
+	C.TypeHysteria2: true,
+	C.TypeTUIC:      true,
+	C.TypeWireGuard: true,
+	"amnezia":       true,
+}
+
+// InboundListeners returns the listening ports of all inbounds and endpoints in a sing-box config.
+// Inbounds that do not listen on a port (e.g. tun) are skipped.
+func InboundListeners(opt *option.Options) []Listener {
+	var listeners []Listener
+	for i, inbound := range opt.Inbounds {
+		wrapper, ok := inbound.Options.(option.ListenOptionsWrapper)
+		if !ok {
+			continue
+		}
+		listen := wrapper.TakeListenOptions()
+		if listen.ListenPort == 0 {
+			continue
+		}
+		l := Listener{
+			Tag:      inbound.Tag,
+			Type:     inbound.Type,
+			Port:     listen.ListenPort,
+			Networks: []string{N.NetworkTCP},
+			Index:    i,
+		}
+		if listen.Listen != nil {
+			if addr := listen.Listen.Build(netip.Addr{}); addr.IsValid() && !addr.IsUnspecified() {
+				l.Address = addr.String()
+			}
+		}
+		switch options := inbound.Options.(type) {
+		case *option.ShadowsocksInboundOptions:
+			l.Networks = options.Network.Build()
+		default:
+			if udpOnlyTypes[inbound.Type] {
+				l.Networks = []string{N.NetworkUDP}
+			}
+		}
+		listeners = append(listeners, l)
+	}
+	for i, endpoint := range opt.Endpoints {
+		if options, ok := endpoint.Options.(*option.WireGuardEndpointOptions); ok && options.ListenPort != 0 {
+			listeners = append(listeners, Listener{
+				Tag:      endpoint.Tag,
+				Type:     endpoint.Type,
+				Port:     options.ListenPort,
+				Networks: []string{N.NetworkUDP},
+				Index:    i,
+				Endpoint: true,
+			})
+		}
+	}
+	return listeners
+}
@@ -0,0 +1,137 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/charmbracelet/log"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// LogFormat selects how log lines are written.
+type LogFormat string
+
+const (
+	// LogFormatText writes human-readable lines.
+	LogFormatText LogFormat = "text"
+	// LogFormatJSON writes one JSON object per line, for log collectors.
+	LogFormatJSON LogFormat = "json"
+)
+
+// Components with their own logger, whose level can be set separately with ConfigureLogging.
+const (
+	LogComponentAuth       = "auth"
+	LogComponentACME       = "acme"
+	LogComponentFirewall   = "firewall"
+	LogComponentSupervisor = "supervisor"
+)
+
+// logComponents are the components whose level can be set.
+var logComponents = []string{LogComponentAuth, LogComponentACME, LogComponentFirewall, LogComponentSupervisor}
+
+// componentLogger is a logger returned by ComponentLogger.
+type componentLogger struct {
+	component string
+	logger    *log.Logger
+}
+
+// loggingConfig is the logging configuration, which is applied to the component loggers
+// when they are created and whenever it changes.
+type loggingConfig struct {
+	sync.Mutex
+	level     log.Level
+	formatter log.Formatter
+	// levels are the levels of components that don't use the default level.
+	levels  map[string]log.Level
+	loggers []componentLogger
+}
+
+// logging is the current logging configuration.
+var logging = loggingConfig{level: log.InfoLevel, formatter: log.TextFormatter}
+
+// ComponentLogger returns a new logger for component whose lines carry a component field.
+// Loggers are usually created once in a package variable; ConfigureLogging updates them
+// when the level or format change later.
+func ComponentLogger(component string) *log.Logger {
+	logging.Lock()
+	defer logging.Unlock()
+	l := log.Default().With("component", component)
+	l.SetLevel(logging.levelLocked(component))
+	l.SetFormatter(logging.formatter)
+	logging.loggers = append(logging.loggers, componentLogger{component: component, logger: l})
+	return l
+}
+
+// ConfigureLogging sets the level and format of the default logger and the component loggers.
+// componentLevels override the level of single components.
+func ConfigureLogging(level log.Level, format LogFormat, componentLevels map[string]log.Level) error {
+	var formatter log.Formatter
+	switch format {
+	case LogFormatText, "":
+		formatter = log.TextFormatter
+	case LogFormatJSON:
+		formatter = log.JSONFormatter
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+	for component := range componentLevels {
+		if !slices.Contains(logComponents, component) {
+			return fmt.Errorf("unknown log component %q, expected one of %s", component, strings.Join(logComponents, ", "))
+		}
+	}
+
+	logging.Lock()
+	defer logging.Unlock()
+	logging.level = level
+	logging.formatter = formatter
+	logging.levels = componentLevels
+	log.SetLevel(level)
+	log.SetFormatter(formatter)
+	for _, cl := range logging.loggers {
+		cl.logger.SetLevel(logging.levelLocked(cl.component))
+		cl.logger.SetFormatter(formatter)
+	}
+	return nil
+}
+
+// levelLocked returns the level of component. logging must be locked.
+func (l *loggingConfig) levelLocked(component string) log.Level {
+	if level, ok := l.levels[component]; ok {
+		return level
+	}
+	return l.level
+}
+
+// ParseComponentLogLevels parses levels given as "component=level" strings, e.g. "acme=debug".
+func ParseComponentLogLevels(levels []string) (map[string]log.Level, error) {
+	parsed := make(map[string]log.Level, len(levels))
+	for _, s := range levels {
+		component, levelName, ok := strings.Cut(s, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid component log level %q, expected component=level", s)
+		}
+		level, err := log.ParseLevel(strings.TrimSpace(levelName))
+		if err != nil {
+			return nil, fmt.Errorf("invalid component log level %q: %w", s, err)
+		}
+		parsed[strings.TrimSpace(component)] = level
+	}
+	return parsed, nil
+}
+
+// Logger returns the default logger with the trace ID of the span in ctx, if there is one,
+// so that log lines can be matched with the traces.
+func Logger(ctx context.Context) *log.Logger {
+	return WithTrace(ctx, log.Default())
+}
+
+// WithTrace returns logger with the trace ID of the span in ctx added, if there is one.
+func WithTrace(ctx context.Context, logger *log.Logger) *log.Logger {
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		return logger.With("trace_id", sc.TraceID().String())
+	}
+	return logger
+}
@@ -0,0 +1,159 @@
+package common
+
+import (
+	"bytes"
+
+	C "github.com/sagernet/sing-box/constant"
+	"github.com/sagernet/sing-box/option"
+	"github.com/sagernet/sing/common/json/badjson"
+)
+
+// managedSections holds the manager's own settings that the parts of the sing-box config
+// outside the inbounds are generated from. Each setting is kept in its own file in the
+// data directory; the generated sections must not be edited in the sing-box config directly.
+type managedSections struct {
+	routing *RoutingConfig
+	dns     *DNSConfig
+	egress  *EgressConfig
+	traffic *TrafficStatsConfig
+}
+
+// loadManagedSections reads all managed settings from the data directory, using defaults for missing files.
+func loadManagedSections(dataDir string) (*managedSections, error) {
+	routing, err := ReadRoutingConfig(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	dns, err := ReadDNSConfig(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	egress, err := ReadEgressConfig(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	traffic, err := ReadTrafficStatsConfig(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	return &managedSections{routing: routing, dns: dns, egress: egress, traffic: traffic}, nil
+}
+
+// save writes all managed settings to the data directory.
+func (m *managedSections) save(dataDir string) error {
+	if err := writeRoutingConfig(dataDir, m.routing); err != nil {
+		return err
+	}
+	if err := writeDNSConfig(dataDir, m.dns); err != nil {
+		return err
+	}
+	if err := writeEgressConfig(dataDir, m.egress); err != nil {
+		return err
+	}
+	return writeTrafficStatsConfig(dataDir, m.traffic)
+}
+
+// validate checks all managed settings.
+func (m *managedSections) validate() error {
+	if err := m.routing.Validate(); err != nil {
+		return err
+	}
+	if err := m.dns.Validate(); err != nil {
+		return err
+	}
+	if err := m.egress.Validate(); err != nil {
+		return err
+	}
+	return m.traffic.Validate()
+}
+
+// apply generates the managed sections into opt, replacing what was there.
+// Routing rules are evaluated before egress rules, so blocked destinations stay blocked
+// whichever upstream a user is routed through.
+func (m *managedSections) apply(opt *option.Options) {
+	final := m.egress.finalOutbound()
+	m.traffic.apply(opt)
+	opt.DNS = m.dns.buildDNSOptions(final)
+	opt.Outbounds, opt.Endpoints = m.egress.buildOutbounds(opt.Endpoints)
+
+	rules, ruleSets, needSniff, needResolve := m.routing.buildRouteRules(final)
+	egressRules, egressSniff := m.egress.buildRouteRules()
+	rules = append(rules, egressRules...)
+	if len(rules) == 0 && len(ruleSets) == 0 && final == "" {
+		opt.Route = nil
+		return
+	}
+	var prefix []option.Rule
+	if needSniff || egressSniff {
+		prefix = append(prefix, actionRule(option.RuleAction{Action: C.RuleActionTypeSniff}))
+	}
+	if needResolve {
+		prefix = append(prefix, actionRule(option.RuleAction{Action: C.RuleActionTypeResolve}))
+	}
+	opt.Route = &option.RouteOptions{
+		Rules:   append(prefix, rules...),
+		RuleSet: ruleSets,
+		Final:   final,
+	}
+}
+
+// updateManagedSections lets mutate change the managed settings, regenerates the sing-box config from them
+// and applies it with ApplySingBoxConfig. The settings are only saved if the config was applied.
+func updateManagedSections(dataDir string, change ConfigChange, mutate func(m *managedSections) error) error {
+	configMu.Lock()
+	defer configMu.Unlock()
+
+	m, err := loadManagedSections(dataDir)
+	if err != nil {
+		return err
+	}
+	if err = mutate(m); err != nil {
+		return err
+	}
+	if err = m.validate(); err != nil {
+		return ValidationErrors{{Message: err.Error()}}
+	}
+	opt, err := ReadSingBoxServerConfig(dataDir)
+	if err != nil {
+		return err
+	}
+	m.apply(opt)
+	if err = applySingBoxConfig(dataDir, opt, change); err != nil {
+		return err
+	}
+	return m.save(dataDir)
+}
+
+// ReconcileManagedSections regenerates the managed sections of the sing-box config from the
+// manager's settings and writes the config if anything changed. Missing settings files are created
+// with defaults, so servers set up before a setting existed get its defaults on upgrade.
+// It does not restart sing-box.
+func ReconcileManagedSections(dataDir string) error {
+	configMu.Lock()
+	defer configMu.Unlock()
+
+	m, err := loadManagedSections(dataDir)
+	if err != nil {
+		return err
+	}
+	if err = m.save(dataDir); err != nil {
+		return err
+	}
+	current, err := ReadSingBoxServerConfigRaw(dataDir)
+	if err != nil {
+		return err
+	}
+	opt, err := ParseSingBoxConfig(current)
+	if err != nil {
+		return err
+	}
+	m.apply(opt)
+	data, err := badjson.MarshallObjects(opt)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(data, current) {
+		return nil
+	}
+	return WriteSingBoxServerConfig(dataDir, opt, SystemChange("regenerate managed sections"))
+}
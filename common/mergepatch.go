@@ -0,0 +1,53 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// MergePatch applies a JSON merge patch (RFC 7386) to a JSON document.
+// Objects in patch are merged into target recursively, null values delete keys
+// and any other value replaces the corresponding value in target.
+func MergePatch(target, patch []byte) ([]byte, error) {
+	t, err := decodeJSONValue(target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid document: %w", err)
+	}
+	p, err := decodeJSONValue(patch)
+	if err != nil {
+		return nil, fmt.Errorf("invalid merge patch: %w", err)
+	}
+	return json.Marshal(mergePatchValue(t, p))
+}
+
+// decodeJSONValue decodes any JSON value, keeping numbers as json.Number so they round-trip exactly.
+func decodeJSONValue(data []byte) (any, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var v any
+	if err := decoder.Decode(&v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// mergePatchValue implements the MergePatch algorithm from RFC 7386, section 2.
+func mergePatchValue(target, patch any) any {
+	patchObject, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	targetObject, ok := target.(map[string]any)
+	if !ok {
+		targetObject = map[string]any{}
+	}
+	for key, value := range patchObject {
+		if value == nil {
+			delete(targetObject, key)
+		} else {
+			targetObject[key] = mergePatchValue(targetObject[key], value)
+		}
+	}
+	return targetObject
+}
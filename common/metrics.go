@@ -0,0 +1,245 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// metricKind is the Prometheus type of a metric.
+type metricKind string
+
+const (
+	metricCounter   metricKind = "counter"
+	metricGauge     metricKind = "gauge"
+	metricHistogram metricKind = "histogram"
+)
+
+// DefaultLatencyBuckets are the histogram buckets, in seconds, used for request latencies.
+var DefaultLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Metric is a counter, gauge or histogram with a fixed set of label names, exposed by WriteMetrics
+// in the Prometheus text format. Each combination of label values is a separate series.
+type Metric struct {
+	name    string
+	help    string
+	kind    metricKind
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*metricSeries
+	// histogram also records the observations of a histogram once the metrics are exported over OTLP.
+	histogram metric.Float64Histogram
+}
+
+// metricSeries is the value of a metric for one combination of label values.
+type metricSeries struct {
+	labelValues []string
+	value       float64
+	// counts are the non-cumulative bucket counts of a histogram, with the +Inf bucket last.
+	counts []uint64
+	count  uint64
+}
+
+var (
+	metricsMu sync.Mutex
+	metrics   []*Metric
+	// metricsCollectors update gauges right before the metrics are written.
+	metricsCollectors []func()
+)
+
+// newMetric creates a metric and registers it for WriteMetrics.
+func newMetric(name, help string, kind metricKind, buckets []float64, labels ...string) *Metric {
+	m := &Metric{name: name, help: help, kind: kind, labels: labels, buckets: buckets, series: make(map[string]*metricSeries)}
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	metrics = append(metrics, m)
+	return m
+}
+
+// NewCounter registers a counter with the given label names.
+func NewCounter(name, help string, labels ...string) *Metric {
+	return newMetric(name, help, metricCounter, nil, labels...)
+}
+
+// NewGauge registers a gauge with the given label names.
+func NewGauge(name, help string, labels ...string) *Metric {
+	return newMetric(name, help, metricGauge, nil, labels...)
+}
+
+// NewHistogram registers a histogram with the given upper bounds of its buckets and label names.
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Metric {
+	return newMetric(name, help, metricHistogram, buckets, labels...)
+}
+
+// RegisterMetricsCollector registers collect to be called before the metrics are written,
+// to set gauges whose values are read from elsewhere.
+func RegisterMetricsCollector(collect func()) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	metricsCollectors = append(metricsCollectors, collect)
+}
+
+// seriesLocked returns the series for labelValues, creating it if needed. m.mu must be held.
+func (m *Metric) seriesLocked(labelValues []string) *metricSeries {
+	if len(labelValues) != len(m.labels) {
+		panic(fmt.Sprintf("metric %s: got %d label values, want %d", m.name, len(labelValues), len(m.labels)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	s, ok := m.series[key]
+	if !ok {
+		s = &metricSeries{labelValues: slices.Clone(labelValues)}
+		if m.kind == metricHistogram {
+			s.counts = make([]uint64, len(m.buckets)+1)
+		}
+		m.series[key] = s
+	}
+	return s
+}
+
+// Inc adds one to a counter.
+func (m *Metric) Inc(labelValues ...string) {
+	m.Add(1, labelValues...)
+}
+
+// Add adds delta to a counter or gauge.
+func (m *Metric) Add(delta float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.seriesLocked(labelValues).value += delta
+}
+
+// Set sets a gauge.
+func (m *Metric) Set(value float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.seriesLocked(labelValues).value = value
+}
+
+// Reset removes all series, e.g. before a collector sets the gauges for the current label values.
+func (m *Metric) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	clear(m.series)
+}
+
+// Observe records value in a histogram.
+func (m *Metric) Observe(value float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.seriesLocked(labelValues)
+	i, _ := slices.BinarySearch(m.buckets, value)
+	s.counts[i]++
+	s.count++
+	s.value += value
+	if m.histogram != nil {
+		m.histogram.Record(context.Background(), value, metric.WithAttributes(m.attributes(labelValues)...))
+	}
+}
+
+// attributes returns labelValues as OpenTelemetry attributes named after the labels of m.
+func (m *Metric) attributes(labelValues []string) []attribute.KeyValue {
+	attrs := make([]attribute.KeyValue, len(m.labels))
+	for i, name := range m.labels {
+		attrs[i] = attribute.String(name, labelValues[i])
+	}
+	return attrs
+}
+
+// collectMetrics runs the registered collectors and returns all metrics sorted by name.
+func collectMetrics() []*Metric {
+	metricsMu.Lock()
+	collectors := slices.Clone(metricsCollectors)
+	all := slices.Clone(metrics)
+	metricsMu.Unlock()
+	for _, collect := range collectors {
+		collect()
+	}
+	slices.SortFunc(all, func(a, b *Metric) int { return strings.Compare(a.name, b.name) })
+	return all
+}
+
+// WriteMetrics runs the registered collectors and writes all metrics in the Prometheus text format.
+func WriteMetrics(w io.Writer) error {
+	var sb strings.Builder
+	for _, m := range collectMetrics() {
+		m.write(&sb)
+	}
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+// write writes the metric with its series sorted by label values.
+func (m *Metric) write(sb *strings.Builder) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, _ = fmt.Fprintf(sb, "# HELP %s %s\n# TYPE %s %s\n", m.name, escapeMetricHelp(m.help), m.name, m.kind)
+	keys := make([]string, 0, len(m.series))
+	for k := range m.series {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		s := m.series[k]
+		if m.kind != metricHistogram {
+			_, _ = fmt.Fprintf(sb, "%s%s %s\n", m.name, m.formatLabels(s.labelValues, ""), formatMetricValue(s.value))
+			continue
+		}
+		var cumulative uint64
+		for i, bound := range m.buckets {
+			cumulative += s.counts[i]
+			_, _ = fmt.Fprintf(sb, "%s_bucket%s %d\n", m.name, m.formatLabels(s.labelValues, formatMetricValue(bound)), cumulative)
+		}
+		_, _ = fmt.Fprintf(sb, "%s_bucket%s %d\n", m.name, m.formatLabels(s.labelValues, "+Inf"), s.count)
+		_, _ = fmt.Fprintf(sb, "%s_sum%s %s\n", m.name, m.formatLabels(s.labelValues, ""), formatMetricValue(s.value))
+		_, _ = fmt.Fprintf(sb, "%s_count%s %d\n", m.name, m.formatLabels(s.labelValues, ""), s.count)
+	}
+}
+
+// formatLabels returns the label set like {route="/api/v1/health",le="0.5"}, with the le label
+// of histogram buckets added if not empty.
+func (m *Metric) formatLabels(values []string, le string) string {
+	var pairs []string
+	for i, name := range m.labels {
+		pairs = append(pairs, name+`="`+escapeLabelValue(values[i])+`"`)
+	}
+	if le != "" {
+		pairs = append(pairs, `le="`+le+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// formatMetricValue formats a sample value, e.g. "1", "0.25" or "+Inf".
+func formatMetricValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// escapeLabelValue escapes backslashes, double quotes and line feeds in a label value.
+func escapeLabelValue(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+// escapeMetricHelp escapes backslashes and line feeds in a help text.
+func escapeMetricHelp(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(s)
+}
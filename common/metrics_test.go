@@ -0,0 +1,98 @@
+package common
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestMetricWrite(t *testing.T) {
+	tests := []struct {
+		name   string
+		metric *Metric
+		record func(m *Metric)
+		want   string
+	}{
+		{
+			name:   "counter without labels",
+			metric: &Metric{name: "lsm_test_total", help: "Test counter.", kind: metricCounter},
+			record: func(m *Metric) { m.Inc(); m.Add(2) },
+			want:   "# HELP lsm_test_total Test counter.\n# TYPE lsm_test_total counter\nlsm_test_total 3\n",
+		},
+		{
+			name:   "gauge series sorted by label values",
+			metric: &Metric{name: "lsm_test", help: "Test gauge.", kind: metricGauge, labels: []string{"inbound", "direction"}},
+			record: func(m *Metric) { m.Set(1.5, "b", "up"); m.Set(-2, "a", "up"); m.Set(0, "a", "down") },
+			want: "# HELP lsm_test Test gauge.\n# TYPE lsm_test gauge\n" +
+				"lsm_test{inbound=\"a\",direction=\"down\"} 0\n" +
+				"lsm_test{inbound=\"a\",direction=\"up\"} -2\n" +
+				"lsm_test{inbound=\"b\",direction=\"up\"} 1.5\n",
+		},
+		{
+			name:   "escaping",
+			metric: &Metric{name: "lsm_test", help: "Back\\slash\nnew line \"quoted\".", kind: metricGauge, labels: []string{"name"}},
+			record: func(m *Metric) { m.Set(1, "a\"b\\c\nd") },
+			want: "# HELP lsm_test Back\\\\slash\\nnew line \"quoted\".\n# TYPE lsm_test gauge\n" +
+				"lsm_test{name=\"a\\\"b\\\\c\\nd\"} 1\n",
+		},
+		{
+			name:   "histogram",
+			metric: &Metric{name: "lsm_test_seconds", help: "Test histogram.", kind: metricHistogram, labels: []string{"route"}, buckets: []float64{0.25, 1}},
+			record: func(m *Metric) { m.Observe(0.25, "/x"); m.Observe(0.5, "/x"); m.Observe(4, "/x") },
+			want: "# HELP lsm_test_seconds Test histogram.\n# TYPE lsm_test_seconds histogram\n" +
+				"lsm_test_seconds_bucket{route=\"/x\",le=\"0.25\"} 1\n" +
+				"lsm_test_seconds_bucket{route=\"/x\",le=\"1\"} 2\n" +
+				"lsm_test_seconds_bucket{route=\"/x\",le=\"+Inf\"} 3\n" +
+				"lsm_test_seconds_sum{route=\"/x\"} 4.75\n" +
+				"lsm_test_seconds_count{route=\"/x\"} 3\n",
+		},
+		{
+			name:   "reset",
+			metric: &Metric{name: "lsm_test", help: "Test gauge.", kind: metricGauge, labels: []string{"inbound"}},
+			record: func(m *Metric) { m.Set(1, "a"); m.Reset() },
+			want:   "# HELP lsm_test Test gauge.\n# TYPE lsm_test gauge\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.metric.series = make(map[string]*metricSeries)
+			tt.record(tt.metric)
+			var sb strings.Builder
+			tt.metric.write(&sb)
+			if got := sb.String(); got != tt.want {
+				t.Errorf("write() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatMetricValue(t *testing.T) {
+	tests := []struct {
+		v    float64
+		want string
+	}{
+		{0, "0"},
+		{1, "1"},
+		{0.25, "0.25"},
+		{-3, "-3"},
+		{1e21, "1e+21"},
+		{math.Inf(1), "+Inf"},
+		{math.Inf(-1), "-Inf"},
+		{math.NaN(), "NaN"},
+	}
+	for _, tt := range tests {
+		if got := formatMetricValue(tt.v); got != tt.want {
+			t.Errorf("formatMetricValue(%v) = %q, want %q", tt.v, got, tt.want)
+		}
+	}
+}
+
+func TestMetricLabelCount(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("Set with the wrong number of label values didn't panic")
+		}
+	}()
+	m := &Metric{name: "lsm_test", kind: metricGauge, labels: []string{"a", "b"}, series: make(map[string]*metricSeries)}
+	m.Set(1, "only one")
+}
@@ -0,0 +1,347 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	C "github.com/sagernet/sing-box/constant"
+	"github.com/sagernet/sing-box/option"
+	N "github.com/sagernet/sing/common/network"
+)
+
+// EventPortsRotated is published when inbounds were moved to new ports.
+// Its data holds the "ports" that changed and when the previous ports stop working ("grace_until").
+const EventPortsRotated = "ports_rotated"
+
+const (
+	// minRotationPort and maxRotationPort bound the random ports inbounds are moved to.
+	minRotationPort = 1024
+	maxRotationPort = 65535
+	// portPickAttempts limits the random ports tried for an inbound.
+	portPickAttempts = 100
+)
+
+// quicTypes are the QUIC based protocols whose clients can hop between the ports of the port hopping range.
+var quicTypes = map[string]bool{
+	C.TypeHysteria:  true,
+	C.TypeHysteria2: true,
+	C.TypeTUIC:      true,
+}
+
+// portHoppingRange is the UDP port range redirected to the first QUIC inbound, set with SetPortHoppingRange.
+var portHoppingRange *PortRule
+
+// SetPortHoppingRange sets the UDP port range, e.g. "20000-40000", that is redirected to the first
+// Hysteria, Hysteria2 or TUIC inbound, so clients can hop between its ports. An empty string disables it.
+// It must be called before the firewall is reconciled.
+func SetPortHoppingRange(s string) error {
+	if s == "" {
+		portHoppingRange = nil
+		return nil
+	}
+	first, last, ok := strings.Cut(s, "-")
+	start, err1 := strconv.ParseUint(first, 10, 16)
+	end, err2 := strconv.ParseUint(last, 10, 16)
+	if !ok || err1 != nil || err2 != nil || start == 0 || end <= start {
+		return fmt.Errorf("invalid port hopping range %q, expected e.g. 20000-40000", s)
+	}
+	portHoppingRange = &PortRule{Protocol: N.NetworkUDP, Port: uint16(start), EndPort: uint16(end)}
+	return nil
+}
+
+// PortHoppingRange returns the port hopping range, or nil if port hopping is disabled.
+func PortHoppingRange() *PortRule {
+	return portHoppingRange
+}
+
+// contains reports whether port is one of the ports of r.
+func (r PortRule) contains(port uint16) bool {
+	return port == r.Port || (r.isRange() && port >= r.Port && port <= r.EndPort)
+}
+
+// PreviousPort is a port an inbound or endpoint was moved away from. Until it expires, its traffic is
+// redirected to the current port of the inbound, so clients with an old config keep working.
+type PreviousPort struct {
+	// Tag is the tag of the inbound.
+	Tag string `json:"tag"`
+	// Index is the position of the inbound in the inbounds or, if Endpoint is set, in the endpoints
+	// of the config, which identifies it together with the tag.
+	Index    int  `json:"index"`
+	Endpoint bool `json:"endpoint,omitempty"`
+	// Port is the previous port.
+	Port uint16 `json:"port"`
+	// Until is when the redirect is removed.
+	Until time.Time `json:"until"`
+}
+
+// PortRotationState is stored in "port_rotation.json" in the data directory.
+type PortRotationState struct {
+	// LastRotation is when the inbounds were last moved to new ports.
+	LastRotation time.Time `json:"last_rotation,omitempty"`
+	// Previous are the previous ports that are still redirected.
+	Previous []PreviousPort `json:"previous,omitempty"`
+}
+
+// PortChange describes an inbound that was moved to a new port.
+type PortChange struct {
+	Tag     string `json:"tag"`
+	OldPort uint16 `json:"old_port"`
+	NewPort uint16 `json:"new_port"`
+}
+
+// portRotationStatePath returns the path of the file holding the port rotation state.
+func portRotationStatePath(dataDir string) string {
+	return path.Join(dataDir, "port_rotation.json")
+}
+
+// ReadPortRotationState reads the port rotation state. A missing file is an empty state.
+func ReadPortRotationState(dataDir string) (*PortRotationState, error) {
+	state := &PortRotationState{}
+	data, err := os.ReadFile(portRotationStatePath(dataDir))
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("failed to parse port rotation state: %w", err)
+	}
+	return state, nil
+}
+
+// writePortRotationState saves the port rotation state.
+func writePortRotationState(dataDir string, state *PortRotationState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(portRotationStatePath(dataDir), data, 0600)
+}
+
+// of reports whether p is a previous port of l.
+func (p PreviousPort) of(l Listener) bool {
+	return p.Endpoint == l.Endpoint && p.Index == l.Index && p.Tag == l.Tag
+}
+
+// NextExpiry returns when the first previous port stops being redirected, or the zero time if there is none.
+func (s *PortRotationState) NextExpiry() time.Time {
+	var next time.Time
+	for _, p := range s.Previous {
+		if next.IsZero() || p.Until.Before(next) {
+			next = p.Until
+		}
+	}
+	return next
+}
+
+// rotatableListener reports whether l listens on a public address, so its port can be rotated and redirected.
+func rotatableListener(l Listener) bool {
+	addr, err := netip.ParseAddr(l.Address)
+	return err != nil || !addr.IsLoopback()
+}
+
+// PortRedirects returns the redirects needed for the inbounds of opt: the port hopping range to the
+// first QUIC inbound, and the previous ports in the rotation state to the current ports of their inbounds.
+// Redirects from ports that an inbound listens on again are skipped.
+func PortRedirects(dataDir string, opt *option.Options) []PortRedirect {
+	var listeners []Listener
+	for _, l := range InboundListeners(opt) {
+		if rotatableListener(l) {
+			listeners = append(listeners, l)
+		}
+	}
+	inUse := func(rule PortRule) bool {
+		return slices.ContainsFunc(listeners, func(l Listener) bool {
+			return slices.Contains(l.Networks, rule.Protocol) && rule.contains(l.Port)
+		})
+	}
+
+	var redirects []PortRedirect
+	if portHoppingRange != nil {
+		i := slices.IndexFunc(listeners, func(l Listener) bool { return quicTypes[l.Type] })
+		switch {
+		case i < 0:
+			firewallLog.Warn("Port hopping range is set, but there is no Hysteria, Hysteria2 or TUIC inbound")
+		case inUse(*portHoppingRange):
+			firewallLog.Warnf("Port hopping range %s overlaps the port of an inbound, not redirecting it", portHoppingRange)
+		default:
+			redirects = append(redirects, PortRedirect{Rule: *portHoppingRange, ToPort: listeners[i].Port})
+		}
+	}
+
+	state, err := ReadPortRotationState(dataDir)
+	if err != nil {
+		firewallLog.Warn("Failed to read port rotation state", "error", err)
+		return redirects
+	}
+	for _, p := range state.Previous {
+		i := slices.IndexFunc(listeners, p.of)
+		if i < 0 || time.Now().After(p.Until) {
+			continue
+		}
+		for _, network := range listeners[i].Networks {
+			redirect := PortRedirect{Rule: PortRule{Protocol: network, Port: p.Port}, ToPort: listeners[i].Port}
+			if !inUse(redirect.Rule) && !slices.Contains(redirects, redirect) {
+				redirects = append(redirects, redirect)
+			}
+		}
+	}
+	return redirects
+}
+
+// RotatePorts moves every inbound and WireGuard endpoint listening on a public address to a new random port and applies the
+// config with UpdateSingBoxConfig. The previous ports are redirected to the new ones for grace, which is
+// refused if the firewall can't redirect ports (see CanRedirectPorts), as clients would be cut off at once.
+// New ports avoid the ports in use, reservedPorts (e.g. the API port) and the port hopping range.
+func RotatePorts(dataDir string, grace time.Duration, reservedPorts ...int) ([]PortChange, error) {
+	if grace > 0 {
+		if err := CanRedirectPorts(); err != nil {
+			return nil, fmt.Errorf("can't redirect the previous ports for the grace period: %w", err)
+		}
+	}
+	var changes []PortChange
+	var names []string
+	var previousState *PortRotationState
+	err := UpdateSingBoxConfig(dataDir, SystemChange("rotate ports"), func(opt *option.Options) error {
+		state, err := ReadPortRotationState(dataDir)
+		if err != nil {
+			return err
+		}
+		previousState = &PortRotationState{LastRotation: state.LastRotation, Previous: slices.Clone(state.Previous)}
+
+		now := time.Now().UTC()
+		state.Previous = slices.DeleteFunc(state.Previous, func(p PreviousPort) bool { return now.After(p.Until) })
+		listeners := InboundListeners(opt)
+		used := make(map[uint16]bool)
+		for _, l := range listeners {
+			used[l.Port] = true
+		}
+		for _, p := range state.Previous {
+			used[p.Port] = true
+		}
+		for _, port := range reservedPorts {
+			used[uint16(port)] = true
+		}
+
+		for _, l := range listeners {
+			if !rotatableListener(l) {
+				continue
+			}
+			port, err := pickPort(l, used)
+			if err != nil {
+				return fmt.Errorf("%s: %w", l.Name(), err)
+			}
+			used[port] = true
+			setListenPort(opt, l, port)
+			changes = append(changes, PortChange{Tag: l.Tag, OldPort: l.Port, NewPort: port})
+			names = append(names, l.Name())
+			state.Previous = append(state.Previous, PreviousPort{Tag: l.Tag, Index: l.Index, Endpoint: l.Endpoint, Port: l.Port, Until: now.Add(grace)})
+		}
+		if len(changes) == 0 {
+			return errors.New("no inbound ports to rotate")
+		}
+		state.LastRotation = now
+		// the state is saved before applying, so the firewall is reconciled with the new redirects
+		return writePortRotationState(dataDir, state)
+	})
+	if err != nil {
+		if previousState != nil {
+			if werr := writePortRotationState(dataDir, previousState); werr != nil {
+				log.Errorf("failed to restore port rotation state: %v", werr)
+			}
+		}
+		return nil, err
+	}
+	for i, c := range changes {
+		log.Infof("Moved inbound %s from port %d to %d", names[i], c.OldPort, c.NewPort)
+	}
+	return changes, nil
+}
+
+// setListenPort moves the inbound or endpoint of l in opt to port.
+func setListenPort(opt *option.Options, l Listener, port uint16) {
+	if l.Endpoint {
+		if options, ok := opt.Endpoints[l.Index].Options.(*option.WireGuardEndpointOptions); ok {
+			options.ListenPort = port
+		}
+		return
+	}
+	if wrapper, ok := opt.Inbounds[l.Index].Options.(option.ListenOptionsWrapper); ok {
+		listen := wrapper.TakeListenOptions()
+		listen.ListenPort = port
+		wrapper.ReplaceListenOptions(listen)
+	}
+}
+
+// pickPort returns a random port for l that isn't used, isn't in the port hopping range and can be bound.
+func pickPort(l Listener, used map[uint16]bool) (uint16, error) {
+	for range portPickAttempts {
+		port := uint16(rand.N(maxRotationPort-minRotationPort+1) + minRotationPort)
+		if used[port] || (portHoppingRange != nil && portHoppingRange.contains(port)) {
+			continue
+		}
+		if portAvailable(l, port) {
+			return port, nil
+		}
+	}
+	return 0, errors.New("no free port found")
+}
+
+// portAvailable reports whether port can be bound on the address of l for all of its networks.
+func portAvailable(l Listener, port uint16) bool {
+	addr := net.JoinHostPort(l.Address, strconv.Itoa(int(port)))
+	for _, network := range l.Networks {
+		switch network {
+		case N.NetworkTCP:
+			ln, err := net.Listen("tcp", addr)
+			if err != nil {
+				return false
+			}
+			_ = ln.Close()
+		case N.NetworkUDP:
+			conn, err := net.ListenPacket("udp", addr)
+			if err != nil {
+				return false
+			}
+			_ = conn.Close()
+		}
+	}
+	return true
+}
+
+// ExpirePreviousPorts drops the previous ports whose grace period is over from the rotation state
+// and reconciles the firewall, removing their redirects.
+func ExpirePreviousPorts(dataDir string) error {
+	configMu.Lock()
+	defer configMu.Unlock()
+	state, err := ReadPortRotationState(dataDir)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	n := len(state.Previous)
+	state.Previous = slices.DeleteFunc(state.Previous, func(p PreviousPort) bool { return !now.Before(p.Until) })
+	if len(state.Previous) == n {
+		return nil
+	}
+	if err = writePortRotationState(dataDir, state); err != nil {
+		return err
+	}
+	opt, err := ReadSingBoxServerConfig(dataDir)
+	if err != nil {
+		return err
+	}
+	ReconcileFirewall(dataDir, opt)
+	return nil
+}
@@ -0,0 +1,137 @@
+package common
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sagernet/sing-box/option"
+	N "github.com/sagernet/sing/common/network"
+)
+
+func TestPortRedirects(t *testing.T) {
+	future := time.Now().Add(time.Hour)
+	past := time.Now().Add(-time.Minute)
+	tcpUDP := func(from, to uint16) []PortRedirect {
+		return []PortRedirect{
+			{Rule: PortRule{Protocol: N.NetworkTCP, Port: from}, ToPort: to},
+			{Rule: PortRule{Protocol: N.NetworkUDP, Port: from}, ToPort: to},
+		}
+	}
+	tests := []struct {
+		name     string
+		opt      option.Options
+		hopping  string
+		previous []PreviousPort
+		want     []PortRedirect
+	}{
+		{
+			name: "nothing to redirect",
+			opt:  option.Options{Inbounds: []option.Inbound{testShadowsocks("ss", "0.0.0.0", 8388, "")}},
+		},
+		{
+			name:    "port hopping to the first QUIC inbound",
+			opt:     option.Options{Inbounds: []option.Inbound{testShadowsocks("ss", "0.0.0.0", 8388, ""), testHysteria2("hy2", 443), testHysteria2("hy2-2", 444)}},
+			hopping: "20000-20010",
+			want:    []PortRedirect{{Rule: PortRule{Protocol: N.NetworkUDP, Port: 20000, EndPort: 20010}, ToPort: 443}},
+		},
+		{
+			name:    "port hopping without a QUIC inbound",
+			opt:     option.Options{Inbounds: []option.Inbound{testShadowsocks("ss", "0.0.0.0", 8388, "")}},
+			hopping: "20000-20010",
+		},
+		{
+			name:    "port hopping overlapping an inbound",
+			opt:     option.Options{Inbounds: []option.Inbound{testHysteria2("hy2", 20005)}},
+			hopping: "20000-20010",
+		},
+		{
+			name:     "previous port",
+			opt:      option.Options{Inbounds: []option.Inbound{testShadowsocks("ss", "0.0.0.0", 8388, "")}},
+			previous: []PreviousPort{{Tag: "ss", Index: 0, Port: 1000, Until: future}},
+			want:     tcpUDP(1000, 8388),
+		},
+		{
+			name:     "expired previous port",
+			opt:      option.Options{Inbounds: []option.Inbound{testShadowsocks("ss", "0.0.0.0", 8388, "")}},
+			previous: []PreviousPort{{Tag: "ss", Index: 0, Port: 1000, Until: past}},
+		},
+		{
+			name: "untagged inbounds are matched by index",
+			opt: option.Options{Inbounds: []option.Inbound{
+				testShadowsocks("", "0.0.0.0", 8388, ""),
+				testShadowsocks("", "0.0.0.0", 9000, ""),
+			}},
+			previous: []PreviousPort{{Index: 1, Port: 1000, Until: future}},
+			want:     tcpUDP(1000, 9000),
+		},
+		{
+			name:     "inbound replaced since the rotation",
+			opt:      option.Options{Inbounds: []option.Inbound{testShadowsocks("other", "0.0.0.0", 8388, "")}},
+			previous: []PreviousPort{{Tag: "ss", Index: 0, Port: 1000, Until: future}},
+		},
+		{
+			name: "endpoint",
+			opt: option.Options{
+				Inbounds:  []option.Inbound{testShadowsocks("ss", "0.0.0.0", 8388, "")},
+				Endpoints: []option.Endpoint{testWireGuard("wg", 51820)},
+			},
+			previous: []PreviousPort{{Tag: "wg", Index: 0, Endpoint: true, Port: 1000, Until: future}},
+			want:     []PortRedirect{{Rule: PortRule{Protocol: N.NetworkUDP, Port: 1000}, ToPort: 51820}},
+		},
+		{
+			name: "previous port in use again",
+			opt: option.Options{Inbounds: []option.Inbound{
+				testShadowsocks("ss", "0.0.0.0", 8388, ""),
+				testShadowsocks("ss-2", "0.0.0.0", 1000, ""),
+			}},
+			previous: []PreviousPort{{Tag: "ss", Index: 0, Port: 1000, Until: future}},
+		},
+		{
+			name:     "loopback inbound",
+			opt:      option.Options{Inbounds: []option.Inbound{testShadowsocks("ss", "127.0.0.1", 8388, "")}},
+			previous: []PreviousPort{{Tag: "ss", Index: 0, Port: 1000, Until: future}},
+		},
+	}
+	t.Cleanup(func() { _ = SetPortHoppingRange("") })
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := SetPortHoppingRange(tt.hopping); err != nil {
+				t.Fatal(err)
+			}
+			dataDir := t.TempDir()
+			if err := writePortRotationState(dataDir, &PortRotationState{Previous: tt.previous}); err != nil {
+				t.Fatal(err)
+			}
+			if got := PortRedirects(dataDir, &tt.opt); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("PortRedirects() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetPortHoppingRange(t *testing.T) {
+	t.Cleanup(func() { _ = SetPortHoppingRange("") })
+	tests := []struct {
+		s       string
+		want    *PortRule
+		wantErr bool
+	}{
+		{s: "", want: nil},
+		{s: "20000-40000", want: &PortRule{Protocol: N.NetworkUDP, Port: 20000, EndPort: 40000}},
+		{s: "20000", wantErr: true},
+		{s: "40000-20000", wantErr: true},
+		{s: "0-100", wantErr: true},
+		{s: "1-70000", wantErr: true},
+	}
+	for _, tt := range tests {
+		err := SetPortHoppingRange(tt.s)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("SetPortHoppingRange(%q) error = %v, want error %v", tt.s, err, tt.wantErr)
+			continue
+		}
+		if got := PortHoppingRange(); err == nil && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("SetPortHoppingRange(%q) set %v, want %v", tt.s, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,364 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/sagernet/sing-box/option"
+)
+
+// blockReportWindow is how long a client report of a failed connection counts towards a block.
+const blockReportWindow = time.Hour
+
+// EventTransportBlocked is published when enough clients reported failed connections to an inbound
+// that the server itself can reach. Its data holds the "tag", "index" and "port" of the inbound.
+const EventTransportBlocked = "transport_blocked"
+
+// ProbeUser is the Shadowsocks user the probes and self-tests connect as. EnsureProbeUser adds it to
+// every Shadowsocks inbound, so they use the same multi-user path as the apps.
+const ProbeUser = "lsm-probe"
+
+var (
+	// errProbeUnsupported is returned when no client outbound can be generated for an inbound.
+	errProbeUnsupported = errors.New("probing is not supported for this inbound type")
+	// errProbeUserPresent is returned by the mutate function of EnsureProbeUser if there is nothing to add.
+	errProbeUserPresent = errors.New("probe user is present")
+	// ErrNotInboundUser is returned by ProbeMonitor.Report if the reporting user can't connect to the inbound.
+	ErrNotInboundUser = errors.New("not a user of this inbound")
+)
+
+// TransportState is the assessed state of an inbound.
+type TransportState string
+
+const (
+	// TransportUnknown means the inbound wasn't probed yet and no client reported failures.
+	TransportUnknown TransportState = "unknown"
+	// TransportOK means the last probe through the inbound succeeded.
+	TransportOK TransportState = "ok"
+	// TransportDown means the last probe through the inbound failed, so the problem is likely on the server.
+	TransportDown TransportState = "down"
+	// TransportBlocked means clients report failed connections while the server can reach the inbound,
+	// which suggests that the port or protocol is blocked on the clients' networks.
+	TransportBlocked TransportState = "blocked"
+)
+
+// ProbeResult is the result of probing an inbound end-to-end.
+type ProbeResult struct {
+	// Port is the port the inbound listened on when it was probed.
+	Port uint16 `json:"port"`
+	// OK is true if the probe URL could be fetched through the inbound.
+	OK bool `json:"ok"`
+	// LatencyMS is how long fetching the probe URL took, in milliseconds.
+	LatencyMS int64 `json:"latency_ms"`
+	// Error describes why the probe failed.
+	Error string `json:"error,omitempty"`
+	// CheckedAt is when the probe was run.
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// TransportStatus is the state of an inbound as seen by the probes and the clients.
+type TransportStatus struct {
+	Tag string `json:"tag"`
+	// Index is the position of the inbound in the config, which identifies inbounds without a tag.
+	Index int            `json:"index"`
+	Type  string         `json:"type"`
+	Port  uint16         `json:"port"`
+	State TransportState `json:"state"`
+	// LastProbe is the last probe of the inbound on its current port.
+	LastProbe *ProbeResult `json:"last_probe,omitempty"`
+	// Reports is the number of users that reported failed connections to the current port within blockReportWindow.
+	Reports int `json:"reports"`
+	// BlockedSince is when the inbound was first assessed as blocked on its current port.
+	BlockedSince *time.Time `json:"blocked_since,omitempty"`
+}
+
+// failureReport is a client report of a failed connection.
+type failureReport struct {
+	port uint16
+	time time.Time
+}
+
+// ProbeMonitor periodically probes each inbound end-to-end by running a client with lantern-box that
+// connects to the server's public address, and collects reports of failed connections from clients.
+// An inbound is blocked if at least threshold users reported failures for its current port while the
+// server's own probe succeeds.
+type ProbeMonitor struct {
+	threshold int
+	// OnBlocked is called in a new goroutine, if set, when an inbound becomes blocked.
+	OnBlocked func(name string)
+
+	// the state is kept by the index of the inbound in the config
+	mu           sync.Mutex
+	probes       map[int]ProbeResult
+	reports      map[int]map[string]failureReport // by index and user
+	blockedSince map[int]time.Time
+}
+
+// NewProbeMonitor creates a ProbeMonitor that considers an inbound blocked after reports from threshold users.
+// Call Run to start probing.
+func NewProbeMonitor(threshold int) *ProbeMonitor {
+	return &ProbeMonitor{
+		threshold:    max(threshold, 1),
+		probes:       make(map[int]ProbeResult),
+		reports:      make(map[int]map[string]failureReport),
+		blockedSince: make(map[int]time.Time),
+	}
+}
+
+// Run probes the inbounds in the data directory through publicIP every interval until ctx is done,
+// fetching probeURL through each of them.
+func (m *ProbeMonitor) Run(ctx context.Context, dataDir string, publicIP func() string, probeURL string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		m.probe(ctx, dataDir, publicIP(), probeURL)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probe runs one round of probes, adding ProbeUser to the inbounds that don't have it first.
+func (m *ProbeMonitor) probe(ctx context.Context, dataDir, publicIP, probeURL string) {
+	if err := EnsureProbeUser(dataDir); err != nil {
+		log.Errorf("failed to add probe user: %v", err)
+		return
+	}
+	opt, err := ReadSingBoxServerConfig(dataDir)
+	if err != nil {
+		log.Errorf("failed to read sing-box config: %v", err)
+		return
+	}
+	for i, inbound := range opt.Inbounds {
+		result, err := ProbeInbound(ctx, inbound, publicIP, probeURL)
+		if errors.Is(err, errProbeUnsupported) || ctx.Err() != nil {
+			continue
+		}
+		name := inboundName(i, inbound)
+		m.mu.Lock()
+		prev, ok := m.probes[i]
+		switch {
+		case !result.OK && (!ok || prev.OK):
+			log.Warnf("probe of inbound %s on port %d failed: %s", name, result.Port, result.Error)
+		case result.OK && ok && !prev.OK:
+			log.Infof("probe of inbound %s on port %d succeeded again", name, result.Port)
+		}
+		m.probes[i] = result
+		m.mu.Unlock()
+		m.checkBlocked(dataDir, i)
+	}
+}
+
+// inboundName returns the tag of the inbound at index i or, if it has none, its position.
+func inboundName(i int, inbound option.Inbound) string {
+	return Listener{Tag: inbound.Tag, Index: i}.Name()
+}
+
+// Report records that user failed to connect to the inbound at index in the config on port.
+// ErrNotInboundUser is returned if user isn't a user of the inbound.
+// If this makes the inbound blocked, an EventTransportBlocked event is published and OnBlocked is called.
+func (m *ProbeMonitor) Report(dataDir string, index int, port uint16, user string) error {
+	opt, err := ReadSingBoxServerConfig(dataDir)
+	if err != nil {
+		return err
+	}
+	if index < 0 || index >= len(opt.Inbounds) || !inboundHasUser(opt.Inbounds[index], user) {
+		return ErrNotInboundUser
+	}
+	m.mu.Lock()
+	if m.reports[index] == nil {
+		m.reports[index] = make(map[string]failureReport)
+	}
+	m.reports[index][user] = failureReport{port: port, time: time.Now()}
+	m.mu.Unlock()
+	m.checkBlocked(dataDir, index)
+	return nil
+}
+
+// inboundHasUser reports whether user can connect to inbound: the admin, who uses the inbound password,
+// or one of the users of a Shadowsocks inbound other than ProbeUser.
+func inboundHasUser(inbound option.Inbound, user string) bool {
+	options, ok := inbound.Options.(*option.ShadowsocksInboundOptions)
+	if !ok || user == ProbeUser {
+		return false
+	}
+	return user == "admin" || slices.ContainsFunc(options.Users, func(u option.ShadowsocksUser) bool { return u.Name == user })
+}
+
+// checkBlocked publishes an event and calls OnBlocked if the inbound at index just became blocked.
+func (m *ProbeMonitor) checkBlocked(dataDir string, index int) {
+	statuses, err := m.Status(dataDir)
+	if err != nil {
+		log.Errorf("failed to get transport status: %v", err)
+		return
+	}
+	i := slices.IndexFunc(statuses, func(s TransportStatus) bool { return s.Index == index })
+	if i < 0 || statuses[i].State != TransportBlocked {
+		return
+	}
+	m.mu.Lock()
+	if _, ok := m.blockedSince[index]; ok {
+		m.mu.Unlock()
+		return
+	}
+	m.blockedSince[index] = time.Now()
+	m.mu.Unlock()
+
+	st := statuses[i]
+	name := Listener{Tag: st.Tag, Index: st.Index}.Name()
+	log.Warnf("inbound %s on port %d seems to be blocked: %d users reported failed connections", name, st.Port, st.Reports)
+	PublishEvent(EventTransportBlocked, map[string]any{"tag": st.Tag, "index": st.Index, "port": st.Port})
+	if m.OnBlocked != nil {
+		go m.OnBlocked(name)
+	}
+}
+
+// Status returns the state of each inbound of the sing-box config in the data directory
+// that listens on a public address.
+func (m *ProbeMonitor) Status(dataDir string) ([]TransportStatus, error) {
+	opt, err := ReadSingBoxServerConfig(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	statuses := make([]TransportStatus, 0)
+	for _, l := range InboundListeners(opt) {
+		if l.Endpoint || !rotatableListener(l) {
+			continue
+		}
+		st := TransportStatus{Tag: l.Tag, Index: l.Index, Type: l.Type, Port: l.Port, State: TransportUnknown}
+		if probe, ok := m.probes[l.Index]; ok && probe.Port == l.Port {
+			st.LastProbe = &probe
+			st.State = TransportOK
+			if !probe.OK {
+				st.State = TransportDown
+			}
+		}
+		for _, r := range m.reports[l.Index] {
+			if r.port == l.Port && time.Since(r.time) < blockReportWindow {
+				st.Reports++
+			}
+		}
+		if st.Reports >= m.threshold && st.State != TransportDown {
+			st.State = TransportBlocked
+		}
+		if since, ok := m.blockedSince[l.Index]; ok {
+			if st.State == TransportBlocked {
+				st.BlockedSince = &since
+			} else {
+				// the inbound recovered or moved to a new port
+				delete(m.blockedSince, l.Index)
+			}
+		}
+		statuses = append(statuses, st)
+	}
+	return statuses, nil
+}
+
+// EnsureProbeUser adds ProbeUser to the Shadowsocks inbounds that don't have it, with the same password
+// in all of them, and applies the config with UpdateSingBoxConfig. If every inbound has it, nothing
+// is applied, so sing-box is only restarted when an inbound was added.
+func EnsureProbeUser(dataDir string) error {
+	opt, err := ReadSingBoxServerConfig(dataDir)
+	if err != nil {
+		return err
+	}
+	if _, missing := probeUserPassword(opt); !missing {
+		return nil
+	}
+	err = UpdateSingBoxConfig(dataDir, SystemChange("add probe user"), func(opt *option.Options) error {
+		password, missing := probeUserPassword(opt)
+		if !missing {
+			return errProbeUserPresent
+		}
+		if password == "" {
+			password = makeShadowsocksPassword()
+		}
+		for _, inbound := range opt.Inbounds {
+			options, ok := inbound.Options.(*option.ShadowsocksInboundOptions)
+			if ok && !slices.ContainsFunc(options.Users, isProbeUser) {
+				options.Users = append(options.Users, option.ShadowsocksUser{Name: ProbeUser, Password: password})
+			}
+		}
+		return nil
+	})
+	if errors.Is(err, errProbeUserPresent) {
+		return nil
+	}
+	return err
+}
+
+// probeUserPassword returns the password of ProbeUser in the Shadowsocks inbounds of opt, if any of them
+// has it, and whether it is missing from one of them.
+func probeUserPassword(opt *option.Options) (password string, missing bool) {
+	for _, inbound := range opt.Inbounds {
+		options, ok := inbound.Options.(*option.ShadowsocksInboundOptions)
+		if !ok {
+			continue
+		}
+		if i := slices.IndexFunc(options.Users, isProbeUser); i >= 0 {
+			password = options.Users[i].Password
+		} else {
+			missing = true
+		}
+	}
+	return password, missing
+}
+
+// isProbeUser reports whether u is ProbeUser.
+func isProbeUser(u option.ShadowsocksUser) bool {
+	return u.Name == ProbeUser
+}
+
+// clientOutbound returns the outbound the user uses to connect to inbound at server, or the admin if user is empty.
+// Only Shadowsocks inbounds are supported, like in GenerateSingBoxConnectConfig.
+func clientOutbound(inbound option.Inbound, server, user string) (option.Outbound, error) {
+	options, ok := inbound.Options.(*option.ShadowsocksInboundOptions)
+	if !ok {
+		return option.Outbound{}, errProbeUnsupported
+	}
+	password := options.Password
+	if user != "" {
+		i := slices.IndexFunc(options.Users, func(u option.ShadowsocksUser) bool { return u.Name == user })
+		if i < 0 {
+			return option.Outbound{}, fmt.Errorf("user %s not found in inbound %s", user, inbound.Tag)
+		}
+		password = options.Users[i].Password
+	}
+	return shadowsocksClientOutbound(server, options.ListenPort, password), nil
+}
+
+// ProbeInbound fetches probeURL through inbound by running a lantern-box client that connects as
+// ProbeUser to the inbound at publicIP and exposes it as a local socks proxy. Behind NAT without
+// hairpinning the server may not reach its own public address, so failures don't always mean the
+// inbound is down. errProbeUnsupported is returned for inbounds that can't be probed.
+func ProbeInbound(ctx context.Context, inbound option.Inbound, publicIP, probeURL string) (ProbeResult, error) {
+	outbound, err := clientOutbound(inbound, publicIP, ProbeUser)
+	if err != nil {
+		return ProbeResult{}, err
+	}
+	result := ProbeResult{Port: listenPort(inbound), CheckedAt: time.Now().UTC()}
+	stats, err := fetchThrough(ctx, option.Options{Outbounds: []option.Outbound{outbound}}, probeURL, false)
+	result.LatencyMS = stats.latency.Milliseconds()
+	result.OK = err == nil
+	if err != nil {
+		result.Error = err.Error()
+	}
+	return result, nil
+}
+
+// listenPort returns the port inbound listens on, or 0 if it doesn't listen on one.
+func listenPort(inbound option.Inbound) uint16 {
+	if wrapper, ok := inbound.Options.(option.ListenOptionsWrapper); ok {
+		return wrapper.TakeListenOptions().ListenPort
+	}
+	return 0
+}
@@ -0,0 +1,158 @@
+package common
+
+import (
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sagernet/sing-box/option"
+	"github.com/sagernet/sing/common/json/badjson"
+)
+
+func TestProbeMonitorStatus(t *testing.T) {
+	dataDir := t.TempDir()
+	data, err := badjson.MarshallObjects(option.Options{
+		Inbounds: []option.Inbound{
+			testShadowsocks("ss", "0.0.0.0", 8388, ""),
+			testShadowsocks("", "0.0.0.0", 9000, ""),
+			testShadowsocks("local", "127.0.0.1", 1080, ""),
+			testHysteria2("hy2", 443),
+		},
+		Endpoints: []option.Endpoint{testWireGuard("wg", 51820)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(path.Join(dataDir, "sing-box-config.json"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	report := func(port uint16, age time.Duration) failureReport {
+		return failureReport{port: port, time: now.Add(-age)}
+	}
+	// status is the part of a TransportStatus that the tests compare
+	type status struct {
+		Index   int
+		State   TransportState
+		Reports int
+		Blocked bool
+	}
+	unknown := []status{{0, TransportUnknown, 0, false}, {1, TransportUnknown, 0, false}, {3, TransportUnknown, 0, false}}
+	with := func(s status) []status {
+		statuses := append([]status(nil), unknown...)
+		for i := range statuses {
+			if statuses[i].Index == s.Index {
+				statuses[i] = s
+			}
+		}
+		return statuses
+	}
+
+	tests := []struct {
+		name  string
+		setup func(m *ProbeMonitor)
+		want  []status
+	}{
+		{
+			name:  "nothing known",
+			setup: func(m *ProbeMonitor) {},
+			want:  unknown,
+		},
+		{
+			name:  "probe succeeded",
+			setup: func(m *ProbeMonitor) { m.probes[0] = ProbeResult{Port: 8388, OK: true} },
+			want:  with(status{0, TransportOK, 0, false}),
+		},
+		{
+			name:  "probe failed",
+			setup: func(m *ProbeMonitor) { m.probes[3] = ProbeResult{Port: 443, Error: "timeout"} },
+			want:  with(status{3, TransportDown, 0, false}),
+		},
+		{
+			name:  "probe of a previous port",
+			setup: func(m *ProbeMonitor) { m.probes[1] = ProbeResult{Port: 1000, OK: true} },
+			want:  unknown,
+		},
+		{
+			name: "reports below the threshold",
+			setup: func(m *ProbeMonitor) {
+				m.probes[0] = ProbeResult{Port: 8388, OK: true}
+				m.reports[0] = map[string]failureReport{"alice": report(8388, time.Minute)}
+			},
+			want: with(status{0, TransportOK, 1, false}),
+		},
+		{
+			name: "blocked",
+			setup: func(m *ProbeMonitor) {
+				m.probes[0] = ProbeResult{Port: 8388, OK: true}
+				m.reports[0] = map[string]failureReport{"alice": report(8388, time.Minute), "bob": report(8388, 0)}
+			},
+			want: with(status{0, TransportBlocked, 2, false}),
+		},
+		{
+			name: "blocked without a probe",
+			setup: func(m *ProbeMonitor) {
+				m.reports[1] = map[string]failureReport{"alice": report(9000, time.Minute), "bob": report(9000, 0)}
+			},
+			want: with(status{1, TransportBlocked, 2, false}),
+		},
+		{
+			name: "down is not blocked",
+			setup: func(m *ProbeMonitor) {
+				m.probes[0] = ProbeResult{Port: 8388, Error: "timeout"}
+				m.reports[0] = map[string]failureReport{"alice": report(8388, time.Minute), "bob": report(8388, 0)}
+			},
+			want: with(status{0, TransportDown, 2, false}),
+		},
+		{
+			name: "old reports and reports of a previous port",
+			setup: func(m *ProbeMonitor) {
+				m.probes[0] = ProbeResult{Port: 8388, OK: true}
+				m.reports[0] = map[string]failureReport{"alice": report(8388, 2*time.Hour), "bob": report(1000, 0)}
+			},
+			want: with(status{0, TransportOK, 0, false}),
+		},
+		{
+			name: "blocked since",
+			setup: func(m *ProbeMonitor) {
+				m.probes[0] = ProbeResult{Port: 8388, OK: true}
+				m.reports[0] = map[string]failureReport{"alice": report(8388, time.Minute), "bob": report(8388, 0)}
+				m.blockedSince[0] = now
+			},
+			want: with(status{0, TransportBlocked, 2, true}),
+		},
+		{
+			name: "recovered",
+			setup: func(m *ProbeMonitor) {
+				m.probes[0] = ProbeResult{Port: 8388, OK: true}
+				m.blockedSince[0] = now
+			},
+			want: with(status{0, TransportOK, 0, false}),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewProbeMonitor(2)
+			tt.setup(m)
+			statuses, err := m.Status(dataDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []status
+			for _, st := range statuses {
+				got = append(got, status{st.Index, st.State, st.Reports, st.BlockedSince != nil})
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Status() = %+v, want %+v", got, tt.want)
+			}
+			for _, st := range statuses {
+				if _, ok := m.blockedSince[st.Index]; ok && st.State != TransportBlocked {
+					t.Errorf("inbound %d is %s but still has a blocked since time", st.Index, st.State)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,444 @@
+package common
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"time"
+
+	C "github.com/sagernet/sing-box/constant"
+	"github.com/sagernet/sing-box/option"
+	"github.com/sagernet/sing/common/json/badoption"
+)
+
+// RouteRuleType is the kind of match a RouteRule performs.
+type RouteRuleType string
+
+const (
+	// RouteRuleDomain matches full domain names.
+	RouteRuleDomain RouteRuleType = "domain"
+	// RouteRuleDomainSuffix matches domain names by suffix, e.g. "example.com" matches "www.example.com".
+	RouteRuleDomainSuffix RouteRuleType = "domain_suffix"
+	// RouteRuleDomainKeyword matches domain names containing a keyword.
+	RouteRuleDomainKeyword RouteRuleType = "domain_keyword"
+	// RouteRuleIPCIDR matches destination IP ranges.
+	RouteRuleIPCIDR RouteRuleType = "ip_cidr"
+	// RouteRulePrivateIP matches private, loopback and link-local destinations. It takes no values.
+	RouteRulePrivateIP RouteRuleType = "ip_is_private"
+	// RouteRulePort matches destination ports.
+	RouteRulePort RouteRuleType = "port"
+	// RouteRulePortRange matches destination port ranges in "from:to" format.
+	RouteRulePortRange RouteRuleType = "port_range"
+	// RouteRuleProtocol matches sniffed protocols, e.g. "bittorrent".
+	RouteRuleProtocol RouteRuleType = "protocol"
+	// RouteRuleRuleSet matches any of the rule sets with the given tags.
+	RouteRuleRuleSet RouteRuleType = "rule_set"
+	// RouteRuleGeoIP matches destination countries using SagerNet's sing-geoip rule sets, e.g. "ir".
+	RouteRuleGeoIP RouteRuleType = "geoip"
+	// RouteRuleGeosite matches site categories using SagerNet's sing-geosite rule sets, e.g. "category-ads-all".
+	RouteRuleGeosite RouteRuleType = "geosite"
+)
+
+// RouteAction is what happens to connections matching a RouteRule.
+type RouteAction string
+
+const (
+	// RouteActionBlock rejects matching connections.
+	RouteActionBlock RouteAction = "block"
+	// RouteActionAllow connects matching connections directly and skips the rules after it.
+	RouteActionAllow RouteAction = "allow"
+)
+
+const (
+	geoIPRuleSetURL   = "https://raw.githubusercontent.com/SagerNet/sing-geoip/rule-set/geoip-%s.srs"
+	geositeRuleSetURL = "https://raw.githubusercontent.com/SagerNet/sing-geosite/rule-set/geosite-%s.srs"
+)
+
+// RouteRule is a single managed routing rule.
+type RouteRule struct {
+	// ID uniquely identifies the rule. It is generated if left empty when the rule is added.
+	ID string `json:"id"`
+	// Type is the kind of match.
+	Type RouteRuleType `json:"type"`
+	// Values are the domains, CIDRs, ports etc. to match, depending on Type.
+	Values []string `json:"values,omitempty"`
+	// Action is applied to matching connections.
+	Action RouteAction `json:"action"`
+	// Enabled rules are included in the sing-box config.
+	Enabled bool `json:"enabled"`
+	// Description is a free-form note about the rule.
+	Description string `json:"description,omitempty"`
+}
+
+// RuleSetSource is a remote sing-box rule set that rules of type "rule_set" can refer to.
+type RuleSetSource struct {
+	// Tag is the name rules use to refer to the rule set.
+	Tag string `json:"tag"`
+	// URL is where sing-box downloads the rule set from.
+	URL string `json:"url"`
+	// Format is "binary" (.srs) or "source" (.json). It is guessed from the URL if empty.
+	Format string `json:"format,omitempty"`
+	// UpdateInterval is how often sing-box refreshes the rule set, e.g. "24h".
+	UpdateInterval string `json:"update_interval,omitempty"`
+}
+
+// RoutingConfig is the manager's routing policy. It is stored in "routing.json" in the data directory
+// and generated into the "route" section of the sing-box config.
+type RoutingConfig struct {
+	// Rules are evaluated in order; the first matching rule decides.
+	Rules []RouteRule `json:"rules"`
+	// RuleSets are the remote rule sets available to rules.
+	RuleSets []RuleSetSource `json:"rule_sets"`
+}
+
+// DefaultRoutingConfig returns the routing policy used for new servers. It keeps invited users
+// away from the server's own network (localhost, LAN, cloud metadata endpoints) and from sending mail.
+// BitTorrent blocking is included but disabled.
+func DefaultRoutingConfig() *RoutingConfig {
+	return &RoutingConfig{
+		Rules: []RouteRule{
+			{
+				ID:          "block-cloud-metadata",
+				Type:        RouteRuleIPCIDR,
+				Values:      []string{"169.254.169.254/32", "fd00:ec2::254/128"},
+				Action:      RouteActionBlock,
+				Enabled:     true,
+				Description: "cloud provider metadata endpoints",
+			},
+			{
+				ID:          "block-private",
+				Type:        RouteRulePrivateIP,
+				Action:      RouteActionBlock,
+				Enabled:     true,
+				Description: "localhost, LAN and link-local addresses",
+			},
+			{
+				ID:          "block-smtp",
+				Type:        RouteRulePort,
+				Values:      []string{"25"},
+				Action:      RouteActionBlock,
+				Enabled:     true,
+				Description: "outgoing mail, to keep the server's IP off spam block lists",
+			},
+			{
+				ID:          "block-bittorrent",
+				Type:        RouteRuleProtocol,
+				Values:      []string{"bittorrent"},
+				Action:      RouteActionBlock,
+				Enabled:     false,
+				Description: "BitTorrent traffic, detected by sniffing",
+			},
+		},
+		RuleSets: []RuleSetSource{},
+	}
+}
+
+// ReadRoutingConfig reads "routing.json" from the data directory.
+// If it doesn't exist, DefaultRoutingConfig is returned.
+func ReadRoutingConfig(dataDir string) (*RoutingConfig, error) {
+	data, err := os.ReadFile(path.Join(dataDir, "routing.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return DefaultRoutingConfig(), nil
+		}
+		return nil, err
+	}
+	var rc RoutingConfig
+	if err = json.Unmarshal(data, &rc); err != nil {
+		return nil, fmt.Errorf("failed to parse routing.json: %w", err)
+	}
+	return &rc, nil
+}
+
+// writeRoutingConfig writes "routing.json" to the data directory.
+func writeRoutingConfig(dataDir string, rc *RoutingConfig) error {
+	data, err := json.MarshalIndent(rc, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(path.Join(dataDir, "routing.json"), data, 0600)
+}
+
+var (
+	ruleIDPattern    = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+	geoValuePattern  = regexp.MustCompile(`^[a-z0-9@!_-]+$`)
+	portRangePattern = regexp.MustCompile(`^\d*:\d*$`)
+)
+
+// newRuleID returns a random id for a rule of the given type.
+func newRuleID(t RouteRuleType) string {
+	b := make([]byte, 4)
+	_, _ = rand.Read(b)
+	return fmt.Sprintf("%s-%s", t, hex.EncodeToString(b))
+}
+
+// Validate checks a rule in the context of the rule sets it may refer to.
+func (r *RouteRule) Validate(ruleSets []RuleSetSource) error {
+	if !ruleIDPattern.MatchString(r.ID) {
+		return fmt.Errorf("invalid rule id %q", r.ID)
+	}
+	switch r.Action {
+	case RouteActionBlock, RouteActionAllow:
+	default:
+		return fmt.Errorf("rule %s: unknown action %q", r.ID, r.Action)
+	}
+	if r.Type == RouteRulePrivateIP {
+		return nil
+	}
+	if len(r.Values) == 0 {
+		return fmt.Errorf("rule %s: at least one value is required", r.ID)
+	}
+	for _, v := range r.Values {
+		var err error
+		switch r.Type {
+		case RouteRuleDomain, RouteRuleDomainSuffix, RouteRuleDomainKeyword, RouteRuleProtocol:
+			if v == "" {
+				err = fmt.Errorf("empty value")
+			}
+		case RouteRuleIPCIDR:
+			_, err = netip.ParsePrefix(v)
+		case RouteRulePort:
+			_, err = strconv.ParseUint(v, 10, 16)
+		case RouteRulePortRange:
+			if !portRangePattern.MatchString(v) || v == ":" {
+				err = fmt.Errorf("expected from:to")
+			}
+		case RouteRuleRuleSet:
+			if !slices.ContainsFunc(ruleSets, func(rs RuleSetSource) bool { return rs.Tag == v }) {
+				err = fmt.Errorf("unknown rule set")
+			}
+		case RouteRuleGeoIP, RouteRuleGeosite:
+			if !geoValuePattern.MatchString(v) {
+				err = fmt.Errorf("invalid code")
+			}
+		default:
+			return fmt.Errorf("rule %s: unknown type %q", r.ID, r.Type)
+		}
+		if err != nil {
+			return fmt.Errorf("rule %s: invalid value %q: %w", r.ID, v, err)
+		}
+	}
+	return nil
+}
+
+// Validate checks all rules and rule sets.
+func (rc *RoutingConfig) Validate() error {
+	tags := make(map[string]bool)
+	for _, rs := range rc.RuleSets {
+		if !ruleIDPattern.MatchString(rs.Tag) {
+			return fmt.Errorf("invalid rule set tag %q", rs.Tag)
+		}
+		if tags[rs.Tag] {
+			return fmt.Errorf("duplicate rule set tag %q", rs.Tag)
+		}
+		tags[rs.Tag] = true
+		if rs.URL == "" {
+			return fmt.Errorf("rule set %s: url is required", rs.Tag)
+		}
+		switch rs.Format {
+		case "", C.RuleSetFormatBinary, C.RuleSetFormatSource:
+		default:
+			return fmt.Errorf("rule set %s: unknown format %q", rs.Tag, rs.Format)
+		}
+		if rs.UpdateInterval != "" {
+			if _, err := time.ParseDuration(rs.UpdateInterval); err != nil {
+				return fmt.Errorf("rule set %s: invalid update interval: %w", rs.Tag, err)
+			}
+		}
+	}
+	ids := make(map[string]bool)
+	for i := range rc.Rules {
+		if err := rc.Rules[i].Validate(rc.RuleSets); err != nil {
+			return err
+		}
+		if ids[rc.Rules[i].ID] {
+			return fmt.Errorf("duplicate rule id %q", rc.Rules[i].ID)
+		}
+		ids[rc.Rules[i].ID] = true
+	}
+	return nil
+}
+
+// UpsertRule adds rule at the end of the rule list, or replaces the rule with the same ID in place.
+// An ID is generated if the rule doesn't have one.
+func (rc *RoutingConfig) UpsertRule(rule RouteRule) RouteRule {
+	if rule.ID == "" {
+		rule.ID = newRuleID(rule.Type)
+	}
+	if i := slices.IndexFunc(rc.Rules, func(r RouteRule) bool { return r.ID == rule.ID }); i >= 0 {
+		rc.Rules[i] = rule
+	} else {
+		rc.Rules = append(rc.Rules, rule)
+	}
+	return rule
+}
+
+// RemoveRule removes the rule with the given ID. It returns false if there is no such rule.
+func (rc *RoutingConfig) RemoveRule(id string) bool {
+	n := len(rc.Rules)
+	rc.Rules = slices.DeleteFunc(rc.Rules, func(r RouteRule) bool { return r.ID == id })
+	return len(rc.Rules) != n
+}
+
+// UpsertRuleSet adds a rule set, or replaces the rule set with the same tag.
+func (rc *RoutingConfig) UpsertRuleSet(rs RuleSetSource) {
+	if i := slices.IndexFunc(rc.RuleSets, func(s RuleSetSource) bool { return s.Tag == rs.Tag }); i >= 0 {
+		rc.RuleSets[i] = rs
+	} else {
+		rc.RuleSets = append(rc.RuleSets, rs)
+	}
+}
+
+// RemoveRuleSet removes the rule set with the given tag. It fails if an enabled or disabled rule still uses it.
+func (rc *RoutingConfig) RemoveRuleSet(tag string) (bool, error) {
+	for _, r := range rc.Rules {
+		if r.Type == RouteRuleRuleSet && slices.Contains(r.Values, tag) {
+			return false, fmt.Errorf("rule set %s is used by rule %s", tag, r.ID)
+		}
+	}
+	n := len(rc.RuleSets)
+	rc.RuleSets = slices.DeleteFunc(rc.RuleSets, func(s RuleSetSource) bool { return s.Tag == tag })
+	return len(rc.RuleSets) != n, nil
+}
+
+// buildRouteRules converts the enabled rules into sing-box rules and the rule sets they need.
+// It also reports whether the rules need the connection to be sniffed first (to match on domains
+// or protocols) or the destination resolved first (to match on IPs, so rules can't be bypassed by
+// using a hostname). "allow" rules send connections to allowOutbound, or connect directly if it's empty.
+func (rc *RoutingConfig) buildRouteRules(allowOutbound string) (rules []option.Rule, ruleSets []option.RuleSet, needSniff, needResolve bool) {
+	addRuleSet := func(tag, url, format, updateInterval string) {
+		if slices.ContainsFunc(ruleSets, func(rs option.RuleSet) bool { return rs.Tag == tag }) {
+			return
+		}
+		rs := option.RuleSet{
+			Type:          C.RuleSetTypeRemote,
+			Tag:           tag,
+			Format:        format,
+			RemoteOptions: option.RemoteRuleSet{URL: url},
+		}
+		if rs.Format == "" {
+			rs.Format = C.RuleSetFormatBinary
+			if path.Ext(url) == ".json" {
+				rs.Format = C.RuleSetFormatSource
+			}
+		}
+		if d, err := time.ParseDuration(updateInterval); err == nil {
+			rs.RemoteOptions.UpdateInterval = badoption.Duration(d)
+		}
+		ruleSets = append(ruleSets, rs)
+	}
+
+	for _, r := range rc.Rules {
+		if !r.Enabled {
+			continue
+		}
+		var raw option.RawDefaultRule
+		switch r.Type {
+		case RouteRuleDomain:
+			raw.Domain = r.Values
+			needSniff = true
+		case RouteRuleDomainSuffix:
+			raw.DomainSuffix = r.Values
+			needSniff = true
+		case RouteRuleDomainKeyword:
+			raw.DomainKeyword = r.Values
+			needSniff = true
+		case RouteRuleIPCIDR:
+			raw.IPCIDR = r.Values
+			needResolve = true
+		case RouteRulePrivateIP:
+			raw.IPIsPrivate = true
+			needResolve = true
+		case RouteRulePort:
+			for _, v := range r.Values {
+				port, _ := strconv.ParseUint(v, 10, 16)
+				raw.Port = append(raw.Port, uint16(port))
+			}
+		case RouteRulePortRange:
+			raw.PortRange = r.Values
+		case RouteRuleProtocol:
+			raw.Protocol = r.Values
+			needSniff = true
+		case RouteRuleRuleSet:
+			raw.RuleSet = r.Values
+			for _, tag := range r.Values {
+				if i := slices.IndexFunc(rc.RuleSets, func(rs RuleSetSource) bool { return rs.Tag == tag }); i >= 0 {
+					addRuleSet(tag, rc.RuleSets[i].URL, rc.RuleSets[i].Format, rc.RuleSets[i].UpdateInterval)
+				}
+			}
+			needSniff, needResolve = true, true
+		case RouteRuleGeoIP:
+			for _, v := range r.Values {
+				tag := "geoip-" + v
+				addRuleSet(tag, fmt.Sprintf(geoIPRuleSetURL, v), C.RuleSetFormatBinary, "")
+				raw.RuleSet = append(raw.RuleSet, tag)
+			}
+			needResolve = true
+		case RouteRuleGeosite:
+			for _, v := range r.Values {
+				tag := "geosite-" + v
+				addRuleSet(tag, fmt.Sprintf(geositeRuleSetURL, v), C.RuleSetFormatBinary, "")
+				raw.RuleSet = append(raw.RuleSet, tag)
+			}
+			needSniff = true
+		default:
+			continue
+		}
+		rules = append(rules, option.Rule{
+			Type: C.RuleTypeDefault,
+			DefaultOptions: option.DefaultRule{
+				RawDefaultRule: raw,
+				RuleAction:     r.Action.build(allowOutbound),
+			},
+		})
+	}
+	return rules, ruleSets, needSniff, needResolve
+}
+
+// build converts a RouteAction into a sing-box rule action. Allowed connections are
+// sent to allowOutbound, or connected directly if it's empty.
+func (a RouteAction) build(allowOutbound string) option.RuleAction {
+	switch {
+	case a == RouteActionAllow && allowOutbound != "":
+		return routeTo(allowOutbound)
+	case a == RouteActionAllow:
+		return option.RuleAction{Action: C.RuleActionTypeDirect}
+	default:
+		return option.RuleAction{Action: C.RuleActionTypeReject}
+	}
+}
+
+// routeTo returns a rule action that sends connections to the outbound with the given tag.
+func routeTo(outbound string) option.RuleAction {
+	return option.RuleAction{
+		Action:       C.RuleActionTypeRoute,
+		RouteOptions: option.RouteActionOptions{Outbound: outbound},
+	}
+}
+
+// actionRule returns a rule that matches every connection and applies action.
+func actionRule(action option.RuleAction) option.Rule {
+	return option.Rule{
+		Type:           C.RuleTypeDefault,
+		DefaultOptions: option.DefaultRule{RuleAction: action},
+	}
+}
+
+// ErrRuleNotFound is returned when a routing rule or rule set to remove doesn't exist.
+var ErrRuleNotFound = errors.New("rule not found")
+
+// UpdateRouting lets mutate change the routing policy and applies the regenerated sing-box config.
+// The policy is only saved if the new config was applied successfully.
+func UpdateRouting(dataDir string, change ConfigChange, mutate func(rc *RoutingConfig) error) error {
+	return updateManagedSections(dataDir, change, func(m *managedSections) error {
+		return mutate(m.routing)
+	})
+}
@@ -0,0 +1,149 @@
+package common
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	C "github.com/sagernet/sing-box/constant"
+	"github.com/sagernet/sing-box/option"
+	"github.com/sagernet/sing/common/json/badoption"
+)
+
+func TestBuildRouteRules(t *testing.T) {
+	reject := option.RuleAction{Action: C.RuleActionTypeReject}
+	direct := option.RuleAction{Action: C.RuleActionTypeDirect}
+	rule := func(raw option.RawDefaultRule, action option.RuleAction) option.Rule {
+		return option.Rule{Type: C.RuleTypeDefault, DefaultOptions: option.DefaultRule{RawDefaultRule: raw, RuleAction: action}}
+	}
+	remote := func(tag, url, format string, interval time.Duration) option.RuleSet {
+		return option.RuleSet{
+			Type:          C.RuleSetTypeRemote,
+			Tag:           tag,
+			Format:        format,
+			RemoteOptions: option.RemoteRuleSet{URL: url, UpdateInterval: badoption.Duration(interval)},
+		}
+	}
+	block := func(typ RouteRuleType, values ...string) RouteRule {
+		return RouteRule{Type: typ, Values: values, Action: RouteActionBlock, Enabled: true}
+	}
+
+	tests := []struct {
+		name          string
+		config        RoutingConfig
+		allowOutbound string
+		wantRules     []option.Rule
+		wantRuleSets  []option.RuleSet
+		wantSniff     bool
+		wantResolve   bool
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name:      "domains need sniffing",
+			config:    RoutingConfig{Rules: []RouteRule{block(RouteRuleDomain, "a.com"), block(RouteRuleDomainSuffix, "b.com"), block(RouteRuleDomainKeyword, "c")}},
+			wantRules: []option.Rule{rule(option.RawDefaultRule{Domain: []string{"a.com"}}, reject), rule(option.RawDefaultRule{DomainSuffix: []string{"b.com"}}, reject), rule(option.RawDefaultRule{DomainKeyword: []string{"c"}}, reject)},
+			wantSniff: true,
+		},
+		{
+			name:      "protocol needs sniffing",
+			config:    RoutingConfig{Rules: []RouteRule{block(RouteRuleProtocol, "bittorrent")}},
+			wantRules: []option.Rule{rule(option.RawDefaultRule{Protocol: []string{"bittorrent"}}, reject)},
+			wantSniff: true,
+		},
+		{
+			name:        "addresses need resolving",
+			config:      RoutingConfig{Rules: []RouteRule{block(RouteRuleIPCIDR, "169.254.169.254/32"), block(RouteRulePrivateIP)}},
+			wantRules:   []option.Rule{rule(option.RawDefaultRule{IPCIDR: []string{"169.254.169.254/32"}}, reject), rule(option.RawDefaultRule{IPIsPrivate: true}, reject)},
+			wantResolve: true,
+		},
+		{
+			name:      "ports",
+			config:    RoutingConfig{Rules: []RouteRule{block(RouteRulePort, "25", "465"), block(RouteRulePortRange, "6881:6889")}},
+			wantRules: []option.Rule{rule(option.RawDefaultRule{Port: []uint16{25, 465}}, reject), rule(option.RawDefaultRule{PortRange: []string{"6881:6889"}}, reject)},
+		},
+		{
+			name: "disabled and unknown rules are skipped",
+			config: RoutingConfig{Rules: []RouteRule{
+				{Type: RouteRuleDomain, Values: []string{"a.com"}, Action: RouteActionBlock},
+				block("unknown", "x"),
+				block(RouteRulePort, "25"),
+			}},
+			wantRules: []option.Rule{rule(option.RawDefaultRule{Port: []uint16{25}}, reject)},
+		},
+		{
+			name:      "allow connects directly",
+			config:    RoutingConfig{Rules: []RouteRule{{Type: RouteRulePort, Values: []string{"443"}, Action: RouteActionAllow, Enabled: true}}},
+			wantRules: []option.Rule{rule(option.RawDefaultRule{Port: []uint16{443}}, direct)},
+		},
+		{
+			name:          "allow routes to the egress outbound",
+			config:        RoutingConfig{Rules: []RouteRule{{Type: RouteRulePort, Values: []string{"443"}, Action: RouteActionAllow, Enabled: true}}},
+			allowOutbound: "egress",
+			wantRules:     []option.Rule{rule(option.RawDefaultRule{Port: []uint16{443}}, routeTo("egress"))},
+		},
+		{
+			name:      "geoip",
+			config:    RoutingConfig{Rules: []RouteRule{block(RouteRuleGeoIP, "cn", "ir"), block(RouteRuleGeoIP, "cn")}},
+			wantRules: []option.Rule{rule(option.RawDefaultRule{RuleSet: []string{"geoip-cn", "geoip-ir"}}, reject), rule(option.RawDefaultRule{RuleSet: []string{"geoip-cn"}}, reject)},
+			wantRuleSets: []option.RuleSet{
+				remote("geoip-cn", "https://raw.githubusercontent.com/SagerNet/sing-geoip/rule-set/geoip-cn.srs", C.RuleSetFormatBinary, 0),
+				remote("geoip-ir", "https://raw.githubusercontent.com/SagerNet/sing-geoip/rule-set/geoip-ir.srs", C.RuleSetFormatBinary, 0),
+			},
+			wantResolve: true,
+		},
+		{
+			name:      "geosite",
+			config:    RoutingConfig{Rules: []RouteRule{block(RouteRuleGeosite, "category-ads")}},
+			wantRules: []option.Rule{rule(option.RawDefaultRule{RuleSet: []string{"geosite-category-ads"}}, reject)},
+			wantRuleSets: []option.RuleSet{
+				remote("geosite-category-ads", "https://raw.githubusercontent.com/SagerNet/sing-geosite/rule-set/geosite-category-ads.srs", C.RuleSetFormatBinary, 0),
+			},
+			wantSniff: true,
+		},
+		{
+			name: "rule sets",
+			config: RoutingConfig{
+				Rules: []RouteRule{block(RouteRuleRuleSet, "srs", "json", "missing")},
+				RuleSets: []RuleSetSource{
+					{Tag: "unused", URL: "https://example.com/unused.srs"},
+					{Tag: "srs", URL: "https://example.com/list.srs", UpdateInterval: "24h"},
+					{Tag: "json", URL: "https://example.com/list.json", UpdateInterval: "invalid"},
+				},
+			},
+			wantRules: []option.Rule{rule(option.RawDefaultRule{RuleSet: []string{"srs", "json", "missing"}}, reject)},
+			wantRuleSets: []option.RuleSet{
+				remote("srs", "https://example.com/list.srs", C.RuleSetFormatBinary, 24*time.Hour),
+				remote("json", "https://example.com/list.json", C.RuleSetFormatSource, 0),
+			},
+			wantSniff:   true,
+			wantResolve: true,
+		},
+		{
+			name: "explicit rule set format",
+			config: RoutingConfig{
+				Rules:    []RouteRule{block(RouteRuleRuleSet, "list")},
+				RuleSets: []RuleSetSource{{Tag: "list", URL: "https://example.com/list", Format: C.RuleSetFormatSource}},
+			},
+			wantRules:    []option.Rule{rule(option.RawDefaultRule{RuleSet: []string{"list"}}, reject)},
+			wantRuleSets: []option.RuleSet{remote("list", "https://example.com/list", C.RuleSetFormatSource, 0)},
+			wantSniff:    true,
+			wantResolve:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, ruleSets, needSniff, needResolve := tt.config.buildRouteRules(tt.allowOutbound)
+			if !reflect.DeepEqual(rules, tt.wantRules) {
+				t.Errorf("buildRouteRules() rules = %+v, want %+v", rules, tt.wantRules)
+			}
+			if !reflect.DeepEqual(ruleSets, tt.wantRuleSets) {
+				t.Errorf("buildRouteRules() rule sets = %+v, want %+v", ruleSets, tt.wantRuleSets)
+			}
+			if needSniff != tt.wantSniff || needResolve != tt.wantResolve {
+				t.Errorf("buildRouteRules() sniff, resolve = %v, %v, want %v, %v", needSniff, needResolve, tt.wantSniff, tt.wantResolve)
+			}
+		})
+	}
+}
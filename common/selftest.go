@@ -0,0 +1,77 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/sagernet/sing-box/option"
+)
+
+// SelfTestOptions configures SelfTest.
+type SelfTestOptions struct {
+	// PublicIP is the address the inbounds are connected to.
+	PublicIP string
+	// URL is fetched through each inbound.
+	URL string
+	// Insecure skips verifying the TLS certificate of URL, e.g. for the manager's own echo endpoint.
+	Insecure bool
+}
+
+// SelfTestResult is the result of the self-test of one inbound.
+type SelfTestResult struct {
+	Tag string `json:"tag"`
+	// Index is the position of the inbound in the config.
+	Index int    `json:"index"`
+	Type  string `json:"type"`
+	Port  uint16 `json:"port"`
+	// OK is true if the URL could be fetched through the inbound.
+	OK bool `json:"ok"`
+	// LatencyMS is the time until the response headers were received, in milliseconds.
+	LatencyMS int64 `json:"latency_ms"`
+	// Bytes is the size of the response body.
+	Bytes int64 `json:"bytes"`
+	// ThroughputKbps is the rate the response body was downloaded at, in kilobits per second.
+	ThroughputKbps float64 `json:"throughput_kbps"`
+	// Error describes why the test failed.
+	Error string `json:"error,omitempty"`
+}
+
+// SelfTest fetches the URL through each inbound listening on a public address as ProbeUser, like an
+// app connecting to opts.PublicIP would. ProbeUser is added with EnsureProbeUser if an inbound lacks it,
+// so sing-box is only restarted if it was missing.
+func SelfTest(ctx context.Context, dataDir string, opts SelfTestOptions) ([]SelfTestResult, error) {
+	if err := EnsureProbeUser(dataDir); err != nil {
+		return nil, fmt.Errorf("failed to add probe user: %w", err)
+	}
+	opt, err := ReadSingBoxServerConfig(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]SelfTestResult, 0)
+	for _, l := range InboundListeners(opt) {
+		if l.Endpoint || !rotatableListener(l) {
+			continue
+		}
+		result := SelfTestResult{Tag: l.Tag, Index: l.Index, Type: l.Type, Port: l.Port}
+		outbound, err := clientOutbound(opt.Inbounds[l.Index], opts.PublicIP, ProbeUser)
+		if err == nil {
+			var stats fetchStats
+			stats, err = fetchThrough(ctx, option.Options{Outbounds: []option.Outbound{outbound}}, opts.URL, opts.Insecure)
+			result.LatencyMS = stats.latency.Milliseconds()
+			result.Bytes = stats.bytes
+			if stats.transfer > 0 {
+				result.ThroughputKbps = float64(stats.bytes) * 8 / 1000 / stats.transfer.Seconds()
+			}
+		}
+		result.OK = err == nil
+		if err != nil {
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+	if len(results) == 0 {
+		return nil, errors.New("no inbounds to test")
+	}
+	return results, nil
+}
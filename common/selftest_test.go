@@ -0,0 +1,176 @@
+package common
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/sagernet/sing-box/option"
+	"github.com/sagernet/sing/common/json/badjson"
+)
+
+// fakeClientEnv is set for the test binary when it runs as the fake lantern-box client of TestFakeSingBoxClient.
+const fakeClientEnv = "LSM_FAKE_CLIENT_CONFIG"
+
+// useFakeSingBoxClient puts a lantern-box first in PATH whose "run" runs this test binary as
+// TestFakeSingBoxClient, a socks proxy that connects directly instead of through the outbounds of the config.
+// Everything else fails, so it can't be used to apply a server config.
+func useFakeSingBoxClient(t *testing.T) {
+	t.Helper()
+	testBinary, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	script := "#!/bin/sh\n[ \"$1\" = run ] || exit 1\n" + fakeClientEnv + "=\"$3\" exec '" + testBinary + "' -test.run='^TestFakeSingBoxClient$'\n"
+	bin := t.TempDir()
+	if err = os.WriteFile(path.Join(bin, SingBoxExe), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+// TestFakeSingBoxClient isn't a test, but the fake lantern-box client of useFakeSingBoxClient. It serves socks
+// CONNECT requests without authentication on the port of the socks inbound of the config until it is killed.
+func TestFakeSingBoxClient(t *testing.T) {
+	configPath := os.Getenv(fakeClientEnv)
+	if configPath == "" {
+		t.Skip("only run as a fake lantern-box client")
+	}
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var config struct {
+		Inbounds []struct {
+			ListenPort int `json:"listen_port"`
+		} `json:"inbounds"`
+	}
+	if err = json.Unmarshal(data, &config); err != nil || len(config.Inbounds) == 0 {
+		t.Fatalf("invalid client config: %v", err)
+	}
+	ln, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(config.Inbounds[0].ListenPort)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		go serveSocks(conn)
+	}
+}
+
+// serveSocks handles a socks5 CONNECT request without authentication on conn.
+func serveSocks(conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+	// version, number of methods and the methods, which must include "no authentication"
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return
+	}
+	if _, err := io.ReadFull(conn, make([]byte, header[1])); err != nil {
+		return
+	}
+	if _, err := conn.Write([]byte{5, 0}); err != nil {
+		return
+	}
+	// version, command, reserved and address type, followed by the address and port
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return
+	}
+	var host string
+	switch request[3] {
+	case 1, 4:
+		ip := make([]byte, map[byte]int{1: 4, 4: 16}[request[3]])
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return
+		}
+		host = net.IP(ip).String()
+	case 3:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return
+		}
+		name := make([]byte, length[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return
+		}
+		host = string(name)
+	default:
+		return
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return
+	}
+	target, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))))
+	if err != nil {
+		_, _ = conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer func() { _ = target.Close() }()
+	if _, err = conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0}); err != nil {
+		return
+	}
+	go func() { _, _ = io.Copy(target, conn) }()
+	_, _ = io.Copy(conn, target)
+}
+
+func TestSelfTest(t *testing.T) {
+	useFakeSingBoxClient(t)
+	const size = 100000
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ok" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte(strings.Repeat("x", size)))
+	}))
+	defer server.Close()
+
+	dataDir := t.TempDir()
+	// the probe user is there already, so the config isn't applied
+	data, err := badjson.MarshallObjects(option.Options{Inbounds: []option.Inbound{
+		withUsers(testShadowsocks("ss", "0.0.0.0", 8388, ""), "alice", ProbeUser),
+		withUsers(testShadowsocks("local", "127.0.0.1", 1080, ""), ProbeUser),
+		testHysteria2("hy2", 443),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(path.Join(dataDir, "sing-box-config.json"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := SelfTest(t.Context(), dataDir, SelfTestOptions{PublicIP: "127.0.0.1", URL: server.URL + "/ok"})
+	if err != nil {
+		t.Fatalf("SelfTest() error = %v", err)
+	}
+	if len(results) != 2 || results[0].Tag != "ss" || results[1].Tag != "hy2" {
+		t.Fatalf("results = %+v, want ss and hy2 but not the loopback inbound", results)
+	}
+	if ss := results[0]; !ss.OK || ss.Bytes != size || ss.ThroughputKbps <= 0 || ss.Port != 8388 {
+		t.Errorf("ss result = %+v, want %d bytes downloaded", ss, size)
+	}
+	if hy2 := results[1]; hy2.OK || hy2.Error == "" || hy2.Index != 2 {
+		t.Errorf("hy2 result = %+v, want an error as it can't be tested", hy2)
+	}
+
+	results, err = SelfTest(t.Context(), dataDir, SelfTestOptions{PublicIP: "127.0.0.1", URL: server.URL + "/missing"})
+	if err != nil {
+		t.Fatalf("SelfTest() error = %v", err)
+	}
+	if ss := results[0]; ss.OK || !strings.Contains(ss.Error, "404") {
+		t.Errorf("ss result for a missing URL = %+v, want it to fail with 404", ss)
+	}
+}
@@ -1,6 +1,7 @@
 package common
 
 import (
+	"context"
 	"encoding/base64"
 	"fmt"
 	"math/rand/v2"
@@ -8,6 +9,10 @@ import (
 	"os"
 	"os/exec"
 	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/charmbracelet/log"
 	box "github.com/getlantern/lantern-box"
@@ -17,52 +22,42 @@ import (
 	"github.com/sagernet/sing/common/json/badjson"
 	"github.com/sagernet/sing/common/json/badoption"
 	"github.com/sethvargo/go-password/password"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // ReadSingBoxServerConfig reads and parses the sing-box server configuration
 // from "sing-box-config.json" located in the specified data directory.
 // It uses sing-box's internal JSON parsing capabilities.
 func ReadSingBoxServerConfig(dataDir string) (*option.Options, error) {
-	data, err := os.ReadFile(path.Join(dataDir, "sing-box-config.json"))
+	data, err := ReadSingBoxServerConfigRaw(dataDir)
 	if err != nil {
 		return nil, err
 	}
-	globalCtx := box.BaseContext()
-
-	opt, err := singJson.UnmarshalExtendedContext[option.Options](globalCtx, data)
-	if err != nil {
-		return nil, err
-	}
-	return &opt, nil
+	return ParseSingBoxConfig(data)
 }
 
 // RevokeUser removes a user from the sing-box Shadowsocks inbound configuration.
 // It reads the current config, finds the user by name in the first inbound's user list,
-// removes them, writes the updated config back, and restarts the sing-box service.
-func RevokeUser(dataDir, username string) error {
-	singBoxServerConfig, err := ReadSingBoxServerConfig(dataDir)
-	if err != nil {
-		return err
-	}
-	if len(singBoxServerConfig.Inbounds) == 0 {
-		return fmt.Errorf("no inbounds found, invalid config")
-	}
-	inboundOptions, ok := singBoxServerConfig.Inbounds[0].Options.(*option.ShadowsocksInboundOptions)
-	if !ok {
-		return fmt.Errorf("inbound is not shadowsocks")
-	}
-	for i, u := range inboundOptions.Users {
-		if u.Name == username {
-			inboundOptions.Users = append(inboundOptions.Users[:i], inboundOptions.Users[i+1:]...)
-			break
+// removes them, and applies the updated config with UpdateSingBoxConfig.
+// The change is recorded in the config history and the audit log as made by actor.
+func RevokeUser(ctx context.Context, dataDir, actor, username string) error {
+	change := ConfigChange{Actor: actor, Reason: fmt.Sprintf("revoke user %s", username), Context: ctx}
+	err := UpdateSingBoxConfig(dataDir, change, func(singBoxServerConfig *option.Options) error {
+		inboundOptions, err := GetShadowsocksInboundConfig(singBoxServerConfig)
+		if err != nil {
+			return err
 		}
-	}
-	if err = WriteSingBoxServerConfig(dataDir, singBoxServerConfig); err != nil {
-		return err
-	}
-
-	// restart singbox
-	return RestartSingBox(dataDir)
+		for i, u := range inboundOptions.Users {
+			if u.Name == username {
+				inboundOptions.Users = append(inboundOptions.Users[:i], inboundOptions.Users[i+1:]...)
+				break
+			}
+		}
+		return nil
+	})
+	Audit(ctx, dataDir, actor, AuditUserRevoked, username, "", err)
+	return err
 }
 
 // GetShadowsocksInboundConfig extracts the Shadowsocks inbound options from a given
@@ -83,8 +78,8 @@ func GetShadowsocksInboundConfig(singBoxServerConfig *option.Options) (*option.S
 // It reads the server's sing-box config, finds or creates the user's Shadowsocks credentials,
 // constructs a client config pointing to the server's public IP and Shadowsocks port,
 // and returns the marshalled JSON configuration. If the user doesn't exist, they are added
-// to the server config, and sing-box is restarted.
-func GenerateSingBoxConnectConfig(dataDir, publicIP, username string) ([]byte, error) {
+// to the server config, which is applied with UpdateSingBoxConfig.
+func GenerateSingBoxConnectConfig(ctx context.Context, dataDir, publicIP, username string) ([]byte, error) {
 	singBoxServerConfig, err := ReadSingBoxServerConfig(dataDir)
 	if err != nil {
 		return nil, err
@@ -105,17 +100,32 @@ func GenerateSingBoxConnectConfig(dataDir, publicIP, username string) ([]byte, e
 		}
 	}
 	if pw == "" {
-		pw = makeShadowsocksPassword()
-		inboundOptions.Users = append(inboundOptions.Users, option.ShadowsocksUser{
-			Name:     username,
-			Password: pw,
+		// user not found. add the user, unless a concurrent request already did
+		change := ConfigChange{Actor: username, Reason: fmt.Sprintf("add user %s", username), Context: ctx}
+		created := false
+		err = UpdateSingBoxConfig(dataDir, change, func(singBoxServerConfig *option.Options) error {
+			inboundOptions, err := GetShadowsocksInboundConfig(singBoxServerConfig)
+			if err != nil {
+				return err
+			}
+			for _, u := range inboundOptions.Users {
+				if u.Name == username {
+					pw = u.Password
+					return nil
+				}
+			}
+			pw = makeShadowsocksPassword()
+			inboundOptions.Users = append(inboundOptions.Users, option.ShadowsocksUser{
+				Name:     username,
+				Password: pw,
+			})
+			created = true
+			return nil
 		})
-		// user now found. add the user
-		if err = WriteSingBoxServerConfig(dataDir, singBoxServerConfig); err != nil {
-			return nil, err
+		if created || err != nil {
+			Audit(ctx, dataDir, username, AuditUserCreated, username, "", err)
 		}
-		// restart singbox
-		if err = RestartSingBox(dataDir); err != nil {
+		if err != nil {
 			return nil, err
 		}
 	}
@@ -137,39 +147,73 @@ func GenerateSingBoxConnectConfig(dataDir, publicIP, username string) ([]byte, e
 				},
 			},
 		},
-		Outbounds: []option.Outbound{
-			{
-				Type: "shadowsocks",
-				Tag:  "ss-outbound",
-				Options: &option.ShadowsocksOutboundOptions{
-					DialerOptions: option.DialerOptions{},
-					ServerOptions: option.ServerOptions{
-						Server:     publicIP,
-						ServerPort: inboundOptions.ListenPort,
-					},
-					Method:   "chacha20-ietf-poly1305",
-					Password: pw,
-				},
+		Outbounds: []option.Outbound{shadowsocksClientOutbound(publicIP, inboundOptions.ListenPort, pw)},
+	}
+	return badjson.MarshallObjects(opt)
+}
+
+// shadowsocksClientOutbound returns the outbound clients use to connect to the Shadowsocks inbound
+// at server and port with password.
+func shadowsocksClientOutbound(server string, port uint16, password string) option.Outbound {
+	return option.Outbound{
+		Type: "shadowsocks",
+		Tag:  "ss-outbound",
+		Options: &option.ShadowsocksOutboundOptions{
+			DialerOptions: option.DialerOptions{},
+			ServerOptions: option.ServerOptions{
+				Server:     server,
+				ServerPort: port,
 			},
+			Method:   "chacha20-ietf-poly1305",
+			Password: password,
 		},
 	}
-	return badjson.MarshallObjects(opt)
 }
 
 // WriteSingBoxServerConfig marshals the provided sing-box options into JSON
 // and writes it to "sing-box-config.json" in the specified data directory.
-func WriteSingBoxServerConfig(dataDir string, opt *option.Options) error {
+// The new contents are recorded in the config history together with change.
+// The users whose traffic is counted are updated to the users of the inbounds first.
+func WriteSingBoxServerConfig(dataDir string, opt *option.Options, change ConfigChange) error {
+	countUserTraffic(opt)
 	data, err := badjson.MarshallObjects(opt)
 	if err != nil {
 		return err
 	}
-	if err = os.WriteFile(path.Join(dataDir, "sing-box-config.json"), data, 0644); err != nil {
+	if err = writeSingBoxConfigFile(dataDir, data); err != nil {
+		return err
+	}
+	if err = RecordConfigVersion(dataDir, ConfigKindSingBox, data, change); err != nil {
+		log.Errorf("failed to record sing-box config history: %v", err)
+	}
+	return nil
+}
+
+// ReadSingBoxServerConfigRaw returns the sing-box server configuration file as-is.
+func ReadSingBoxServerConfigRaw(dataDir string) ([]byte, error) {
+	return os.ReadFile(path.Join(dataDir, "sing-box-config.json"))
+}
+
+// ParseSingBoxConfig parses a sing-box configuration using lantern-box's registry
+// of inbound, outbound and endpoint types.
+func ParseSingBoxConfig(data []byte) (*option.Options, error) {
+	opt, err := singJson.UnmarshalExtendedContext[option.Options](box.BaseContext(), data)
+	if err != nil {
+		return nil, err
+	}
+	return &opt, nil
+}
+
+// writeSingBoxConfigFile writes already marshalled sing-box options to the data directory
+// and, in systemd mode, to the location the sing-box service reads it from.
+func writeSingBoxConfigFile(dataDir string, data []byte) error {
+	if err := os.WriteFile(path.Join(dataDir, "sing-box-config.json"), data, 0644); err != nil {
 		return err
 	}
 	if !noSystemd {
 		// in systemd mode, sing-box-extensions expects the config to be in /etc/sing-box-extensions/config.json
 		// make sure that the path exists and copy the config
-		if err = os.MkdirAll("/etc/sing-box-extensions", 0755); err != nil {
+		if err := os.MkdirAll("/etc/sing-box-extensions", 0755); err != nil {
 			return err
 		}
 		return os.WriteFile("/etc/sing-box-extensions/config.json", data, 0644)
@@ -220,8 +264,17 @@ func GenerateBasicSingBoxServerConfig(dataDir string, listenPort int) (*option.O
 			},
 		},
 	}
+	// add routing rules and other sections generated from the manager's settings
+	managed, err := loadManagedSections(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	if err = managed.save(dataDir); err != nil {
+		return nil, err
+	}
+	managed.apply(&opt)
 	log.Infof("Writing intial vpn config to sing-box-config.json")
-	return &opt, WriteSingBoxServerConfig(dataDir, &opt)
+	return &opt, WriteSingBoxServerConfig(dataDir, &opt, SystemChange("initial config"))
 }
 
 // CheckSingBoxInstalled checks if the 'sing-box' executable is available in the system's PATH.
@@ -233,37 +286,151 @@ func CheckSingBoxInstalled() bool {
 // ValidateSingBoxConfig uses the 'sing-box check' command to validate the syntax
 // of the configuration file located at "sing-box-config.json" in the data directory.
 func ValidateSingBoxConfig(dataDir string) error {
+	return validateSingBoxConfigFile(path.Join(dataDir, "sing-box-config.json"))
+}
+
+// validateSingBoxConfigFile runs 'sing-box check' on the given file.
+// The output of the check is included in the returned error.
+func validateSingBoxConfigFile(configPath string) error {
 	singBoxPath, err := exec.LookPath(SingBoxExe)
 	if err != nil {
 		return fmt.Errorf("'%s' not found in PATH: %w", SingBoxExe, err)
 	}
 	// check for non-zero exit code
-	if err = exec.Command(singBoxPath, "check", "--config", path.Join(dataDir, "sing-box-config.json")).Run(); err != nil {
+	if out, err := exec.Command(singBoxPath, "check", "--config", configPath).CombinedOutput(); err != nil {
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			return fmt.Errorf("failed to validate sing-box config: %s", msg)
+		}
 		return fmt.Errorf("failed to validate sing-box config: %w", err)
 	}
 	return nil
 }
 
-// noSystemd controls whether systemd is used for service management.
-// If the environment variable NO_SYSTEMD is set to any non-empty value,
-// sing-box will be managed directly using pkill and running the command.
-// Otherwise, it assumes systemd is available and uses `systemctl restart sing-box`.
-var noSystemd = os.Getenv("NO_SYSTEMD") != ""
+// SupervisorMode selects how the sing-box process is managed.
+type SupervisorMode string
+
+const (
+	// SupervisorModeSystemd assumes systemd is available and uses `systemctl restart sing-box`.
+	SupervisorModeSystemd SupervisorMode = "systemd"
+	// SupervisorModeProcess runs sing-box as a child process of the manager under singBoxSupervisor.
+	SupervisorModeProcess SupervisorMode = "process"
+)
+
+// noSystemd is true if sing-box is run under singBoxSupervisor rather than systemd.
+// It is set with SetSupervisorMode.
+var noSystemd bool
+
+// SetSupervisorMode selects how the sing-box process is managed.
+func SetSupervisorMode(mode SupervisorMode) error {
+	switch mode {
+	case SupervisorModeSystemd, SupervisorModeProcess:
+		noSystemd = mode == SupervisorModeProcess
+		return nil
+	default:
+		return fmt.Errorf("unknown supervisor mode %q", mode)
+	}
+}
 
 const SingBoxExe = "lantern-box"
 
+// singBoxSupervisor owns the sing-box child process in process mode.
+var singBoxSupervisor = NewSupervisor(SingBoxExe)
+
+var (
+	singBoxRestarts = NewCounter("lsm_singbox_restarts_total",
+		"Restarts of sing-box by the manager, e.g. to apply a config change.")
+	singBoxRestartFailures = NewCounter("lsm_singbox_restart_failures_total",
+		"Restarts of sing-box by the manager that failed.")
+	singBoxRestartDuration = NewHistogram("lsm_singbox_restart_duration_seconds",
+		"How long restarts of sing-box by the manager took.", DefaultLatencyBuckets)
+)
+
 // RestartSingBox restarts the sing-box service.
 // It either uses `systemctl restart sing-box` or, if noSystemd is true,
-// kills any existing sing-box process and starts a new one directly using the
+// gracefully stops the supervised sing-box process and starts a new one using the
 // configuration file in the data directory.
-func RestartSingBox(dataDir string) error {
+func RestartSingBox(ctx context.Context, dataDir string) error {
+	_, span := Tracer.Start(ctx, "sing-box restart", trace.WithAttributes(attribute.Bool("process_mode", noSystemd)))
+	start := time.Now()
+	singBoxRestarts.Inc()
+	err := restartSingBox(dataDir)
+	singBoxRestartDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		singBoxRestartFailures.Inc()
+	}
+	EndSpan(span, err)
+	return err
+}
+
+// restartSingBox restarts sing-box with systemctl or the supervisor.
+func restartSingBox(dataDir string) error {
 	if noSystemd {
-		singBoxPath, _ := exec.LookPath(SingBoxExe)
-		// kill process
-		_ = exec.Command("pkill", "-9", SingBoxExe).Run()
-		// start process
-		return exec.Command(singBoxPath, "run", "--config", path.Join(dataDir, "sing-box-config.json")).Start()
+		singBoxPath, err := exec.LookPath(SingBoxExe)
+		if err != nil {
+			return fmt.Errorf("'%s' not found in PATH: %w", SingBoxExe, err)
+		}
+		return singBoxSupervisor.Restart(singBoxPath, "run", "--config", path.Join(dataDir, "sing-box-config.json"))
 	}
 
+	defer invalidateSingBoxStatus()
 	return exec.Command("systemctl", "restart", SingBoxExe).Run()
 }
+
+// StopSingBox gracefully stops the supervised sing-box process.
+// In systemd mode sing-box is a separate service that outlives the manager, so this does nothing.
+func StopSingBox() {
+	if noSystemd {
+		singBoxSupervisor.Stop()
+	}
+}
+
+// singBoxStatusTTL is how long the status queried from systemctl is reused, so that frequent
+// health checks and metric scrapes don't run systemctl each time.
+const singBoxStatusTTL = 5 * time.Second
+
+// singBoxStatusCache holds the last status queried from systemctl.
+var singBoxStatusCache struct {
+	sync.Mutex
+	status    SupervisorStatus
+	queriedAt time.Time
+}
+
+// invalidateSingBoxStatus makes the next SingBoxStatus query systemctl again.
+func invalidateSingBoxStatus() {
+	singBoxStatusCache.Lock()
+	defer singBoxStatusCache.Unlock()
+	singBoxStatusCache.queriedAt = time.Time{}
+}
+
+// SingBoxStatus reports the state of the sing-box process.
+// In systemd mode the state and PID are queried from systemctl at most every singBoxStatusTTL.
+func SingBoxStatus() SupervisorStatus {
+	if noSystemd {
+		return singBoxSupervisor.Status()
+	}
+	singBoxStatusCache.Lock()
+	defer singBoxStatusCache.Unlock()
+	if time.Since(singBoxStatusCache.queriedAt) < singBoxStatusTTL {
+		return singBoxStatusCache.status
+	}
+	st := SupervisorStatus{Mode: string(SupervisorModeSystemd), State: SupervisorStopped}
+	out, err := exec.Command("systemctl", "show", "--property", "ActiveState,MainPID,NRestarts", SingBoxExe).Output()
+	if err == nil {
+		for _, line := range strings.Split(string(out), "\n") {
+			key, value, _ := strings.Cut(strings.TrimSpace(line), "=")
+			switch key {
+			case "ActiveState":
+				if value == "active" {
+					st.State = SupervisorRunning
+				}
+			case "MainPID":
+				st.PID, _ = strconv.Atoi(value)
+			case "NRestarts":
+				st.Restarts, _ = strconv.Atoi(value)
+			}
+		}
+	}
+	singBoxStatusCache.status = st
+	singBoxStatusCache.queriedAt = time.Now()
+	return st
+}
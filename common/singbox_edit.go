@@ -0,0 +1,188 @@
+package common
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"strings"
+
+	C "github.com/sagernet/sing-box/constant"
+	"github.com/sagernet/sing-box/option"
+	singJson "github.com/sagernet/sing/common/json"
+)
+
+// ValidationError describes a single problem found in a sing-box config submitted through the API.
+type ValidationError struct {
+	// Field is the JSON path of the offending value, e.g. "inbounds[0].listen_port".
+	// It is empty if the problem is not tied to a single field.
+	Field string `json:"field,omitempty"`
+	// Message describes the problem.
+	Message string `json:"message"`
+}
+
+func (e ValidationError) Error() string {
+	if e.Field == "" {
+		return e.Message
+	}
+	return fmt.Sprintf("%s: %s", e.Field, e.Message)
+}
+
+// CheckSingBoxConfig checks the parts of a sing-box config the manager depends on:
+// the first inbound has to be the Shadowsocks inbound users are added to, and no two
+// inbounds or endpoints may listen on the same port (or on one of reservedPorts, e.g. the API port).
+// It returns all problems found, or nil if there are none.
+func CheckSingBoxConfig(opt *option.Options, reservedPorts ...int) []ValidationError {
+	var errs []ValidationError
+	if len(opt.Inbounds) == 0 {
+		return append(errs, ValidationError{Field: "inbounds", Message: "at least one inbound is required"})
+	}
+	if opt.Inbounds[0].Type != C.TypeShadowsocks {
+		errs = append(errs, ValidationError{Field: "inbounds[0].type", Message: "the first inbound must be shadowsocks, users are managed there"})
+	} else if ss, ok := opt.Inbounds[0].Options.(*option.ShadowsocksInboundOptions); ok && ss.Method == "" {
+		errs = append(errs, ValidationError{Field: "inbounds[0].method", Message: "method is required"})
+	}
+
+	type portKey struct {
+		network string
+		port    uint16
+	}
+	used := make(map[portKey]string)
+	for _, l := range InboundListeners(opt) {
+		field := l.Field()
+		if slices.Contains(reservedPorts, int(l.Port)) {
+			errs = append(errs, ValidationError{Field: field, Message: fmt.Sprintf("port %d is reserved for the manager", l.Port)})
+		}
+		for _, network := range l.Networks {
+			key := portKey{network, l.Port}
+			if other, ok := used[key]; ok {
+				errs = append(errs, ValidationError{Field: field, Message: fmt.Sprintf("%s port %d is already used by %q", network, l.Port, other)})
+				continue
+			}
+			used[key] = l.Name()
+		}
+	}
+	return errs
+}
+
+// CheckManagedSections compares the sections of candidate that are owned by the manager with those of current
+// and returns an error naming each one that was changed, as they can only be changed through their own APIs:
+// the users of the Shadowsocks inbounds, the route, dns and outbounds sections, the upstream WireGuard
+// endpoints and the Clash API section the manager reads traffic statistics from.
+// Users of each Shadowsocks inbound are compared with those of the current inbound with the same tag,
+// or, for the first inbound, of the current first inbound.
+func CheckManagedSections(current, candidate *option.Options) []ValidationError {
+	var errs []ValidationError
+	if !sameJSON(current.Route, candidate.Route) {
+		errs = append(errs, managedSectionError("route", "the routing API, /api/v1/routing"))
+	}
+	if !sameJSON(current.DNS, candidate.DNS) {
+		errs = append(errs, managedSectionError("dns", "the DNS API, /api/v1/dns"))
+	}
+	errs = append(errs, checkEgressSections(current, candidate)...)
+	errs = append(errs, checkTrafficStats(current, candidate)...)
+	return append(errs, checkUsers(current, candidate)...)
+}
+
+// managedSectionError returns the error for a change of the managed section at field, which can only be changed through api.
+func managedSectionError(field, api string) ValidationError {
+	return ValidationError{Field: field, Message: "is managed by the server and can only be changed through " + api}
+}
+
+// sameJSON reports whether a and b marshal to the same JSON.
+func sameJSON(a, b any) bool {
+	dataA, errA := singJson.Marshal(a)
+	dataB, errB := singJson.Marshal(b)
+	return errA == nil && errB == nil && bytes.Equal(dataA, dataB)
+}
+
+// checkUsers returns an error for each Shadowsocks inbound of candidate whose users differ from those
+// of the current inbound with the same tag or, for the first inbound, of the current first inbound.
+func checkUsers(current, candidate *option.Options) []ValidationError {
+	var errs []ValidationError
+	for i, inbound := range candidate.Inbounds {
+		ss, ok := inbound.Options.(*option.ShadowsocksInboundOptions)
+		if !ok {
+			continue
+		}
+		idx := currentInboundIndex(current, i, inbound)
+		if idx < 0 {
+			continue
+		}
+		if currentSS, ok := current.Inbounds[idx].Options.(*option.ShadowsocksInboundOptions); ok && !sameJSON(currentSS.Users, ss.Users) {
+			errs = append(errs, managedSectionError(fmt.Sprintf("inbounds[%d].users", i), "share links, /api/v1/share-link/{name}, and /api/v1/revoke/{name}"))
+		}
+	}
+	return errs
+}
+
+// preserveUsers replaces the users of each Shadowsocks inbound in candidate with those of the current
+// inbound with the same tag or, for the first inbound, of the current first inbound.
+func preserveUsers(current, candidate *option.Options) {
+	for i, inbound := range candidate.Inbounds {
+		ss, ok := inbound.Options.(*option.ShadowsocksInboundOptions)
+		if !ok {
+			continue
+		}
+		idx := currentInboundIndex(current, i, inbound)
+		if idx < 0 {
+			continue
+		}
+		if currentSS, ok := current.Inbounds[idx].Options.(*option.ShadowsocksInboundOptions); ok {
+			ss.Users = currentSS.Users
+		}
+	}
+}
+
+// currentInboundIndex returns the index of the inbound in current that corresponds to inbound, which is
+// at index i of another config: the one with the same tag or, for the first inbound, the current first
+// inbound. It returns -1 if there is none.
+func currentInboundIndex(current *option.Options, i int, inbound option.Inbound) int {
+	idx := slices.IndexFunc(current.Inbounds, func(in option.Inbound) bool { return in.Tag == inbound.Tag })
+	if idx < 0 && i == 0 && len(current.Inbounds) > 0 {
+		idx = 0
+	}
+	return idx
+}
+
+// ValidationErrors is returned by EditSingBoxConfig when a submitted config is rejected.
+type ValidationErrors []ValidationError
+
+func (e ValidationErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return "invalid sing-box config: " + strings.Join(msgs, "; ")
+}
+
+// EditSingBoxConfig replaces the sing-box config with data, or, if patch is true, applies data to it
+// as a JSON merge patch. The result is parsed with the embedded sing-box parser, checked with
+// CheckManagedSections and CheckSingBoxConfig, and applied with ApplySingBoxConfig.
+// Problems with the submitted config, including changes of the manager-owned sections, are returned as ValidationErrors.
+func EditSingBoxConfig(dataDir string, data []byte, patch bool, change ConfigChange, reservedPorts ...int) error {
+	configMu.Lock()
+	defer configMu.Unlock()
+
+	currentData, err := ReadSingBoxServerConfigRaw(dataDir)
+	if err != nil {
+		return err
+	}
+	current, err := ParseSingBoxConfig(currentData)
+	if err != nil {
+		return err
+	}
+	if patch {
+		if data, err = MergePatch(currentData, data); err != nil {
+			return ValidationErrors{{Message: err.Error()}}
+		}
+	}
+	candidate, err := ParseSingBoxConfig(data)
+	if err != nil {
+		return ValidationErrors{{Message: err.Error()}}
+	}
+	errs := CheckManagedSections(current, candidate)
+	if errs = append(errs, CheckSingBoxConfig(candidate, reservedPorts...)...); len(errs) > 0 {
+		return ValidationErrors(errs)
+	}
+	return applySingBoxConfig(dataDir, candidate, change)
+}
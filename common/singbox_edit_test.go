@@ -0,0 +1,147 @@
+package common
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+
+	C "github.com/sagernet/sing-box/constant"
+	"github.com/sagernet/sing-box/option"
+	"github.com/sagernet/sing/common"
+	"github.com/sagernet/sing/common/json/badoption"
+	N "github.com/sagernet/sing/common/network"
+)
+
+// testListen returns the listen options for addr, e.g. "0.0.0.0", and port.
+func testListen(addr string, port uint16) option.ListenOptions {
+	return option.ListenOptions{
+		Listen:     common.Ptr(badoption.Addr(netip.MustParseAddr(addr))),
+		ListenPort: port,
+	}
+}
+
+// testShadowsocks returns a Shadowsocks inbound on addr and port for network, or TCP and UDP if it's empty.
+func testShadowsocks(tag, addr string, port uint16, network string) option.Inbound {
+	return option.Inbound{Type: C.TypeShadowsocks, Tag: tag, Options: &option.ShadowsocksInboundOptions{
+		ListenOptions: testListen(addr, port),
+		Network:       option.NetworkList(network),
+		Method:        "chacha20-ietf-poly1305",
+		Password:      "password",
+	}}
+}
+
+// testHysteria2 returns a Hysteria2 inbound on all addresses and port.
+func testHysteria2(tag string, port uint16) option.Inbound {
+	return option.Inbound{Type: C.TypeHysteria2, Tag: tag, Options: &option.Hysteria2InboundOptions{
+		ListenOptions: testListen("0.0.0.0", port),
+	}}
+}
+
+// withUsers returns inbound, a Shadowsocks inbound, with the given users.
+func withUsers(inbound option.Inbound, names ...string) option.Inbound {
+	options := *inbound.Options.(*option.ShadowsocksInboundOptions)
+	options.Users = nil
+	for _, name := range names {
+		options.Users = append(options.Users, option.ShadowsocksUser{Name: name, Password: name})
+	}
+	inbound.Options = &options
+	return inbound
+}
+
+func TestCheckSingBoxConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		inbounds []option.Inbound
+		reserved []int
+		want     []string
+	}{
+		{
+			name:     "valid",
+			inbounds: []option.Inbound{testShadowsocks("ss", "0.0.0.0", 8388, ""), testHysteria2("hy2", 443)},
+		},
+		{
+			name: "no inbounds",
+			want: []string{"inbounds"},
+		},
+		{
+			name:     "first inbound isn't shadowsocks",
+			inbounds: []option.Inbound{testHysteria2("hy2", 443)},
+			want:     []string{"inbounds[0].type"},
+		},
+		{
+			name:     "port used twice",
+			inbounds: []option.Inbound{testShadowsocks("ss", "0.0.0.0", 8388, ""), testShadowsocks("", "0.0.0.0", 8388, N.NetworkUDP)},
+			want:     []string{"inbounds[1].listen_port"},
+		},
+		{
+			name:     "reserved port",
+			inbounds: []option.Inbound{testShadowsocks("ss", "0.0.0.0", 8443, "")},
+			reserved: []int{8443},
+			want:     []string{"inbounds[0].listen_port"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var fields []string
+			for _, err := range CheckSingBoxConfig(&option.Options{Inbounds: tt.inbounds}, tt.reserved...) {
+				fields = append(fields, err.Field)
+			}
+			if !reflect.DeepEqual(fields, tt.want) {
+				t.Errorf("CheckSingBoxConfig() fields = %v, want %v", fields, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckManagedSections(t *testing.T) {
+	current := &option.Options{Inbounds: []option.Inbound{
+		withUsers(testShadowsocks("ss", "0.0.0.0", 8388, ""), "alice", "bob"),
+		withUsers(testShadowsocks("ss-2", "0.0.0.0", 9000, ""), "carol"),
+	}}
+	tests := []struct {
+		name     string
+		inbounds []option.Inbound
+		want     []string
+	}{
+		{
+			name:     "unchanged",
+			inbounds: current.Inbounds,
+		},
+		{
+			name: "inbounds changed and reordered",
+			inbounds: []option.Inbound{
+				withUsers(testShadowsocks("ss", "0.0.0.0", 443, ""), "alice", "bob"),
+				withUsers(testShadowsocks("new", "0.0.0.0", 9001, ""), "dave"),
+				withUsers(testShadowsocks("ss-2", "0.0.0.0", 9000, ""), "carol"),
+			},
+		},
+		{
+			name:     "renamed first inbound",
+			inbounds: []option.Inbound{withUsers(testShadowsocks("renamed", "0.0.0.0", 8388, ""), "alice", "bob")},
+		},
+		{
+			name: "users changed",
+			inbounds: []option.Inbound{
+				withUsers(testShadowsocks("ss", "0.0.0.0", 8388, ""), "alice"),
+				withUsers(testShadowsocks("ss-2", "0.0.0.0", 9000, ""), "carol", "mallory"),
+			},
+			want: []string{"inbounds[0].users", "inbounds[1].users"},
+		},
+		{
+			name:     "users dropped",
+			inbounds: []option.Inbound{testShadowsocks("ss", "0.0.0.0", 8388, "")},
+			want:     []string{"inbounds[0].users"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var fields []string
+			for _, err := range CheckManagedSections(current, &option.Options{Inbounds: tt.inbounds}) {
+				fields = append(fields, err.Field)
+			}
+			if !reflect.DeepEqual(fields, tt.want) {
+				t.Errorf("CheckManagedSections() fields = %v, want %v", fields, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,290 @@
+package common
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// SupervisorState describes the lifecycle state of a supervised process.
+type SupervisorState string
+
+const (
+	// SupervisorStopped means the process is not running and will not be restarted.
+	SupervisorStopped SupervisorState = "stopped"
+	// SupervisorRunning means the process has been started and has not exited yet.
+	SupervisorRunning SupervisorState = "running"
+	// SupervisorBackoff means the process exited unexpectedly and is waiting to be restarted.
+	SupervisorBackoff SupervisorState = "backoff"
+	// SupervisorStopping means a graceful shutdown has been requested and is in progress.
+	SupervisorStopping SupervisorState = "stopping"
+)
+
+const (
+	// supervisorMinBackoff is the delay before the first restart after a crash.
+	supervisorMinBackoff = time.Second
+	// supervisorMaxBackoff caps the exponential restart delay.
+	supervisorMaxBackoff = time.Minute
+	// supervisorStableRun is how long a process has to stay up for the backoff to reset.
+	supervisorStableRun = 30 * time.Second
+	// supervisorStopTimeout is how long to wait after SIGTERM before sending SIGKILL.
+	supervisorStopTimeout = 10 * time.Second
+	// supervisorMaxLine is the longest line of process output that is logged.
+	supervisorMaxLine = 1 << 20
+)
+
+// SupervisorStatus is a snapshot of the supervised process, suitable for JSON encoding.
+type SupervisorStatus struct {
+	// Mode is either "systemd" or "process" depending on how sing-box is managed.
+	Mode string `json:"mode"`
+	// State is the current lifecycle state of the process.
+	State SupervisorState `json:"state"`
+	// PID is the process id of the running process, if any.
+	PID int `json:"pid,omitempty"`
+	// Restarts counts how many times the process was restarted after a crash.
+	Restarts int `json:"restarts"`
+	// StartedAt is when the current process was started.
+	StartedAt *time.Time `json:"started_at,omitempty"`
+	// LastExit describes how the previous process exited.
+	LastExit string `json:"last_exit,omitempty"`
+	// LastExitAt is when the previous process exited.
+	LastExitAt *time.Time `json:"last_exit_at,omitempty"`
+}
+
+// Supervisor runs a single child process, forwards its output to the log,
+// restarts it with exponential backoff when it crashes and stops it gracefully on request.
+type Supervisor struct {
+	// controlMu serializes Restart and Stop, so a process started by one Restart isn't left running
+	// by another one that stopped the previous process at the same time. It is held while waiting
+	// for the process to exit, which mu must not be, as wait needs mu to record the exit.
+	controlMu sync.Mutex
+	mu        sync.Mutex
+	logger    *log.Logger
+
+	path string
+	args []string
+
+	cmd        *exec.Cmd
+	exited     chan struct{}
+	generation int
+	wanted     bool
+	state      SupervisorState
+	restarts   int
+	backoff    time.Duration
+	startedAt  time.Time
+	lastExit   string
+	lastExitAt time.Time
+	timer      *time.Timer
+}
+
+// supervisorLogger returns a component logger for the supervisor of the process name, whose lines are
+// prefixed with the name.
+func supervisorLogger(name string) *log.Logger {
+	logger := ComponentLogger(LogComponentSupervisor)
+	logger.SetPrefix(name)
+	return logger
+}
+
+// NewSupervisor creates a supervisor whose log lines are tagged with the given name.
+func NewSupervisor(name string) *Supervisor {
+	return &Supervisor{
+		logger:  supervisorLogger(name),
+		state:   SupervisorStopped,
+		backoff: supervisorMinBackoff,
+	}
+}
+
+// Restart stops the currently running process (if any) and starts the given command.
+// The command is restarted automatically if it exits without being asked to.
+func (s *Supervisor) Restart(path string, args ...string) error {
+	s.controlMu.Lock()
+	defer s.controlMu.Unlock()
+	s.stop()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.path = path
+	s.args = args
+	s.wanted = true
+	s.backoff = supervisorMinBackoff
+	return s.startLocked()
+}
+
+// Stop sends SIGTERM to the running process and waits for it to exit,
+// escalating to SIGKILL if it does not exit within supervisorStopTimeout.
+// The process will not be restarted until Restart is called again.
+func (s *Supervisor) Stop() {
+	s.controlMu.Lock()
+	defer s.controlMu.Unlock()
+	s.stop()
+}
+
+// stop implements Stop. s.controlMu must be held.
+func (s *Supervisor) stop() {
+	s.mu.Lock()
+	s.wanted = false
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	cmd, exited := s.cmd, s.exited
+	if cmd == nil {
+		s.state = SupervisorStopped
+		s.mu.Unlock()
+		return
+	}
+	s.state = SupervisorStopping
+	s.mu.Unlock()
+
+	s.logger.Debug("stopping process", "pid", cmd.Process.Pid)
+	_ = cmd.Process.Signal(syscall.SIGTERM)
+	select {
+	case <-exited:
+	case <-time.After(supervisorStopTimeout):
+		s.logger.Warn("process did not exit after SIGTERM, killing it", "pid", cmd.Process.Pid)
+		_ = cmd.Process.Kill()
+		<-exited
+	}
+
+	s.mu.Lock()
+	s.state = SupervisorStopped
+	s.mu.Unlock()
+}
+
+// Status returns a snapshot of the supervised process state.
+func (s *Supervisor) Status() SupervisorStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := SupervisorStatus{
+		Mode:     string(SupervisorModeProcess),
+		State:    s.state,
+		Restarts: s.restarts,
+		LastExit: s.lastExit,
+	}
+	if s.cmd != nil {
+		st.PID = s.cmd.Process.Pid
+		startedAt := s.startedAt
+		st.StartedAt = &startedAt
+	}
+	if !s.lastExitAt.IsZero() {
+		lastExitAt := s.lastExitAt
+		st.LastExitAt = &lastExitAt
+	}
+	return st
+}
+
+// startLocked starts the configured command. s.mu must be held.
+func (s *Supervisor) startLocked() error {
+	cmd := exec.Command(s.path, s.args...)
+	setChildProcAttr(cmd)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	if err = cmd.Start(); err != nil {
+		s.state = SupervisorStopped
+		return fmt.Errorf("failed to start %s: %w", s.path, err)
+	}
+	s.generation++
+	s.cmd = cmd
+	s.exited = make(chan struct{})
+	s.state = SupervisorRunning
+	s.startedAt = time.Now()
+	s.logger.Info("process started", "pid", cmd.Process.Pid)
+
+	var output sync.WaitGroup
+	output.Add(2)
+	go s.forward(&output, stdout)
+	go s.forward(&output, stderr)
+	go s.wait(cmd, s.exited, s.generation, &output)
+	return nil
+}
+
+// forward copies every line of r into the supervisor's log. If a line is too long to log,
+// the rest of the output is discarded, so that the process doesn't block writing to the pipe.
+func (s *Supervisor) forward(wg *sync.WaitGroup, r io.Reader) {
+	defer wg.Done()
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64<<10), supervisorMaxLine)
+	for scanner.Scan() {
+		s.logger.Info(scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		s.logger.Warn("failed to read process output, discarding the rest", "error", err)
+		_, _ = io.Copy(io.Discard, r)
+	}
+}
+
+// wait reaps the process, records how it exited and schedules a restart if the exit was unexpected.
+func (s *Supervisor) wait(cmd *exec.Cmd, exited chan struct{}, generation int, output *sync.WaitGroup) {
+	// the pipes have to be drained before Wait closes them
+	output.Wait()
+	err := cmd.Wait()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer close(exited)
+	if generation != s.generation {
+		return
+	}
+	ranFor := time.Since(s.startedAt)
+	s.cmd = nil
+	s.lastExitAt = time.Now()
+	s.lastExit = describeExit(err)
+	if !s.wanted {
+		s.logger.Info("process stopped", "status", s.lastExit)
+		return
+	}
+
+	if ranFor >= supervisorStableRun {
+		s.backoff = supervisorMinBackoff
+	}
+	s.logger.Error("process exited unexpectedly", "status", s.lastExit, "ran_for", ranFor.Round(time.Millisecond))
+	s.scheduleRestartLocked()
+}
+
+// scheduleRestartLocked starts the process again after the current backoff delay
+// and doubles the delay for the next attempt. s.mu must be held.
+func (s *Supervisor) scheduleRestartLocked() {
+	delay := s.backoff
+	s.backoff = min(s.backoff*2, supervisorMaxBackoff)
+	s.state = SupervisorBackoff
+	generation := s.generation
+	s.logger.Info("restarting process", "in", delay)
+	s.timer = time.AfterFunc(delay, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if !s.wanted || s.generation != generation {
+			return
+		}
+		s.timer = nil
+		s.restarts++
+		if err := s.startLocked(); err != nil {
+			s.logger.Error("failed to restart process", "error", err)
+			s.scheduleRestartLocked()
+		}
+	})
+}
+
+// describeExit turns the result of exec.Cmd.Wait into a short human-readable string.
+func describeExit(err error) string {
+	if err == nil {
+		return "exit status 0"
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ProcessState.String()
+	}
+	return err.Error()
+}
@@ -0,0 +1,12 @@
+package common
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setChildProcAttr makes the kernel send SIGTERM to the child if the manager dies,
+// so a crashed manager doesn't leave an orphaned sing-box holding the VPN port.
+func setChildProcAttr(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Pdeathsig: syscall.SIGTERM}
+}
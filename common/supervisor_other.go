@@ -0,0 +1,8 @@
+//go:build !linux
+
+package common
+
+import "os/exec"
+
+// setChildProcAttr is a no-op on platforms without a parent-death signal.
+func setChildProcAttr(_ *exec.Cmd) {}
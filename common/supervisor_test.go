@@ -0,0 +1,105 @@
+package common
+
+import (
+	"os/exec"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// waitForState waits until the supervisor is in the state, failing the test after a few seconds.
+func waitForState(t *testing.T, s *Supervisor, state SupervisorState) SupervisorStatus {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status := s.Status()
+		if status.State == state {
+			return status
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("state = %s, want %s", status.State, state)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSupervisorRestartAndStop(t *testing.T) {
+	sleep, err := exec.LookPath("sleep")
+	if err != nil {
+		t.Skip("sleep is not available")
+	}
+	s := NewSupervisor("test")
+	if err = s.Restart(sleep, "60"); err != nil {
+		t.Fatalf("Restart() error = %v", err)
+	}
+	first := waitForState(t, s, SupervisorRunning)
+	if first.PID == 0 {
+		t.Fatal("running process has no PID")
+	}
+
+	// concurrent restarts must leave exactly one process running
+	var wg sync.WaitGroup
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.Restart(sleep, "60"); err != nil {
+				t.Errorf("Restart() error = %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	second := waitForState(t, s, SupervisorRunning)
+	if second.PID == first.PID {
+		t.Error("Restart() kept the previous process")
+	}
+	if err = syscall.Kill(first.PID, 0); err == nil {
+		t.Errorf("previous process %d is still running", first.PID)
+	}
+	if second.Restarts != 0 {
+		t.Errorf("restarts = %d, want 0 for requested restarts", second.Restarts)
+	}
+
+	s.Stop()
+	stopped := s.Status()
+	if stopped.State != SupervisorStopped || stopped.PID != 0 {
+		t.Errorf("status after Stop() = %+v, want stopped without a PID", stopped)
+	}
+	if err = syscall.Kill(second.PID, 0); err == nil {
+		t.Errorf("process %d is still running after Stop()", second.PID)
+	}
+}
+
+func TestSupervisorRestartsCrashedProcess(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("sh is not available")
+	}
+	s := NewSupervisor("test")
+	defer s.Stop()
+	if err = s.Restart(sh, "-c", "exit 3"); err != nil {
+		t.Fatalf("Restart() error = %v", err)
+	}
+	status := waitForState(t, s, SupervisorBackoff)
+	if status.LastExit != "exit status 3" {
+		t.Errorf("last exit = %q, want %q", status.LastExit, "exit status 3")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for s.Status().Restarts == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("crashed process was not restarted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSupervisorRestartMissingExecutable(t *testing.T) {
+	s := NewSupervisor("test")
+	if err := s.Restart("/nonexistent/sing-box", "run"); err == nil {
+		t.Fatal("Restart() of a missing executable succeeded")
+	}
+	if state := s.Status().State; state != SupervisorStopped {
+		t.Errorf("state = %s, want %s", state, SupervisorStopped)
+	}
+}
@@ -0,0 +1,169 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/propagation"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// telemetryServiceName is the service.name resource attribute of the exported spans and metrics.
+	telemetryServiceName = "lantern-server-manager"
+	// telemetryScope is the instrumentation scope of the manager's spans and metrics.
+	telemetryScope = "github.com/getlantern/lantern-server-manager"
+	// telemetryExportTimeout limits a single export request to the collector, and the final export on shutdown.
+	telemetryExportTimeout = 10 * time.Second
+	// maxPendingSpans is how many finished spans are queued until the next export; more are dropped.
+	maxPendingSpans = 2048
+)
+
+// Tracer creates the manager's spans. They are only recorded once StartTelemetry has been called.
+var Tracer = otel.Tracer(telemetryScope)
+
+// TelemetryOptions configures the export of spans and metrics over OTLP/HTTP.
+type TelemetryOptions struct {
+	// Endpoint is the base URL of the collector, e.g. http://localhost:4318. Spans are sent to
+	// /v1/traces and metrics to /v1/metrics below it.
+	Endpoint string
+	// Headers are added to every export request, e.g. for authentication.
+	Headers map[string]string
+	// Interval is how often the spans and metrics are exported.
+	Interval time.Duration
+}
+
+// ParseTelemetryHeaders parses headers given as "key=value" strings.
+func ParseTelemetryHeaders(headers []string) (map[string]string, error) {
+	parsed := make(map[string]string, len(headers))
+	for _, h := range headers {
+		k, v, ok := strings.Cut(h, "=")
+		if !ok || strings.TrimSpace(k) == "" {
+			return nil, fmt.Errorf("invalid OTLP header %q, expected key=value", h)
+		}
+		parsed[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return parsed, nil
+}
+
+// StartTelemetry records spans with the OpenTelemetry SDK and exports them, together with the metrics
+// also served in the Prometheus format by WriteMetrics, to the collector at opts.Endpoint every opts.Interval.
+// The returned function exports whatever is pending and stops the export; call it once serving stopped.
+func StartTelemetry(ctx context.Context, opts TelemetryOptions) (func(), error) {
+	endpoint := strings.TrimSuffix(opts.Endpoint, "/")
+	if u, err := url.Parse(endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid OTLP endpoint %q, expected e.g. http://localhost:4318", opts.Endpoint)
+	}
+	traceExporter, err := otlptracehttp.New(ctx,
+		otlptracehttp.WithEndpointURL(endpoint+"/v1/traces"),
+		otlptracehttp.WithHeaders(opts.Headers),
+		otlptracehttp.WithTimeout(telemetryExportTimeout))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP trace exporter: %w", err)
+	}
+	metricExporter, err := otlpmetrichttp.New(ctx,
+		otlpmetrichttp.WithEndpointURL(endpoint+"/v1/metrics"),
+		otlpmetrichttp.WithHeaders(opts.Headers),
+		otlpmetrichttp.WithTimeout(telemetryExportTimeout))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP metric exporter: %w", err)
+	}
+
+	res := resource.NewSchemaless(attribute.String("service.name", telemetryServiceName))
+	tracerProvider := sdktrace.NewTracerProvider(
+		sdktrace.WithResource(res),
+		sdktrace.WithBatcher(traceExporter,
+			sdktrace.WithBatchTimeout(opts.Interval),
+			sdktrace.WithMaxQueueSize(maxPendingSpans)))
+	meterProvider := sdkmetric.NewMeterProvider(
+		sdkmetric.WithResource(res),
+		sdkmetric.WithReader(sdkmetric.NewPeriodicReader(metricExporter, sdkmetric.WithInterval(opts.Interval))))
+	if err = registerOTelMetrics(meterProvider.Meter(telemetryScope)); err != nil {
+		return nil, errors.Join(err, tracerProvider.Shutdown(ctx), meterProvider.Shutdown(ctx))
+	}
+
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		log.Warnf("failed to export telemetry: %v", err)
+	}))
+	otel.SetTracerProvider(tracerProvider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return func() {
+		// ctx may be done already, so the last export needs its own
+		ctx, cancel := context.WithTimeout(context.Background(), telemetryExportTimeout)
+		defer cancel()
+		if err := errors.Join(tracerProvider.Shutdown(ctx), meterProvider.Shutdown(ctx)); err != nil {
+			log.Warnf("failed to export telemetry on shutdown: %v", err)
+		}
+	}, nil
+}
+
+// registerOTelMetrics exposes the metrics served by WriteMetrics through meter. Counters and gauges are
+// observed from their current values each time the metrics are exported, after running the registered
+// collectors. Histograms record each observation from now on, see Metric.Observe.
+func registerOTelMetrics(meter metric.Meter) error {
+	observables := make(map[*Metric]metric.Float64Observable)
+	var instruments []metric.Observable
+	for _, m := range collectMetrics() {
+		var err error
+		var inst metric.Float64Observable
+		switch m.kind {
+		case metricCounter:
+			inst, err = meter.Float64ObservableCounter(m.name, metric.WithDescription(m.help))
+		case metricGauge:
+			inst, err = meter.Float64ObservableGauge(m.name, metric.WithDescription(m.help))
+		case metricHistogram:
+			var h metric.Float64Histogram
+			h, err = meter.Float64Histogram(m.name, metric.WithDescription(m.help), metric.WithExplicitBucketBoundaries(m.buckets...))
+			if err == nil {
+				m.mu.Lock()
+				m.histogram = h
+				m.mu.Unlock()
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("failed to register metric %s: %w", m.name, err)
+		}
+		if inst != nil {
+			observables[m] = inst
+			instruments = append(instruments, inst)
+		}
+	}
+	_, err := meter.RegisterCallback(func(_ context.Context, o metric.Observer) error {
+		for _, m := range collectMetrics() {
+			inst, ok := observables[m]
+			if !ok {
+				continue
+			}
+			m.mu.Lock()
+			for _, s := range m.series {
+				o.ObserveFloat64(inst, s.value, metric.WithAttributes(m.attributes(s.labelValues)...))
+			}
+			m.mu.Unlock()
+		}
+		return nil
+	}, instruments...)
+	return err
+}
+
+// EndSpan records err on span, if it isn't nil, and ends the span.
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
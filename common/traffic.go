@@ -0,0 +1,429 @@
+package common
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/sagernet/sing-box/experimental/v2rayapi"
+	"github.com/sagernet/sing-box/option"
+	"github.com/sagernet/sing/common/json/badjson"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+const (
+	// trafficStatsTimeout limits a request to the sing-box traffic statistics.
+	trafficStatsTimeout = 5 * time.Second
+	// trafficPollInterval is how often RunTrafficMetrics polls sing-box. The Clash API only reports open
+	// connections, so this bounds the traffic of closed connections that has to be split between inbounds.
+	trafficPollInterval = 5 * time.Second
+)
+
+// TrafficStatsConfig is where the manager reads traffic statistics from sing-box. They are served by
+// sing-box's Clash API and, if lantern-box has it, its V2Ray API, which are enabled on the loopback
+// address only. It is stored in "traffic_stats.json" in the data directory and created with free ports
+// and a random secret.
+type TrafficStatsConfig struct {
+	// Controller is the loopback address and port the Clash API listens on.
+	Controller string `json:"controller"`
+	// Secret is the bearer token the Clash API requires.
+	Secret string `json:"secret"`
+	// UserStats is the loopback address and port of sing-box's V2Ray API, which counts the traffic of
+	// each user. It is empty if lantern-box is built without the V2Ray API.
+	UserStats string `json:"user_stats,omitempty"`
+}
+
+// defaultTrafficStatsConfig picks a free loopback port and a random secret.
+func defaultTrafficStatsConfig() (*TrafficStatsConfig, error) {
+	port, err := freeLocalPort()
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	tc := &TrafficStatsConfig{
+		Controller: net.JoinHostPort("127.0.0.1", strconv.Itoa(int(port))),
+		Secret:     hex.EncodeToString(b),
+	}
+	return tc, tc.addUserStats()
+}
+
+// addUserStats picks a free loopback port for the V2Ray API if there is none yet and lantern-box supports it.
+func (tc *TrafficStatsConfig) addUserStats() error {
+	if tc.UserStats != "" || !userStatsSupported() {
+		return nil
+	}
+	port, err := freeLocalPort()
+	if err != nil {
+		return err
+	}
+	tc.UserStats = net.JoinHostPort("127.0.0.1", strconv.Itoa(int(port)))
+	return nil
+}
+
+// userStatsSupported reports whether lantern-box is built with the V2Ray API, by checking a config that
+// enables it. It is only checked once.
+var userStatsSupported = sync.OnceValue(func() bool {
+	data, err := badjson.MarshallObjects(option.Options{Experimental: &option.ExperimentalOptions{
+		V2RayAPI: &option.V2RayAPIOptions{Listen: "127.0.0.1:0", Stats: &option.V2RayStatsServiceOptions{Enabled: true}},
+	}})
+	if err != nil {
+		return false
+	}
+	f, err := os.CreateTemp("", "lantern-v2ray-api-*.json")
+	if err != nil {
+		return false
+	}
+	defer func() { _ = os.Remove(f.Name()) }()
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err != nil || closeErr != nil {
+		return false
+	}
+	if err = validateSingBoxConfigFile(f.Name()); err != nil {
+		log.Debugf("per-user traffic counters are not available: %v", err)
+		return false
+	}
+	return true
+})
+
+// ReadTrafficStatsConfig reads "traffic_stats.json" from the data directory.
+// A new config is returned if the file doesn't exist. An address for the V2Ray API is added if
+// lantern-box supports it and the file has none, e.g. because lantern-box was upgraded.
+func ReadTrafficStatsConfig(dataDir string) (*TrafficStatsConfig, error) {
+	data, err := os.ReadFile(path.Join(dataDir, "traffic_stats.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return defaultTrafficStatsConfig()
+		}
+		return nil, err
+	}
+	var tc TrafficStatsConfig
+	if err = json.Unmarshal(data, &tc); err != nil {
+		return nil, fmt.Errorf("failed to parse traffic_stats.json: %w", err)
+	}
+	return &tc, tc.addUserStats()
+}
+
+// writeTrafficStatsConfig writes "traffic_stats.json" to the data directory.
+func writeTrafficStatsConfig(dataDir string, tc *TrafficStatsConfig) error {
+	data, err := json.MarshalIndent(tc, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(path.Join(dataDir, "traffic_stats.json"), data, 0600)
+}
+
+// Validate checks that the Clash API and the V2Ray API are only reachable from the server itself.
+func (tc *TrafficStatsConfig) Validate() error {
+	if err := checkLoopbackAddress("traffic stats controller", tc.Controller); err != nil {
+		return err
+	}
+	if tc.Secret == "" {
+		return fmt.Errorf("traffic stats secret must not be empty")
+	}
+	if tc.UserStats != "" {
+		return checkLoopbackAddress("user traffic stats address", tc.UserStats)
+	}
+	return nil
+}
+
+// checkLoopbackAddress returns an error if address isn't a loopback IP address and port.
+func checkLoopbackAddress(name, address string) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("invalid %s %q: %w", name, address, err)
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return fmt.Errorf("%s %q must be a loopback address", name, address)
+	}
+	return nil
+}
+
+// apply sets the Clash API and V2Ray API sections of opt, keeping the other experimental options.
+func (tc *TrafficStatsConfig) apply(opt *option.Options) {
+	if opt.Experimental == nil {
+		opt.Experimental = &option.ExperimentalOptions{}
+	}
+	opt.Experimental.ClashAPI = &option.ClashAPIOptions{
+		ExternalController: tc.Controller,
+		Secret:             tc.Secret,
+	}
+	opt.Experimental.V2RayAPI = nil
+	if tc.UserStats != "" {
+		opt.Experimental.V2RayAPI = &option.V2RayAPIOptions{
+			Listen: tc.UserStats,
+			Stats:  &option.V2RayStatsServiceOptions{Enabled: true},
+		}
+	}
+	countUserTraffic(opt)
+}
+
+// countUserTraffic sets the users the V2Ray API counts the traffic of to the users of the inbounds,
+// as it only counts listed users. It is called whenever the sing-box config is written, so users
+// added or removed since the V2Ray API section was generated are counted or dropped.
+func countUserTraffic(opt *option.Options) {
+	if opt.Experimental == nil || opt.Experimental.V2RayAPI == nil || opt.Experimental.V2RayAPI.Stats == nil {
+		return
+	}
+	var users []string
+	for _, inbound := range opt.Inbounds {
+		if ss, ok := inbound.Options.(*option.ShadowsocksInboundOptions); ok {
+			for _, u := range ss.Users {
+				users = append(users, u.Name)
+			}
+		}
+	}
+	slices.Sort(users)
+	opt.Experimental.V2RayAPI.Stats.Users = slices.Compact(users)
+}
+
+// checkTrafficStats returns an error if the Clash API or V2Ray API section of candidate differs from
+// that of current, as the manager reads the traffic statistics from them.
+func checkTrafficStats(current, candidate *option.Options) []ValidationError {
+	var currentExperimental, candidateExperimental option.ExperimentalOptions
+	if current.Experimental != nil {
+		currentExperimental = *current.Experimental
+	}
+	if candidate.Experimental != nil {
+		candidateExperimental = *candidate.Experimental
+	}
+	var errs []ValidationError
+	if !sameJSON(currentExperimental.ClashAPI, candidateExperimental.ClashAPI) {
+		errs = append(errs, managedSectionError("experimental.clash_api", "traffic_stats.json in the data directory"))
+	}
+	if !sameJSON(currentExperimental.V2RayAPI, candidateExperimental.V2RayAPI) {
+		errs = append(errs, managedSectionError("experimental.v2ray_api", "traffic_stats.json in the data directory"))
+	}
+	return errs
+}
+
+// clashConnections is the response of the Clash API's connections endpoint.
+type clashConnections struct {
+	UploadTotal   int64             `json:"uploadTotal"`
+	DownloadTotal int64             `json:"downloadTotal"`
+	Connections   []clashConnection `json:"connections"`
+}
+
+// clashConnection is an open connection as reported by the Clash API.
+type clashConnection struct {
+	ID       string `json:"id"`
+	Metadata struct {
+		// Type is the inbound type and tag, like "shadowsocks/ss-in".
+		Type string `json:"type"`
+	} `json:"metadata"`
+	Upload   int64 `json:"upload"`
+	Download int64 `json:"download"`
+}
+
+// inbound returns the tag of the inbound the connection came in on.
+func (c clashConnection) inbound() string {
+	if _, tag, ok := strings.Cut(c.Metadata.Type, "/"); ok {
+		return tag
+	}
+	return c.Metadata.Type
+}
+
+var (
+	singBoxTrafficBytes = NewCounter("lsm_singbox_traffic_bytes_total",
+		"Bytes proxied by sing-box since it started, by direction.", "direction")
+	inboundTrafficBytes = NewCounter("lsm_inbound_traffic_bytes_total",
+		"Bytes proxied per inbound, by direction. Bytes of connections that closed between two polls are split between the inbounds of those connections.",
+		"inbound", "direction")
+	inboundConnections = NewGauge("lsm_inbound_connections", "Open connections per inbound.", "inbound")
+	userTrafficBytes   = NewCounter("lsm_user_traffic_bytes_total",
+		"Bytes proxied per user since sing-box started, by direction. Only available if lantern-box is built with the V2Ray API.",
+		"user", "direction")
+)
+
+// unknownInbound is the inbound label of traffic of connections that opened and closed between two polls
+// if no other connection closed in between, so it can't be attributed to an inbound.
+const unknownInbound = "unknown"
+
+// trafficCounter turns the byte counts of open connections reported by sing-box into per-inbound
+// counters, by adding what each connection transferred since the previous poll.
+var trafficCounter struct {
+	sync.Mutex
+	// seen are the byte counts of the connections at the previous poll.
+	seen map[string]clashConnection
+	// upload and download are the totals at the previous poll.
+	upload, download int64
+}
+
+// RunTrafficMetrics calls CollectTrafficMetrics every trafficPollInterval until ctx is done, so the
+// per-inbound counters don't depend on how often the metrics are scraped.
+func RunTrafficMetrics(ctx context.Context, dataDir string) {
+	ticker := time.NewTicker(trafficPollInterval)
+	defer ticker.Stop()
+	for {
+		if err := CollectTrafficMetrics(ctx, dataDir); err != nil && ctx.Err() == nil {
+			log.Debugf("failed to collect traffic metrics: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// CollectTrafficMetrics polls sing-box for its traffic statistics and updates the traffic metrics.
+// Traffic per inbound is read from the Clash API, and per user from the V2Ray API if lantern-box has it.
+func CollectTrafficMetrics(ctx context.Context, dataDir string) error {
+	tc, err := ReadTrafficStatsConfig(dataDir)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, trafficStatsTimeout)
+	defer cancel()
+	if err = collectInboundTraffic(ctx, tc); err != nil {
+		return err
+	}
+	if tc.UserStats != "" {
+		return collectUserTraffic(ctx, tc.UserStats)
+	}
+	return nil
+}
+
+// collectInboundTraffic reads the open connections from the Clash API and updates the total and
+// per-inbound counters.
+func collectInboundTraffic(ctx context.Context, tc *TrafficStatsConfig) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+tc.Controller+"/connections", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+tc.Secret)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s from sing-box traffic statistics", resp.Status)
+	}
+	var conns clashConnections
+	if err = json.NewDecoder(resp.Body).Decode(&conns); err != nil {
+		return fmt.Errorf("failed to parse sing-box traffic statistics: %w", err)
+	}
+
+	singBoxTrafficBytes.Set(float64(conns.UploadTotal), "upload")
+	singBoxTrafficBytes.Set(float64(conns.DownloadTotal), "download")
+
+	trafficCounter.Lock()
+	defer trafficCounter.Unlock()
+	countInboundTraffic(&conns)
+	return nil
+}
+
+// countInboundTraffic adds what each open connection transferred since the previous poll to the
+// counter of its inbound. The Clash API only reports open connections, so what connections transferred
+// between the previous poll and closing is the part of the change of the totals that the open
+// connections don't account for. It is split between the inbounds of the connections that closed,
+// in proportion to what they had transferred. trafficCounter must be locked.
+func countInboundTraffic(conns *clashConnections) {
+	seen := make(map[string]clashConnection, len(conns.Connections))
+	var openUpload, openDownload int64
+	inboundConnections.Reset()
+	for _, c := range conns.Connections {
+		prev := trafficCounter.seen[c.ID]
+		inbound := c.inbound()
+		upload, download := max(c.Upload-prev.Upload, 0), max(c.Download-prev.Download, 0)
+		inboundTrafficBytes.Add(float64(upload), inbound, "upload")
+		inboundTrafficBytes.Add(float64(download), inbound, "download")
+		openUpload += upload
+		openDownload += download
+		inboundConnections.Add(1, inbound)
+		seen[c.ID] = c
+	}
+
+	// sing-box was restarted if the totals went down, and what it transferred before is lost
+	if trafficCounter.seen != nil && conns.UploadTotal >= trafficCounter.upload && conns.DownloadTotal >= trafficCounter.download {
+		var closed []clashConnection
+		for id, c := range trafficCounter.seen {
+			if _, ok := seen[id]; !ok {
+				closed = append(closed, c)
+			}
+		}
+		splitClosedTraffic(closed, conns.UploadTotal-trafficCounter.upload-openUpload, "upload",
+			func(c clashConnection) int64 { return c.Upload })
+		splitClosedTraffic(closed, conns.DownloadTotal-trafficCounter.download-openDownload, "download",
+			func(c clashConnection) int64 { return c.Download })
+	}
+	trafficCounter.seen = seen
+	trafficCounter.upload, trafficCounter.download = conns.UploadTotal, conns.DownloadTotal
+}
+
+// splitClosedTraffic adds bytes in the given direction to the inbounds of the closed connections,
+// in proportion to what bytesOf returns for each of them, or to unknownInbound if none closed.
+func splitClosedTraffic(closed []clashConnection, bytes int64, direction string, bytesOf func(c clashConnection) int64) {
+	if bytes <= 0 {
+		return
+	}
+	if len(closed) == 0 {
+		inboundTrafficBytes.Add(float64(bytes), unknownInbound, direction)
+		return
+	}
+	// every connection gets a share, even if it hadn't transferred anything at the previous poll
+	var total int64
+	for _, c := range closed {
+		total += bytesOf(c) + 1
+	}
+	for _, c := range closed {
+		inboundTrafficBytes.Add(float64(bytes)*float64(bytesOf(c)+1)/float64(total), c.inbound(), direction)
+	}
+}
+
+// userTrafficPrefix is the start of the names of the V2Ray API counters of users,
+// which look like "user>>>alice>>>traffic>>>uplink".
+const userTrafficPrefix = "user>>>"
+
+// collectUserTraffic reads the traffic of each user from the V2Ray API at address and sets the per-user counters.
+func collectUserTraffic(ctx context.Context, address string) error {
+	conn, err := grpc.NewClient(address, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn.Close() }()
+	resp, err := v2rayapi.NewStatsServiceClient(conn).QueryStats(ctx, &v2rayapi.QueryStatsRequest{Patterns: []string{userTrafficPrefix}})
+	if err != nil {
+		return fmt.Errorf("failed to query sing-box user traffic statistics: %w", err)
+	}
+	userTrafficBytes.Reset()
+	for _, stat := range resp.Stat {
+		user, direction, ok := parseUserTrafficStat(stat.Name)
+		if ok {
+			userTrafficBytes.Set(float64(stat.Value), user, direction)
+		}
+	}
+	return nil
+}
+
+// parseUserTrafficStat returns the user and direction, "upload" or "download", of a V2Ray API counter name.
+func parseUserTrafficStat(name string) (user, direction string, ok bool) {
+	rest, ok := strings.CutPrefix(name, userTrafficPrefix)
+	if !ok {
+		return "", "", false
+	}
+	user, link, ok := strings.Cut(rest, ">>>traffic>>>")
+	switch {
+	case !ok || user == "":
+		return "", "", false
+	case link == "uplink":
+		return user, "upload", true
+	case link == "downlink":
+		return user, "download", true
+	}
+	return "", "", false
+}
@@ -0,0 +1,143 @@
+package common
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/sagernet/sing-box/option"
+)
+
+func TestCountInboundTraffic(t *testing.T) {
+	conn := func(id, inbound string, upload, download int64) clashConnection {
+		c := clashConnection{ID: id, Upload: upload, Download: download}
+		c.Metadata.Type = "shadowsocks/" + inbound
+		return c
+	}
+	// polls are the connections and totals reported at each poll
+	type poll struct {
+		conns            []clashConnection
+		upload, download int64
+	}
+	tests := []struct {
+		name  string
+		polls []poll
+		// want are the per-inbound upload and download counters after the last poll
+		want map[string][2]float64
+	}{
+		{
+			name: "open connections",
+			polls: []poll{
+				{conns: []clashConnection{conn("1", "a", 10, 100), conn("2", "b", 5, 50)}, upload: 15, download: 150},
+				{conns: []clashConnection{conn("1", "a", 30, 300), conn("2", "b", 5, 80)}, upload: 35, download: 380},
+			},
+			want: map[string][2]float64{"a": {30, 300}, "b": {5, 80}},
+		},
+		{
+			name: "closed connection",
+			polls: []poll{
+				{conns: []clashConnection{conn("1", "a", 10, 100), conn("2", "b", 5, 50)}, upload: 15, download: 150},
+				{conns: []clashConnection{conn("2", "b", 5, 50)}, upload: 20, download: 200},
+			},
+			want: map[string][2]float64{"a": {15, 150}, "b": {5, 50}},
+		},
+		{
+			name: "closed connections on several inbounds",
+			polls: []poll{
+				{conns: []clashConnection{conn("1", "a", 29, 0), conn("2", "b", 9, 0)}, upload: 38, download: 0},
+				{upload: 78},
+			},
+			want: map[string][2]float64{"a": {59, 0}, "b": {19, 0}},
+		},
+		{
+			name: "connection opened and closed between polls",
+			polls: []poll{
+				{conns: []clashConnection{conn("1", "a", 10, 100)}, upload: 10, download: 100},
+				{conns: []clashConnection{conn("1", "a", 10, 100)}, upload: 15, download: 110},
+			},
+			want: map[string][2]float64{"a": {10, 100}, unknownInbound: {5, 10}},
+		},
+		{
+			name: "sing-box restarted",
+			polls: []poll{
+				{conns: []clashConnection{conn("1", "a", 10, 100)}, upload: 50, download: 500},
+				{conns: []clashConnection{conn("2", "a", 1, 2)}, upload: 1, download: 2},
+			},
+			want: map[string][2]float64{"a": {11, 102}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inboundTrafficBytes.Reset()
+			trafficCounter.Lock()
+			trafficCounter.seen = nil
+			trafficCounter.upload, trafficCounter.download = 0, 0
+			for _, p := range tt.polls {
+				countInboundTraffic(&clashConnections{UploadTotal: p.upload, DownloadTotal: p.download, Connections: p.conns})
+			}
+			trafficCounter.Unlock()
+
+			got := make(map[string][2]float64)
+			inboundTrafficBytes.mu.Lock()
+			for _, series := range inboundTrafficBytes.series {
+				counts := got[series.labelValues[0]]
+				if series.labelValues[1] == "upload" {
+					counts[0] = series.value
+				} else {
+					counts[1] = series.value
+				}
+				got[series.labelValues[0]] = counts
+			}
+			inboundTrafficBytes.mu.Unlock()
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("inbound traffic = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseUserTrafficStat(t *testing.T) {
+	tests := []struct {
+		name          string
+		wantUser      string
+		wantDirection string
+		wantOK        bool
+	}{
+		{name: "user>>>alice>>>traffic>>>uplink", wantUser: "alice", wantDirection: "upload", wantOK: true},
+		{name: "user>>>alice>>>traffic>>>downlink", wantUser: "alice", wantDirection: "download", wantOK: true},
+		{name: "inbound>>>ss>>>traffic>>>uplink"},
+		{name: "user>>>>>>traffic>>>uplink"},
+		{name: "user>>>alice>>>traffic>>>sideways"},
+		{name: "user>>>alice"},
+	}
+	for _, tt := range tests {
+		user, direction, ok := parseUserTrafficStat(tt.name)
+		if user != tt.wantUser || direction != tt.wantDirection || ok != tt.wantOK {
+			t.Errorf("parseUserTrafficStat(%q) = %q, %q, %v, want %q, %q, %v", tt.name, user, direction, ok, tt.wantUser, tt.wantDirection, tt.wantOK)
+		}
+	}
+}
+
+func TestCountUserTraffic(t *testing.T) {
+	opt := option.Options{
+		Inbounds: []option.Inbound{
+			withUsers(testShadowsocks("ss", "0.0.0.0", 8388, ""), "bob", "alice"),
+			withUsers(testShadowsocks("ss-2", "0.0.0.0", 9000, ""), "alice", "carol"),
+			testHysteria2("hy2", 443),
+		},
+		Experimental: &option.ExperimentalOptions{V2RayAPI: &option.V2RayAPIOptions{
+			Listen: "127.0.0.1:9090",
+			Stats:  &option.V2RayStatsServiceOptions{Enabled: true, Users: []string{"removed"}},
+		}},
+	}
+	countUserTraffic(&opt)
+	if got, want := opt.Experimental.V2RayAPI.Stats.Users, []string{"alice", "bob", "carol"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("counted users = %v, want %v", got, want)
+	}
+
+	// without the V2Ray API nothing is added
+	opt.Experimental = nil
+	countUserTraffic(&opt)
+	if opt.Experimental != nil {
+		t.Errorf("countUserTraffic() added %+v", opt.Experimental)
+	}
+}